@@ -10,17 +10,20 @@ from bson.json_util import dumps
 def dump_op(output, op):
     copier = utils.DictionaryCopier(op)
     copier.copy_fields("ts", "ns", "op")
+    # how the op failed, if it did, as reported by the profiler
+    copier.copy_fields("errCode", "errMsg", "exceptionCode", "exception")
     op_type = op["op"]
 
     # handpick some essential fields to execute.
     if op_type == "query":
-        copier.copy_fields("query", "ntoskip", "ntoreturn")
+        copier.copy_fields("query", "ntoskip", "ntoreturn", "nreturned", "cursorid")
     elif op_type == "insert":
         copier.copy_fields("o")
     elif op_type == "update":
-        copier.copy_fields("updateobj", "query")
+        copier.copy_fields("updateobj", "query", "upsert")
     elif op_type == "remove":
-        copier.copy_fields("query")
+        # how many documents were deleted tells single from multi deletes
+        copier.copy_fields("query", "ndeleted")
     elif op_type == "command":
         copier.copy_fields("command")
 
@@ -1,16 +1,18 @@
 package main
 
 import (
+	"context"
 	"errors"
 	"flag"
-	"gopkg.in/mgo.v2"
 	. "replay"
 	"runtime"
-	"sync/atomic"
 	"time"
 	"os"
 	"fmt"
 	"math"
+	"math/rand"
+	"strconv"
+	"strings"
 )
 
 func panicOnError(err error) {
@@ -20,21 +22,101 @@ func panicOnError(err error) {
 }
 
 var (
+	limit         int
+	maxDuration   time.Duration
 	maxOps        int
 	numSkipOps    int
 	opsFilename   string
+	opsFormat     string
 	sampleRate    float64
+	rateSpec      string
+	downsample    int
+	sampleRates   map[OpType]float64
 	socketTimeout int64
+	selectTimeout time.Duration
+	stepdownWait  time.Duration
+	speed         float64
+	maxGap        time.Duration
+	gapCap        *GapCap
+	targetP99     time.Duration
+	tuneEvery     time.Duration
+	tuner         *SpeedTuner
 	startTime     int64
 	style         string
 	url           string
+	appName       string
+	proxyURL      string
+	shadowURL     string
+	targetDb      string
 	verbose       bool
+	compare       bool
+	explainSlow   time.Duration
+	onlySucceeded bool
+	matchSpec     string
+	opFilters     []*OpFilter
+	checkSchema   bool
+	verifyCounts  bool
+	causal        bool
+	redactSpec    string
+	redactor      *Redactor
+	shuffleWindow time.Duration
+	seed          int64
+	deterministic bool
+	rng           *rand.Rand
+	failOrphans   bool
+	strict        bool
+	noCursorTmout bool
+	mapCursors    bool
+	idConflict    string
+	labelBy       string
+	slowestLabels int
+	labeler       OpLabeler
+	reportWorkers bool
+	poolWaits     bool
+	gcPauses      bool
 	workers       int
+	rampSpec      string
+	ramp          *Ramp
+	queueSize     int
 	stderr        string
 	stdout        string
 	logger        *Logger
 	statsFilename string
-	statsFile     *os.File
+	slaSpec       string
+	timeoutSpec   string
+	maxTimeMS     int64
+	opTimeouts    OpTimeouts
+	histogramFile string
+	manifestFile  string
+	reportFile    string
+	reportFormat  string
+	latencyFile   string
+	errorLogFile  string
+	errorLogOps   bool
+	slowOpFile    string
+	slowOpMin     time.Duration
+	seriesFile    string
+	seriesEvery   time.Duration
+	hdrLogFile    string
+	hdrLogEvery   time.Duration
+	intervalEvery time.Duration
+	dashboard     bool
+	controlAddr   string
+	statsSocket   string
+	socketEvery   time.Duration
+	statsdAddr    string
+	statsdPrefix  string
+	statsdTagSpec string
+	statsdTags    []string
+	statsdEvery   time.Duration
+	otlpEndpoint  string
+	traceRate     float64
+	runId         string
+	commentOps    bool
+	sla           SLA
+	// the replay's readiness is measured from here, before the flags are
+	// even parsed
+	processStart = time.Now()
 )
 
 const (
@@ -46,11 +128,29 @@ func init() {
 	flag.StringVar(&opsFilename,
 		"ops_filename",
 		"",
-		"The file for the serialized ops, generated by the Record scripts.")
+		"The file for the serialized ops, generated by the Record scripts. "+
+			"Several comma-separated files are replayed together, merged by timestamp.")
 	flag.StringVar(&url,
 		"url",
 		"",
-		"[Optional] The database server's url, in the format of <host>[:<port>]. Defaults to localhost:27017")
+		"[Optional] The database server's url, in the format of <host>[:<port>]. Defaults to localhost:27017. "+
+			"For a sharded cluster, several comma-separated mongos routers can be given.")
+	flag.StringVar(&shadowURL,
+		"shadow_url",
+		"",
+		"[Optional] Also replay each op on this second target, right after `url`, e.g. to "+
+			"validate a new cluster version. The latencies of the two targets and the ops they "+
+			"served differently are compared at the end.")
+	flag.StringVar(&appName,
+		"app_name",
+		DefaultAppName,
+		"[Optional] The application name replayed connections report to the server, "+
+			"as shown in `currentOp`.")
+	flag.StringVar(&proxyURL,
+		"proxy",
+		"",
+		"[Optional] Connect to the servers through a SOCKS5 proxy, in the format of "+
+			"socks5://[<user>:<password>@]<host>:<port>, e.g. an `ssh -D <port> <bastion>` tunnel.")
 	flag.StringVar(&style,
 		"style",
 		"",
@@ -61,12 +161,39 @@ func init() {
 		"workers",
 		10,
 		"[Optional] Number of workers that sends ops to database.")
+	flag.StringVar(&rampSpec,
+		"ramp",
+		"",
+		"[Optional] Step up the number of workers over the replay, in the format of "+
+			"<start>:<max>:<every>, e.g. 1:64:30s starts with 1 worker and adds one every "+
+			"30s up to 64, and reports the throughput and latencies of each step. "+
+			"Overrides `workers`.")
+	flag.StringVar(&opsFormat,
+		"ops_format",
+		"line",
+		"[Optional] The format of ops_filename: `line` for the one op per line files "+
+			"generated by the Record scripts, or `extjson` for a stream of MongoDB Extended JSON ops.")
+	flag.IntVar(&queueSize,
+		"queue_size",
+		0,
+		"[Optional] In the `stress` style, stream ops to the workers through a queue "+
+			"of this many ops instead of preloading all of them into memory.")
 	flag.IntVar(&maxOps,
 		"maxOps",
 		0,
-		"[Optional] Maximal amount of ops to be replayed from the "+
-			"ops_filename file. By setting it to `0`, replayer will "+
-			"replay all the ops.")
+		"[Optional] Maximal amount of ops to be read from the "+
+			"ops_filename file, counted before the ops are filtered. By setting it to `0`, "+
+			"replayer will replay all the ops.")
+	flag.IntVar(&limit,
+		"limit",
+		0,
+		"[Optional] Stop after dispatching N ops, counted after the ops are "+
+			"filtered, then print the final stats. Useful for quick smoke tests.")
+	flag.DurationVar(&maxDuration,
+		"max_duration",
+		0,
+		"[Optional] Stop replaying after this long, e.g. 30m, however many ops are left. "+
+			"The ops in flight are finished and the final stats are printed.")
 	flag.IntVar(&numSkipOps,
 		"numSkipOps",
 		0,
@@ -76,14 +203,168 @@ func init() {
 		"socketTimeout",
 		defaultMgoSocketTimeout,
 		"[Optional] Mongo socket timeout in nanoseconds.")
+	flag.DurationVar(&selectTimeout,
+		"server_selection_timeout",
+		time.Minute,
+		"[Optional] How long an op waits for a suitable server, e.g. a new "+
+			"primary after a stepdown, before it fails.")
+	flag.DurationVar(&stepdownWait,
+		"stepdown_wait",
+		30*time.Second,
+		"[Optional] How long the ops that fail because the primary stepped down are "+
+			"retried on the new primary. 0 means no retries.")
+	flag.Float64Var(&speed,
+		"speed",
+		1.0,
+		"[Optional] Speed multiplier for the `real` style, e.g. 2.0 replays "+
+			"ops twice as fast as they were recorded.")
+	flag.DurationVar(&maxGap,
+		"max_gap",
+		0,
+		"[Optional] The longest wait between two ops for the `real` style, "+
+			"e.g. 5s collapses the idle periods of a recording. 0 means no cap.")
+	flag.DurationVar(&targetP99,
+		"target_p99",
+		0,
+		"[Optional] Tune the speed of the `real` style to the fastest one whose p99 "+
+			"latency stays under this target, starting from `speed`, and report the "+
+			"sustainable rate. 0 means no tuning.")
+	flag.DurationVar(&tuneEvery,
+		"tune_interval",
+		10*time.Second,
+		"[Optional] How often `target_p99` adjusts the speed.")
 	flag.Float64Var(&sampleRate,
 		"sample_rate",
 		0.1,
 		"[Optional] Sample ops for latency, between (0.0, 1.0].")
+	flag.StringVar(&rateSpec,
+		"sample_rates",
+		"",
+		"[Optional] Per op type overrides of `sample_rate`, in the format of "+
+			"<op type>=<rate>[,...], e.g. command.count=1,query=0.01")
+	flag.IntVar(&downsample,
+		"latency_downsample",
+		1,
+		"[Optional] Only pass every Nth sampled latency on to the latency percentiles, "+
+			"to bound the overhead of sampling on huge replays.")
 	flag.BoolVar(&verbose,
 		"verbose",
 		false,
 		"[Optional] Print op errors and other verbose information to stdout.")
+	flag.StringVar(&idConflict,
+		"id_conflict",
+		string(IdConflictError),
+		"[Optional] What to do with inserts whose _id already exists on the target: "+
+			"`error`, `skip` them, or `replace` the existing documents.")
+	flag.StringVar(&labelBy,
+		"label_ops_by",
+		"",
+		"[Optional] Also break the stats down by the `namespace` or the `database` of the ops.")
+	flag.IntVar(&slowestLabels,
+		"slowest_labels",
+		0,
+		"[Optional] Only report the stats of this many namespaces or databases of `label_ops_by`, "+
+			"the slowest first. 0 reports all of them, in alphabetical order.")
+	flag.BoolVar(&failOrphans,
+		"fail_orphan_getmores",
+		false,
+		"[Optional] Report getMores on cursors that were never opened on the target as errors, "+
+			"instead of only counting them.")
+	flag.BoolVar(&strict,
+		"strict",
+		false,
+		"[Optional] Abort the replay on the first recorded op without a valid namespace, "+
+			"instead of skipping it.")
+	flag.BoolVar(&noCursorTmout,
+		"no_cursor_timeout",
+		false,
+		"[Optional] Keep the cursors of replayed queries open until they are exhausted, "+
+			"so slow replays don't fail on the server's cursor timeout.")
+	flag.BoolVar(&mapCursors,
+		"replay_cursors",
+		false,
+		"[Optional] Keep the cursors of the queries that left one open when they were recorded, "+
+			"and replay the recorded getMore and killCursors ops on them. By default queries "+
+			"fetch all their results at once.")
+	flag.BoolVar(&poolWaits,
+		"report_pool_waits",
+		false,
+		"[Optional] Report how often and how long ops waited for a free connection "+
+			"of the driver's pool.")
+	flag.BoolVar(&gcPauses,
+		"report_gc_pauses",
+		false,
+		"[Optional] Report how long the garbage collector paused flashback, which adds to the "+
+			"measured latencies without the target being slow.")
+	flag.BoolVar(&reportWorkers,
+		"report_workers",
+		false,
+		"[Optional] Also report the throughput and latency of each worker, to spot a lagging one.")
+	flag.BoolVar(&onlySucceeded,
+		"only_successful",
+		false,
+		"[Optional] Skip the ops that failed when they were recorded.")
+	flag.StringVar(&targetDb,
+		"target_db",
+		"",
+		"[Optional] Replay all the ops into this database of the target, keeping their "+
+			"collections, e.g. into a scratch database.")
+	flag.StringVar(&matchSpec,
+		"match",
+		"",
+		"[Optional] Only replay the ops whose query or command filter has all of these fields, "+
+			"in the format of <path>[=<value>][,...], e.g. status=active,owner.id. Ops without "+
+			"a filter, e.g. inserts, are skipped.")
+	flag.DurationVar(&shuffleWindow,
+		"shuffle_window",
+		0,
+		"[Optional] Shuffle the ops within consecutive windows of this much recorded time, "+
+			"e.g. 100ms, to approximate many independent clients. The cadence of the "+
+			"replay is kept, but not the exact order of the ops. 0 means no shuffling.")
+	flag.Int64Var(&seed,
+		"seed",
+		1,
+		"[Optional] The seed of the random choices of the replay, e.g. `shuffle_window`, "+
+			"so that a run can be reproduced.")
+	flag.BoolVar(&deterministic,
+		"deterministic",
+		false,
+		"[Optional] Replay without any random choice or concurrency, e.g. for golden-file tests: "+
+			"a single worker replays the ops in order, unshuffled, and the latencies are sampled "+
+			"at evenly spaced ops rather than at random.")
+	flag.StringVar(&redactSpec,
+		"redact",
+		"",
+		"[Optional] Rewrite fields of the inserted and updated documents before they are "+
+			"replayed, in the format of <path>=hash|remove|constant:<value>[,...], "+
+			"e.g. email=hash,address.zip=remove,name=constant:redacted")
+	flag.BoolVar(&checkSchema,
+		"check_schema",
+		false,
+		"[Optional] Before replaying, warn about the recorded namespaces that don't exist on "+
+			"the target, or that lack an index on the fields their ops filter on.")
+	flag.BoolVar(&verifyCounts,
+		"verify_counts",
+		false,
+		"[Optional] After replaying, check that each namespace that received inserts holds "+
+			"as many documents as were inserted, e.g. to catch unacknowledged writes. Only "+
+			"meaningful for a target that was empty, and for recordings without removes.")
+	flag.BoolVar(&causal,
+		"causal_consistency",
+		false,
+		"[Optional] Make the queries and counts replayed after a write read at or after its "+
+			"cluster time, so they observe it even when reading from a secondary, e.g. with "+
+			"readPreference=secondary in the url.")
+	flag.BoolVar(&compare,
+		"compare_results",
+		false,
+		"[Optional] Compare the results of queries and findAndModify commands with the "+
+			"ones captured in the recording, and count the mismatches.")
+	flag.DurationVar(&explainSlow,
+		"explain_slower_than",
+		0,
+		"[Optional] Explain the ops slower than this, e.g. 100ms, on the target and "+
+			"log a summary of their plan. 0 means no ops are explained.")
 	flag.Int64Var(&startTime,
 		"start_time",
 		0,
@@ -101,6 +382,146 @@ func init() {
 		"statsfilename",
 		"",
 		"[Optional] Provide a path to a file that will store the stats analyzer output at each interval.")
+	flag.StringVar(&histogramFile,
+		"histogram_file",
+		"",
+		"[Optional] Write the latency histogram of each op type to this file as JSON at the end of the run. "+
+			"Its buckets are 2% apart, so the percentiles read from them are up to 2% above the exact ones.")
+	flag.StringVar(&seriesFile,
+		"timeseries_file",
+		"",
+		"[Optional] Write the count, ops/sec, average, p50 and p99 latencies and errors of "+
+			"each op type over each `timeseries_interval` of the run to this file, as CSV if "+
+			"it ends in .csv, as NDJSON otherwise. The percentiles are up to 2% above the exact ones.")
+	flag.DurationVar(&seriesEvery,
+		"timeseries_interval",
+		10*time.Second,
+		"[Optional] The length of the intervals of `timeseries_file`.")
+	flag.StringVar(&hdrLogFile,
+		"hdr_log",
+		"",
+		"[Optional] Write the latency histograms of all the op types and of each op type over "+
+			"each `hdr_log_interval` to this file in the HdrHistogram interval log format, "+
+			"e.g. for HistogramLogProcessor or hdr-plot. The values are in nanoseconds, at the "+
+			"upper bounds of the collector's buckets, so up to 2% above the exact latencies.")
+	flag.DurationVar(&hdrLogEvery,
+		"hdr_log_interval",
+		time.Second,
+		"[Optional] The length of the intervals of `hdr_log`.")
+	flag.DurationVar(&intervalEvery,
+		"report_interval",
+		0,
+		"[Optional] Print the points of `timeseries_file` over each interval of this length to "+
+			"stdout as lines of JSON, e.g. for jq. Set `stdout` to keep the log messages apart.")
+	flag.StringVar(&latencyFile,
+		"latency_file",
+		"",
+		"[Optional] Write every sampled latency to this file as newline-delimited JSON. "+
+			"The file is gzipped if its name ends in .gz.")
+	flag.StringVar(&errorLogFile,
+		"error_log",
+		"",
+		"[Optional] Write the ops that failed to this file as newline-delimited JSON, "+
+			"with their type, namespace, error code and message.")
+	flag.BoolVar(&errorLogOps,
+		"error_log_ops",
+		false,
+		"[Optional] Also write the content of the failed ops to `error_log`, after any redaction.")
+	flag.StringVar(&slowOpFile,
+		"slow_op_log",
+		"",
+		"[Optional] Write the ops slower than `slow_op_threshold` to this file as newline-delimited "+
+			"JSON, with their type, namespace, query and duration. The queries go through `redact`.")
+	flag.DurationVar(&slowOpMin,
+		"slow_op_threshold",
+		100*time.Millisecond,
+		"[Optional] The latency above which the ops are written to `slow_op_log`.")
+	flag.BoolVar(&dashboard,
+		"dashboard",
+		false,
+		"[Optional] Draw the throughput, latencies, error rate, worker utilization and ops file "+
+			"progress over the terminal every second, in place of the periodic reports.")
+	flag.StringVar(&controlAddr,
+		"control_addr",
+		"",
+		"[Optional] Serve the /pause, /resume and /stats control endpoints over HTTP on this "+
+			"address, e.g. localhost:8080, along with the stats as Prometheus metrics on /metrics. "+
+			"While paused, the `real` style catches up on resume.")
+	flag.StringVar(&statsSocket,
+		"stats_socket",
+		"",
+		"[Optional] Push the stats, as the /stats control endpoint serves them, to the Unix "+
+			"domain socket at this path every `stats_socket_interval`, e.g. to a metrics sidecar.")
+	flag.DurationVar(&socketEvery,
+		"stats_socket_interval",
+		10*time.Second,
+		"[Optional] How often the stats are pushed to `stats_socket`.")
+	flag.StringVar(&statsdAddr,
+		"statsd_addr",
+		"",
+		"[Optional] Send the op counts, error counts, ops in flight and sampled latencies "+
+			"over UDP in the StatsD format to this address, e.g. localhost:8125 for a Datadog agent.")
+	flag.StringVar(&statsdPrefix,
+		"statsd_prefix",
+		"flashback.",
+		"[Optional] The prefix of the metric names sent to `statsd_addr`.")
+	flag.StringVar(&statsdTagSpec,
+		"statsd_tags",
+		"",
+		"[Optional] Comma-separated DogStatsD tags of the metrics sent to `statsd_addr`, "+
+			"e.g. env:staging,run:42.")
+	flag.DurationVar(&statsdEvery,
+		"statsd_interval",
+		10*time.Second,
+		"[Optional] How often the counters are flushed to `statsd_addr`.")
+	flag.StringVar(&otlpEndpoint,
+		"otlp_endpoint",
+		"",
+		"[Optional] Export a span per traced op, with its type, namespace, latency and error, "+
+			"to the OpenTelemetry collector at this OTLP/HTTP endpoint, e.g. http://localhost:4318.")
+	flag.Float64Var(&traceRate,
+		"trace_sample_rate",
+		0.01,
+		"[Optional] The share of the ops traced to `otlp_endpoint`, between (0.0, 1.0].")
+	flag.StringVar(&reportFile,
+		"report_file",
+		"",
+		"[Optional] Write the final stats of each op type and of each namespace, or of each "+
+			"database with `label_ops_by`, to this file in `report_format`.")
+	flag.StringVar(&reportFormat,
+		"report_format",
+		"json",
+		"[Optional] The format of `report_file`: `json` or `csv`.")
+	flag.StringVar(&manifestFile,
+		"manifest_file",
+		"",
+		"[Optional] Write the run's configuration, start and end times and final stats to this file as JSON.")
+	flag.StringVar(&runId,
+		"run_id",
+		"",
+		"[Optional] Identifies this run in the exported stats and in the comment of the "+
+			"replayed ops. Defaults to a random UUID.")
+	flag.BoolVar(&commentOps,
+		"comment_ops",
+		true,
+		"[Optional] Attach `flashback run <run id>` as the comment of the replayed queries and "+
+			"commands. Servers older than 4.4 reject the comment of some commands.")
+	flag.StringVar(&slaSpec,
+		"sla",
+		"",
+		"[Optional] P99 latency targets to check each op type against, in the format of "+
+			"<op type>=<duration>[,...], e.g. query=50ms,update=100ms")
+	flag.StringVar(&timeoutSpec,
+		"timeout",
+		"",
+		"[Optional] How long the ops of some types may take before they are counted as timed "+
+			"out, in the format of <op type>=<duration>[,...], e.g. query=1s,command.count=30s. "+
+			"The other op types time out after `socketTimeout`.")
+	flag.Int64Var(&maxTimeMS,
+		"max_time_ms",
+		0,
+		"[Optional] The maxTimeMS of the replayed queries and counts, after which the server "+
+			"aborts them, e.g. to match the limit of production. 0 for no limit.")
 }
 
 func parseFlags() error {
@@ -111,208 +532,646 @@ func parseFlags() error {
 	if opsFilename == "" {
 		return errors.New("Missing required `ops_filename` argument")
 	}
+	if opsFormat != "line" && opsFormat != "extjson" {
+		return errors.New("Invalid `ops_format` argument passed to program: " + opsFormat)
+	}
 	if workers <= 0 {
 		return errors.New("The `workers` argument must be a positive number")
 	}
+	if rampSpec != "" {
+		var err error
+		if ramp, err = ParseRamp(rampSpec); err != nil {
+			return err
+		}
+		workers = ramp.Max
+	}
+	switch IdConflict(idConflict) {
+	case IdConflictError, IdConflictSkip, IdConflictReplace:
+	default:
+		return errors.New("Invalid `id_conflict` argument passed to program: " + idConflict)
+	}
+	switch labelBy {
+	case "":
+		// the report file breaks the stats down by namespace
+		if reportFile != "" {
+			labeler = LabelByNamespace
+		}
+	case "namespace":
+		labeler = LabelByNamespace
+	case "database":
+		labeler = LabelByDatabase
+	default:
+		return errors.New("Invalid `label_ops_by` argument passed to program: " + labelBy)
+	}
+	if reportFormat != "json" && reportFormat != "csv" {
+		return errors.New("Invalid `report_format` argument passed to program: " + reportFormat)
+	}
+	if slowestLabels < 0 {
+		return errors.New("The `slowest_labels` argument must not be negative")
+	}
+	if queueSize < 0 {
+		return errors.New("The `queue_size` argument must not be negative")
+	}
+	if downsample <= 0 {
+		return errors.New("The `latency_downsample` argument must be a positive number")
+	}
+	if speed <= 0 {
+		return errors.New("The `speed` argument must be a positive number")
+	}
+	if stepdownWait < 0 {
+		return errors.New("The `stepdown_wait` argument must not be negative")
+	}
+	if slowOpMin <= 0 {
+		return errors.New("The `slow_op_threshold` argument must be positive")
+	}
+	if explainSlow < 0 {
+		return errors.New("The `explain_slower_than` argument must not be negative")
+	}
+	if seriesEvery <= 0 {
+		return errors.New("The `timeseries_interval` argument must be a positive duration")
+	}
+	if hdrLogEvery <= 0 {
+		return errors.New("The `hdr_log_interval` argument must be a positive duration")
+	}
+	if intervalEvery < 0 {
+		return errors.New("The `report_interval` argument must not be negative")
+	}
+	if socketEvery <= 0 {
+		return errors.New("The `stats_socket_interval` argument must be a positive duration")
+	}
+	if traceRate <= 0 || traceRate > 1 {
+		return errors.New("The `trace_sample_rate` argument must be between (0.0, 1.0]")
+	}
+	if statsdEvery <= 0 {
+		return errors.New("The `statsd_interval` argument must be a positive duration")
+	}
+	if shuffleWindow < 0 {
+		return errors.New("The `shuffle_window` argument must not be negative")
+	}
+	rng = rand.New(rand.NewSource(seed))
+	if deterministic {
+		if rampSpec != "" {
+			return errors.New("The `ramp` argument can't be used with `deterministic`, " +
+				"which replays with a single worker")
+		}
+		workers = 1
+		shuffleWindow = 0
+	}
+	if maxGap < 0 {
+		return errors.New("The `max_gap` argument must not be negative")
+	}
+	if targetP99 < 0 {
+		return errors.New("The `target_p99` argument must not be negative")
+	}
+	if targetP99 > 0 && style != "real" {
+		return errors.New("The `target_p99` argument requires the `real` style")
+	}
+	if tuneEvery <= 0 {
+		return errors.New("The `tune_interval` argument must be a positive duration")
+	}
 	if maxOps == 0 {
 		maxOps = math.MaxUint32
 	}
+	if maxDuration < 0 {
+		return errors.New("The `max_duration` argument must not be negative")
+	}
+	if limit < 0 {
+		return errors.New("The `limit` argument must not be negative")
+	}
 	var err error
+	if runId == "" {
+		runId = NewRunId()
+	}
+	if sla, err = ParseSLA(slaSpec); err != nil {
+		return err
+	}
+	if maxTimeMS < 0 {
+		return errors.New("The `max_time_ms` argument must not be negative")
+	}
+	if opTimeouts, err = ParseOpTimeouts(timeoutSpec); err != nil {
+		return err
+	}
+	if sampleRates, err = ParseSampleRates(rateSpec); err != nil {
+		return err
+	}
+	if statsdTags, err = ParseStatsDTags(statsdTagSpec); err != nil {
+		return err
+	}
+	if proxyURL != "" {
+		if _, err = ParseProxyURL(proxyURL); err != nil {
+			return err
+		}
+	}
+	if targetDb != "" && !(&Op{Database: targetDb, Collection: "c"}).HasValidNamespace() {
+		return fmt.Errorf("The `target_db` argument %q is not a valid database name", targetDb)
+	}
+	if shadowURL != "" && shadowURL == url {
+		return errors.New("The `shadow_url` argument must be another target than `url`")
+	}
+	if onlySucceeded {
+		opFilters = append(opFilters,
+			&OpFilter{Reason: "failed when recorded", Keep: SucceededWhenRecorded})
+	}
+	if matchSpec != "" {
+		predicates, err := ParseFieldPredicates(matchSpec)
+		if err != nil {
+			return err
+		}
+		opFilters = append(opFilters,
+			&OpFilter{Reason: "don't match " + matchSpec, Keep: MatchesAll(predicates)})
+	}
+	if redactSpec != "" {
+		rules, err := ParseRedactRules(redactSpec)
+		if err != nil {
+			return err
+		}
+		redactor = NewRedactor(rules...)
+	}
 	if logger, err = NewLogger(stdout, stderr); err != nil {
 		return err
 	}
 	return nil
 }
 
-func retryOnSocketFailure(block func() error, session *mgo.Session) error {
-	err := block()
-	if err == nil {
-		return nil
+func sessionOptions() SessionOptions {
+	return SessionOptions{
+		URL:                    url,
+		SocketTimeout:          time.Duration(socketTimeout),
+		ServerSelectionTimeout: selectTimeout,
+		AppName:                appName,
+		NoCursorTimeout:        noCursorTmout,
+		Proxy:                  proxyURL,
 	}
+}
 
-	switch err.(type) {
-	case *mgo.QueryError, *mgo.LastError: return err
+func openOpsFile(filename string, logger *Logger) (OpsReader, error) {
+	if opsFormat == "extjson" {
+		err, reader := NewFileExtJSONOpsReader(filename, logger)
+		if err != nil {
+			return nil, err
+		}
+		return reader, nil
 	}
-
-	switch err {
-	case mgo.ErrNotFound, NotSupported: return err
+	err, reader := NewFileByLineOpsReader(filename, logger)
+	if err != nil {
+		return nil, err
 	}
+	return reader, nil
+}
 
-	// Otherwise it's probably a socket error so we refresh the connection,
-	// and try again
-	session.Refresh()
-	logger.Error("retrying mongo query after error: ", err)
-	return block()
+// Open the ops to replay, shuffled within shuffleWindow.
+func newShuffledOpsReader(opsFilename string, logger *Logger) (OpsReader, error) {
+	reader, err := newOpsReader(opsFilename, logger)
+	if err != nil {
+		return reader, err
+	}
+	if shuffleWindow > 0 {
+		reader = NewShuffledOpsReader(reader, shuffleWindow, rng)
+	}
+	return reader, nil
 }
 
-func makeOpsChan(style string, opsFilename string, logger *Logger) (chan *Op, error) {
-	// Prepare to dispatch ops
-	var (
-		reader OpsReader
-		err    error
-	)
+func newOpsReader(opsFilename string, logger *Logger) (OpsReader, error) {
+	filenames := strings.Split(opsFilename, ",")
+	if len(filenames) == 1 {
+		return openOpsFile(opsFilename, logger)
+	}
 
-	if style == "stress" {
-		err, reader = NewFileByLineOpsReader(opsFilename, logger)
+	readers := make([]OpsReader, 0, len(filenames))
+	for _, filename := range filenames {
+		reader, err := openOpsFile(filename, logger)
 		if err != nil {
+			for _, opened := range readers {
+				opened.Close()
+			}
 			return nil, err
 		}
+		readers = append(readers, reader)
+	}
+	return NewMergedOpsReader(readers, logger), nil
+}
 
-		if startTime > 0 {
-			if _, err = reader.SetStartTime(startTime); err != nil {
-				return nil, err
-			}
-		}
-		if numSkipOps > 0 {
-			if err := reader.SkipOps(numSkipOps); err != nil {
-				return nil, err
-			}
-		}
-		return NewBestEffortOpsDispatcher(reader, maxOps, logger), nil
+// The ops to replay in `style`; Replay drops the filtered ones and skips to the
+// start.
+func makeOpsReader(style string, opsFilename string, logger *Logger) (OpsReader, error) {
+	if style == "stress" {
+		return newShuffledOpsReader(opsFilename, logger)
 	}
 
 	// TODO NewCyclicOpsReader: do we really want to make it cyclic?
-	reader = NewCyclicOpsReader(func() OpsReader {
-		err, reader := NewFileByLineOpsReader(opsFilename, logger)
+	return NewCyclicOpsReader(func() OpsReader {
+		reader, err := newShuffledOpsReader(opsFilename, logger)
 		panicOnError(err)
 		return reader
-	}, logger)
+	}, logger), nil
+}
 
-	if startTime > 0 {
-		if _, err := reader.SetStartTime(startTime); err != nil {
-			return nil, err
+// The pace of the real style: `speed`, tuned to `target_p99` and with the idle
+// gaps capped at `max_gap`.
+func replayScaler() TimeScaler {
+	scaler := ConstantSpeed(speed)
+	if targetP99 > 0 {
+		tuner = NewSpeedTuner(targetP99, speed, time.Now())
+		scaler = tuner.Scaler()
+	}
+	if maxGap > 0 {
+		gapCap = &GapCap{Max: maxGap}
+		scaler = gapCap.Scaler(scaler)
+	}
+	return scaler
+}
+
+// inspect implements `flashback inspect`, which prints the inventory of a
+// recording without replaying it.
+func inspect(args []string) error {
+	flags := flag.NewFlagSet("inspect", flag.ExitOnError)
+	filename := flags.String("ops_filename", "",
+		"The file for the serialized ops, generated by the Record scripts. "+
+			"Several comma-separated files are inspected together.")
+	flags.StringVar(&opsFormat, "ops_format", "line",
+		"The format of ops_filename, `line` or `extjson`.")
+	flags.StringVar(&url, "url", "",
+		"[Optional] Also check the namespaces against the indexes of this server, in the "+
+			"format of <host>[:<port>].")
+	flags.StringVar(&proxyURL, "proxy", "",
+		"[Optional] Connect to `url` through a SOCKS5 proxy, in the format of "+
+			"socks5://[<user>:<password>@]<host>:<port>.")
+	flags.Parse(args)
+	if *filename == "" {
+		return errors.New("Missing required `ops_filename` argument")
+	}
+
+	logger, err := NewLogger("", "")
+	if err != nil {
+		return err
+	}
+	defer logger.Close()
+	reader, err := newOpsReader(*filename, logger)
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+	inventory, err := Inspect(reader)
+	if err != nil {
+		return err
+	}
+	inventory.Print(os.Stdout)
+	if url == "" {
+		return nil
+	}
+	warnings, err := schemaWarnings(inventory)
+	for _, warning := range warnings {
+		fmt.Println("Warning: " + warning)
+	}
+	return err
+}
+
+// compareHistograms implements `flashback compare <before> <after>`, which
+// compares the latency distributions of two runs exported by
+// `histogram_file`.
+func compareHistograms(args []string) error {
+	if len(args) != 2 {
+		return errors.New("Usage: compare <before histogram_file> <after histogram_file>")
+	}
+	exports := make([]*HistogramExport, len(args))
+	for i, filename := range args {
+		file, err := os.Open(filename)
+		if err != nil {
+			return err
+		}
+		exports[i], err = LoadHistograms(file)
+		file.Close()
+		if err != nil {
+			return fmt.Errorf("Failed to load %s: %v", filename, err)
 		}
 	}
-	if numSkipOps > 0 {
-		if err := reader.SkipOps(numSkipOps); err != nil {
-			return nil, err
+	PrintHistogramDiffs(os.Stdout, CompareHistograms(exports[0], exports[1]))
+	return nil
+}
+
+// calibrate implements `flashback calibrate`, which measures the overhead the
+// stats collector adds to each op, without any server.
+func calibrate(args []string) error {
+	flags := flag.NewFlagSet("calibrate", flag.ExitOnError)
+	ops := flags.Int("ops", 1000000, "[Optional] How many ops to time at each sample rate.")
+	ratesSpec := flags.String("sample_rates", "1,0.1,0.01",
+		"[Optional] The comma-separated sample rates to time the ops at.")
+	flags.Parse(args)
+	if *ops <= 0 {
+		return errors.New("The `ops` argument must be positive")
+	}
+	rates := []float64{}
+	for _, spec := range strings.Split(*ratesSpec, ",") {
+		rate, err := strconv.ParseFloat(strings.TrimSpace(spec), 64)
+		if err != nil || rate < 0 || rate > 1 {
+			return fmt.Errorf("Invalid sample rate %q, expected a number between 0 and 1", spec)
+		}
+		rates = append(rates, rate)
+	}
+	PrintCalibrations(os.Stdout, Calibrate(*ops, rates))
+	return nil
+}
+
+// Log the namespaces that don't hold as many documents as the replay inserted.
+func verifyInsertCounts(inserts *InsertCounts, logger *Logger) {
+	session, err := DialSession(sessionOptions())
+	if err != nil {
+		logger.Errorf("Failed to verify the counts: %v", err)
+		return
+	}
+	defer session.Close()
+	checks, err := VerifyCounts(inserts, session)
+	if err != nil {
+		logger.Errorf("Failed to verify the counts: %v", err)
+		return
+	}
+	mismatches := 0
+	for _, check := range checks {
+		if !check.Matches() {
+			mismatches++
+			logger.Errorf("Count mismatch on %s: %d documents inserted, %d found",
+				check.Namespace, check.Inserted, check.Found)
+		}
+	}
+	logger.Infof("Verified the counts of %d namespaces: %d mismatches", len(checks), mismatches)
+}
+
+// Check the namespaces of a recording against the target.
+func schemaWarnings(inventory *Inventory) ([]string, error) {
+	session, err := DialSession(sessionOptions())
+	if err != nil {
+		return nil, err
+	}
+	defer session.Close()
+	checks, err := CheckSchema(inventory, session)
+	if err != nil {
+		return nil, err
+	}
+	warnings := []string{}
+	for _, check := range checks {
+		if warning := check.Warning(); warning != "" {
+			warnings = append(warnings, warning)
 		}
 	}
-	return NewByTimeOpsDispatcher(reader, maxOps, logger), nil
+	return warnings, nil
+}
+
+// Warn about the namespaces of the recording that would make the replayed
+// latencies meaningless, e.g. because their indexes are missing.
+func warnSchemaDrift(opsFilename string, logger *Logger) error {
+	reader, err := newOpsReader(opsFilename, logger)
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+	inventory, err := Inspect(reader)
+	if err != nil {
+		return err
+	}
+	warnings, err := schemaWarnings(inventory)
+	for _, warning := range warnings {
+		logger.Errorf("Warning: %s", warning)
+	}
+	if err == nil && len(warnings) == 0 {
+		logger.Info("No schema drift found between the recording and the target")
+	}
+	return err
+}
+
+// The effective value of every flag, including the defaulted ones.
+func effectiveConfig() map[string]string {
+	config := map[string]string{}
+	flag.VisitAll(func(f *flag.Flag) {
+		config[f.Name] = f.Value.String()
+	})
+	config["run_id"] = runId
+	return config
 }
 
 func main() {
 	// Will enable system threads to make sure all cpus can be well utilized.
 	runtime.GOMAXPROCS(runtime.NumCPU())
+	if len(os.Args) > 1 && os.Args[1] == "inspect" {
+		panicOnError(inspect(os.Args[2:]))
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "ops" {
+		PrintOpTypes(os.Stdout)
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "calibrate" {
+		panicOnError(calibrate(os.Args[2:]))
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "compare" {
+		panicOnError(compareHistograms(os.Args[2:]))
+		return
+	}
 	err := parseFlags()
 	panicOnError(err)
 	defer logger.Close()
+	startedAt := time.Now()
 
-	opsChan, err := makeOpsChan(style, opsFilename, logger)
+	if checkSchema {
+		panicOnError(warnSchemaDrift(opsFilename, logger))
+	}
+	reader, err := makeOpsReader(style, opsFilename, logger)
 	panicOnError(err)
 
-	if statsFilename != "" {
-		var err error
-		statsFile, err = os.Create(statsFilename)
-		panicOnError(err)
-		defer statsFile.Close()
+	// Closes the files the stats are written to once the replay is over
+	outputs, err := OpenStatsOutputs(OutputOptions{
+		RunId:           runId,
+		StartTime:       startedAt,
+		Config:          effectiveConfig(),
+		Workers:         workers,
+		StatsFile:       statsFilename,
+		LatencyFile:     latencyFile,
+		ErrorLogFile:    errorLogFile,
+		ErrorLogOps:     errorLogOps,
+		SlowOpFile:      slowOpFile,
+		SlowOpMin:       slowOpMin,
+		Redactor:        redactor,
+		TimeSeriesFile:  seriesFile,
+		TimeSeriesEvery: seriesEvery,
+		IntervalEvery:   intervalEvery,
+		HdrLogFile:      hdrLogFile,
+		HdrLogEvery:     hdrLogEvery,
+		Dashboard:       dashboard,
+		ControlAddr:     controlAddr,
+		StatsSocket:     statsSocket,
+		SocketEvery:     socketEvery,
+		StatsDAddr:      statsdAddr,
+		StatsDPrefix:    statsdPrefix,
+		StatsDTags:      statsdTags,
+		StatsDEvery:     statsdEvery,
+		HistogramFile:   histogramFile,
+		ReportFile:      reportFile,
+		ReportFormat:    reportFormat,
+		ManifestFile:    manifestFile,
+	}, logger)
+	panicOnError(err)
+	defer outputs.Close()
+
+	inserts := NewInsertCounts()
+
+	// Bounds the total duration of the replay
+	ctx := context.Background()
+	if maxDuration > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, maxDuration)
+		defer cancel()
 	}
 
+	// Pausing stops the workers from taking new ops
+	gate := NewPauseGate()
 
-	latencyChan := make(chan Latency, workers)
+	// Before any session is dialed, so all the connections are tracked
+	if poolWaits {
+		EnablePoolWaits()
+	}
+	var gcTracker *GCTracker
+	if gcPauses {
+		gcTracker = NewGCTracker()
+	}
 
-	// Set up workers to do the job
-	exit := make(chan int)
-	opsExecuted := int64(0)
-	fetch := func(id int, statsCollector IStatsCollector) {
-		logger.Infof("Worker #%d report for duty\n", id)
+	options := ReplayOptions{
+		Session:            sessionOptions(),
+		Workers:            workers,
+		Ramp:               ramp,
+		Style:              style,
+		Scaler:             replayScaler(),
+		QueueSize:          queueSize,
+		MaxOps:             maxOps,
+		Limit:              limit,
+		StartTime:          startTime,
+		SkipOps:            numSkipOps,
+		Filters:            opFilters,
+		Redactor:           redactor,
+		TargetDb:           targetDb,
+		SampleRate:         sampleRate,
+		SampleRates:        sampleRates,
+		Downsample:         downsample,
+		Deterministic:      deterministic,
+		Timeouts:           opTimeouts,
+		MaxTime:            time.Duration(maxTimeMS) * time.Millisecond,
+		StepdownWait:       stepdownWait,
+		IdConflict:         IdConflict(idConflict),
+		FailOrphanGetMores: failOrphans,
+		MapCursors:         mapCursors,
+		CausalConsistency:  causal,
+		Labeler:            labeler,
+		ShadowURL:          shadowURL,
+		Strict:             strict,
+		Gate:               gate,
+		Readiness:          NewReadiness(processStart),
+		SlowOps:            outputs.SlowOps(),
+		Outputs:            outputs,
+		Logger:             logger,
+	}
+	// Only the first few mismatches are logged in detail
+	if compare {
+		options.Comparator = NewResultComparator(logger, 10)
+	}
+	if explainSlow > 0 {
+		options.Explainer = NewSlowOpExplainer(logger, explainSlow)
+	}
+	if verifyCounts {
+		options.Inserts = inserts
+	}
+	var tracer *OpTracer
+	if otlpEndpoint != "" {
+		tracer = NewOpTracer(otlpEndpoint, traceRate,
+			map[string]string{"flashback.run_id": runId}, logger)
+		options.Tracer = tracer
+	}
+	if commentOps {
+		options.Comment = "flashback run " + runId
+	}
 
-		session, err := mgo.Dial(url)
-		panicOnError(err)
-		session.SetSocketTimeout(time.Duration(socketTimeout))
-
-		defer session.Close()
-		exec := OpsExecutorWithStats(session, statsCollector)
-		for {
-			op := <-opsChan
-			if op == nil {
-				break
-			}
-			block := func() error {
-				err := exec.Execute(op)
-				return err
-			}
-			err := retryOnSocketFailure(block, session)
-			if verbose == true && err != nil {
-				logger.Error(fmt.Sprintf(
-					"error executing op - type:%s,database:%s,collection:%s,error:%s",
-					op.Type,op.Database,op.Collection,err))
-			}
-			atomic.AddInt64(&opsExecuted, 1)
+	options.Hooks.Executed = func(op *Op, err error) {
+		if verbose == true && err != nil {
+			logger.Error(fmt.Sprintf(
+				"error executing op - type:%s,database:%s,collection:%s,error:%s",
+				op.Type,op.Database,op.Collection,err))
 		}
-		exit <- 1
-		logger.Infof("Worker #%d done!\n", id)
-	}
-	statsCollectorList := make([]*StatsCollector, workers)
-	for i := 0; i < workers; i++ {
-		statsCollectorList[i] = NewStatsCollector()
-		statsCollectorList[i].SampleLatencies(sampleRate, latencyChan)
-		go fetch(i, statsCollectorList[i])
 	}
 
 	// Periodically report execution status
-	go func() {
-		statsAnalyzer := NewStatsAnalyzer(statsCollectorList, &opsExecuted,
-			latencyChan, int(sampleRate*float64(maxOps)))
-		toFloat := func(nano int64) float64 {
-			return float64(nano) / float64(1e6)
+	options.Hooks.Report = func(status *ExecutionStatus) {
+		if poolWaits {
+			status.PoolWaits = GetPoolWaits()
 		}
+		if gcTracker != nil {
+			status.GCPauses = gcTracker.Pauses()
+		}
+		Report(status, sla, logger)
+		if labeler != nil {
+			ReportLabels(status, slowestLabels, logger)
+		}
+		if reportWorkers {
+			ReportWorkers(status, logger)
+		}
+	}
 
-		report := func() {
-			var statsLineOutput string
-
-			status := statsAnalyzer.GetStatus()
-			logger.Infof("Executed %d ops, %.2f ops/sec (avg), %.2f ops/sec (last)", opsExecuted,
-				status.OpsPerSec, status.OpsPerSecLast)
-
-			if statsFilename != "" {
-				timestamp := time.Now().Format("2006-01-02 15:04:05 -0700")
-				statsLineOutput = fmt.Sprintf("%s,%d,%.2f", timestamp, (status.OpsExecuted - status.OpsExecutedLast), status.OpsPerSecLast)
-			}
+	if tuner != nil {
+		outputs.Every("the speed", tuneEvery, false, func(now time.Time, stats *StatsCollector) error {
+			p99, opsSec := tuner.Tune(now, stats)
+			logger.Infof("p99 latency %v at %.2f ops/sec, speed now %.2fx", p99, opsSec, tuner.Speed())
+			return nil
+		})
+	}
 
-			for _, opType := range AllOpTypes {
-				allTime := status.AllTimeLatencies[opType]
-				sinceLast := status.SinceLastLatencies[opType]
-				logger.Infof("  Op type: %s, count: %d, avg ops/sec: %.2f, last ops/sec: %.2f",
-					opType, status.Counts[opType],
-					status.TypeOpsSec[opType], status.TypeOpsSecLast[opType])
-				template := "   %s: P50: %.2fms, P70: %.2fms, P90: %.2fms, " +
-					"P95 %.2fms, P99 %.2fms, Max %.2fms\n"
-				logger.Infof(template, "Total", toFloat(allTime[P50]),
-					toFloat(allTime[P70]), toFloat(allTime[P90]),
-					toFloat(allTime[P95]), toFloat(allTime[P99]),
-					toFloat(allTime[P100]))
-				logger.Infof(template, "Last ", toFloat(sinceLast[P50]),
-					toFloat(sinceLast[P70]), toFloat(sinceLast[P90]),
-					toFloat(sinceLast[P95]), toFloat(sinceLast[P99]),
-					toFloat(sinceLast[P100]))
-
-				if statsFilename != "" {
-					statsLineOutput = fmt.Sprintf("%s,%d,%.2f", statsLineOutput,
-							(status.Counts[opType] - status.CountsLast[opType]), status.TypeOpsSecLast[opType])
+	// Each step of the ramp ends when the next worker joins, and the last one
+	// once all the workers are done.
+	if ramp != nil {
+		outputs.Follow(func(stop <-chan struct{}, statsCollectorList []*StatsCollector) {
+			rampStart := time.Now()
+			recorder := NewRampRecorder(rampStart)
+			for active := ramp.Start; ; active++ {
+				var next <-chan time.Time
+				if active < ramp.Max {
+					next = time.After(time.Until(rampStart.Add(ramp.Delay(active))))
+				}
+				finished := false
+				select {
+				case <-stop:
+					finished = true
+				case <-next:
+				}
+				step := recorder.EndStep(active, time.Now(), CombineStats(statsCollectorList...))
+				logger.Infof("Ramp step of %d workers: %.2f ops/sec, avg latency %.2fms, P99 %v",
+					step.Workers, step.OpsSec, step.LatencyInMs, step.P99)
+				if finished {
+					return
 				}
 			}
+		})
+	}
 
-			// Write stats to disk at each interval for analysis later
-			// Format is:
-			// time,  ops, ops/sec, insert ops, inserts/sec, update ops, update/sec, remove ops, remove/sec,
-			// query ops, query/sec, count ops, count/sec, fam ops, fam/sec
-			if statsFilename != "" {
-				statsFile.WriteString(statsLineOutput + "\n")
-			}
+	options.Hooks.Done = func() {
+		if ctx.Err() == context.DeadlineExceeded {
+			logger.Infof("Stopped replaying after reaching the max duration of %v", maxDuration)
 		}
-		defer report()
+		if gapCap != nil {
+			logger.Infof("Collapsed %v of idle time between ops", gapCap.Collapsed())
+		}
+	}
 
-		for opsExecuted < int64(maxOps) {
-			time.Sleep(5 * time.Second)
-			report()
+	stats, err := Replay(ctx, reader, options)
+	panicOnError(err)
+	if tracer != nil {
+		tracer.Close()
+		if dropped := tracer.Dropped(); dropped > 0 {
+			logger.Infof("Dropped %d spans the collector couldn't take", dropped)
 		}
-	}()
+	}
+	if tuner != nil {
+		logger.Infof("Sustained %.2f ops/sec at speed %.2fx with a p99 latency under %v",
+			tuner.MaxRate(), tuner.MaxSpeed(), targetP99)
+	}
 
-	// Wait for workers
-	received := 0
-	for received < workers {
-		<-exit
-		received += 1
+	if verifyCounts {
+		verifyInsertCounts(inserts, logger)
 	}
+	panicOnError(outputs.Finish(stats))
 }
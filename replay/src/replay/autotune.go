@@ -0,0 +1,108 @@
+package replay
+
+import (
+	"math"
+	"sync/atomic"
+	"time"
+)
+
+// SpeedTuner searches for the fastest speed at which the target keeps up with
+// a replay: it doubles the speed of the `real` style after every interval
+// whose p99 latency stayed under a target, then bisects between the fastest
+// speed that met the target and the slowest one that didn't, so the speed
+// converges on the sustainable one.
+type SpeedTuner struct {
+	target time.Duration
+	// the current speed multiplier, as float64 bits, read by the dispatcher
+	speed uint64
+	// the fastest speed that met the target, and the slowest one that didn't;
+	// 0 when there is none yet
+	low  float64
+	high float64
+	// the throughput of the fastest interval that met the target, and its
+	// speed
+	maxRate  float64
+	maxSpeed float64
+	// the stats at the end of the previous interval
+	last     *StatsCollector
+	lastTime time.Time
+}
+
+// NewSpeedTuner starts tuning at speed `initial`, with the first interval
+// starting at `start`.
+func NewSpeedTuner(target time.Duration, initial float64, start time.Time) *SpeedTuner {
+	return &SpeedTuner{
+		target:   target,
+		speed:    math.Float64bits(initial),
+		last:     NewStatsCollector(),
+		lastTime: start,
+	}
+}
+
+// Speed returns the current speed multiplier.
+func (t *SpeedTuner) Speed() float64 {
+	return math.Float64frombits(atomic.LoadUint64(&t.speed))
+}
+
+// MaxRate returns the highest ops/sec seen over an interval whose p99 latency
+// met the target, i.e. the discovered sustainable rate.
+func (t *SpeedTuner) MaxRate() float64 {
+	return t.maxRate
+}
+
+// MaxSpeed returns the speed multiplier of the interval of MaxRate.
+func (t *SpeedTuner) MaxSpeed() float64 {
+	return t.maxSpeed
+}
+
+// Scaler replays ops at the current speed.
+func (t *SpeedTuner) Scaler() TimeScaler {
+	return func(origGap time.Duration, elapsed time.Duration) time.Duration {
+		return time.Duration(float64(origGap) / t.Speed())
+	}
+}
+
+// Tune ends the current interval at `now`, and adjusts the speed by the p99
+// of the latencies sampled over the interval, out of the stats collected
+// since the start of the run. Returns the p99 and the ops/sec of the
+// interval; intervals without sampled latencies leave the speed as is.
+func (t *SpeedTuner) Tune(now time.Time, stats *StatsCollector) (p99 time.Duration, opsSec float64) {
+	current := NewStatsCollector()
+	current.Add(stats)
+	if interval := now.Sub(t.lastTime); interval > 0 {
+		opsSec = float64(current.total-t.last.total) / interval.Seconds()
+	}
+	p99 = intervalPercentile(t.last, current, 0.99)
+	t.last, t.lastTime = current, now
+	if p99 == 0 {
+		return p99, opsSec
+	}
+
+	speed := t.Speed()
+	// the target may have slowed down since a speed met it, or sped up since a
+	// speed didn't, in which case the search starts over on that side
+	if p99 <= t.target {
+		t.low = speed
+		if t.high <= t.low {
+			t.high = 0
+		}
+		if opsSec > t.maxRate {
+			t.maxRate, t.maxSpeed = opsSec, speed
+		}
+	} else {
+		t.high = speed
+		if t.low >= t.high {
+			t.low = 0
+		}
+	}
+	switch {
+	case t.high == 0:
+		speed *= 2
+	case t.low == 0:
+		speed /= 2
+	default:
+		speed = (t.low + t.high) / 2
+	}
+	atomic.StoreUint64(&t.speed, math.Float64bits(speed))
+	return p99, opsSec
+}
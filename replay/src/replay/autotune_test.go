@@ -0,0 +1,45 @@
+package replay
+
+import (
+	. "gopkg.in/check.v1"
+	"time"
+)
+
+type TestAutotuneSuite struct{}
+
+var _ = Suite(&TestAutotuneSuite{})
+
+func (s *TestAutotuneSuite) TestSpeedTuner(c *C) {
+	start := time.Unix(1500000000, 0)
+	stats := NewStatsCollector()
+	tuner := NewSpeedTuner(10*time.Millisecond, 1, start)
+	now := start
+	// runs an interval of 100 ops, whose p99 is `latency`
+	interval := func(latency time.Duration) time.Duration {
+		replayOps(stats, Query, 100, latency)
+		now = now.Add(time.Second)
+		p99, opsSec := tuner.Tune(now, stats)
+		c.Assert(opsSec, Equals, 100.0)
+		return p99
+	}
+
+	// no latencies sampled, no change
+	now = now.Add(time.Second)
+	p99, _ := tuner.Tune(now, stats)
+	c.Assert(p99, Equals, time.Duration(0))
+	c.Assert(tuner.Speed(), Equals, 1.0)
+
+	c.Assert(interval(time.Millisecond) <= 10*time.Millisecond, Equals, true)
+	c.Assert(tuner.Speed(), Equals, 2.0)
+	interval(time.Millisecond)
+	c.Assert(tuner.Speed(), Equals, 4.0)
+	c.Assert(interval(time.Second) > 10*time.Millisecond, Equals, true)
+	c.Assert(tuner.Speed(), Equals, 3.0)
+	interval(time.Millisecond)
+	c.Assert(tuner.Speed(), Equals, 3.5)
+	interval(time.Second)
+	c.Assert(tuner.Speed(), Equals, 3.25)
+
+	c.Assert(tuner.MaxRate(), Equals, 100.0)
+	c.Assert(tuner.MaxSpeed(), Equals, 1.0)
+}
@@ -0,0 +1,60 @@
+package replay
+
+import (
+	"fmt"
+	"io"
+	"time"
+)
+
+// Calibration is the overhead the stats collector adds to the latency of
+// each op at a sample rate.
+type Calibration struct {
+	SampleRate float64
+	// in nanoseconds, fractional since the overhead of unsampled ops is
+	// often below a nanosecond
+	NsPerOp float64
+}
+
+// Calibrate times `ops` StartOp() and EndOp() pairs with nothing in between,
+// at each of `sampleRates`, without any server. The sampled latencies go
+// through a channel drained as fast as possible, like the replay's. The
+// overhead is the floor of the measured latencies, worth subtracting from
+// the ones of sub-microsecond ops, or lowering the sample rate for.
+func Calibrate(ops int, sampleRates []float64) []Calibration {
+	calibrations := make([]Calibration, 0, len(sampleRates))
+	for _, sampleRate := range sampleRates {
+		latencies := make(chan Latency, 1024)
+		drained := make(chan struct{})
+		go func() {
+			defer close(drained)
+			for range latencies {
+			}
+		}()
+		stats := NewStatsCollector()
+		stats.SampleLatencies(sampleRate, latencies)
+
+		start := time.Now()
+		for i := 0; i < ops; i++ {
+			stats.StartOp(Query)
+			stats.EndOp()
+		}
+		elapsed := time.Since(start)
+		close(latencies)
+		<-drained
+
+		calibration := Calibration{SampleRate: sampleRate}
+		if ops > 0 {
+			calibration.NsPerOp = float64(elapsed.Nanoseconds()) / float64(ops)
+		}
+		calibrations = append(calibrations, calibration)
+	}
+	return calibrations
+}
+
+// PrintCalibrations writes the overhead at each sample rate to `w`, one per
+// line.
+func PrintCalibrations(w io.Writer, calibrations []Calibration) {
+	for _, calibration := range calibrations {
+		fmt.Fprintf(w, "sample rate %g: %.0fns/op\n", calibration.SampleRate, calibration.NsPerOp)
+	}
+}
@@ -0,0 +1,22 @@
+package replay
+
+import (
+	"bytes"
+	. "gopkg.in/check.v1"
+)
+
+type TestCalibrateSuite struct{}
+
+var _ = Suite(&TestCalibrateSuite{})
+
+func (s *TestCalibrateSuite) TestCalibrate(c *C) {
+	calibrations := Calibrate(1000, []float64{1, 0})
+	c.Assert(calibrations, HasLen, 2)
+	c.Assert(calibrations[0].SampleRate, Equals, 1.0)
+	c.Assert(calibrations[0].NsPerOp > 0, Equals, true)
+	c.Assert(calibrations[1].SampleRate, Equals, 0.0)
+
+	out := bytes.Buffer{}
+	PrintCalibrations(&out, []Calibration{{SampleRate: 0.1, NsPerOp: 120.4}})
+	c.Assert(out.String(), Equals, "sample rate 0.1: 120ns/op\n")
+}
@@ -0,0 +1,103 @@
+package replay
+
+import (
+	"github.com/globalsign/mgo"
+	"github.com/globalsign/mgo/bson"
+	"sync"
+)
+
+// ClusterClock tracks the latest cluster time the writes of the replay were
+// applied at, so the reads replayed after them read at or after that time,
+// even from a lagging secondary, like the causally consistent sessions of the
+// recorded clients did. It's shared by the executors of all the workers, since
+// a write and the read that follows it may be replayed by different workers.
+// The recording doesn't tell the clients' sessions apart, so a read waits for
+// all the writes that completed before it started, not only its client's.
+type ClusterClock struct {
+	lock sync.Mutex
+	time bson.MongoTimestamp
+}
+
+func NewClusterClock() *ClusterClock {
+	return &ClusterClock{}
+}
+
+// Advance moves the clock forward to `ts`. An earlier time is ignored.
+func (c *ClusterClock) Advance(ts bson.MongoTimestamp) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if ts > c.time {
+		c.time = ts
+	}
+}
+
+// Time returns the latest cluster time, 0 until a write went through.
+func (c *ClusterClock) Time() bson.MongoTimestamp {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.time
+}
+
+// The read concern of the reads, nil until a write went through, e.g. against
+// a standalone server, which has no cluster time.
+func (e *OpsExecutor) readConcern() bson.D {
+	if e.clock == nil {
+		return nil
+	}
+	ts := e.clock.Time()
+	if ts == 0 {
+		return nil
+	}
+	return bson.D{{Name: "afterClusterTime", Value: ts}}
+}
+
+// Advance the clock to the cluster time of the write the executor just ran.
+// The driver doesn't expose the operationTime of the writes, so it's read off a
+// ping to the primary, on the connection of the write: its operationTime
+// isn't earlier than the write's.
+func (e *OpsExecutor) observeClusterTime() {
+	primary := e.session.Clone()
+	defer primary.Close()
+	primary.SetMode(mgo.Primary, false)
+	reply := struct {
+		OperationTime bson.MongoTimestamp `bson:"operationTime"`
+	}{}
+	if err := primary.Run("ping", &reply); err == nil {
+		e.clock.Advance(reply.OperationTime)
+	}
+}
+
+// Replay a query as a find command, which unlike the driver's queries takes a
+// read concern.
+func (e *OpsExecutor) execCausalQuery(content Document, coll *mgo.Collection,
+	readConcern bson.D) error {
+	cmd := bson.D{{Name: "find", Value: coll.Name}, {Name: "filter", Value: content["query"]}}
+	if ntoreturn, ok := content["ntoreturn"].(float64); ok && ntoreturn != 0 {
+		cmd = append(cmd, bson.DocElem{Name: "limit", Value: int(ntoreturn)})
+	}
+	if ntoskip, ok := content["ntoskip"].(float64); ok && ntoskip != 0 {
+		cmd = append(cmd, bson.DocElem{Name: "skip", Value: int(ntoskip)})
+	}
+	if e.comment != "" {
+		cmd = append(cmd, bson.DocElem{Name: "comment", Value: e.comment})
+	}
+	if e.maxTime > 0 {
+		cmd = append(cmd, bson.DocElem{Name: "maxTimeMS", Value: maxTimeMS(e.maxTime)})
+	}
+	cmd = append(cmd, bson.DocElem{Name: "readConcern", Value: readConcern})
+
+	reply := struct {
+		Cursor struct {
+			Id         int64      `bson:"id"`
+			FirstBatch []bson.Raw `bson:"firstBatch"`
+		} `bson:"cursor"`
+	}{}
+	result := []Document{}
+	err := coll.Database.Run(cmd, &reply)
+	if err == nil {
+		// the getMores read from the cursor's snapshot, without a read concern
+		err = coll.NewIter(nil, reply.Cursor.FirstBatch, reply.Cursor.Id, nil).All(&result)
+	}
+	e.lastResult = &result
+	return err
+}
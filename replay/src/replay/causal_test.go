@@ -0,0 +1,25 @@
+package replay
+
+import (
+	"github.com/globalsign/mgo/bson"
+	. "gopkg.in/check.v1"
+)
+
+type TestCausalSuite struct{}
+
+var _ = Suite(&TestCausalSuite{})
+
+func (s *TestCausalSuite) TestClusterClock(c *C) {
+	clock := NewClusterClock()
+	exec := NewOpsExecutor(nil)
+	c.Assert(exec.readConcern(), IsNil)
+	exec.CausalConsistency(clock)
+	// no read concern until a write went through
+	c.Assert(exec.readConcern(), IsNil)
+
+	clock.Advance(bson.MongoTimestamp(6 << 32))
+	clock.Advance(bson.MongoTimestamp(5 << 32))
+	c.Assert(clock.Time(), Equals, bson.MongoTimestamp(6<<32))
+	c.Assert(exec.readConcern(), DeepEquals,
+		bson.D{{Name: "afterClusterTime", Value: bson.MongoTimestamp(6 << 32)}})
+}
@@ -0,0 +1,99 @@
+package replay
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// PauseGate lets the replay be paused and resumed: while it's paused, Wait()
+// blocks, so the workers take no new ops and only finish the ones in flight.
+type PauseGate struct {
+	lock sync.Mutex
+	// closed when the replay is resumed; nil while it runs
+	resumed chan struct{}
+}
+
+func NewPauseGate() *PauseGate {
+	return &PauseGate{}
+}
+
+func (g *PauseGate) Pause() {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	if g.resumed == nil {
+		g.resumed = make(chan struct{})
+	}
+}
+
+func (g *PauseGate) Resume() {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	if g.resumed != nil {
+		close(g.resumed)
+		g.resumed = nil
+	}
+}
+
+func (g *PauseGate) Paused() bool {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	return g.resumed != nil
+}
+
+// Wait blocks while the replay is paused, or until `ctx` is done, in which
+// case it returns its error.
+func (g *PauseGate) Wait(ctx context.Context) error {
+	g.lock.Lock()
+	resumed := g.resumed
+	g.lock.Unlock()
+	if resumed == nil {
+		return nil
+	}
+	select {
+	case <-resumed:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// ControlHandler serves the control endpoints of a replay:
+//
+//	/pause   stops taking new ops
+//	/resume  takes new ops again
+//	/stats   returns the current stats as JSON, e.g. with the recent figures
+//	         of LiveStats
+func ControlHandler(gate *PauseGate, stats func() StatsSnapshot) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/pause", func(w http.ResponseWriter, r *http.Request) {
+		gate.Pause()
+		w.Write([]byte("paused\n"))
+	})
+	mux.HandleFunc("/resume", func(w http.ResponseWriter, r *http.Request) {
+		gate.Resume()
+		w.Write([]byte("resumed\n"))
+	})
+	mux.HandleFunc("/stats", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(stats())
+	})
+	return mux
+}
+
+// PushSnapshot writes `snapshot` as a line of JSON, like /stats serves it, to
+// the Unix domain socket at `path`, e.g. of a metrics sidecar where opening a
+// port isn't allowed. It dials the socket for each snapshot, so the sidecar
+// may restart during the replay.
+func PushSnapshot(path string, snapshot StatsSnapshot, timeout time.Duration) error {
+	conn, err := net.DialTimeout("unix", path, timeout)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(timeout))
+	return json.NewEncoder(conn).Encode(snapshot)
+}
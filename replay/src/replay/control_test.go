@@ -0,0 +1,40 @@
+package replay
+
+import (
+	"encoding/json"
+	. "gopkg.in/check.v1"
+	"net"
+	"path/filepath"
+	"time"
+)
+
+type TestControlSuite struct{}
+
+var _ = Suite(&TestControlSuite{})
+
+func (s *TestControlSuite) TestPushSnapshot(c *C) {
+	path := filepath.Join(c.MkDir(), "stats.sock")
+	listener, err := net.Listen("unix", path)
+	c.Assert(err, IsNil)
+	defer listener.Close()
+	received := make(chan StatsSnapshot)
+	go func() {
+		conn, err := listener.Accept()
+		if !c.Check(err, IsNil) {
+			close(received)
+			return
+		}
+		defer conn.Close()
+		snapshot := StatsSnapshot{}
+		c.Check(json.NewDecoder(conn).Decode(&snapshot), IsNil)
+		received <- snapshot
+	}()
+
+	stats := NewStatsCollector()
+	replayOps(stats, Insert, 1, 0)
+	c.Assert(PushSnapshot(path, stats.Snapshot(), time.Second), IsNil)
+	c.Assert((<-received).Counts[Insert], Equals, int64(1))
+
+	listener.Close()
+	c.Assert(PushSnapshot(path, stats.Snapshot(), time.Second), NotNil)
+}
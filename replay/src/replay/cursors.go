@@ -0,0 +1,151 @@
+package replay
+
+import (
+	"github.com/globalsign/mgo"
+	"github.com/globalsign/mgo/bson"
+	"strconv"
+	"sync"
+)
+
+// CursorMap maps the ids of the cursors in the recording to the ids of the
+// cursors opened in their place by the replay, so the recorded getMore and
+// killCursors ops reach the replayed cursors. It's shared by the executors of
+// all the workers, since the ops of a cursor may be replayed by different
+// workers.
+type CursorMap struct {
+	lock sync.Mutex
+	live map[int64]int64
+}
+
+func NewCursorMap() *CursorMap {
+	return &CursorMap{live: map[int64]int64{}}
+}
+
+// Add maps a recorded cursor id to the id of the cursor replayed in its place.
+func (m *CursorMap) Add(recorded int64, live int64) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.live[recorded] = live
+}
+
+// Get returns the id of the replayed cursor standing for a recorded one.
+func (m *CursorMap) Get(recorded int64) (int64, bool) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	live, ok := m.live[recorded]
+	return live, ok
+}
+
+// Remove forgets a recorded cursor, once its replayed cursor is closed.
+func (m *CursorMap) Remove(recorded int64) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	delete(m.live, recorded)
+}
+
+// Len returns how many replayed cursors are open.
+func (m *CursorMap) Len() int {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	return len(m.live)
+}
+
+// Cursor ids are 64 bits integers, which the recordings hold as numbers or
+// {"$numberLong": ...} documents. Returns 0, which is never a valid cursor
+// id, if `val` isn't a cursor id.
+func cursorId(val interface{}) int64 {
+	switch id := val.(type) {
+	case int64:
+		return id
+	case int:
+		return int64(id)
+	case float64:
+		return int64(id)
+	case map[string]interface{}:
+		str, _ := id["$numberLong"].(string)
+		n, _ := strconv.ParseInt(str, 10, 64)
+		return n
+	}
+	return 0
+}
+
+// The cursor part of the reply of the find and getMore commands.
+type cursorReply struct {
+	Cursor struct {
+		Id         int64      `bson:"id"`
+		FirstBatch []Document `bson:"firstBatch"`
+	} `bson:"cursor"`
+}
+
+// Replay a query that left a cursor open when it was recorded: only the first
+// batch is fetched, as many documents as were recorded, and the cursor is
+// kept open for the recorded getMores.
+func (e *OpsExecutor) execCursorQuery(op *Op, coll *mgo.Collection) error {
+	content := op.Content
+	cmd := bson.D{{Name: "find", Value: coll.Name}, {Name: "filter", Value: content["query"]}}
+	if ntoreturn, ok := content["ntoreturn"].(float64); ok && ntoreturn != 0 {
+		cmd = append(cmd, bson.DocElem{Name: "limit", Value: int(ntoreturn)})
+	}
+	if ntoskip, ok := content["ntoskip"].(float64); ok && ntoskip != 0 {
+		cmd = append(cmd, bson.DocElem{Name: "skip", Value: int(ntoskip)})
+	}
+	nreturned, _ := op.Recorded["nreturned"].(float64)
+	cmd = append(cmd, bson.DocElem{Name: "batchSize", Value: int(nreturned)})
+	if e.comment != "" {
+		cmd = append(cmd, bson.DocElem{Name: "comment", Value: e.comment})
+	}
+	if e.maxTime > 0 {
+		cmd = append(cmd, bson.DocElem{Name: "maxTimeMS", Value: maxTimeMS(e.maxTime)})
+	}
+	if readConcern := e.readConcern(); readConcern != nil {
+		cmd = append(cmd, bson.DocElem{Name: "readConcern", Value: readConcern})
+	}
+
+	reply := cursorReply{}
+	err := coll.Database.Run(cmd, &reply)
+	e.lastResult = &reply.Cursor.FirstBatch
+	if err == nil && reply.Cursor.Id != 0 {
+		e.cursors.Add(cursorId(op.Recorded["cursorid"]), reply.Cursor.Id)
+	}
+	return err
+}
+
+// Replay a getMore on the cursor replayed in place of the recorded one.
+func (e *OpsExecutor) execMappedGetMore(recorded int64, live int64,
+	content Document, coll *mgo.Collection) error {
+	mapped := Document{}
+	for key, value := range content {
+		mapped[key] = value
+	}
+	mapped["getMore"] = live
+	reply := cursorReply{}
+	err := coll.Database.Run(e.buildCommand("getMore", mapped), &reply)
+	// the server closes exhausted cursors, and the ones that failed
+	if err != nil || reply.Cursor.Id == 0 {
+		e.cursors.Remove(recorded)
+	}
+	return err
+}
+
+// Point the cursors of a recorded killCursors to the replayed ones. Cursors
+// that weren't replayed are left as is: the server just reports them as not
+// found.
+func (e *OpsExecutor) mapKilledCursors(content Document) Document {
+	ids, _ := content["cursors"].([]interface{})
+	mapped := Document{}
+	for key, value := range content {
+		mapped[key] = value
+	}
+	liveIds := make([]interface{}, 0, len(ids))
+	for _, id := range ids {
+		recorded := cursorId(id)
+		if live, ok := e.cursors.Get(recorded); ok {
+			e.cursors.Remove(recorded)
+			liveIds = append(liveIds, live)
+		} else {
+			liveIds = append(liveIds, recorded)
+		}
+	}
+	mapped["cursors"] = liveIds
+	return mapped
+}
@@ -0,0 +1,132 @@
+package replay
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// The bytes read so far from the ops files opened by NewFileByLineOpsReader
+// and NewFileExtJSONOpsReader, and their total size.
+var opsFileRead, opsFileSize int64
+
+// OpsFileProgress returns how many bytes of the ops files were read so far,
+// and their total size. Gzipped files count their compressed bytes.
+func OpsFileProgress() (read int64, size int64) {
+	return atomic.LoadInt64(&opsFileRead), atomic.LoadInt64(&opsFileSize)
+}
+
+// Counts the bytes read from an ops file into OpsFileProgress().
+func trackOpsFile(file *os.File) io.Reader {
+	if info, err := file.Stat(); err == nil {
+		atomic.AddInt64(&opsFileSize, info.Size())
+	}
+	return &progressReader{file}
+}
+
+type progressReader struct {
+	reader io.Reader
+}
+
+func (r *progressReader) Read(p []byte) (int, error) {
+	n, err := r.reader.Read(p)
+	atomic.AddInt64(&opsFileRead, int64(n))
+	return n, err
+}
+
+// Dashboard draws the progress of a replay over the whole terminal, for long
+// replays whose logs scroll by too fast: the throughput, the latency
+// percentiles of each op type, the error rate, how busy the workers are and
+// how far into the ops file the replay is. The percentiles, the error rate and
+// the utilization are over the time since the previous Draw().
+type Dashboard struct {
+	writer  io.Writer
+	workers int
+	start   time.Time
+	// the stats at the previous draw
+	last     *StatsCollector
+	lastTime time.Time
+}
+
+// NewDashboard draws to `writer`, a terminal that understands the ANSI escape
+// codes, the replay of `workers` workers started at `start`.
+func NewDashboard(writer io.Writer, workers int, start time.Time) *Dashboard {
+	return &Dashboard{
+		writer:   writer,
+		workers:  workers,
+		start:    start,
+		last:     NewStatsCollector(),
+		lastTime: start,
+	}
+}
+
+// Draw redraws the dashboard at `now` out of the stats collected since the
+// start of the replay.
+func (d *Dashboard) Draw(now time.Time, stats *StatsCollector) error {
+	current := NewStatsCollector()
+	current.Add(stats)
+	last, interval := d.last, now.Sub(d.lastTime)
+	d.last, d.lastTime = current, now
+
+	var out strings.Builder
+	// clear the screen and move to its top left corner
+	out.WriteString("\x1b[H\x1b[2J")
+	elapsed := now.Sub(d.start).Truncate(time.Second)
+	fmt.Fprintf(&out, "flashback  %v elapsed", elapsed)
+	if read, size := OpsFileProgress(); size > 0 {
+		fmt.Fprintf(&out, ", ops file %.1f%% read (%s of %s)", float64(read)/float64(size)*100,
+			formatBytes(read), formatBytes(size))
+	}
+	out.WriteString("\n\n")
+
+	total, recent := current.total, 0.0
+	for _, opType := range current.OpTypes() {
+		recent += current.RecentOpsSec(opType)
+	}
+	avg := 0.0
+	if elapsed > 0 {
+		avg = float64(total) / now.Sub(d.start).Seconds()
+	}
+	fmt.Fprintf(&out, "Ops:      %d, %.2f ops/sec (last %v), %.2f ops/sec (avg), %d in flight\n",
+		total, recent, RecentOpsSecWindow, avg, current.InFlight())
+
+	errors, lastErrors := int64(0), int64(0)
+	for code, count := range current.errorCodes {
+		errors += count
+		lastErrors += count - last.errorCodes[code]
+	}
+	errorRate := 0.0
+	if ops := total - last.total; ops > 0 {
+		errorRate = float64(lastErrors) / float64(ops) * 100
+	}
+	fmt.Fprintf(&out, "Errors:   %.2f%% of the ops, %d in total\n", errorRate, errors)
+
+	busy := 0.0
+	if d.workers > 0 && interval > 0 {
+		serving := current.ServiceTime() - last.ServiceTime()
+		busy = float64(serving) / float64(interval*time.Duration(d.workers)) * 100
+	}
+	fmt.Fprintf(&out, "Workers:  %d, busy %.0f%% of the time\n\n", d.workers, busy)
+
+	fmt.Fprintf(&out, "%-18s %12s %12s %10s %10s %10s\n", "OP TYPE", "COUNT", "OPS/SEC",
+		"P50", "P95", "P99")
+	for _, opType := range current.OpTypes() {
+		if current.counts[opType] == 0 {
+			continue
+		}
+		// none sampled during the interval
+		percentile := func(p float64) string {
+			if ms := opIntervalPercentileInMs(last, current, opType, p); ms > 0 {
+				return fmt.Sprintf("%.2fms", ms)
+			}
+			return "-"
+		}
+		fmt.Fprintf(&out, "%-18s %12d %12.2f %10s %10s %10s\n", opType, current.counts[opType],
+			current.RecentOpsSec(opType), percentile(0.5), percentile(0.95), percentile(0.99))
+	}
+	_, err := io.WriteString(d.writer, out.String())
+	return err
+}
@@ -0,0 +1,71 @@
+package replay
+
+import (
+	"bytes"
+	. "gopkg.in/check.v1"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+type TestDashboardSuite struct{}
+
+var _ = Suite(&TestDashboardSuite{})
+
+func (s *TestDashboardSuite) TestDashboard(c *C) {
+	start := time.Now().Add(-2 * time.Second)
+	var out bytes.Buffer
+	board := NewDashboard(&out, 2, start)
+	stats := NewStatsCollector()
+	stats.SampleLatencies(0, nil)
+	replayOps(stats, Query, 4, 0)
+	stats.StartOp(Insert)
+	stats.histograms[Query].record(3 * time.Millisecond)
+	stats.RecordErrorCode(11000)
+	stats.RecordServiceTime(time.Second)
+	c.Assert(board.Draw(start.Add(2*time.Second), stats), IsNil)
+
+	screen := out.String()
+	c.Assert(strings.HasPrefix(screen, "\x1b[H\x1b[2J"), Equals, true)
+	c.Assert(strings.Contains(screen, "Ops:      5, "), Equals, true, Commentf(screen))
+	c.Assert(strings.Contains(screen, "1 in flight"), Equals, true, Commentf(screen))
+	c.Assert(strings.Contains(screen, "Errors:   20.00% of the ops, 1 in total"), Equals, true,
+		Commentf(screen))
+	c.Assert(strings.Contains(screen, "Workers:  2, busy 25% of the time"), Equals, true,
+		Commentf(screen))
+	rows := map[string]string{}
+	for _, line := range strings.Split(screen, "\n") {
+		if fields := strings.Fields(line); len(fields) == 6 {
+			rows[fields[0]] = line
+		}
+	}
+	c.Assert(strings.Fields(rows["query"])[1], Equals, "4")
+	c.Assert(strings.HasPrefix(strings.Fields(rows["query"])[3], "3."), Equals, true, Commentf(rows["query"]))
+	// no latency sampled
+	c.Assert(strings.Fields(rows["insert"])[3], Equals, "-")
+	_, ok := rows["update"]
+	c.Assert(ok, Equals, false)
+
+	// the percentiles are over the last interval only
+	out.Reset()
+	c.Assert(board.Draw(start.Add(3*time.Second), stats), IsNil)
+	c.Assert(strings.Contains(out.String(), "Errors:   0.00% of the ops, 1 in total"), Equals, true)
+	c.Assert(strings.Contains(out.String(), "busy 0% of the time"), Equals, true)
+}
+
+func (s *TestDashboardSuite) TestOpsFileProgress(c *C) {
+	filename := filepath.Join(c.MkDir(), "ops.json")
+	content := `{"ts": {"$date": 1396456709420}, "ns": "db.coll", "op": "insert", "o": {"n": 1}}` + "\n"
+	c.Assert(os.WriteFile(filename, []byte(content), 0644), IsNil)
+	read, size := OpsFileProgress()
+	logger, _ := NewLogger("", "")
+	err, reader := NewFileByLineOpsReader(filename, logger)
+	c.Assert(err, IsNil)
+	defer reader.Close()
+	_, sizeAfter := OpsFileProgress()
+	c.Assert(sizeAfter-size, Equals, int64(len(content)))
+	c.Assert(reader.Next(), NotNil)
+	readAfter, _ := OpsFileProgress()
+	c.Assert(readAfter-read, Equals, int64(len(content)))
+}
@@ -0,0 +1,80 @@
+package replay
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"os"
+	"sync"
+	"time"
+)
+
+// ErrorRecord describes an op that failed, as written to an ErrorLog.
+type ErrorRecord struct {
+	Time      time.Time `json:"time"`
+	OpType    OpType    `json:"op_type"`
+	Namespace string    `json:"ns"`
+	// the server error code, 0 if the error didn't come from the server
+	Code    int    `json:"code,omitempty"`
+	Message string `json:"message"`
+	// the position of the op in its recording, see Op.Offset
+	Offset int `json:"offset,omitempty"`
+	// the content of the op, when the log includes them
+	Op Document `json:"op,omitempty"`
+}
+
+// ErrorLog writes the ops that failed to a file as newline-delimited JSON, one
+// ErrorRecord per line, so the errors of a run can be aggregated offline. It's
+// shared by all the workers. The logged ops are the ones the readers returned,
+// i.e. after any redaction.
+type ErrorLog struct {
+	lock    sync.Mutex
+	file    *os.File
+	buffer  *bufio.Writer
+	encoder *json.Encoder
+	withOps bool
+}
+
+// CreateErrorLog creates the log `filename`. With `withOps`, the records also
+// hold the content of the failed ops.
+func CreateErrorLog(filename string, withOps bool) (*ErrorLog, error) {
+	file, err := os.Create(filename)
+	if err != nil {
+		return nil, err
+	}
+	log := &ErrorLog{file: file, buffer: bufio.NewWriter(file), withOps: withOps}
+	log.encoder = json.NewEncoder(log.buffer)
+	return log, nil
+}
+
+// Write logs that `op` failed with `err`.
+func (l *ErrorLog) Write(op *Op, err error) error {
+	record := ErrorRecord{
+		Time:      time.Now(),
+		OpType:    op.Type,
+		Namespace: op.Database + "." + op.Collection,
+		Message:   err.Error(),
+		Offset:    op.Offset,
+	}
+	var execErr *ExecError
+	if errors.As(err, &execErr) {
+		record.Code = execErr.Code
+	}
+	if l.withOps {
+		record.Op = op.Content
+	}
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	return l.encoder.Encode(record)
+}
+
+// Close flushes the buffered records.
+func (l *ErrorLog) Close() error {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	err := l.buffer.Flush()
+	if closeErr := l.file.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
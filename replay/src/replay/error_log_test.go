@@ -0,0 +1,50 @@
+package replay
+
+import (
+	"encoding/json"
+	"errors"
+	. "gopkg.in/check.v1"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+type TestErrorLogSuite struct{}
+
+var _ = Suite(&TestErrorLogSuite{})
+
+func (s *TestErrorLogSuite) TestLogErrors(c *C) {
+	filename := filepath.Join(c.MkDir(), "errors.json")
+	for _, withOps := range []bool{false, true} {
+		log, err := CreateErrorLog(filename, withOps)
+		c.Assert(err, IsNil)
+		op := &Op{Database: "db", Collection: "c1", Type: Insert, Offset: 3,
+			Content: Document{"o": Document{"_id": 1.0}}}
+		failure := &ExecError{OpType: Insert, Code: 11000, Err: errors.New("duplicate key")}
+		c.Assert(log.Write(op, failure), IsNil)
+		c.Assert(log.Write(op, io.EOF), IsNil)
+		c.Assert(log.Close(), IsNil)
+
+		file, err := os.Open(filename)
+		c.Assert(err, IsNil)
+		decoder := json.NewDecoder(file)
+		var record ErrorRecord
+		c.Assert(decoder.Decode(&record), IsNil)
+		c.Assert(record.OpType, Equals, Insert)
+		c.Assert(record.Namespace, Equals, "db.c1")
+		c.Assert(record.Code, Equals, 11000)
+		c.Assert(record.Message, Equals, failure.Error())
+		c.Assert(record.Offset, Equals, 3)
+		if withOps {
+			c.Assert(record.Op, DeepEquals, Document{"o": map[string]interface{}{"_id": 1.0}})
+		} else {
+			c.Assert(record.Op, IsNil)
+		}
+		record = ErrorRecord{}
+		c.Assert(decoder.Decode(&record), IsNil)
+		c.Assert(record.Code, Equals, 0)
+		c.Assert(record.Message, Equals, "EOF")
+		c.Assert(decoder.Decode(&record), Equals, io.EOF)
+		file.Close()
+	}
+}
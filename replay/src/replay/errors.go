@@ -0,0 +1,133 @@
+package replay
+
+import (
+	"errors"
+	"fmt"
+	"github.com/globalsign/mgo"
+	"io"
+	"net"
+	"time"
+)
+
+// ErrUnsupportedOp is returned by the executor for ops it can't replay.
+var ErrUnsupportedOp = errors.New("op type not supported")
+
+// ParseError is returned by the ops readers for a recorded op they can't
+// parse.
+type ParseError struct {
+	// The position of the op among the ones read, starting at 1.
+	Offset int
+	Err    error
+}
+
+func (e *ParseError) Error() string {
+	return fmt.Sprintf("cannot parse op #%d: %v", e.Offset, e.Err)
+}
+
+func (e *ParseError) Unwrap() error {
+	return e.Err
+}
+
+// MalformedOpError is returned by the executor for a recorded op without a
+// valid namespace, which it skips rather than replay on a bogus target.
+type MalformedOpError struct {
+	// The position of the op in its recording, see Op.Offset.
+	Offset    int
+	Namespace string
+}
+
+func (e *MalformedOpError) Error() string {
+	return fmt.Sprintf("op #%d has an invalid namespace %q", e.Offset, e.Namespace)
+}
+
+// TimeoutError is the cause of an ExecError for an op that took longer than
+// the timeout of its type, see OpsExecutor.SetTimeouts(). The op may still
+// complete on the server.
+type TimeoutError struct {
+	// 0 when the executor doesn't know the timeout
+	Timeout time.Duration
+	Err     error
+}
+
+func (e *TimeoutError) Error() string {
+	if e.Timeout == 0 {
+		return fmt.Sprintf("timed out: %v", e.Err)
+	}
+	return fmt.Sprintf("timed out after %v: %v", e.Timeout, e.Err)
+}
+
+func (e *TimeoutError) Unwrap() error {
+	return e.Err
+}
+
+// ExecError is returned by the executor for an op that failed, either because
+// the server rejected it or because the server couldn't be reached.
+type ExecError struct {
+	OpType OpType
+	// The server error code, 0 if the error didn't come from the server.
+	Code int
+	Err  error
+}
+
+func (e *ExecError) Error() string {
+	return fmt.Sprintf("%s failed: %v", e.OpType, e.Err)
+}
+
+func (e *ExecError) Unwrap() error {
+	return e.Err
+}
+
+// ServerError tells whether the server rejected the op, rather than the op
+// failing to reach it.
+func (e *ExecError) ServerError() bool {
+	switch e.Err.(type) {
+	case *mgo.QueryError, *mgo.LastError, *mgo.BulkError:
+		return true
+	}
+	return e.Err == mgo.ErrNotFound
+}
+
+// ErrorClass is the kind of failure of an op, which the stats count the failed
+// ops of each op type by.
+type ErrorClass string
+
+const (
+	// the server couldn't be reached, or the connection broke
+	ErrorNetwork ErrorClass = "network"
+	// an insert or an update hit an existing unique key
+	ErrorDuplicateKey ErrorClass = "duplicate_key"
+	// the op took longer than its timeout
+	ErrorTimeout ErrorClass = "timeout"
+	// the server rejected the op
+	ErrorCommand ErrorClass = "command"
+	// the op failed in the replay itself, e.g. it isn't supported
+	ErrorOther ErrorClass = "other"
+)
+
+// ErrorClasses are all the error classes, in the order they are reported.
+var ErrorClasses = []ErrorClass{ErrorNetwork, ErrorDuplicateKey, ErrorTimeout, ErrorCommand, ErrorOther}
+
+// ClassifyError tells the kind of failure of an op that failed with `err`.
+func ClassifyError(err error) ErrorClass {
+	var timeout *TimeoutError
+	if errors.As(err, &timeout) || isTimeout(err) {
+		return ErrorTimeout
+	}
+	var execErr *ExecError
+	if errors.As(err, &execErr) {
+		err = execErr.Err
+	}
+	if mgo.IsDup(err) {
+		return ErrorDuplicateKey
+	}
+	switch err.(type) {
+	case *mgo.QueryError, *mgo.LastError, *mgo.BulkError:
+		return ErrorCommand
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) || errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) ||
+		err.Error() == "no reachable servers" {
+		return ErrorNetwork
+	}
+	return ErrorOther
+}
@@ -0,0 +1,57 @@
+package replay
+
+import (
+	"github.com/globalsign/mgo"
+	. "gopkg.in/check.v1"
+	"io"
+	"net"
+	"os"
+)
+
+type TestErrorsSuite struct{}
+
+var _ = Suite(&TestErrorsSuite{})
+
+func (s *TestErrorsSuite) TestClassifyErrors(c *C) {
+	dup := &mgo.LastError{Code: 11000, Err: "E11000 duplicate key error"}
+	for err, class := range map[error]ErrorClass{
+		dup:                                  ErrorDuplicateKey,
+		&ExecError{OpType: Insert, Err: dup}: ErrorDuplicateKey,
+		&mgo.QueryError{Code: 2}:             ErrorCommand,
+		&ExecError{OpType: Query, Err: &TimeoutError{Err: io.EOF}}: ErrorTimeout,
+		&ExecError{OpType: Query, Err: io.EOF}:                     ErrorNetwork,
+		&net.OpError{Op: "dial", Err: os.ErrNotExist}:              ErrorNetwork,
+		ErrUnsupportedOp: ErrorOther,
+	} {
+		c.Assert(ClassifyError(err), Equals, class, Commentf("%v", err))
+	}
+
+	stats := NewStatsCollector()
+	stats.SampleLatencies(0, nil)
+	stats.StartOp(Insert)
+	stats.EndOpWithError(dup)
+	stats.StartOp(Insert)
+	stats.EndOpWithError(dup)
+	stats.StartOp(Query)
+	stats.EndOpWithError(io.EOF)
+	stats.StartOp(Query)
+	stats.EndOpWithError(nil)
+	stats.StartOp(Query)
+	stats.EndOp()
+	c.Assert(stats.InFlight(), Equals, int64(0))
+	c.Assert(stats.Errors(), DeepEquals, map[OpType]map[ErrorClass]int64{
+		Insert: {ErrorDuplicateKey: 2},
+		Query:  {ErrorNetwork: 1},
+	})
+
+	shared := NewSharedStatsCollector(2)
+	worker := shared.Worker()
+	worker.StartOp(Update)
+	worker.EndOpWithError(&mgo.QueryError{Code: 2})
+	combined := CombineStats(stats, shared.Stats())
+	c.Assert(combined.Snapshot().Errors[Update], DeepEquals, map[ErrorClass]int64{ErrorCommand: 1})
+	c.Assert(combined.Errors()[Insert], DeepEquals, map[ErrorClass]int64{ErrorDuplicateKey: 2})
+
+	c.Assert(FormatErrors(map[ErrorClass]int64{ErrorTimeout: 4, ErrorNetwork: 1}), Equals,
+		"5 (network: 1, timeout: 4)")
+}
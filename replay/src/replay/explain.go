@@ -0,0 +1,140 @@
+package replay
+
+import (
+	"fmt"
+	"github.com/globalsign/mgo"
+	"github.com/globalsign/mgo/bson"
+	"strings"
+	"time"
+)
+
+// SlowOpExplainer runs an explain on the target for the replayed ops that took
+// longer than a threshold, and logs a summary of the plan the server picked,
+// so a slow op can be told apart from, say, a collection scan. It can be
+// shared by the executors of all the workers.
+type SlowOpExplainer struct {
+	logger    *Logger
+	threshold time.Duration
+}
+
+func NewSlowOpExplainer(logger *Logger, threshold time.Duration) *SlowOpExplainer {
+	return &SlowOpExplainer{
+		logger:    logger,
+		threshold: threshold,
+	}
+}
+
+// IsSlow tells whether an op that took `latency` is explained.
+func (x *SlowOpExplainer) IsSlow(latency time.Duration) bool {
+	return latency >= x.threshold
+}
+
+// Explain runs the explain of an op and logs its summary. Ops that can't be
+// explained, like DDL, are ignored.
+func (x *SlowOpExplainer) Explain(op *Op, coll *mgo.Collection, latency time.Duration) {
+	cmd := explainCommand(op, coll.Name)
+	if cmd == nil {
+		return
+	}
+	result := bson.M{}
+	err := coll.Database.Run(bson.D{
+		{Name: "explain", Value: cmd},
+		{Name: "verbosity", Value: "executionStats"},
+	}, &result)
+	if err != nil {
+		x.logger.Errorf("Failed to explain slow %s on %s.%s: %v",
+			op.Type, op.Database, op.Collection, err)
+		return
+	}
+	x.logger.Infof("Slow %s on %s.%s took %.2fms: %s", op.Type, op.Database,
+		op.Collection, float64(latency)/float64(time.Millisecond), explainSummary(result))
+}
+
+// The command explained for an op, or nil if the op type can't be explained.
+func explainCommand(op *Op, collection string) bson.D {
+	content := op.Content
+	switch op.Type {
+	case Query:
+		cmd := bson.D{{Name: "find", Value: collection}, {Name: "filter", Value: content["query"]}}
+		if ntoreturn, ok := content["ntoreturn"].(float64); ok {
+			cmd = append(cmd, bson.DocElem{Name: "limit", Value: int(ntoreturn)})
+		}
+		if ntoskip, ok := content["ntoskip"].(float64); ok {
+			cmd = append(cmd, bson.DocElem{Name: "skip", Value: int(ntoskip)})
+		}
+		return cmd
+	case Update, Upsert:
+		return bson.D{{Name: "update", Value: collection}, {Name: "updates", Value: []bson.M{{
+			"q": content["query"], "u": content["updateobj"], "upsert": op.Type == Upsert,
+		}}}}
+	case Remove, RemoveMulti:
+		limit := 1
+		if op.Type == RemoveMulti {
+			limit = 0
+		}
+		return bson.D{{Name: "delete", Value: collection}, {Name: "deletes", Value: []bson.M{{
+			"q": content["query"], "limit": limit,
+		}}}}
+	case Count, FindAndModify:
+		// the recorded op is the command itself
+		name := commandName(op.Type)
+		cmd := bson.D{{Name: name, Value: collection}}
+		for _, key := range sortedKeys(content) {
+			if key != name {
+				cmd = append(cmd, bson.DocElem{Name: key, Value: content[key]})
+			}
+		}
+		return cmd
+	}
+	return nil
+}
+
+// Summarize the result of an explain: the stages of the winning plan, and how
+// much work its execution took.
+func explainSummary(result bson.M) string {
+	planner, _ := result["queryPlanner"].(bson.M)
+	plan, _ := planner["winningPlan"].(bson.M)
+	// the slot based engine nests the plan one level deeper
+	if queryPlan, ok := plan["queryPlan"].(bson.M); ok {
+		plan = queryPlan
+	}
+	stats, _ := result["executionStats"].(bson.M)
+	return fmt.Sprintf("plan %s, %d keys and %d docs examined, %d returned",
+		planSummary(plan), explainInt(stats["totalKeysExamined"]),
+		explainInt(stats["totalDocsExamined"]), explainInt(stats["nReturned"]))
+}
+
+// The stages of a plan from the root down, e.g. "FETCH > IXSCAN(a_1)".
+func planSummary(plan bson.M) string {
+	stages := []string{}
+	for plan != nil {
+		stage, _ := plan["stage"].(string)
+		if index, ok := plan["indexName"].(string); ok {
+			stage += "(" + index + ")"
+		}
+		stages = append(stages, stage)
+
+		next, _ := plan["inputStage"].(bson.M)
+		if inputs, ok := plan["inputStages"].([]interface{}); ok && len(inputs) > 0 {
+			// only the first branch of an OR is summarized
+			next, _ = inputs[0].(bson.M)
+		}
+		plan = next
+	}
+	if len(stages) == 0 {
+		return "unknown"
+	}
+	return strings.Join(stages, " > ")
+}
+
+func explainInt(val interface{}) int64 {
+	switch n := val.(type) {
+	case int:
+		return int64(n)
+	case int64:
+		return n
+	case float64:
+		return int64(n)
+	}
+	return 0
+}
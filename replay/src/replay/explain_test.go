@@ -0,0 +1,48 @@
+package replay
+
+import (
+	"github.com/globalsign/mgo/bson"
+	. "gopkg.in/check.v1"
+	"time"
+)
+
+type TestExplainSuite struct{}
+
+var _ = Suite(&TestExplainSuite{})
+
+func (s *TestExplainSuite) TestSlowOpExplain(c *C) {
+	cmd, err := parseJson(`{"ts": {"$date": 1396456709472}, "ns": "db.c1", "op": "query", ` +
+		`"query": {"a": 1}, "ntoreturn": 10}`)
+	c.Assert(err, IsNil)
+	op := makeOp(cmd)
+	c.Assert(explainCommand(op, "c1"), DeepEquals, bson.D{
+		{Name: "find", Value: "c1"},
+		{Name: "filter", Value: map[string]interface{}{"a": 1.0}},
+		{Name: "limit", Value: 10},
+	})
+	op.Type = CreateIndexes
+	c.Assert(explainCommand(op, "c1"), IsNil)
+
+	result := bson.M{
+		"queryPlanner": bson.M{"winningPlan": bson.M{
+			"stage": "FETCH",
+			"inputStage": bson.M{
+				"stage": "OR",
+				"inputStages": []interface{}{
+					bson.M{"stage": "IXSCAN", "indexName": "a_1"},
+					bson.M{"stage": "IXSCAN", "indexName": "b_1"},
+				},
+			},
+		}},
+		"executionStats": bson.M{"nReturned": 3, "totalKeysExamined": int64(4),
+			"totalDocsExamined": 5.0},
+	}
+	c.Assert(explainSummary(result), Equals,
+		"plan FETCH > OR > IXSCAN(a_1), 4 keys and 5 docs examined, 3 returned")
+	c.Assert(explainSummary(bson.M{}), Equals,
+		"plan unknown, 0 keys and 0 docs examined, 0 returned")
+
+	explainer := NewSlowOpExplainer(nil, 100*time.Millisecond)
+	c.Assert(explainer.IsSlow(99*time.Millisecond), Equals, false)
+	c.Assert(explainer.IsSlow(100*time.Millisecond), Equals, true)
+}
@@ -0,0 +1,296 @@
+package replay
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/globalsign/mgo/bson"
+	"io"
+	"os"
+	"strconv"
+	"time"
+)
+
+// ExtJSONOpsReader reads ops from a stream of MongoDB Extended JSON documents,
+// in either the canonical or the relaxed format. Unlike ByLineOpsReader, the
+// documents don't have to be one per line, so hand-written, pretty-printed
+// recordings can be replayed.
+//
+// The type wrappers, like {"$oid": ...} or {"$numberLong": ...}, are converted
+// to the values mgo sends to the server.
+type ExtJSONOpsReader struct {
+	decoder *json.Decoder
+	// an op read ahead by SetStartTime()
+	pending *Op
+	// how many documents were decoded
+	decoded   int
+	err       error
+	opsRead   int
+	closeFunc func()
+	logger    *Logger
+}
+
+func NewExtJSONOpsReader(reader io.Reader, logger *Logger) (error, *ExtJSONOpsReader) {
+	return nil, &ExtJSONOpsReader{
+		decoder: json.NewDecoder(reader),
+		logger:  logger,
+	}
+}
+
+func NewFileExtJSONOpsReader(filename string, logger *Logger) (error, *ExtJSONOpsReader) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return err, nil
+	}
+	err, reader := NewExtJSONOpsReader(trackOpsFile(file), logger)
+	if err != nil {
+		return err, reader
+	}
+	reader.closeFunc = func() {
+		file.Close()
+	}
+	return nil, reader
+}
+
+// Decode the next document of the stream.
+func (self *ExtJSONOpsReader) nextDoc() (Document, error) {
+	rawObj := Document{}
+	err := self.decoder.Decode(&rawObj)
+	if err == io.EOF {
+		return nil, err
+	}
+	self.decoded++
+	if err == nil {
+		err = normalizeExtJSON(rawObj)
+	}
+	if err != nil {
+		return nil, &ParseError{Offset: self.decoded, Err: err}
+	}
+	return rawObj, nil
+}
+
+func (self *ExtJSONOpsReader) SkipOps(numSkipOps int) error {
+	for numSkipped := 0; numSkipped < numSkipOps; numSkipped++ {
+		if self.pending != nil {
+			self.pending = nil
+			continue
+		}
+		var raw json.RawMessage
+		if err := self.decoder.Decode(&raw); err != nil {
+			self.err = err
+			return err
+		}
+		self.decoded++
+	}
+
+	self.logger.Infof("Done skipping %d ops.\n", numSkipOps)
+	return nil
+}
+
+func (self *ExtJSONOpsReader) SetStartTime(startTime int64) (int64, error) {
+	var numSkipped int64
+	searchTime := time.Unix(startTime/1000, startTime%1000*1000000)
+
+	for {
+		rawObj, err := self.nextDoc()
+		if err != nil {
+			self.err = err
+			if err == io.EOF {
+				return numSkipped, errors.New("no ops found after specified start_time")
+			}
+			return numSkipped, err
+		}
+
+		timestamp, ok := rawObj["ts"].(time.Time)
+		if ok && !timestamp.Before(searchTime) {
+			self.pending = makeOp(rawObj)
+			if self.pending != nil {
+				self.pending.Offset = self.decoded
+			}
+			self.logger.Infof("Skipped %d ops to begin at timestamp %v.", numSkipped, timestamp)
+			return numSkipped, nil
+		}
+		numSkipped++
+	}
+}
+
+func (self *ExtJSONOpsReader) Next() *Op {
+	if self.pending != nil {
+		op := self.pending
+		self.pending = nil
+		self.opsRead++
+		return op
+	}
+	// we may need to skip certain type of ops
+	for {
+		rawObj, err := self.nextDoc()
+		self.err = err
+		if err != nil {
+			return nil
+		}
+		self.opsRead++
+		op := makeOp(rawObj)
+		if op == nil {
+			continue
+		}
+		op.Offset = self.decoded
+
+		return op
+	}
+}
+
+func (self *ExtJSONOpsReader) OpsRead() int {
+	return self.opsRead
+}
+
+func (self *ExtJSONOpsReader) AllLoaded() bool {
+	return self.err == io.EOF
+}
+
+func (self *ExtJSONOpsReader) Err() error {
+	return self.err
+}
+
+func (self *ExtJSONOpsReader) Close() {
+	if self.closeFunc != nil {
+		self.closeFunc()
+	}
+}
+
+// Recursively replace the Extended JSON type wrappers of a document with the
+// values they stand for.
+func normalizeExtJSON(rawObj Document) error {
+	for key, val := range rawObj {
+		converted, err := convertExtJSON(val)
+		if err != nil {
+			return fmt.Errorf("%s: %v", key, err)
+		}
+		rawObj[key] = converted
+	}
+	return nil
+}
+
+func convertExtJSON(val interface{}) (interface{}, error) {
+	switch typedVal := val.(type) {
+	case map[string]interface{}:
+		if converted, ok, err := parseExtJSONWrapper(typedVal); ok || err != nil {
+			return converted, err
+		}
+		return typedVal, normalizeExtJSON(typedVal)
+	case []interface{}:
+		for i, item := range typedVal {
+			converted, err := convertExtJSON(item)
+			if err != nil {
+				return nil, err
+			}
+			typedVal[i] = converted
+		}
+	}
+	return val, nil
+}
+
+// Convert a type wrapper, like {"$numberLong": "42"}, to its value. Returns
+// false if `obj` is a plain document.
+func parseExtJSONWrapper(obj map[string]interface{}) (interface{}, bool, error) {
+	switch len(obj) {
+	case 1:
+		for key, val := range obj {
+			value, err := parseExtJSONValue(key, val)
+			return value, value != nil || err != nil, err
+		}
+	case 2:
+		// the legacy formats of binaries and regular expressions
+		if data, ok := obj["$binary"].(string); ok {
+			subType, _ := obj["$type"].(string)
+			return parseBinary(data, subType)
+		}
+		if pattern, ok := obj["$regex"].(string); ok {
+			options, _ := obj["$options"].(string)
+			return bson.RegEx{Pattern: pattern, Options: options}, true, nil
+		}
+	}
+	return nil, false, nil
+}
+
+// Convert the value of a single key type wrapper. Returns nil if `key` isn't
+// a type wrapper.
+func parseExtJSONValue(key string, val interface{}) (interface{}, error) {
+	str, isString := val.(string)
+	fields, isDoc := val.(map[string]interface{})
+	switch key {
+	case "$oid":
+		if !isString || !bson.IsObjectIdHex(str) {
+			return nil, fmt.Errorf("invalid $oid %v", val)
+		}
+		return bson.ObjectIdHex(str), nil
+	case "$date":
+		return parseExtJSONDate(val)
+	case "$numberInt":
+		n, err := strconv.ParseInt(str, 10, 32)
+		return int(n), err
+	case "$numberLong":
+		return strconv.ParseInt(str, 10, 64)
+	case "$numberDouble":
+		return strconv.ParseFloat(str, 64)
+	case "$numberDecimal":
+		return bson.ParseDecimal128(str)
+	case "$binary":
+		if isDoc {
+			data, _ := fields["base64"].(string)
+			subType, _ := fields["subType"].(string)
+			value, _, err := parseBinary(data, subType)
+			return value, err
+		}
+	case "$regularExpression":
+		if isDoc {
+			pattern, _ := fields["pattern"].(string)
+			options, _ := fields["options"].(string)
+			return bson.RegEx{Pattern: pattern, Options: options}, nil
+		}
+	case "$timestamp":
+		if isDoc {
+			t, _ := fields["t"].(float64)
+			i, _ := fields["i"].(float64)
+			return bson.MongoTimestamp(int64(t)<<32 | int64(i)), nil
+		}
+	case "$minKey":
+		return bson.MinKey, nil
+	case "$maxKey":
+		return bson.MaxKey, nil
+	}
+	return nil, nil
+}
+
+// Dates are either milliseconds since the epoch, as a number or a
+// {"$numberLong": ...}, or an ISO-8601 string.
+func parseExtJSONDate(val interface{}) (interface{}, error) {
+	var millis int64
+	switch typedVal := val.(type) {
+	case float64:
+		millis = int64(typedVal)
+	case string:
+		return time.Parse(time.RFC3339Nano, typedVal)
+	case map[string]interface{}:
+		str, _ := typedVal["$numberLong"].(string)
+		var err error
+		if millis, err = strconv.ParseInt(str, 10, 64); err != nil {
+			return nil, fmt.Errorf("invalid $date %v", val)
+		}
+	default:
+		return nil, fmt.Errorf("invalid $date %v", val)
+	}
+	return time.Unix(millis/1000, millis%1000*1000000), nil
+}
+
+func parseBinary(data string, subType string) (interface{}, bool, error) {
+	bytes, err := base64.StdEncoding.DecodeString(data)
+	if err != nil {
+		return nil, true, err
+	}
+	kind, err := strconv.ParseUint(subType, 16, 8)
+	if err != nil {
+		return nil, true, fmt.Errorf("invalid binary subtype %q", subType)
+	}
+	return bson.Binary{Kind: byte(kind), Data: bytes}, true, nil
+}
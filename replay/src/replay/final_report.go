@@ -0,0 +1,117 @@
+package replay
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+	"time"
+)
+
+// FinalReport is the end-of-run stats in a machine-readable form, e.g. for CI
+// jobs and spreadsheets: the stats of each op type, and of each label if the
+// ops were labeled, e.g. by namespace.
+type FinalReport struct {
+	RunId       string        `json:"run_id"`
+	DurationSec float64       `json:"duration_sec"`
+	Total       int64         `json:"total"`
+	OpsSec      float64       `json:"ops_sec"`
+	ErrorCodes  map[int]int64 `json:"error_codes"`
+	OpTypes     []ReportRow   `json:"op_types"`
+	Labels      []ReportRow   `json:"labels,omitempty"`
+}
+
+// ReportRow holds the stats of an op type or a label in a FinalReport. Only the
+// op types have errors and latency percentiles.
+type ReportRow struct {
+	Name         string  `json:"name"`
+	Count        int64   `json:"count"`
+	Errors       int64   `json:"errors,omitempty"`
+	OpsSec       float64 `json:"ops_sec"`
+	AvgLatencyMs float64 `json:"avg_latency_ms"`
+	P50          float64 `json:"p50_ms,omitempty"`
+	P90          float64 `json:"p90_ms,omitempty"`
+	P95          float64 `json:"p95_ms,omitempty"`
+	P99          float64 `json:"p99_ms,omitempty"`
+	Max          float64 `json:"max_ms,omitempty"`
+}
+
+// NewFinalReport builds the report of the stats of a run that lasted
+// `duration`.
+func NewFinalReport(runId string, duration time.Duration, stats *StatsCollector) *FinalReport {
+	snapshot := stats.Snapshot()
+	report := &FinalReport{
+		RunId:       runId,
+		DurationSec: duration.Seconds(),
+		Total:       snapshot.Total,
+		ErrorCodes:  snapshot.ErrorCodes,
+		OpTypes:     []ReportRow{},
+	}
+	if duration > 0 {
+		report.OpsSec = float64(snapshot.Total) / duration.Seconds()
+	}
+	percentile := func(opType OpType, p float64) float64 {
+		return float64(stats.LatencyPercentile(opType, p)) / float64(time.Millisecond)
+	}
+	for _, opType := range stats.OpTypes() {
+		errors := int64(0)
+		for _, count := range snapshot.Errors[opType] {
+			errors += count
+		}
+		report.OpTypes = append(report.OpTypes, ReportRow{
+			Name:         string(opType),
+			Count:        snapshot.Counts[opType],
+			Errors:       errors,
+			OpsSec:       snapshot.OpsSec[opType],
+			AvgLatencyMs: snapshot.LatencyInMs[opType],
+			P50:          percentile(opType, 0.5),
+			P90:          percentile(opType, 0.9),
+			P95:          percentile(opType, 0.95),
+			P99:          percentile(opType, 0.99),
+			Max:          percentile(opType, 1),
+		})
+	}
+	for _, label := range SortLabels(snapshot.LabelLatencyInMs, 0) {
+		report.Labels = append(report.Labels, ReportRow{
+			Name:         label,
+			Count:        snapshot.LabelCounts[label],
+			OpsSec:       snapshot.LabelOpsSec[label],
+			AvgLatencyMs: snapshot.LabelLatencyInMs[label],
+		})
+	}
+	return report
+}
+
+// WriteFinalReport writes `report` to `w` as indented JSON, or as CSV with a
+// row per op type then per label, the kind of each row in its first column.
+func WriteFinalReport(w io.Writer, format string, report *FinalReport) error {
+	switch format {
+	case "json":
+		encoder := json.NewEncoder(w)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(report)
+	case "csv":
+	default:
+		return fmt.Errorf("unknown report format %q, expected json or csv", format)
+	}
+	writer := csv.NewWriter(w)
+	writer.Write([]string{"kind", "name", "count", "errors", "ops_sec", "avg_latency_ms",
+		"p50_ms", "p90_ms", "p95_ms", "p99_ms", "max_ms"})
+	for _, row := range report.OpTypes {
+		writer.Write([]string{"op_type", row.Name, strconv.FormatInt(row.Count, 10),
+			strconv.FormatInt(row.Errors, 10), formatFloat(row.OpsSec, 2), formatFloat(row.AvgLatencyMs, 3), formatFloat(row.P50, 3),
+			formatFloat(row.P90, 3), formatFloat(row.P95, 3), formatFloat(row.P99, 3),
+			formatFloat(row.Max, 3)})
+	}
+	for _, row := range report.Labels {
+		writer.Write([]string{"label", row.Name, strconv.FormatInt(row.Count, 10), "",
+			formatFloat(row.OpsSec, 2), formatFloat(row.AvgLatencyMs, 3), "", "", "", "", ""})
+	}
+	writer.Flush()
+	return writer.Error()
+}
+
+func formatFloat(value float64, precision int) string {
+	return strconv.FormatFloat(value, 'f', precision, 64)
+}
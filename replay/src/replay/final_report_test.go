@@ -0,0 +1,59 @@
+package replay
+
+import (
+	"bytes"
+	"encoding/json"
+	. "gopkg.in/check.v1"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type TestFinalReportSuite struct{}
+
+var _ = Suite(&TestFinalReportSuite{})
+
+func (s *TestFinalReportSuite) TestFinalReport(c *C) {
+	stats := NewStatsCollector()
+	stats.SampleLatencies(0, nil)
+	stats.StartLabeledOp(Query, "db.a")
+	stats.EndOp()
+	stats.StartLabeledOp(Query, "db.b")
+	stats.EndOp()
+	stats.histograms[Query].record(10 * time.Millisecond)
+	stats.RecordErrorCode(11000)
+	report := NewFinalReport("r1", 2*time.Second, stats)
+	c.Assert(report.Total, Equals, int64(2))
+	c.Assert(report.OpsSec, Equals, 1.0)
+	c.Assert(report.OpTypes, HasLen, len(stats.OpTypes()))
+	c.Assert(report.Labels, HasLen, 2)
+	c.Assert(report.Labels[0].Name, Equals, "db.a")
+	c.Assert(report.Labels[0].Count, Equals, int64(1))
+
+	var out bytes.Buffer
+	c.Assert(WriteFinalReport(&out, "json", report), IsNil)
+	var decoded FinalReport
+	c.Assert(json.Unmarshal(out.Bytes(), &decoded), IsNil)
+	c.Assert(decoded.ErrorCodes, DeepEquals, map[int]int64{11000: 1})
+	c.Assert(decoded.Labels, DeepEquals, report.Labels)
+
+	out.Reset()
+	c.Assert(WriteFinalReport(&out, "csv", report), IsNil)
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	c.Assert(lines, HasLen, 1+len(report.OpTypes)+2)
+	c.Assert(lines[0], Equals, "kind,name,count,errors,ops_sec,avg_latency_ms,p50_ms,p90_ms,p95_ms,p99_ms,max_ms")
+	query := ""
+	for _, line := range lines {
+		if strings.HasPrefix(line, "op_type,query,") {
+			query = line
+		}
+	}
+	c.Assert(strings.HasPrefix(query, "op_type,query,2,0,"), Equals, true, Commentf(query))
+	// the max is the bound of the 10ms bucket
+	max, err := strconv.ParseFloat(query[strings.LastIndex(query, ",")+1:], 64)
+	c.Assert(err, IsNil)
+	c.Assert(max >= 10 && max <= 10.2, Equals, true, Commentf(query))
+	c.Assert(lines[len(lines)-1], Equals, "label,db.b,1,,"+formatFloat(report.Labels[1].OpsSec, 2)+",0.000,,,,,")
+
+	c.Assert(WriteFinalReport(&out, "xml", report), NotNil)
+}
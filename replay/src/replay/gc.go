@@ -0,0 +1,51 @@
+package replay
+
+import (
+	"runtime"
+	"time"
+)
+
+// GCPauses sums up the garbage collection pauses of the replay's own process.
+// A pause stalls the ops in flight, so it shows in their measured latency
+// without the target being slow.
+type GCPauses struct {
+	Count int
+	Time  time.Duration
+	// the longest of the last 256 pauses
+	Max time.Duration
+}
+
+// GCTracker reports the pauses since it was created.
+type GCTracker struct {
+	baseline runtime.MemStats
+}
+
+// NewGCTracker starts tracking the pauses from now.
+func NewGCTracker() *GCTracker {
+	tracker := &GCTracker{}
+	runtime.ReadMemStats(&tracker.baseline)
+	return tracker
+}
+
+// Pauses returns the pauses so far. It briefly stops the world, like each
+// runtime.ReadMemStats() call, so it's meant to be called once per report.
+func (g *GCTracker) Pauses() GCPauses {
+	stats := runtime.MemStats{}
+	runtime.ReadMemStats(&stats)
+	pauses := GCPauses{
+		Count: int(stats.NumGC - g.baseline.NumGC),
+		Time:  time.Duration(stats.PauseTotalNs - g.baseline.PauseTotalNs),
+	}
+	// PauseNs is a circular buffer of the most recent pauses
+	recent := pauses.Count
+	if recent > len(stats.PauseNs) {
+		recent = len(stats.PauseNs)
+	}
+	for i := 0; i < recent; i++ {
+		pause := time.Duration(stats.PauseNs[(int(stats.NumGC)-1-i+len(stats.PauseNs))%len(stats.PauseNs)])
+		if pause > pauses.Max {
+			pauses.Max = pause
+		}
+	}
+	return pauses
+}
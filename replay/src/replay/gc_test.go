@@ -0,0 +1,20 @@
+package replay
+
+import (
+	. "gopkg.in/check.v1"
+	"runtime"
+)
+
+type TestGCSuite struct{}
+
+var _ = Suite(&TestGCSuite{})
+
+func (s *TestGCSuite) TestGCPauses(c *C) {
+	tracker := NewGCTracker()
+	runtime.GC()
+	runtime.GC()
+	pauses := tracker.Pauses()
+	c.Assert(pauses.Count >= 2, Equals, true)
+	c.Assert(pauses.Max > 0, Equals, true)
+	c.Assert(pauses.Max <= pauses.Time, Equals, true)
+}
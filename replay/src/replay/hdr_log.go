@@ -0,0 +1,238 @@
+package replay
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+	"math/bits"
+	"time"
+)
+
+// The settings of the HdrHistograms written by HdrLogWriter: the values are
+// in nanoseconds, with 3 significant digits, which the buckets of the
+// collectors are far coarser than anyway.
+const (
+	hdrSignificantDigits = 3
+	hdrEncodingCookie    = 0x1c849303 | 0x10
+	hdrCompressedCookie  = 0x1c849304 | 0x10
+	hdrHeaderSize        = 40
+)
+
+// HdrLogWriter writes the latency histograms of each interval of a run in the
+// interval log format of HdrHistogram (version 1.3), so the runs can be
+// compared with the other benchmarks, e.g. wrk2's, by the tools that read
+// those logs: HistogramLogProcessor, hdr-plot, histogram-log-analyzer. Each
+// interval has an untagged histogram of all the op types, then a histogram
+// per sampled op type, tagged with it. The values are in nanoseconds, and the
+// interval maxes in milliseconds, the defaults of HistogramLogProcessor. A
+// latency is recorded at the upper bound of its bucket in the collector, so
+// within the 2% of DefaultLatencyBuckets.
+type HdrLogWriter struct {
+	writer    io.Writer
+	start     time.Time
+	wroteHead bool
+	// the stats at the end of the previous interval
+	last     *StatsCollector
+	lastTime time.Time
+}
+
+// NewHdrLogWriter writes the histograms to `writer`. The first interval starts
+// at `start`, which all the intervals are timestamped from.
+func NewHdrLogWriter(writer io.Writer, start time.Time) *HdrLogWriter {
+	return &HdrLogWriter{
+		writer:   writer,
+		start:    start,
+		last:     NewStatsCollector(),
+		lastTime: start,
+	}
+}
+
+// Write ends the current interval at `now`, and writes its histograms out of
+// the stats collected since the start of the run.
+func (t *HdrLogWriter) Write(now time.Time, stats *StatsCollector) error {
+	current := NewStatsCollector()
+	current.Add(stats)
+	last, lastTime := t.last, t.lastTime
+	t.last, t.lastTime = current, now
+
+	var out bytes.Buffer
+	if !t.wroteHead {
+		startSec := float64(t.start.UnixNano()) / 1e9
+		fmt.Fprintf(&out, "#[Histogram log format version 1.3]\n")
+		fmt.Fprintf(&out, "#[StartTime: %.3f (seconds since epoch), %s]\n", startSec,
+			t.start.Format(time.UnixDate))
+		fmt.Fprintf(&out, "#[BaseTime: %.3f (seconds since epoch)]\n", startSec)
+		out.WriteString("\"StartTimestamp\",\"Interval_Length\",\"Interval_Max\"," +
+			"\"Interval_Compressed_Histogram\"\n")
+		t.wroteHead = true
+	}
+	interval := fmt.Sprintf("%.3f,%.3f", lastTime.Sub(t.start).Seconds(),
+		now.Sub(lastTime).Seconds())
+
+	all := make([]int64, len(current.buckets)+1)
+	perOp := map[OpType][]int64{}
+	for _, opType := range current.opTypes {
+		counts := intervalCounts(last, current, opType)
+		sampled := int64(0)
+		for i, count := range counts {
+			all[i] += count
+			sampled += count
+		}
+		if sampled > 0 {
+			perOp[opType] = counts
+		}
+	}
+	line, err := hdrLogLine(current.buckets, all)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(&out, "%s,%s\n", interval, line)
+	for _, opType := range current.opTypes {
+		counts, ok := perOp[opType]
+		if !ok {
+			continue
+		}
+		line, err := hdrLogLine(current.buckets, counts)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(&out, "Tag=%s,%s,%s\n", opType, interval, line)
+	}
+	_, err = t.writer.Write(out.Bytes())
+	return err
+}
+
+// The "<max>,<compressed histogram>" of a log line, out of the counts of the
+// latencies in the buckets `bounds`. The ones above the highest bound are
+// recorded at it.
+func hdrLogLine(bounds []time.Duration, counts []int64) (string, error) {
+	highest := int64(2)
+	if len(bounds) > 0 && int64(bounds[len(bounds)-1]) > highest {
+		highest = int64(bounds[len(bounds)-1])
+	}
+	histogram := newHdrHistogram(highest)
+	maxValue := int64(0)
+	for i, count := range counts {
+		if count == 0 {
+			continue
+		}
+		value := highest
+		if i < len(bounds) {
+			value = int64(bounds[i])
+		}
+		histogram.record(value, count)
+		if value > maxValue {
+			maxValue = value
+		}
+	}
+	encoded, err := histogram.compressedEncoding()
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%.3f,%s", float64(maxValue)/float64(time.Millisecond),
+		base64.StdEncoding.EncodeToString(encoded)), nil
+}
+
+// hdrHistogram lays out its counts like the HdrHistogram of the values from 1
+// to `highest`, so they can be encoded the way it does.
+type hdrHistogram struct {
+	highest                     int64
+	subBucketHalfCountMagnitude uint
+	subBucketHalfCount          int
+	subBucketMask               int64
+	leadingZeroCountBase        int
+	counts                      []int64
+	maxIndex                    int
+}
+
+func newHdrHistogram(highest int64) *hdrHistogram {
+	largestSingleUnit := 2 * int64(math.Pow10(hdrSignificantDigits))
+	subBucketCountMagnitude := uint(math.Ceil(math.Log2(float64(largestSingleUnit))))
+	subBucketCount := int64(1) << subBucketCountMagnitude
+	bucketCount := 1
+	for smallestUntrackable := subBucketCount; smallestUntrackable <= highest; bucketCount++ {
+		if smallestUntrackable > math.MaxInt64/2 {
+			bucketCount++
+			break
+		}
+		smallestUntrackable <<= 1
+	}
+	return &hdrHistogram{
+		highest:                     highest,
+		subBucketHalfCountMagnitude: subBucketCountMagnitude - 1,
+		subBucketHalfCount:          int(subBucketCount / 2),
+		subBucketMask:               subBucketCount - 1,
+		leadingZeroCountBase:        64 - int(subBucketCountMagnitude),
+		counts:                      make([]int64, (bucketCount+1)*int(subBucketCount/2)),
+	}
+}
+
+func (h *hdrHistogram) index(value int64) int {
+	bucketIndex := h.leadingZeroCountBase - bits.LeadingZeros64(uint64(value|h.subBucketMask))
+	subBucketIndex := int(value >> uint(bucketIndex))
+	return (bucketIndex+1)<<h.subBucketHalfCountMagnitude + subBucketIndex - h.subBucketHalfCount
+}
+
+func (h *hdrHistogram) record(value int64, count int64) {
+	i := h.index(value)
+	h.counts[i] += count
+	if i > h.maxIndex {
+		h.maxIndex = i
+	}
+}
+
+// The V2 encoding of the histogram, deflated: the counts up to the highest
+// one as ZigZag LEB128 varints, the runs of zeros as their negated length.
+func (h *hdrHistogram) compressedEncoding() ([]byte, error) {
+	payload := []byte{}
+	for i := 0; i <= h.maxIndex; i++ {
+		count := h.counts[i]
+		zeros := int64(0)
+		for ; i+1 <= h.maxIndex && count == 0 && h.counts[i+1] == 0; i++ {
+			zeros++
+		}
+		if zeros > 0 {
+			count = -(zeros + 1)
+		}
+		payload = appendZigZag(payload, count)
+	}
+
+	header := make([]byte, hdrHeaderSize)
+	binary.BigEndian.PutUint32(header[0:], hdrEncodingCookie)
+	binary.BigEndian.PutUint32(header[4:], uint32(len(payload)))
+	// the normalizing index offset stays 0
+	binary.BigEndian.PutUint32(header[12:], hdrSignificantDigits)
+	binary.BigEndian.PutUint64(header[16:], 1)
+	binary.BigEndian.PutUint64(header[24:], uint64(h.highest))
+	binary.BigEndian.PutUint64(header[32:], math.Float64bits(1.0))
+
+	var deflated bytes.Buffer
+	compressor := zlib.NewWriter(&deflated)
+	compressor.Write(header)
+	compressor.Write(payload)
+	if err := compressor.Close(); err != nil {
+		return nil, err
+	}
+	encoded := make([]byte, 8, 8+deflated.Len())
+	binary.BigEndian.PutUint32(encoded[0:], hdrCompressedCookie)
+	binary.BigEndian.PutUint32(encoded[4:], uint32(deflated.Len()))
+	return append(encoded, deflated.Bytes()...), nil
+}
+
+// Appends `value` the way HdrHistogram's ZigZagEncoding does: 7 bits per byte,
+// and all the 8 bits of the 9th one.
+func appendZigZag(buffer []byte, value int64) []byte {
+	encoded := uint64(value<<1) ^ uint64(value>>63)
+	for i := 0; i < 8; i++ {
+		if encoded < 0x80 {
+			return append(buffer, byte(encoded))
+		}
+		buffer = append(buffer, byte(encoded&0x7f|0x80))
+		encoded >>= 7
+	}
+	return append(buffer, byte(encoded))
+}
@@ -0,0 +1,98 @@
+package replay
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/base64"
+	"encoding/binary"
+	. "gopkg.in/check.v1"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type TestHdrLogSuite struct{}
+
+var _ = Suite(&TestHdrLogSuite{})
+
+func (s *TestHdrLogSuite) TestHdrLog(c *C) {
+	start := time.Unix(1500000000, 0)
+	var out bytes.Buffer
+	writer := NewHdrLogWriter(&out, start)
+	stats := NewStatsCollector()
+	for _, ms := range []int{1, 2, 2, 100} {
+		stats.histograms[Query].record(time.Duration(ms) * time.Millisecond)
+	}
+	stats.histograms[Insert].record(5 * time.Millisecond)
+	c.Assert(writer.Write(start.Add(time.Second), stats), IsNil)
+	c.Assert(writer.Write(start.Add(2*time.Second), stats), IsNil)
+
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	c.Assert(lines, HasLen, 8)
+	c.Assert(lines[0], Equals, "#[Histogram log format version 1.3]")
+	c.Assert(strings.HasPrefix(lines[1], "#[StartTime: 1500000000.000 (seconds since epoch), "),
+		Equals, true)
+	c.Assert(lines[2], Equals, "#[BaseTime: 1500000000.000 (seconds since epoch)]")
+	c.Assert(lines[3], Equals, `"StartTimestamp","Interval_Length","Interval_Max","Interval_Compressed_Histogram"`)
+
+	// the untagged histogram of all the op types, then one per op type
+	fields := strings.Split(lines[4], ",")
+	c.Assert(fields[:2], DeepEquals, []string{"0.000", "1.000"})
+	maxMs, err := strconv.ParseFloat(fields[2], 64)
+	c.Assert(err, IsNil)
+	c.Assert(maxMs >= 100 && maxMs <= 102, Equals, true, Commentf("%v", maxMs))
+	c.Assert(decodeHdrHistogram(c, fields[3]), HasLen, 5)
+	c.Assert(strings.HasPrefix(lines[5], "Tag=insert,0.000,1.000,"), Equals, true, Commentf(lines[5]))
+	fields = strings.Split(lines[6], ",")
+	c.Assert(fields[0], Equals, "Tag=query")
+	values := decodeHdrHistogram(c, fields[4])
+	c.Assert(values, HasLen, 4)
+	// within the 2% of the buckets, and the 0.1% of the HdrHistogram
+	for i, ms := range []float64{1, 2, 2, 100} {
+		c.Assert(values[i] >= ms && values[i] <= ms*1.021, Equals, true, Commentf("%v", values))
+	}
+
+	// nothing was sampled during the second interval
+	fields = strings.Split(lines[7], ",")
+	c.Assert(fields[:3], DeepEquals, []string{"1.000", "1.000", "0.000"})
+	c.Assert(decodeHdrHistogram(c, fields[3]), HasLen, 0)
+}
+
+// The values, in ms, of a base64 compressed HdrHistogram of 3 significant
+// digits, one per count.
+func decodeHdrHistogram(c *C, encoded string) []float64 {
+	compressed, err := base64.StdEncoding.DecodeString(encoded)
+	c.Assert(err, IsNil)
+	c.Assert(binary.BigEndian.Uint32(compressed), Equals, uint32(0x1c849314))
+	c.Assert(int(binary.BigEndian.Uint32(compressed[4:])), Equals, len(compressed)-8)
+	reader, err := zlib.NewReader(bytes.NewReader(compressed[8:]))
+	c.Assert(err, IsNil)
+	decoded, err := io.ReadAll(reader)
+	c.Assert(err, IsNil)
+	c.Assert(binary.BigEndian.Uint32(decoded), Equals, uint32(0x1c849313))
+	c.Assert(int(binary.BigEndian.Uint32(decoded[4:])), Equals, len(decoded)-40)
+	c.Assert(binary.BigEndian.Uint32(decoded[12:]), Equals, uint32(3))
+	c.Assert(binary.BigEndian.Uint64(decoded[16:]), Equals, uint64(1))
+
+	values := []float64{}
+	payload := bytes.NewReader(decoded[40:])
+	for index := 0; payload.Len() > 0; {
+		count, err := binary.ReadVarint(payload)
+		c.Assert(err, IsNil)
+		if count < 0 {
+			index += int(-count)
+			continue
+		}
+		// 2048 sub-buckets, the upper half of each bucket past the first one
+		bucket, subBucket := index>>10-1, index&1023+1024
+		if bucket < 0 {
+			bucket, subBucket = 0, subBucket-1024
+		}
+		for i := int64(0); i < count; i++ {
+			values = append(values, float64(int64(subBucket)<<uint(bucket))/1e6)
+		}
+		index++
+	}
+	return values
+}
@@ -0,0 +1,397 @@
+package replay
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"time"
+)
+
+// DefaultLatencyBuckets are the upper bounds used by NewStatsCollector: from
+// 50µs up to ~100s, each 2% above the previous one. A percentile is reported
+// as the upper bound of the bucket it falls in, so between 50µs and 100s it
+// overestimates the exact percentile of the sampled latencies by at most 2%,
+// whatever the quantile: every sampled latency is counted, so p99.9 and
+// p99.99 are as accurate as p50. Percentiles below 50µs are reported as 50µs,
+// and the ones above 100s as unbounded.
+var DefaultLatencyBuckets = exponentialBuckets(50*time.Microsecond, 1.02, 734)
+
+// HistBucket is one bucket of a cumulative latency histogram: Count latencies
+// were less than or equal to UpperBound. The last bucket of a histogram is
+// unbounded and its Count is the total number of recorded latencies.
+type HistBucket struct {
+	UpperBound time.Duration `json:"upper_bound"`
+	Count      int64         `json:"count"`
+}
+
+// HistogramExport is a self-contained record of the latency histograms of a
+// run, which can be archived to compare distributions across runs.
+type HistogramExport struct {
+	RunId      string                  `json:"run_id"`
+	Timestamp  time.Time               `json:"timestamp"`
+	Histograms map[OpType][]HistBucket `json:"histograms"`
+}
+
+// ExportHistograms writes the latency histogram of each op type the stats
+// are broken down by to `w` as JSON, keyed by run id and the time of the
+// export.
+func ExportHistograms(w io.Writer, runId string, stats *StatsCollector) error {
+	export := HistogramExport{
+		RunId:      runId,
+		Timestamp:  time.Now(),
+		Histograms: map[OpType][]HistBucket{},
+	}
+	for _, opType := range stats.OpTypes() {
+		export.Histograms[opType] = stats.LatencyHistogramSnapshot(opType)
+	}
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(export)
+}
+
+// SaveHistograms writes the latency histogram of each op type to `w`, in the
+// format of ExportHistograms, so LoadHistograms can read them back.
+func (s *StatsCollector) SaveHistograms(w io.Writer) error {
+	return ExportHistograms(w, "", s)
+}
+
+// LoadHistograms reads the histograms written by SaveHistograms or
+// ExportHistograms.
+func LoadHistograms(r io.Reader) (*HistogramExport, error) {
+	export := &HistogramExport{}
+	if err := json.NewDecoder(r).Decode(export); err != nil {
+		return nil, err
+	}
+	for opType, buckets := range export.Histograms {
+		for i := 1; i < len(buckets); i++ {
+			if buckets[i].UpperBound <= buckets[i-1].UpperBound || buckets[i].Count < buckets[i-1].Count {
+				return nil, fmt.Errorf("the histogram of %s isn't cumulative", opType)
+			}
+		}
+	}
+	return export, nil
+}
+
+// BucketDelta compares the share (between 0.0 and 1.0) of the latencies of
+// two runs that fell into the same bucket.
+type BucketDelta struct {
+	UpperBound time.Duration `json:"upper_bound"`
+	Before     float64       `json:"before"`
+	After      float64       `json:"after"`
+}
+
+// HistogramDiff compares the latency distributions of an op type in two runs.
+type HistogramDiff struct {
+	OpType OpType `json:"op_type"`
+	// how many latencies each run recorded
+	Before int64 `json:"before"`
+	After  int64 `json:"after"`
+	// the Kolmogorov-Smirnov statistic: the largest gap between the
+	// cumulative distributions, between 0.0 (same) and 1.0 (disjoint)
+	KS      float64       `json:"ks"`
+	Buckets []BucketDelta `json:"buckets"`
+}
+
+// CompareHistograms compares the latency distributions of each op type that
+// both runs recorded latencies of. The histograms don't need the same
+// buckets: both are compared at every bucket bound of either.
+func CompareHistograms(before *HistogramExport, after *HistogramExport) []HistogramDiff {
+	diffs := []HistogramDiff{}
+	for _, opType := range AllOpTypes {
+		a, b := before.Histograms[opType], after.Histograms[opType]
+		if histogramTotal(a) == 0 || histogramTotal(b) == 0 {
+			continue
+		}
+		diff := HistogramDiff{OpType: opType, Before: histogramTotal(a), After: histogramTotal(b)}
+		lastA, lastB := 0.0, 0.0
+		for _, bound := range unionBounds(a, b) {
+			cdfA, cdfB := histogramCDF(a, bound), histogramCDF(b, bound)
+			diff.KS = math.Max(diff.KS, math.Abs(cdfA-cdfB))
+			if cdfA > lastA || cdfB > lastB {
+				diff.Buckets = append(diff.Buckets, BucketDelta{bound, cdfA - lastA, cdfB - lastB})
+			}
+			lastA, lastB = cdfA, cdfB
+		}
+		diffs = append(diffs, diff)
+	}
+	return diffs
+}
+
+// PrintHistogramDiffs prints the comparisons of CompareHistograms, one line
+// per bucket that either run has latencies in.
+func PrintHistogramDiffs(w io.Writer, diffs []HistogramDiff) {
+	for _, diff := range diffs {
+		fmt.Fprintf(w, "%s: %d -> %d latencies, KS %.4f\n", diff.OpType, diff.Before, diff.After, diff.KS)
+		for _, bucket := range diff.Buckets {
+			bound := "+Inf"
+			if bucket.UpperBound != time.Duration(math.MaxInt64) {
+				bound = bucket.UpperBound.String()
+			}
+			fmt.Fprintf(w, "  <= %s: %.2f%% -> %.2f%% (%+.2f%%)\n", bound, bucket.Before*100,
+				bucket.After*100, (bucket.After-bucket.Before)*100)
+		}
+	}
+}
+
+// The number of latencies of a cumulative histogram.
+func histogramTotal(buckets []HistBucket) int64 {
+	if len(buckets) == 0 {
+		return 0
+	}
+	return buckets[len(buckets)-1].Count
+}
+
+// The share of the latencies of a cumulative histogram that are known to be
+// less than or equal to `bound`.
+func histogramCDF(buckets []HistBucket, bound time.Duration) float64 {
+	i := sort.Search(len(buckets), func(i int) bool {
+		return buckets[i].UpperBound > bound
+	})
+	if i == 0 {
+		return 0
+	}
+	return float64(buckets[i-1].Count) / float64(histogramTotal(buckets))
+}
+
+// The sorted bucket bounds of either histogram.
+func unionBounds(a []HistBucket, b []HistBucket) []time.Duration {
+	seen := map[time.Duration]bool{}
+	bounds := []time.Duration{}
+	for _, buckets := range [][]HistBucket{a, b} {
+		for _, bucket := range buckets {
+			if !seen[bucket.UpperBound] {
+				seen[bucket.UpperBound] = true
+				bounds = append(bounds, bucket.UpperBound)
+			}
+		}
+	}
+	sort.Slice(bounds, func(i, j int) bool { return bounds[i] < bounds[j] })
+	return bounds
+}
+
+// DocSizeBuckets are the upper bounds, in bytes, of the document size
+// histograms: 64B doubling up to 16MB, the largest BSON document.
+var DocSizeBuckets = exponentialSizeBuckets(64, 19)
+
+// SizeBucket is one bucket of a cumulative document size histogram: Count
+// documents were at most UpperBound bytes. The last bucket is unbounded.
+type SizeBucket struct {
+	UpperBound int64 `json:"upper_bound"`
+	Count      int64 `json:"count"`
+}
+
+func exponentialSizeBuckets(start int64, count int) []int64 {
+	bounds := make([]int64, count)
+	for i := range bounds {
+		bounds[i] = start << uint(i)
+	}
+	return bounds
+}
+
+// sizeHistogram counts document sizes into the DocSizeBuckets, like
+// latencyHistogram does for latencies.
+type sizeHistogram struct {
+	counts []int64
+}
+
+func newSizeHistogram() *sizeHistogram {
+	return &sizeHistogram{counts: make([]int64, len(DocSizeBuckets)+1)}
+}
+
+func (h *sizeHistogram) record(size int64) {
+	i := sort.Search(len(DocSizeBuckets), func(i int) bool {
+		return DocSizeBuckets[i] >= size
+	})
+	h.counts[i]++
+}
+
+func (h *sizeHistogram) add(other *sizeHistogram) {
+	for i, count := range other.counts {
+		h.counts[i] += count
+	}
+}
+
+func (h *sizeHistogram) snapshot() []SizeBucket {
+	buckets := make([]SizeBucket, 0, len(h.counts))
+	cumulative := int64(0)
+	for i, count := range h.counts {
+		cumulative += count
+		bound := int64(math.MaxInt64)
+		if i < len(DocSizeBuckets) {
+			bound = DocSizeBuckets[i]
+		}
+		buckets = append(buckets, SizeBucket{bound, cumulative})
+	}
+	return buckets
+}
+
+// SizePercentile returns the smallest bucket bound, in bytes, of a cumulative
+// size histogram below which at least the `p` share (between 0.0 and 1.0) of
+// the documents fall, or 0 if there are none.
+func SizePercentile(buckets []SizeBucket, p float64) int64 {
+	if len(buckets) == 0 || buckets[len(buckets)-1].Count == 0 {
+		return 0
+	}
+	rank := int64(math.Ceil(p * float64(buckets[len(buckets)-1].Count)))
+	for _, bucket := range buckets {
+		if bucket.Count >= rank {
+			return bucket.UpperBound
+		}
+	}
+	return int64(math.MaxInt64)
+}
+
+func exponentialBuckets(start time.Duration, factor float64, count int) []time.Duration {
+	bounds := make([]time.Duration, count)
+	bound := float64(start)
+	for i := range bounds {
+		bounds[i] = time.Duration(bound)
+		bound *= factor
+	}
+	return bounds
+}
+
+// latencyHistogram counts latencies into fixed buckets. counts[i] holds the
+// latencies in (bounds[i-1], bounds[i]]; the extra last slot holds the ones
+// above the highest bound.
+type latencyHistogram struct {
+	bounds []time.Duration
+	counts []int64
+}
+
+func newLatencyHistogram(bounds []time.Duration) *latencyHistogram {
+	return &latencyHistogram{
+		bounds: bounds,
+		counts: make([]int64, len(bounds)+1),
+	}
+}
+
+func (h *latencyHistogram) record(latency time.Duration) {
+	h.recordN(latency, 1)
+}
+
+func (h *latencyHistogram) recordN(latency time.Duration, n int64) {
+	i := sort.Search(len(h.bounds), func(i int) bool {
+		return h.bounds[i] >= latency
+	})
+	h.counts[i] += n
+}
+
+// add merges the counts of other into h. Histograms with different bounds
+// are merged by re-recording each of other's buckets at its upper bound.
+func (h *latencyHistogram) add(other *latencyHistogram) {
+	if sameBuckets(h.bounds, other.bounds) {
+		for i, count := range other.counts {
+			h.counts[i] += count
+		}
+		return
+	}
+	for i, count := range other.counts {
+		if count == 0 {
+			continue
+		}
+		if i < len(other.bounds) {
+			h.recordN(other.bounds[i], count)
+		} else {
+			h.counts[len(h.counts)-1] += count
+		}
+	}
+}
+
+func (h *latencyHistogram) snapshot() []HistBucket {
+	buckets := make([]HistBucket, 0, len(h.counts))
+	cumulative := int64(0)
+	for i, count := range h.counts {
+		cumulative += count
+		bound := time.Duration(math.MaxInt64)
+		if i < len(h.bounds) {
+			bound = h.bounds[i]
+		}
+		buckets = append(buckets, HistBucket{bound, cumulative})
+	}
+	return buckets
+}
+
+func sameBuckets(a, b []time.Duration) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// The counts of the latencies of `opType` sampled between two cumulative
+// copies of the stats, made by NewStatsCollector() and Add(), in the buckets
+// of `current`. The two copies may not have the same buckets, after
+// SetLatencyBuckets(), nor the same op types, after RegisterOpType(): the
+// latencies of `last` are rebucketed like SetLatencyBuckets() does, and an op
+// type it doesn't have had none.
+func intervalCounts(last *StatsCollector, current *StatsCollector, opType OpType) []int64 {
+	counts := make([]int64, len(current.buckets)+1)
+	histogram, ok := current.histograms[opType]
+	if !ok {
+		return counts
+	}
+	copy(counts, histogram.counts)
+	before, ok := last.histograms[opType]
+	if !ok {
+		return counts
+	}
+	if !sameBuckets(before.bounds, histogram.bounds) {
+		rebucketed := newLatencyHistogram(histogram.bounds)
+		rebucketed.add(before)
+		before = rebucketed
+	}
+	for i, count := range before.counts {
+		counts[i] -= count
+	}
+	return counts
+}
+
+// The `p` percentile of the latencies of all op types sampled between two
+// cumulative copies of the stats.
+func intervalPercentile(last *StatsCollector, current *StatsCollector, p float64) time.Duration {
+	counts := make([]int64, len(current.buckets)+1)
+	for _, opType := range current.opTypes {
+		for i, count := range intervalCounts(last, current, opType) {
+			counts[i] += count
+		}
+	}
+	return bucketPercentile(current.buckets, counts, p)
+}
+
+// The `p` percentile, in ms, of the latencies of `opType` sampled between two
+// cumulative copies of the stats.
+func opIntervalPercentileInMs(last *StatsCollector, current *StatsCollector, opType OpType,
+	p float64) float64 {
+	counts := intervalCounts(last, current, opType)
+	return float64(bucketPercentile(current.buckets, counts, p)) / float64(time.Millisecond)
+}
+
+// The smallest bucket bound below which at least the `p` share (between 0.0
+// and 1.0) of the latencies counted by `counts` fall, or 0 if there are none.
+func bucketPercentile(bounds []time.Duration, counts []int64, p float64) time.Duration {
+	total := int64(0)
+	for _, count := range counts {
+		total += count
+	}
+	if total == 0 {
+		return 0
+	}
+	rank := int64(math.Ceil(p * float64(total)))
+	cumulative := int64(0)
+	for i := range bounds {
+		cumulative += counts[i]
+		if cumulative >= rank {
+			return bounds[i]
+		}
+	}
+	// above the highest bound
+	return time.Duration(math.MaxInt64)
+}
@@ -0,0 +1,104 @@
+package replay
+
+import (
+	"bytes"
+	. "gopkg.in/check.v1"
+	"math"
+	"strings"
+	"time"
+)
+
+type TestHistogramSuite struct{}
+
+var _ = Suite(&TestHistogramSuite{})
+
+func (s *TestHistogramSuite) TestSaveHistograms(c *C) {
+	before, after := NewStatsCollector(), NewStatsCollector()
+	for i := 0; i < 4; i++ {
+		before.histograms[Query].record(time.Millisecond)
+		after.histograms[Query].record(time.Millisecond)
+	}
+	after.histograms[Query].record(time.Second)
+	before.histograms[Insert].record(time.Millisecond)
+
+	exports := []*HistogramExport{}
+	for _, stats := range []*StatsCollector{before, after} {
+		var saved bytes.Buffer
+		c.Assert(stats.SaveHistograms(&saved), IsNil)
+		export, err := LoadHistograms(&saved)
+		c.Assert(err, IsNil)
+		c.Assert(export.Histograms[Query], DeepEquals, stats.LatencyHistogramSnapshot(Query))
+		exports = append(exports, export)
+	}
+
+	// only Query has latencies in both runs
+	diffs := CompareHistograms(exports[0], exports[1])
+	c.Assert(diffs, HasLen, 1)
+	c.Assert(diffs[0].OpType, Equals, Query)
+	c.Assert(diffs[0].Before, Equals, int64(4))
+	c.Assert(diffs[0].After, Equals, int64(5))
+	c.Assert(math.Abs(diffs[0].KS-0.2) < 1e-9, Equals, true)
+	c.Assert(diffs[0].Buckets, HasLen, 2)
+	c.Assert(diffs[0].Buckets[0].Before, Equals, 1.0)
+	c.Assert(diffs[0].Buckets[0].After, Equals, 0.8)
+	c.Assert(diffs[0].Buckets[1].UpperBound >= time.Second, Equals, true)
+
+	_, err := LoadHistograms(strings.NewReader(
+		`{"histograms": {"query": [{"upper_bound": 2, "count": 3}, {"upper_bound": 1, "count": 4}]}}`))
+	c.Assert(err, NotNil)
+}
+
+func (s *TestHistogramSuite) TestIntervalPercentiles(c *C) {
+	coarse := []time.Duration{time.Millisecond, 10 * time.Millisecond, 2 * time.Second}
+	// the latencies of two intervals, whose buckets change from `before` to
+	// `after` in between
+	snapshots := func(before []time.Duration, after []time.Duration) (*StatsCollector, *StatsCollector) {
+		stats := NewStatsCollector()
+		stats.SampleLatencies(0, nil)
+		stats.SetLatencyBuckets(before)
+		replayOps(stats, Query, 2, time.Millisecond)
+		last := NewStatsCollector()
+		last.SetLatencyBuckets(before)
+		last.Add(stats)
+		stats.SetLatencyBuckets(after)
+		replayOps(stats, Query, 2, time.Second)
+		return last, stats
+	}
+
+	last, current := snapshots(DefaultLatencyBuckets, coarse)
+	c.Assert(intervalPercentile(last, current, 0.01), Equals, 2*time.Second)
+	c.Assert(opIntervalPercentileInMs(last, current, Query, 0.5), Equals, 2000.0)
+
+	last, current = snapshots(coarse, DefaultLatencyBuckets)
+	p50 := opIntervalPercentileInMs(last, current, Query, 0.5)
+	c.Assert(p50 >= 1000 && p50 <= 1020, Equals, true, Commentf("%v", p50))
+	c.Assert(intervalPercentile(last, current, 0.01), Equals, time.Duration(p50*float64(time.Millisecond)))
+}
+
+func (s *TestHistogramSuite) TestIntervalOpTypes(c *C) {
+	defer func(opTypes []OpType, registered []registeredOpType) {
+		AllOpTypes, registeredOpTypes = opTypes, registered
+	}(AllOpTypes, registeredOpTypes)
+
+	start := time.Unix(1500000000, 0)
+	var out bytes.Buffer
+	series, err := NewTimeSeriesWriter(&out, "ndjson", start)
+	c.Assert(err, IsNil)
+	last := NewStatsCollector()
+	compact := OpType("command.compact")
+	c.Assert(RegisterOpType(compact, func(cmd Document) bool { return cmd["compact"] != nil }), IsNil)
+	current := NewStatsCollector()
+	current.SampleLatencies(0, nil)
+	replayOps(current, compact, 2, time.Second)
+
+	// the op type registered since the last stats had no latencies then
+	p50 := opIntervalPercentileInMs(last, current, compact, 0.5)
+	c.Assert(p50 >= 1000 && p50 <= 1020, Equals, true, Commentf("%v", p50))
+	c.Assert(intervalPercentile(last, current, 0.5), Equals, time.Duration(p50*float64(time.Millisecond)))
+	c.Assert(opIntervalPercentileInMs(current, last, compact, 0.5), Equals, 0.0)
+
+	c.Assert(series.Write(start.Add(time.Second), current), IsNil)
+	points := timeSeriesPoints(c, out.String())
+	c.Assert(points[0].Counts[compact], Equals, int64(2))
+	c.Assert(points[0].P50InMs[compact], Equals, p50)
+}
@@ -0,0 +1,135 @@
+package replay
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"time"
+)
+
+// NamespaceInventory counts the ops of each type recorded on a namespace.
+type NamespaceInventory struct {
+	Namespace string
+	Counts    map[OpType]int64
+	Total     int64
+	// how many ops filter on each top-level field
+	QueriedFields map[string]int64
+}
+
+// Inventory summarizes what a recording holds, to plan a replay of it.
+type Inventory struct {
+	// sorted by namespace
+	Namespaces []*NamespaceInventory
+	Total      int64
+	// the time span covered by the recording
+	First time.Time
+	Last  time.Time
+}
+
+// Inspect reads all the ops of `reader`, without executing them, and takes
+// the inventory of the namespaces and op types they cover. Commands are
+// counted under the op type they'd be replayed as; unsupported ones under
+// "command".
+func Inspect(reader OpsReader) (*Inventory, error) {
+	inventory := &Inventory{}
+	namespaces := map[string]*NamespaceInventory{}
+	for {
+		op := reader.Next()
+		if op == nil {
+			break
+		}
+		if inventory.Total == 0 || op.Timestamp.Before(inventory.First) {
+			inventory.First = op.Timestamp
+		}
+		if op.Timestamp.After(inventory.Last) {
+			inventory.Last = op.Timestamp
+		}
+		inventory.Total++
+
+		opType := op.Type
+		canonical := canonicalizeOp(op)
+		if canonical != nil {
+			opType = canonical.Type
+		}
+		ns := op.Database + "." + op.Collection
+		namespace, ok := namespaces[ns]
+		if !ok {
+			namespace = &NamespaceInventory{Namespace: ns, Counts: map[OpType]int64{},
+				QueriedFields: map[string]int64{}}
+			namespaces[ns] = namespace
+			inventory.Namespaces = append(inventory.Namespaces, namespace)
+		}
+		namespace.Counts[opType]++
+		namespace.Total++
+		if canonical != nil {
+			for _, field := range queriedFields(canonical) {
+				namespace.QueriedFields[field]++
+			}
+		}
+	}
+	if err := reader.Err(); err != nil && err != io.EOF {
+		return nil, err
+	}
+	sort.Slice(inventory.Namespaces, func(i, j int) bool {
+		return inventory.Namespaces[i].Namespace < inventory.Namespaces[j].Namespace
+	})
+	return inventory, nil
+}
+
+// The top-level fields the filter of an op matches on, including the ones of
+// the clauses of a top-level $and or $or.
+func queriedFields(op *Op) []string {
+	var filter interface{}
+	switch op.Type {
+	case Query, Update, Upsert, Remove, RemoveMulti, Count, FindAndModify:
+		filter = op.Content["query"]
+	}
+	// legacy queries wrap the filter along with their modifiers
+	if wrapped, ok := filter.(map[string]interface{}); ok && wrapped["$query"] != nil {
+		filter = wrapped["$query"]
+	}
+	fields := []string{}
+	doc, _ := filter.(map[string]interface{})
+	for _, field := range sortedKeys(doc) {
+		if !strings.HasPrefix(field, "$") {
+			fields = append(fields, field)
+			continue
+		}
+		if field != "$and" && field != "$or" {
+			continue
+		}
+		clauses, _ := doc[field].([]interface{})
+		for _, clause := range clauses {
+			clauseDoc, _ := clause.(map[string]interface{})
+			for key := range clauseDoc {
+				if !strings.HasPrefix(key, "$") {
+					fields = append(fields, key)
+				}
+			}
+		}
+	}
+	return fields
+}
+
+// Print writes the inventory to `w` as text, one line per namespace.
+func (inventory *Inventory) Print(w io.Writer) {
+	fmt.Fprintf(w, "%d ops", inventory.Total)
+	if inventory.Total > 0 {
+		fmt.Fprintf(w, " from %s to %s (%s)", inventory.First.Format(time.RFC3339),
+			inventory.Last.Format(time.RFC3339), inventory.Last.Sub(inventory.First))
+	}
+	fmt.Fprintln(w)
+	for _, namespace := range inventory.Namespaces {
+		fmt.Fprintf(w, "  %s: %d ops", namespace.Namespace, namespace.Total)
+		opTypes := make([]string, 0, len(namespace.Counts))
+		for opType := range namespace.Counts {
+			opTypes = append(opTypes, string(opType))
+		}
+		sort.Strings(opTypes)
+		for _, opType := range opTypes {
+			fmt.Fprintf(w, ", %s: %d", opType, namespace.Counts[OpType(opType)])
+		}
+		fmt.Fprintln(w)
+	}
+}
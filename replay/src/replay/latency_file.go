@@ -0,0 +1,54 @@
+package replay
+
+import (
+	"bufio"
+	"compress/gzip"
+	"encoding/json"
+	"io"
+	"os"
+	"strings"
+)
+
+// LatencyFile writes sampled latencies to a file as newline-delimited JSON,
+// one Latency per line. Files whose name ends in ".gz" are gzipped.
+type LatencyFile struct {
+	file    *os.File
+	gzipped *gzip.Writer
+	buffer  *bufio.Writer
+	encoder *json.Encoder
+}
+
+func CreateLatencyFile(filename string) (*LatencyFile, error) {
+	file, err := os.Create(filename)
+	if err != nil {
+		return nil, err
+	}
+	latencyFile := &LatencyFile{file: file}
+	var w io.Writer = file
+	if strings.HasSuffix(filename, ".gz") {
+		latencyFile.gzipped = gzip.NewWriter(file)
+		w = latencyFile.gzipped
+	}
+	latencyFile.buffer = bufio.NewWriter(w)
+	latencyFile.encoder = json.NewEncoder(latencyFile.buffer)
+	return latencyFile, nil
+}
+
+func (f *LatencyFile) Write(latency Latency) error {
+	return f.encoder.Encode(latency)
+}
+
+// Close flushes the buffered latencies and finalizes the gzip stream. The
+// file is truncated unless it's closed.
+func (f *LatencyFile) Close() error {
+	err := f.buffer.Flush()
+	if f.gzipped != nil {
+		if gzErr := f.gzipped.Close(); err == nil {
+			err = gzErr
+		}
+	}
+	if closeErr := f.file.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
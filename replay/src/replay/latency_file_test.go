@@ -0,0 +1,44 @@
+package replay
+
+import (
+	"compress/gzip"
+	"encoding/json"
+	. "gopkg.in/check.v1"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+type TestLatencyFileSuite struct{}
+
+var _ = Suite(&TestLatencyFileSuite{})
+
+func (s *TestLatencyFileSuite) TestLatencyFile(c *C) {
+	dir := c.MkDir()
+	for _, name := range []string{"latencies.json", "latencies.json.gz"} {
+		filename := filepath.Join(dir, name)
+		file, err := CreateLatencyFile(filename)
+		c.Assert(err, IsNil)
+		c.Assert(file.Write(Latency{Query, time.Millisecond}), IsNil)
+		c.Assert(file.Write(Latency{Insert, 2 * time.Millisecond}), IsNil)
+		c.Assert(file.Close(), IsNil)
+
+		raw, err := os.Open(filename)
+		c.Assert(err, IsNil)
+		var r io.Reader = raw
+		if strings.HasSuffix(name, ".gz") {
+			r, err = gzip.NewReader(raw)
+			c.Assert(err, IsNil)
+		}
+		decoder := json.NewDecoder(r)
+		var latency Latency
+		c.Assert(decoder.Decode(&latency), IsNil)
+		c.Assert(latency, Equals, Latency{Query, time.Millisecond})
+		c.Assert(decoder.Decode(&latency), IsNil)
+		c.Assert(latency, Equals, Latency{Insert, 2 * time.Millisecond})
+		c.Assert(decoder.Decode(&latency), Equals, io.EOF)
+		raw.Close()
+	}
+}
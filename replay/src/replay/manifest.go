@@ -0,0 +1,43 @@
+package replay
+
+import (
+	"crypto/rand"
+	"encoding/json"
+	"fmt"
+	"io"
+	"time"
+)
+
+// Version of the replay tool, recorded in the run manifests. Release builds
+// set it with `-ldflags "-X replay.Version=<version>"`.
+var Version = "dev"
+
+// Manifest records how a run was configured next to the stats it produced,
+// so a result can be traced back to the exact setup that produced it.
+type Manifest struct {
+	RunId     string            `json:"run_id"`
+	Version   string            `json:"version"`
+	StartTime time.Time         `json:"start_time"`
+	EndTime   time.Time         `json:"end_time"`
+	Config    map[string]string `json:"config"`
+	Stats     StatsSnapshot     `json:"stats"`
+}
+
+// NewRunId generates a random (version 4) UUID to identify a run.
+func NewRunId() string {
+	uuid := make([]byte, 16)
+	if _, err := rand.Read(uuid); err != nil {
+		// the system's randomness is gone; the time is unique enough
+		return time.Now().Format("20060102T150405.000000000")
+	}
+	uuid[6] = uuid[6]&0x0f | 0x40
+	uuid[8] = uuid[8]&0x3f | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", uuid[0:4], uuid[4:6], uuid[6:8], uuid[8:10], uuid[10:])
+}
+
+// WriteManifest writes `manifest` to `w` as indented JSON.
+func WriteManifest(w io.Writer, manifest *Manifest) error {
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(manifest)
+}
@@ -0,0 +1,15 @@
+package replay
+
+import (
+	. "gopkg.in/check.v1"
+)
+
+type TestManifestSuite struct{}
+
+var _ = Suite(&TestManifestSuite{})
+
+func (s *TestManifestSuite) TestNewRunId(c *C) {
+	id := NewRunId()
+	c.Assert(id, Matches, "[0-9a-f]{8}-[0-9a-f]{4}-4[0-9a-f]{3}-[89ab][0-9a-f]{3}-[0-9a-f]{12}")
+	c.Assert(NewRunId(), Not(Equals), id)
+}
@@ -0,0 +1,135 @@
+package replay
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strings"
+)
+
+// FieldPredicate matches the ops whose filter has a field at Path, equal to
+// Value if HasValue is set.
+type FieldPredicate struct {
+	Path     string
+	Value    interface{}
+	HasValue bool
+}
+
+// ParseFieldPredicates parses predicates in the format of
+// <path>[=<value>][,...], e.g. "status=active,owner.id". The value is read
+// as JSON, e.g. 5 or true, or taken as a string if it isn't valid JSON.
+func ParseFieldPredicates(spec string) ([]FieldPredicate, error) {
+	predicates := []FieldPredicate{}
+	for _, target := range strings.Split(spec, ",") {
+		parts := strings.SplitN(target, "=", 2)
+		predicate := FieldPredicate{Path: strings.TrimSpace(parts[0])}
+		if predicate.Path == "" {
+			return nil, fmt.Errorf("invalid predicate %q, expected <path>[=<value>]", target)
+		}
+		if len(parts) == 2 {
+			predicate.HasValue = true
+			value := strings.TrimSpace(parts[1])
+			if json.Unmarshal([]byte(value), &predicate.Value) != nil {
+				predicate.Value = value
+			}
+		}
+		predicates = append(predicates, predicate)
+	}
+	return predicates, nil
+}
+
+// MatchesAll keeps the ops whose filter matches all the predicates, looking
+// at its top-level fields and at the ones of the clauses of a top-level $and
+// or $or. Ops without a filter, e.g. inserts, never match.
+func MatchesAll(predicates []FieldPredicate) func(op *Op) bool {
+	return func(op *Op) bool {
+		filter := opFilterDoc(op)
+		if filter == nil {
+			return false
+		}
+		for _, predicate := range predicates {
+			if !predicate.matches(filter) {
+				return false
+			}
+		}
+		return true
+	}
+}
+
+func (predicate FieldPredicate) matches(filter map[string]interface{}) bool {
+	docs := []map[string]interface{}{filter}
+	for _, operator := range []string{"$and", "$or"} {
+		clauses, _ := filter[operator].([]interface{})
+		for _, clause := range clauses {
+			if doc, ok := clause.(map[string]interface{}); ok {
+				docs = append(docs, doc)
+			}
+		}
+	}
+	for _, doc := range docs {
+		value, exist := lookupPath(doc, predicate.Path)
+		if exist && (!predicate.HasValue || sameValue(value, predicate.Value)) {
+			return true
+		}
+	}
+	return false
+}
+
+// The value at a dotted `path` of `doc`, either nested or under the dotted
+// name itself, as filters name fields both ways.
+func lookupPath(doc map[string]interface{}, path string) (interface{}, bool) {
+	if value, exist := doc[path]; exist {
+		return value, true
+	}
+	parts := strings.SplitN(path, ".", 2)
+	if len(parts) != 2 {
+		return nil, false
+	}
+	nested, ok := doc[parts[0]].(map[string]interface{})
+	if !ok {
+		return nil, false
+	}
+	return lookupPath(nested, parts[1])
+}
+
+// Whether a recorded value equals a predicate's, comparing numbers whatever
+// their type, and matching an array that holds the value like the server does.
+func sameValue(recorded interface{}, value interface{}) bool {
+	if items, ok := recorded.([]interface{}); ok {
+		for _, item := range items {
+			if sameValue(item, value) {
+				return true
+			}
+		}
+		return false
+	}
+	if n, ok := legacyNumber(recorded).(float64); ok {
+		m, ok := legacyNumber(value).(float64)
+		return ok && n == m
+	}
+	return reflect.DeepEqual(recorded, value)
+}
+
+// The filter of an op as recorded, i.e. before canonicalizeOp(): the query of
+// the CRUD ops, or the query or filter of a command.
+func opFilterDoc(op *Op) map[string]interface{} {
+	var filter interface{}
+	switch op.Type {
+	case Query, Update, Remove:
+		filter = op.Content["query"]
+	case Command:
+		cmd, _ := op.Content["command"].(map[string]interface{})
+		for _, key := range []string{"query", "filter", "q"} {
+			if cmd[key] != nil {
+				filter = cmd[key]
+				break
+			}
+		}
+	}
+	// legacy queries wrap the filter along with their modifiers
+	if wrapped, ok := filter.(map[string]interface{}); ok && wrapped["$query"] != nil {
+		filter = wrapped["$query"]
+	}
+	doc, _ := filter.(map[string]interface{})
+	return doc
+}
@@ -0,0 +1,107 @@
+package replay
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// MetricsLatencyBuckets are the upper bounds of the latency histograms served
+// by MetricsHandler. Prometheus keeps a time series per bucket, so they are
+// far coarser than the buckets of the collectors.
+var MetricsLatencyBuckets = []time.Duration{
+	500 * time.Microsecond, time.Millisecond, 2500 * time.Microsecond,
+	5 * time.Millisecond, 10 * time.Millisecond, 25 * time.Millisecond,
+	50 * time.Millisecond, 100 * time.Millisecond, 250 * time.Millisecond,
+	500 * time.Millisecond, time.Second, 2500 * time.Millisecond,
+	5 * time.Second, 10 * time.Second,
+}
+
+// MetricsHandler serves the stats of a replay as Prometheus metrics, in the
+// text exposition format, e.g. to be scraped at /metrics and graphed along
+// with the metrics of the target.
+func MetricsHandler(stats func() *StatsCollector) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		WriteMetrics(w, stats())
+	})
+}
+
+// WriteMetrics writes the metrics of `stats` in the Prometheus text format:
+//
+//	flashback_ops_total           the ops started, by op type
+//	flashback_op_latency_seconds  the histograms of the sampled latencies,
+//	                              by op type
+//	flashback_errors_total        the failed ops, by error code, "client"
+//	                              for the errors not from the server
+//	flashback_ops_in_flight       the ops started and not ended yet
+//
+// A sampled latency is counted in the buckets at or above the upper bound of
+// its bucket in the collector, so within the 2% of DefaultLatencyBuckets.
+func WriteMetrics(w io.Writer, stats *StatsCollector) error {
+	out := bufio.NewWriter(w)
+	snapshot := stats.Snapshot()
+	opTypes := stats.OpTypes()
+
+	metricHeader(out, "flashback_ops_total", "counter", "The ops started, by op type.")
+	for _, opType := range opTypes {
+		fmt.Fprintf(out, "flashback_ops_total{op_type=%s} %d\n",
+			strconv.Quote(string(opType)), snapshot.Counts[opType])
+	}
+
+	metricHeader(out, "flashback_op_latency_seconds", "histogram",
+		"The sampled latencies of the ops, by op type.")
+	for _, opType := range opTypes {
+		label := strconv.Quote(string(opType))
+		histogram := snapshot.Histograms[opType]
+		for _, bound := range MetricsLatencyBuckets {
+			fmt.Fprintf(out, "flashback_op_latency_seconds_bucket{op_type=%s,le=\"%g\"} %d\n",
+				label, bound.Seconds(), cumulativeCount(histogram, bound))
+		}
+		count := histogramTotal(histogram)
+		fmt.Fprintf(out, "flashback_op_latency_seconds_bucket{op_type=%s,le=\"+Inf\"} %d\n",
+			label, count)
+		fmt.Fprintf(out, "flashback_op_latency_seconds_sum{op_type=%s} %g\n",
+			label, stats.TotalTime(opType).Seconds())
+		fmt.Fprintf(out, "flashback_op_latency_seconds_count{op_type=%s} %d\n", label, count)
+	}
+
+	metricHeader(out, "flashback_errors_total", "counter", "The failed ops, by error code.")
+	codes := make([]int, 0, len(snapshot.ErrorCodes))
+	for code := range snapshot.ErrorCodes {
+		codes = append(codes, code)
+	}
+	sort.Ints(codes)
+	for _, code := range codes {
+		name := strconv.Itoa(code)
+		if code == 0 {
+			name = "client"
+		}
+		fmt.Fprintf(out, "flashback_errors_total{code=%q} %d\n", name, snapshot.ErrorCodes[code])
+	}
+
+	metricHeader(out, "flashback_ops_in_flight", "gauge", "The ops started and not ended yet.")
+	fmt.Fprintf(out, "flashback_ops_in_flight %d\n", stats.InFlight())
+	return out.Flush()
+}
+
+func metricHeader(out io.Writer, name string, kind string, help string) {
+	fmt.Fprintf(out, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+}
+
+// How many latencies of a cumulative histogram fall in the buckets whose upper
+// bounds are at most `bound`.
+func cumulativeCount(buckets []HistBucket, bound time.Duration) int64 {
+	count := int64(0)
+	for _, bucket := range buckets {
+		if bucket.UpperBound > bound {
+			break
+		}
+		count = bucket.Count
+	}
+	return count
+}
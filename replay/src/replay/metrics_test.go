@@ -0,0 +1,51 @@
+package replay
+
+import (
+	"bytes"
+	. "gopkg.in/check.v1"
+	"strings"
+	"time"
+)
+
+type TestMetricsSuite struct{}
+
+var _ = Suite(&TestMetricsSuite{})
+
+func (s *TestMetricsSuite) TestPrometheusMetrics(c *C) {
+	stats := NewStatsCollector()
+	stats.SampleLatencies(0, nil)
+	for i := 0; i < 3; i++ {
+		stats.StartOp(Query)
+	}
+	stats.EndOp()
+	stats.EndOp()
+	c.Assert(stats.InFlight(), Equals, int64(1))
+	stats.histograms[Query].record(5 * time.Millisecond)
+	stats.histograms[Query].record(time.Second)
+	stats.RecordErrorCode(11000)
+	stats.RecordErrorCode(0)
+
+	var out bytes.Buffer
+	c.Assert(WriteMetrics(&out, stats), IsNil)
+	lines := map[string]bool{}
+	for _, line := range strings.Split(out.String(), "\n") {
+		lines[line] = true
+	}
+	for _, line := range []string{
+		"# TYPE flashback_ops_total counter",
+		`flashback_ops_total{op_type="query"} 3`,
+		`flashback_ops_total{op_type="insert"} 0`,
+		"# TYPE flashback_op_latency_seconds histogram",
+		`flashback_op_latency_seconds_bucket{op_type="query",le="0.0025"} 0`,
+		`flashback_op_latency_seconds_bucket{op_type="query",le="0.01"} 1`,
+		`flashback_op_latency_seconds_bucket{op_type="query",le="2.5"} 2`,
+		`flashback_op_latency_seconds_bucket{op_type="query",le="+Inf"} 2`,
+		`flashback_op_latency_seconds_count{op_type="query"} 2`,
+		`flashback_errors_total{code="client"} 1`,
+		`flashback_errors_total{code="11000"} 1`,
+		"# TYPE flashback_ops_in_flight gauge",
+		"flashback_ops_in_flight 1",
+	} {
+		c.Assert(lines[line], Equals, true, Commentf(line))
+	}
+}
@@ -1,6 +1,10 @@
 package replay
 
 import (
+	"fmt"
+	"io"
+	"strings"
+	"text/tabwriter"
 	"time"
 )
 
@@ -14,21 +18,137 @@ type Document map[string]interface{}
 const (
 	Insert        OpType = "insert"
 	Update        OpType = "update"
+	Upsert        OpType = "update.upsert"
 	Remove        OpType = "remove"
+	RemoveMulti   OpType = "remove.multi"
 	Query         OpType = "query"
 	Command       OpType = "command"
 	Count         OpType = "command.count"
 	FindAndModify OpType = "command.findandmodify"
+
+	CreateCollection OpType = "command.create"
+	DropCollection   OpType = "command.drop"
+	CreateIndexes    OpType = "command.createIndexes"
+	DropIndexes      OpType = "command.dropIndexes"
+	ListCollections  OpType = "command.listCollections"
+	ListIndexes      OpType = "command.listIndexes"
+	GetMore          OpType = "command.getMore"
+	KillCursors      OpType = "command.killCursors"
 )
 
 // AllOpTypes specifies all supported op types
 var AllOpTypes = []OpType{
 	Insert,
 	Update,
+	Upsert,
 	Remove,
+	RemoveMulti,
 	Query,
 	Count,
 	FindAndModify,
+	CreateCollection,
+	DropCollection,
+	CreateIndexes,
+	DropIndexes,
+	ListCollections,
+	ListIndexes,
+	GetMore,
+	KillCursors,
+}
+
+// CommandClassifier tells whether a recorded command belongs to a custom op
+// type.
+type CommandClassifier func(command Document) bool
+
+type registeredOpType struct {
+	opType   OpType
+	classify CommandClassifier
+}
+
+// custom op types, in the order they were registered.
+var registeredOpTypes []registeredOpType
+
+// RegisterOpType adds a custom op type for commands matched by `classify`.
+// Matching commands are replayed as-is with the database's `runCommand` and
+// reported under their own op type; the new type is appended to AllOpTypes.
+// Op types are named "command.<name>", where <name> is the command's name.
+//
+// Op types must be registered before any StatsCollector is created, e.g. from
+// an init() function, as this is not safe for concurrent use.
+func RegisterOpType(opType OpType, classify CommandClassifier) error {
+	for _, existing := range AllOpTypes {
+		if existing == opType {
+			return fmt.Errorf("op type %s is already registered", opType)
+		}
+	}
+	registeredOpTypes = append(registeredOpTypes, registeredOpType{opType, classify})
+	AllOpTypes = append(AllOpTypes, opType)
+	return nil
+}
+
+// classifyCommand returns the custom op type matching a command, if any.
+func classifyCommand(command Document) (OpType, bool) {
+	for _, registered := range registeredOpTypes {
+		if registered.classify(command) {
+			return registered.opType, true
+		}
+	}
+	return "", false
+}
+
+// String returns the name of the op type, as used by the flags and reports.
+func (t OpType) String() string {
+	return string(t)
+}
+
+// Category tells what the ops of a type do: "read", "write", "ddl",
+// "cursor", or "custom" for the types added with RegisterOpType().
+func (t OpType) Category() string {
+	switch {
+	case t.IsWrite():
+		return "write"
+	case t.IsDDL():
+		return "ddl"
+	case t == GetMore || t == KillCursors:
+		return "cursor"
+	}
+	for _, registered := range registeredOpTypes {
+		if registered.opType == t {
+			return "custom"
+		}
+	}
+	return "read"
+}
+
+// PrintOpTypes lists the op types the ops are replayed and reported as, one
+// per line with their category, followed by what is done with the recorded
+// ops of no such type.
+func PrintOpTypes(w io.Writer) {
+	table := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	for _, opType := range AllOpTypes {
+		fmt.Fprintf(table, "%s\t%s\treplayed\n", opType, opType.Category())
+	}
+	fmt.Fprintf(table, "%s\t%s\tskipped, unless a custom op type matches\n", Command, "other commands")
+	table.Flush()
+}
+
+// IsWrite reports whether ops of this type modify data on the server.
+func (t OpType) IsWrite() bool {
+	switch t {
+	case Insert, Update, Upsert, Remove, RemoveMulti, FindAndModify:
+		return true
+	}
+	return false
+}
+
+// IsDDL reports whether ops of this type change the collections or indexes
+// that other ops depend on.
+func (t OpType) IsDDL() bool {
+	switch t {
+	case CreateCollection, DropCollection, CreateIndexes, DropIndexes:
+		return true
+	}
+	return false
 }
 
 // Op represents a MongoDB operation that contains enough details to be
@@ -42,4 +162,40 @@ type Op struct {
 	Timestamp time.Time
 	// The details of this op, which may vary from different op types.
 	Content Document
+
+	// How the op behaved when it was recorded, if the recording captured it.
+	// e.g. "result" holds the documents returned by a query, and "nreturned"
+	// how many there were. Failed ops have the profiler's "errCode" and
+	// "errMsg", or "exceptionCode" and "exception" on older servers.
+	Recorded Document
+
+	// indicates when a dispatcher queued this op for the workers. Zero for ops
+	// that were never dispatched.
+	Dispatched time.Time
+
+	// indicates when the op was due to start, according to the recording.
+	// Only set by the dispatchers that follow the recorded timing.
+	Scheduled time.Time
+
+	// The position of the op among the ones read from its recording, starting
+	// at 1. Zero for ops that weren't read from a recording.
+	Offset int
+}
+
+// HasValidNamespace tells whether the op was recorded with a namespace it can
+// be replayed on: a valid database name and a collection.
+func (op *Op) HasValidNamespace() bool {
+	return op.Database != "" && !strings.ContainsAny(op.Database, "/\\. \"$\x00") &&
+		op.Collection != ""
+}
+
+// FailedWhenRecorded tells whether the recording shows the op failed on the
+// source.
+func (op *Op) FailedWhenRecorded() bool {
+	for _, field := range []string{"errCode", "errMsg", "exceptionCode", "exception"} {
+		if _, failed := op.Recorded[field]; failed {
+			return true
+		}
+	}
+	return false
 }
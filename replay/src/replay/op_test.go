@@ -0,0 +1,26 @@
+package replay
+
+import (
+	"bytes"
+	. "gopkg.in/check.v1"
+	"strings"
+)
+
+type TestOpSuite struct{}
+
+var _ = Suite(&TestOpSuite{})
+
+func (s *TestOpSuite) TestOpTypeCategories(c *C) {
+	c.Assert(Upsert.Category(), Equals, "write")
+	c.Assert(CreateIndexes.Category(), Equals, "ddl")
+	c.Assert(GetMore.Category(), Equals, "cursor")
+	c.Assert(Count.Category(), Equals, "read")
+	c.Assert(Query.String(), Equals, "query")
+
+	var listed bytes.Buffer
+	PrintOpTypes(&listed)
+	lines := strings.Split(strings.TrimSpace(listed.String()), "\n")
+	c.Assert(lines, HasLen, len(AllOpTypes)+1)
+	c.Assert(strings.Fields(lines[0]), DeepEquals, []string{"insert", "write", "replayed"})
+	c.Assert(strings.HasPrefix(lines[len(lines)-1], "command "), Equals, true)
+}
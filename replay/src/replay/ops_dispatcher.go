@@ -1,10 +1,82 @@
 package replay
 
 import (
+	"context"
+	"sync/atomic"
 	"time"
 )
 
-func NewBestEffortOpsDispatcher(reader OpsReader, opsSize int, logger *Logger) chan *Op {
+// The dispatchers send the ops in exactly the order their reader returns
+// them, which only depends on the recording. Keep it that way: nothing on
+// the dispatch path may depend on map iteration, whose order Go randomizes,
+// or replays would not be reproducible.
+//
+// They all stop once their `ctx` is done, even if the workers stopped
+// reading, and close their channel when they stop.
+
+// TimeScaler computes how long the by-time dispatcher should wait before
+// sending the next op. origGap is the recorded gap between the op and its
+// predecessor, and elapsed is how far into the recording (by recorded
+// timestamps) the op is. Custom scalers can warp different parts of a
+// recording at different speeds.
+type TimeScaler func(origGap time.Duration, elapsed time.Duration) time.Duration
+
+// ConstantSpeed replays ops `multiplier` times as fast as they were recorded.
+func ConstantSpeed(multiplier float64) TimeScaler {
+	return func(origGap time.Duration, elapsed time.Duration) time.Duration {
+		return time.Duration(float64(origGap) / multiplier)
+	}
+}
+
+// MaxSpeed ignores the recorded gaps and dispatches ops as fast as possible.
+func MaxSpeed(origGap time.Duration, elapsed time.Duration) time.Duration {
+	return 0
+}
+
+// GapCap caps the wait between two ops at Max, which collapses the long idle
+// periods of a recording while preserving the timing of its busy ones.
+type GapCap struct {
+	Max time.Duration
+	// the total wait cut by the cap, in nanoseconds
+	collapsed int64
+}
+
+// Scaler caps the waits computed by `scaler`.
+func (c *GapCap) Scaler(scaler TimeScaler) TimeScaler {
+	return func(origGap time.Duration, elapsed time.Duration) time.Duration {
+		gap := scaler(origGap, elapsed)
+		if gap > c.Max {
+			atomic.AddInt64(&c.collapsed, int64(gap-c.Max))
+			return c.Max
+		}
+		return gap
+	}
+}
+
+// Collapsed returns how much idle time the cap has cut so far.
+func (c *GapCap) Collapsed() time.Duration {
+	return time.Duration(atomic.LoadInt64(&c.collapsed))
+}
+
+// IdleTime adds up how long the by-time dispatcher slept waiting for the ops
+// to be due. Compared to the time the target took serving them, it tells
+// whether the schedule or the target limits the replay: a mostly idle replay
+// can be sped up.
+type IdleTime struct {
+	// in nanoseconds
+	slept int64
+}
+
+func (i *IdleTime) add(slept time.Duration) {
+	atomic.AddInt64(&i.slept, int64(slept))
+}
+
+// Slept returns how long the dispatcher has slept so far.
+func (i *IdleTime) Slept() time.Duration {
+	return time.Duration(atomic.LoadInt64(&i.slept))
+}
+
+func NewBestEffortOpsDispatcher(ctx context.Context, reader OpsReader, opsSize int, logger *Logger) chan *Op {
 	queue := make([]*Op, opsSize, opsSize)
 	i := 0
 
@@ -17,7 +89,7 @@ func NewBestEffortOpsDispatcher(reader OpsReader, opsSize int, logger *Logger) c
 	}
 	defer reportStatus()
 
-	for ; i < opsSize && !reader.AllLoaded(); i++ {
+	for ; i < opsSize && !reader.AllLoaded() && ctx.Err() == nil; i++ {
 		op := reader.Next()
 		if op == nil {
 			break
@@ -28,13 +100,18 @@ func NewBestEffortOpsDispatcher(reader OpsReader, opsSize int, logger *Logger) c
 			reportStatus()
 		}
 	}
+	// only dispatch the ops that were loaded
+	queue = queue[:i]
 	opChannel := make(chan *Op, 10000)
 	// start a gorountine to dispatch these ops as fast as workers can handle.
 	go func() {
 		logger.Info("Started dispatching ops: as fast as possible")
 		for i, op := range queue {
 			queue[i] = nil
-			opChannel <- op
+			op.Dispatched = time.Now()
+			if !sendOp(ctx, opChannel, op) {
+				break
+			}
 		}
 		close(opChannel)
 		logger.Info("Dispatching ended")
@@ -43,12 +120,49 @@ func NewBestEffortOpsDispatcher(reader OpsReader, opsSize int, logger *Logger) c
 	return opChannel
 }
 
-func NewByTimeOpsDispatcher(reader OpsReader, opsSize int, logger *Logger) chan *Op {
+// NewBoundedOpsDispatcher dispatches ops as fast as the workers can handle,
+// like NewBestEffortOpsDispatcher, but streams them from the reader through a
+// queue of `queueSize` ops instead of preloading them all. The reader blocks
+// whenever the workers fall behind, so memory stays bounded however large the
+// recording is.
+func NewBoundedOpsDispatcher(ctx context.Context, reader OpsReader, opsSize int, queueSize int,
+	logger *Logger) chan *Op {
+	opChannel := make(chan *Op, queueSize)
+	go func() {
+		logger.Infof("Started dispatching ops: as fast as possible, through a queue of %d ops", queueSize)
+		for i := 0; i < opsSize && !reader.AllLoaded(); i++ {
+			op := reader.Next()
+			if op == nil {
+				break
+			}
+			op.Dispatched = time.Now()
+			if !sendOp(ctx, opChannel, op) {
+				break
+			}
+		}
+		close(opChannel)
+		logger.Info("Dispatching ended")
+	}()
+	return opChannel
+}
+
+// NewByTimeOpsDispatcher replays ops in accordance to their recorded
+// timestamps. The wait between two consecutive ops is computed by `scaler`;
+// a nil scaler replays at the original speed. The time spent sleeping is
+// added to `idle`, unless it's nil.
+func NewByTimeOpsDispatcher(ctx context.Context, reader OpsReader, opsSize int, scaler TimeScaler,
+	idle *IdleTime, logger *Logger) chan *Op {
+	if scaler == nil {
+		scaler = ConstantSpeed(1)
+	}
 	opChannel := make(chan *Op, 5000)
 	go func() {
 		logger.Info("Started replaying ops by time")
 		now_epoch := time.Now()
 		epoch := time.Unix(0, 0)
+		last := epoch
+		// when the current op is due, relative to now_epoch
+		scheduled := time.Duration(0)
 		for i := 0; i < opsSize && !reader.AllLoaded(); i++ {
 			op := reader.Next()
 			if op == nil {
@@ -56,14 +170,25 @@ func NewByTimeOpsDispatcher(reader OpsReader, opsSize int, logger *Logger) chan
 			}
 			if epoch.Unix() == 0 {
 				epoch = op.Timestamp
+				last = op.Timestamp
 			}
 
-			elapsed := op.Timestamp.Sub(epoch)
+			scheduled += scaler(op.Timestamp.Sub(last), op.Timestamp.Sub(epoch))
+			last = op.Timestamp
 			currentClapsed := time.Now().Sub(now_epoch)
-			if elapsed > currentClapsed {
-				time.Sleep(elapsed - currentClapsed)
+			if scheduled > currentClapsed {
+				if !sleep(ctx, scheduled-currentClapsed) {
+					break
+				}
+				if idle != nil {
+					idle.add(scheduled - currentClapsed)
+				}
+			}
+			op.Scheduled = now_epoch.Add(scheduled)
+			op.Dispatched = time.Now()
+			if !sendOp(ctx, opChannel, op) {
+				break
 			}
-			opChannel <- op
 			if reader.OpsRead()%10000 == 0 {
 				logger.Info("Timestamp for latest op: ", op.Timestamp)
 			}
@@ -73,3 +198,27 @@ func NewByTimeOpsDispatcher(reader OpsReader, opsSize int, logger *Logger) chan
 	}()
 	return opChannel
 }
+
+// Sends `op` to the workers, unless `ctx` is done first. It returns whether
+// the op was sent.
+func sendOp(ctx context.Context, opChannel chan *Op, op *Op) bool {
+	select {
+	case opChannel <- op:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// Sleeps for `duration`, unless `ctx` is done first. It returns whether it
+// slept all along.
+func sleep(ctx context.Context, duration time.Duration) bool {
+	timer := time.NewTimer(duration)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
@@ -0,0 +1,277 @@
+package replay
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	. "gopkg.in/check.v1"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"time"
+)
+
+type TestOpsDispatcherSuite struct{}
+
+var _ = Suite(&TestOpsDispatcherSuite{})
+
+// A recording mixing op types and namespaces, with some colliding timestamps.
+func dispatcherTestRecording() string {
+	lines := []string{}
+	for i := 0; i < 50; i++ {
+		lines = append(lines, fmt.Sprintf(
+			`{"ts": {"$date": %d}, "ns": "db%d.coll%d", "op": "insert", "o": {"n": %d}}`,
+			1396456709420+i/3, i%3, i%5, i))
+		lines = append(lines, fmt.Sprintf(
+			`{"ts": {"$date": %d}, "ns": "db.coll", "op": "query", "query": {"n": %d}, "ntoreturn": 1}`,
+			1396456709420+i/3, i))
+	}
+	return strings.Join(lines, "\n")
+}
+
+func (s *TestOpsDispatcherSuite) TestMaxOpsAndLimit(c *C) {
+	logger, _ := NewLogger("", "")
+	// counts the inserts dispatched out of the 100 ops of the recording,
+	// half of which are inserts
+	inserts := func(opts ReplayOptions, limit int) int {
+		_, reader := NewByLineOpsReader(
+			bytes.NewReader([]byte(dispatcherTestRecording())), logger)
+		opts.Style = "stress"
+		opts.Filters = []*OpFilter{{Reason: "aren't inserts",
+			Keep: func(op *Op) bool { return op.Type == Insert }}}
+		ops, _, err := dispatchOps(context.Background(), reader, opts, limit, logger)
+		c.Assert(err, IsNil)
+		dispatched := 0
+		for op := range ops {
+			c.Assert(op.Type, Equals, Insert)
+			dispatched++
+		}
+		return dispatched
+	}
+	c.Assert(inserts(ReplayOptions{}, 1000), Equals, 50)
+	// maxOps counts the ops read before the filters, the limit the ones
+	// dispatched after them
+	c.Assert(inserts(ReplayOptions{MaxOps: 10}, 1000), Equals, 5)
+	c.Assert(inserts(ReplayOptions{}, 10), Equals, 10)
+}
+
+func dispatchOrder(c *C, makeDispatcher func(reader OpsReader) chan *Op) []string {
+	logger, _ := NewLogger("", "")
+	_, reader := NewByLineOpsReader(
+		bytes.NewReader([]byte(dispatcherTestRecording())), logger)
+	order := []string{}
+	// a single worker
+	for op := range makeDispatcher(reader) {
+		if op == nil {
+			break
+		}
+		order = append(order, fmt.Sprintf("%s %s.%s %v", op.Type, op.Database,
+			op.Collection, op.Content))
+	}
+	return order
+}
+
+func (s *TestOpsDispatcherSuite) TestDeterministicOrder(c *C) {
+	logger, _ := NewLogger("", "")
+	bestEffort := func(reader OpsReader) chan *Op {
+		return NewBestEffortOpsDispatcher(context.Background(), reader, 1000, logger)
+	}
+	bounded := func(reader OpsReader) chan *Op {
+		return NewBoundedOpsDispatcher(context.Background(), reader, 1000, 10, logger)
+	}
+	byTime := func(reader OpsReader) chan *Op {
+		return NewByTimeOpsDispatcher(context.Background(), reader, 1000, MaxSpeed, nil, logger)
+	}
+
+	first := dispatchOrder(c, bestEffort)
+	c.Assert(first, HasLen, 100)
+	c.Assert(dispatchOrder(c, bestEffort), DeepEquals, first)
+	c.Assert(dispatchOrder(c, bounded), DeepEquals, first)
+	c.Assert(dispatchOrder(c, byTime), DeepEquals, first)
+	c.Assert(dispatchOrder(c, byTime), DeepEquals, first)
+}
+
+func (s *TestOpsDispatcherSuite) TestIdleTime(c *C) {
+	logger, _ := NewLogger("", "")
+	idle := &IdleTime{}
+	// the recording spans 16ms
+	order := dispatchOrder(c, func(reader OpsReader) chan *Op {
+		return NewByTimeOpsDispatcher(context.Background(), reader, 1000, ConstantSpeed(1), idle, logger)
+	})
+	c.Assert(order, HasLen, 100)
+	c.Assert(idle.Slept() > 0, Equals, true)
+	c.Assert(idle.Slept() <= 16*time.Millisecond, Equals, true)
+}
+
+func (s *TestOpsDispatcherSuite) TestGapCap(c *C) {
+	gapCap := &GapCap{Max: time.Second}
+	scaler := gapCap.Scaler(ConstantSpeed(2))
+
+	c.Assert(scaler(time.Second, 0), Equals, 500*time.Millisecond)
+	c.Assert(gapCap.Collapsed(), Equals, time.Duration(0))
+	// the cap applies to the scaled wait
+	c.Assert(scaler(2*time.Second, 0), Equals, time.Second)
+	c.Assert(scaler(time.Hour, 0), Equals, time.Second)
+	c.Assert(gapCap.Collapsed(), Equals, 30*time.Minute-time.Second)
+}
+
+func (s *TestOpsDispatcherSuite) TestTimeScaler(c *C) {
+	c.Assert(ConstantSpeed(2)(time.Second, time.Hour), Equals, 500*time.Millisecond)
+	c.Assert(MaxSpeed(time.Second, time.Hour), Equals, time.Duration(0))
+
+	// replays the first half of the recording as recorded, and the second
+	// one twice as fast
+	gaps, elapsed := []time.Duration{}, []time.Duration{}
+	warp := func(origGap time.Duration, sinceStart time.Duration) time.Duration {
+		gaps = append(gaps, origGap)
+		elapsed = append(elapsed, sinceStart)
+		if sinceStart >= 8*time.Millisecond {
+			return origGap / 2
+		}
+		return origGap
+	}
+	logger, _ := NewLogger("", "")
+	_, reader := NewByLineOpsReader(
+		bytes.NewReader([]byte(dispatcherTestRecording())), logger)
+	ops := []*Op{}
+	for op := range NewByTimeOpsDispatcher(context.Background(), reader, 1000, warp, nil, logger) {
+		ops = append(ops, op)
+	}
+	c.Assert(ops, HasLen, 100)
+	c.Assert(gaps, HasLen, 100)
+	total := time.Duration(0)
+	for i, gap := range gaps {
+		total += gap
+		c.Assert(elapsed[i], Equals, total)
+	}
+	// the recording spans 16ms, a 1ms gap every 3 inserts
+	c.Assert(total, Equals, 16*time.Millisecond)
+	c.Assert(ops[99].Scheduled.Sub(ops[0].Scheduled), Equals, 7*time.Millisecond+9*time.Millisecond/2)
+}
+
+func (s *TestOpsDispatcherSuite) TestCancel(c *C) {
+	logger, _ := NewLogger("", "")
+	closed := func(ops chan *Op) int {
+		read := 0
+		for {
+			select {
+			case op := <-ops:
+				if op == nil {
+					return read
+				}
+				read++
+			case <-time.After(time.Second):
+				c.Fatal("the dispatcher goes on once cancelled")
+			}
+		}
+	}
+
+	// the ops past the first ones are due in an hour
+	slow := func(origGap time.Duration, elapsed time.Duration) time.Duration {
+		if elapsed > 0 {
+			return time.Hour
+		}
+		return 0
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	_, reader := NewByLineOpsReader(
+		bytes.NewReader([]byte(dispatcherTestRecording())), logger)
+	ops := NewByTimeOpsDispatcher(ctx, reader, 1000, slow, nil, logger)
+	for i := 0; i < 6; i++ {
+		c.Assert(<-ops, NotNil)
+	}
+	cancel()
+	c.Assert(closed(ops), Equals, 0)
+
+	// nobody reads the ops anymore
+	ctx, cancel = context.WithCancel(context.Background())
+	_, reader = NewByLineOpsReader(
+		bytes.NewReader([]byte(dispatcherTestRecording())), logger)
+	ops = NewBoundedOpsDispatcher(ctx, reader, 1000, 1, logger)
+	for len(ops) == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	cancel()
+	c.Assert(closed(ops) < 50, Equals, true)
+}
+
+func (s *TestOpsDispatcherSuite) TestReplayOptionsPipeline(c *C) {
+	logger, _ := NewLogger("", "")
+	filter := &OpFilter{Reason: "are out of db0", Keep: func(op *Op) bool {
+		return op.Database == "db0"
+	}}
+	opts := ReplayOptions{
+		Style:    "stress",
+		Filters:  []*OpFilter{filter},
+		TargetDb: "target",
+		SkipOps:  2,
+	}
+	order := dispatchOrder(c, func(reader OpsReader) chan *Op {
+		opsChan, idle, err := dispatchOps(context.Background(), reader, opts, 1000, logger)
+		c.Assert(err, IsNil)
+		c.Assert(idle, IsNil)
+		return opsChan
+	})
+	// the filter sees the recorded namespaces, before they move into target,
+	// and the skipped ops are counted as recorded
+	c.Assert(order, HasLen, 16)
+	c.Assert(filter.Skipped(), Equals, int64(82))
+	for _, key := range order {
+		c.Assert(strings.HasPrefix(key, "insert target.coll"), Equals, true, Commentf(key))
+	}
+
+	opts = ReplayOptions{Style: "slow"}
+	_, _, err := dispatchOps(context.Background(), NewSliceOpsReader(nil), opts, 1000, logger)
+	c.Assert(err, NotNil)
+}
+
+func (s *TestOpsDispatcherSuite) TestControl(c *C) {
+	gate := NewPauseGate()
+	stats := NewStatsCollector()
+	stats.StartOp(Query)
+	stats.EndOp()
+	handler := ControlHandler(gate, stats.Snapshot)
+	request := func(path string) *httptest.ResponseRecorder {
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, httptest.NewRequest("POST", path, nil))
+		c.Assert(recorder.Code, Equals, http.StatusOK)
+		return recorder
+	}
+
+	request("/pause")
+	c.Assert(gate.Paused(), Equals, true)
+	waited := make(chan struct{})
+	go func() {
+		c.Check(gate.Wait(context.Background()), IsNil)
+		close(waited)
+	}()
+	select {
+	case <-waited:
+		c.Fatal("Wait() returned while paused")
+	case <-time.After(10 * time.Millisecond):
+	}
+	request("/resume")
+	<-waited
+	c.Assert(gate.Paused(), Equals, false)
+
+	// the replay can be stopped while paused
+	gate.Pause()
+	ctx, cancel := context.WithCancel(context.Background())
+	stopped := make(chan error)
+	go func() {
+		stopped <- gate.Wait(ctx)
+	}()
+	cancel()
+	select {
+	case err := <-stopped:
+		c.Assert(err, Equals, context.Canceled)
+	case <-time.After(time.Second):
+		c.Fatal("Wait() didn't return once canceled")
+	}
+	gate.Resume()
+
+	var snapshot StatsSnapshot
+	c.Assert(json.Unmarshal(request("/stats").Body.Bytes(), &snapshot), IsNil)
+	c.Assert(snapshot.Total, Equals, int64(1))
+}
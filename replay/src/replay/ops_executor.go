@@ -1,14 +1,47 @@
 package replay
 
 import (
-	"errors"
-	"gopkg.in/mgo.v2"
+	"github.com/globalsign/mgo"
+	"github.com/globalsign/mgo/bson"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
 )
 
 var (
-	NotSupported = errors.New("op type not supported")
+	// NotSupported is the former name of ErrUnsupportedOp.
+	NotSupported = ErrUnsupportedOp
 )
 
+// DDLBarrier orders the DDL ops of a replay with its other ops: a DDL op waits
+// for the ops in flight on the other workers, and holds back the ops picked up
+// after it, so that data ops run against the collections and indexes they were
+// recorded with. It's shared by the executors of all the workers of a replay,
+// and only held while the commands run on the target.
+type DDLBarrier struct {
+	lock sync.RWMutex
+}
+
+func NewDDLBarrier() *DDLBarrier {
+	return &DDLBarrier{}
+}
+
+// Takes the barrier for an op of `opType`, and returns how to release it. A
+// nil barrier orders nothing.
+func (b *DDLBarrier) hold(opType OpType) (release func()) {
+	if b == nil {
+		return func() {}
+	}
+	if opType.IsDDL() {
+		b.lock.Lock()
+		return b.lock.Unlock
+	}
+	b.lock.RLock()
+	return b.lock.RUnlock
+}
+
 type execute func(content Document, collection *mgo.Collection) error
 
 type OpsExecutor struct {
@@ -19,8 +52,103 @@ type OpsExecutor struct {
 	// only.
 	lastResult  interface{}
 	subExecutes map[OpType]execute
+
+	// when set, check the results of queries and findAndModify commands
+	// against the recorded ones.
+	comparator *ResultComparator
+
+	// when set, getMores on cursors that don't exist on the target are
+	// reported as errors rather than as orphan getMores.
+	failOrphanGetMores bool
+
+	// what to do with inserts whose _id already exists on the target
+	idConflict IdConflict
+
+	// when set, explain the ops slower than its threshold
+	explainer *SlowOpExplainer
+
+	// when set, the stats of the ops are also broken down by its labels
+	labeler OpLabeler
+
+	// when set, attached to the queries and commands, so the server's logs
+	// and profiler tell which ops were replayed
+	comment string
+
+	// when set, queries that left a cursor open are replayed as such, and
+	// the getMore and killCursors ops go to the replayed cursors
+	cursors *CursorMap
+
+	// when set, counts the documents inserted in each namespace
+	inserts *InsertCounts
+
+	// how long the ops that failed because of a primary stepdown are retried
+	stepdownWait time.Duration
+
+	// when set, the reads that follow a write read at or after its cluster
+	// time
+	clock *ClusterClock
+	// whether the last op was a write that went through, for clock
+	lastWrite bool
+
+	// when set, the timeouts of the op types, and the timeout of the other
+	// ones
+	timeouts        OpTimeouts
+	fallbackTimeout time.Duration
+	// the current timeout of the session's socket
+	socketTimeout time.Duration
+	// when set, the maxTimeMS of the reads
+	maxTime time.Duration
+
+	// when set, called with the outcome of every op
+	resultHandler OpResultHandler
+	// how long the last op took on the server, for resultHandler, and when it
+	// was sent, for tracer
+	lastLatency time.Duration
+	lastStart   time.Time
+
+	// when set, traces the ops sent to the server
+	tracer *OpTracer
+
+	// when set, logs the ops slower than its threshold
+	slowOps *SlowOpLog
+
+	// when set, orders the DDL ops with the ops of the other workers
+	ddl *DDLBarrier
 }
 
+// OpResultHandler observes the outcome of each op the executor ran: the op,
+// how long it took on the target, and the error it failed with, if any. Ops
+// that weren't sent to the target, e.g. unsupported or malformed ones, have
+// a zero latency.
+type OpResultHandler func(op *Op, latency time.Duration, err error)
+
+// OpLabeler derives the label an op's stats are also counted under. Ops with
+// an empty label are only counted by op type.
+type OpLabeler func(op *Op) string
+
+// LabelByNamespace labels the ops with their "<db>.<collection>" namespace.
+func LabelByNamespace(op *Op) string {
+	return op.Database + "." + op.Collection
+}
+
+// LabelByDatabase labels the ops with their database.
+func LabelByDatabase(op *Op) string {
+	return op.Database
+}
+
+// IdConflict says what the executor does with an insert whose _id already
+// exists on the target.
+type IdConflict string
+
+const (
+	// fail the insert, like the server does
+	IdConflictError IdConflict = "error"
+	// leave the existing document alone
+	IdConflictSkip IdConflict = "skip"
+	// replace the existing document with the inserted one
+	IdConflictReplace IdConflict = "replace"
+)
+
 func OpsExecutorWithStats(session *mgo.Session,
 	statsCollector IStatsCollector) *OpsExecutor {
 	e := &OpsExecutor{
@@ -32,9 +160,20 @@ func OpsExecutorWithStats(session *mgo.Session,
 		Query:         e.execQuery,
 		Insert:        e.execInsert,
 		Update:        e.execUpdate,
+		Upsert:        e.execUpsert,
 		Remove:        e.execRemove,
+		RemoveMulti:   e.execRemoveMulti,
 		Count:         e.execCount,
 		FindAndModify: e.execFindAndModify,
+
+		CreateCollection: e.execCommandNamed("create"),
+		DropCollection:   e.execCommandNamed("drop"),
+		CreateIndexes:    e.execCommandNamed("createIndexes"),
+		DropIndexes:      e.execCommandNamed("dropIndexes"),
+		ListCollections:  e.execCommandNamed("listCollections"),
+		ListIndexes:      e.execCommandNamed("listIndexes"),
+		GetMore:          e.execCommandNamed("getMore"),
+		KillCursors:      e.execCommandNamed("killCursors"),
 	}
 	return e
 }
@@ -43,8 +182,107 @@ func NewOpsExecutor(session *mgo.Session) *OpsExecutor {
 	return OpsExecutorWithStats(session, NewNullStatsCollector())
 }
 
+// CausalConsistency makes the reads replayed after a write observe it, even
+// when the reads go to secondaries, see ClusterClock.
+func (e *OpsExecutor) CausalConsistency(clock *ClusterClock) {
+	e.clock = clock
+}
+
+// CompareResults enables the comparison of replayed results with recorded
+// ones. Mismatches are counted by the stats collector.
+func (e *OpsExecutor) CompareResults(comparator *ResultComparator) {
+	e.comparator = comparator
+}
+
+// ExplainSlowOps enables the explain of the ops slower than the threshold of
+// `explainer`. The explain runs after the op is timed, so it doesn't add to
+// its latency.
+func (e *OpsExecutor) ExplainSlowOps(explainer *SlowOpExplainer) {
+	e.explainer = explainer
+}
+
+// OrderDDL makes the DDL ops wait for the ops in flight on the executors that
+// share `barrier`, and hold back theirs while they run.
+func (e *OpsExecutor) OrderDDL(barrier *DDLBarrier) {
+	e.ddl = barrier
+}
+
+// CountInserts counts the documents inserted in each namespace into
+// `inserts`, for VerifyCounts(). Inserts that hit an existing _id aren't
+// counted, whatever IdConflict resolved them.
+func (e *OpsExecutor) CountInserts(inserts *InsertCounts) {
+	e.inserts = inserts
+}
+
+// RetryStepdowns retries the ops that fail because the primary stepped down,
+// for up to `wait` after they started, once the driver found the new primary.
+// Ops interrupted mid-way by the stepdown may have been partially applied
+// before they are retried. 0 disables the retries.
+func (e *OpsExecutor) RetryStepdowns(wait time.Duration) {
+	e.stepdownWait = wait
+}
+
+// OnResult calls `handler` after every op, e.g. to run custom assertions or
+// metrics when embedding the executor. The handler runs on the worker of the
+// executor, outside of any lock; nil disables it.
+func (e *OpsExecutor) OnResult(handler OpResultHandler) {
+	e.resultHandler = handler
+}
+
+// TraceOps exports a span for the sampled ops sent to the target through
+// `tracer`. The ops that weren't sent, e.g. unsupported ones, aren't traced.
+func (e *OpsExecutor) TraceOps(tracer *OpTracer) {
+	e.tracer = tracer
+}
+
+// LogSlowOps writes the ops that took longer than the threshold of `log` on
+// the target to it.
+func (e *OpsExecutor) LogSlowOps(log *SlowOpLog) {
+	e.slowOps = log
+}
+
+// LabelOps breaks down the stats of the ops by the labels of `labeler`, in
+// addition to their op type.
+func (e *OpsExecutor) LabelOps(labeler OpLabeler) {
+	e.labeler = labeler
+}
+
+// MapCursors replays the cursors of the recording: the queries that left a
+// cursor open only fetch their first batch and keep the cursor open, and the
+// recorded getMore and killCursors ops are pointed to it through `cursors`.
+// Otherwise queries fetch all of their results at once, and the recorded
+// getMores are orphans.
+func (e *OpsExecutor) MapCursors(cursors *CursorMap) {
+	e.cursors = cursors
+}
+
+// SetComment attaches `comment` to the replayed queries and commands, e.g. to
+// attribute them to a run in the server's logs. The driver can't attach a
+// comment to inserts, updates, removes, counts and findAndModify commands,
+// which are only told apart by the application name of their connection.
+func (e *OpsExecutor) SetComment(comment string) {
+	e.comment = comment
+}
+
+// SetIdConflict sets what to do with inserts whose _id already exists on the
+// target. By default they fail.
+func (e *OpsExecutor) SetIdConflict(idConflict IdConflict) {
+	e.idConflict = idConflict
+}
+
+// FailOrphanGetMores reports getMores whose cursor doesn't exist on the target
+// as errors. By default they are only counted as orphan getMores, since the
+// query that opened the cursor is often missing from the replayed ops, e.g.
+// when replaying a time range.
+func (e *OpsExecutor) FailOrphanGetMores(fail bool) {
+	e.failOrphanGetMores = fail
+}
+
 func (e *OpsExecutor) execQuery(
 	content Document, coll *mgo.Collection) error {
+	if readConcern := e.readConcern(); readConcern != nil {
+		return e.execCausalQuery(content, coll, readConcern)
+	}
 	query := coll.Find(content["query"])
 	result := []Document{}
 	if content["ntoreturn"] != nil {
@@ -55,32 +293,170 @@ func (e *OpsExecutor) execQuery(
 		ntoskip := int(content["ntoskip"].(float64))
 		query.Skip(ntoskip)
 	}
+	if e.comment != "" {
+		query.Comment(e.comment)
+	}
+	if e.maxTime > 0 {
+		query.SetMaxTime(e.maxTime)
+	}
 	err := query.All(&result)
 	e.lastResult = &result
 	return err
 }
 
 func (e *OpsExecutor) execInsert(content Document, coll *mgo.Collection) error {
-	return coll.Insert(content["o"])
+	if docs, ok := content["o"].([]interface{}); ok {
+		return e.execInsertMany(docs, coll)
+	}
+	err := coll.Insert(content["o"])
+	if err == nil && e.inserts != nil {
+		e.inserts.Add(coll.FullName)
+	}
+	if e.idConflict == IdConflictError || e.idConflict == "" || !isIdConflict(err) {
+		return err
+	}
+	doc, _ := content["o"].(map[string]interface{})
+	if e.idConflict == IdConflictReplace {
+		if _, err = coll.UpsertId(doc["_id"], doc); err != nil {
+			return err
+		}
+	}
+	e.statsCollector.RecordIdConflict(e.idConflict)
+	return nil
+}
+
+// Insert several documents at once, as recorded by the servers that take
+// OP_MSG. The `id_conflict` resolution only applies to single inserts: a
+// conflict fails the remaining documents, as it did on the source.
+func (e *OpsExecutor) execInsertMany(docs []interface{}, coll *mgo.Collection) error {
+	err := coll.Insert(docs...)
+	if err == nil && e.inserts != nil {
+		for range docs {
+			e.inserts.Add(coll.FullName)
+		}
+	}
+	return err
+}
+
+// The server error code of a duplicate key.
+const duplicateKey = 11000
+
+// The index a duplicate key error names, which mgo doesn't parse: "index: _id_"
+// since MongoDB 3.4, "index: <db>.<collection>.$_id_" before.
+var idIndexPattern = regexp.MustCompile(`index: (\S*\$)?_id_ `)
+
+// Whether an insert failed because a document with the same _id exists,
+// rather than because of another unique index.
+func isIdConflict(err error) bool {
+	return ErrorCode(err) == duplicateKey && idIndexPattern.MatchString(err.Error())
 }
 
 func (e *OpsExecutor) execUpdate(content Document, coll *mgo.Collection) error {
 	return coll.Update(content["query"], content["updateobj"])
 }
 
+func (e *OpsExecutor) execUpsert(content Document, coll *mgo.Collection) error {
+	_, err := coll.Upsert(content["query"], content["updateobj"])
+	return err
+}
+
 func (e *OpsExecutor) execRemove(content Document, coll *mgo.Collection) error {
 	return coll.Remove(content["query"])
 }
 
+func (e *OpsExecutor) execRemoveMulti(content Document, coll *mgo.Collection) error {
+	_, err := coll.RemoveAll(content["query"])
+	return err
+}
+
 func (e *OpsExecutor) execCount(content Document, coll *mgo.Collection) error {
+	if readConcern := e.readConcern(); readConcern != nil {
+		cmd := bson.D{{Name: "count", Value: coll.Name}, {Name: "readConcern", Value: readConcern}}
+		if e.maxTime > 0 {
+			cmd = append(cmd, bson.DocElem{Name: "maxTimeMS", Value: maxTimeMS(e.maxTime)})
+		}
+		result := bson.M{}
+		return coll.Database.Run(cmd, &result)
+	}
+	if e.maxTime > 0 {
+		_, err := coll.Find(nil).SetMaxTime(e.maxTime).Count()
+		return err
+	}
 	_, err := coll.Count()
 	return err
 }
 
+// Run a recorded command on the database. The server expects the command
+// name to be the first field, which a map can't guarantee, so the command is
+// rebuilt with `name` first and the other fields in a stable order.
+func (e *OpsExecutor) runCommand(name string, content Document, coll *mgo.Collection) error {
+	result := bson.M{}
+	return coll.Database.Run(e.buildCommand(name, content), &result)
+}
+
+func (e *OpsExecutor) buildCommand(name string, content Document) bson.D {
+	cmd := bson.D{{Name: name, Value: content[name]}}
+	for _, key := range sortedKeys(content) {
+		if key != name {
+			cmd = append(cmd, bson.DocElem{Name: key, Value: content[key]})
+		}
+	}
+	// a comment recorded with the command is kept
+	if _, commented := content["comment"]; e.comment != "" && !commented {
+		cmd = append(cmd, bson.DocElem{Name: "comment", Value: e.comment})
+	}
+	return cmd
+}
+
+func sortedKeys(content Document) []string {
+	keys := make([]string, 0, len(content))
+	for key := range content {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func (e *OpsExecutor) execCommandNamed(name string) execute {
+	return func(content Document, coll *mgo.Collection) error {
+		return e.runCommand(name, content, coll)
+	}
+}
+
+// How an op is replayed when the cursors of the recording are replayed.
+func (e *OpsExecutor) cursorExecute(op *Op, execute execute) execute {
+	switch op.Type {
+	case Query:
+		if cursorId(op.Recorded["cursorid"]) != 0 {
+			return func(content Document, coll *mgo.Collection) error {
+				return e.execCursorQuery(op, coll)
+			}
+		}
+	case GetMore:
+		recorded := cursorId(op.Content["getMore"])
+		if live, ok := e.cursors.Get(recorded); ok {
+			return func(content Document, coll *mgo.Collection) error {
+				return e.execMappedGetMore(recorded, live, content, coll)
+			}
+		}
+	case KillCursors:
+		return func(content Document, coll *mgo.Collection) error {
+			return execute(e.mapKilledCursors(content), coll)
+		}
+	}
+	return execute
+}
+
+// The command name of a "command.<name>" op type.
+func commandName(opType OpType) string {
+	return strings.TrimPrefix(string(opType), "command.")
+}
+
 func (e *OpsExecutor) execFindAndModify(content Document, coll *mgo.Collection) error {
 	result := Document{}
 	change := mgo.Change{Update: content["update"].(map[string]interface{})}
 	_, err := coll.Find(content["query"]).Apply(change, result)
+	e.lastResult = result
 	return err
 }
 
@@ -91,13 +467,33 @@ func (e *OpsExecutor) execFindAndModify(content Document, coll *mgo.Collection)
 // its job honestly and the consumer of these ops decide how to further process
 // the original ops.
 func canonicalizeOp(op *Op) *Op {
+	if op.Type == Insert && op.Collection == "system.indexes" {
+		return canonicalizeIndexInsert(op)
+	}
+	// upserts are told apart from plain updates, which perform differently
+	if op.Type == Update && op.Content["upsert"] == true {
+		op.Type = Upsert
+		return op
+	}
+	// and so are the removes of all the matching documents from the ones of
+	// the first one
+	if op.Type == Remove && op.Content["multi"] == true {
+		op.Type = RemoveMulti
+		return op
+	}
 	if op.Type != Command {
 		return op
 	}
 
 	cmd := op.Content["command"].(map[string]interface{})
+	// "deleteIndexes" is the legacy name of "dropIndexes"
+	if collName, exist := cmd["deleteIndexes"]; exist {
+		delete(cmd, "deleteIndexes")
+		cmd["dropIndexes"] = collName
+	}
 
-	for _, name := range []string{"findandmodify", "count"} {
+	for _, name := range []string{"findandmodify", "count", "create", "drop",
+		"createIndexes", "dropIndexes", "listIndexes"} {
 		collName, exist := cmd[name]
 		if !exist {
 			continue
@@ -110,20 +506,278 @@ func canonicalizeOp(op *Op) *Op {
 		return op
 	}
 
+	if collName, exist := cmd["killCursors"].(string); exist {
+		op.Type = KillCursors
+		op.Collection = collName
+		op.Content = cmd
+		return op
+	}
+
+	// getMore names the cursor rather than the collection
+	if _, exist := cmd["getMore"]; exist {
+		op.Type = GetMore
+		if collName, ok := cmd["collection"].(string); ok {
+			op.Collection = collName
+		}
+		op.Content = cmd
+		return op
+	}
+
+	if _, exist := cmd["listCollections"]; exist {
+		op.Type = ListCollections
+		op.Content = cmd
+		return op
+	}
+
+	if opType, ok := classifyCommand(Document(cmd)); ok {
+		op.Type = opType
+		op.Content = cmd
+		return op
+	}
+
 	return nil
 }
 
+// Older servers created indexes by inserting their spec into
+// `<db>.system.indexes`, which newer servers refuse. Such inserts are
+// replayed as `createIndexes` commands instead.
+func canonicalizeIndexInsert(op *Op) *Op {
+	spec := Document{}
+	for key, value := range op.Content["o"].(map[string]interface{}) {
+		spec[key] = value
+	}
+	ns, _ := spec["ns"].(string)
+	parts := strings.SplitN(ns, ".", 2)
+	if len(parts) != 2 {
+		return nil
+	}
+	delete(spec, "ns")
+
+	op.Type = CreateIndexes
+	op.Collection = parts[1]
+	op.Content = Document{
+		"createIndexes": parts[1],
+		"indexes":       []interface{}{spec},
+	}
+	return op
+}
+
+// The server error code of a getMore on a cursor it doesn't know of.
+const cursorNotFound = 43
+
+// isOrphanCursor tells whether a getMore failed because its cursor was never
+// opened on the target, or was opened under a different id.
+func isOrphanCursor(err error) bool {
+	return err == mgo.ErrCursor || ErrorCode(err) == cursorNotFound
+}
+
+// The server error codes of ops that failed because the primary stepped down
+// or was shutting down: NotWritablePrimary, NotPrimaryNoSecondaryOk,
+// NotPrimaryOrSecondary, InterruptedDueToReplStateChange,
+// InterruptedAtShutdown, PrimarySteppedDown and ShutdownInProgress.
+var stepdownCodes = map[int]bool{10107: true, 13435: true, 13436: true, 11602: true,
+	11600: true, 189: true, 91: true}
+
+// isStepdown tells whether an op failed because the primary it was sent to
+// stepped down, so it can be retried on the new primary. Old servers only
+// tell it in the error message.
+func isStepdown(err error) bool {
+	if err == nil {
+		return false
+	}
+	if stepdownCodes[ErrorCode(err)] {
+		return true
+	}
+	msg := err.Error()
+	return strings.Contains(msg, "not master") || strings.Contains(msg, "node is recovering")
+}
+
+// ErrorCode extracts the server error code of a failed op. It returns 0 for
+// errors that didn't come from the server, e.g. network errors or timeouts.
+func ErrorCode(err error) int {
+	switch err := err.(type) {
+	case *mgo.QueryError:
+		return err.Code
+	case *mgo.LastError:
+		return err.Code
+	case *mgo.BulkError:
+		for _, c := range err.Cases() {
+			if code := ErrorCode(c.Err); code != 0 {
+				return code
+			}
+		}
+	}
+	return 0
+}
+
 func (e *OpsExecutor) Execute(op *Op) error {
+	e.lastLatency = 0
+	e.lastWrite = false
+	err := e.executeOp(op)
+	// after the op is timed, so the ping doesn't add up to its latency
+	if e.clock != nil && e.lastWrite {
+		e.observeClusterTime()
+	}
+	// called once the op released the DDL barrier, so a slow handler only
+	// holds up its own worker
+	if e.resultHandler != nil {
+		e.resultHandler(op, e.lastLatency, err)
+	}
+	if e.tracer != nil && e.lastLatency > 0 {
+		e.tracer.Record(op, e.lastStart, e.lastLatency, err)
+	}
+	if e.slowOps != nil && e.lastLatency > 0 && e.slowOps.IsSlow(e.lastLatency) {
+		e.slowOps.Write(op, e.lastLatency)
+	}
+	return err
+}
+
+// The size in bytes, once encoded to BSON, of the document an insert or an
+// update writes, or 0 for the other ops.
+func docSize(op *Op) int64 {
+	var doc interface{}
+	switch op.Type {
+	case Insert:
+		doc = op.Content["o"]
+		if docs, ok := doc.([]interface{}); ok {
+			size := int64(0)
+			for _, doc := range docs {
+				encoded, err := bson.Marshal(doc)
+				if err == nil {
+					size += int64(len(encoded))
+				}
+			}
+			return size
+		}
+	case Update, Upsert:
+		doc = op.Content["updateobj"]
+	default:
+		return 0
+	}
+	if doc == nil {
+		return 0
+	}
+	encoded, err := bson.Marshal(doc)
+	if err != nil {
+		return 0
+	}
+	return int64(len(encoded))
+}
+
+func (e *OpsExecutor) executeOp(op *Op) error {
+	// checked before canonicalizeOp(), which moves commands off "$cmd"
+	if !op.HasValidNamespace() {
+		e.statsCollector.RecordMalformed()
+		return &MalformedOpError{Offset: op.Offset,
+			Namespace: strings.TrimSuffix(op.Database+"."+op.Collection, ".")}
+	}
 	op = canonicalizeOp(op)
 	if op == nil {
-		return NotSupported
+		return ErrUnsupportedOp
+	}
+
+	// Time spent waiting for a worker is reported apart from the latency, so
+	// the replayer's own backpressure doesn't look like a slow server.
+	if !op.Dispatched.IsZero() {
+		e.statsCollector.RecordQueueTime(op.Type, time.Now().Sub(op.Dispatched))
+		op.Dispatched = time.Time{}
+	}
+	// How late the op starts compared to the recording, which grows when the
+	// target can't keep up with the requested speed.
+	if !op.Scheduled.IsZero() {
+		e.statsCollector.RecordScheduleDrift(time.Now().Sub(op.Scheduled))
+		op.Scheduled = time.Time{}
 	}
 
-	e.statsCollector.StartOp(op.Type)
-	defer e.statsCollector.EndOp()
+	if size := docSize(op); size > 0 {
+		e.statsCollector.RecordDocSize(op.Type, size)
+	}
 
 	content := op.Content
 	coll := e.session.DB(op.Database).C(op.Collection)
 
-	return e.subExecutes[op.Type](content, coll)
+	if e.explainer != nil {
+		start := time.Now()
+		// deferred before EndOp(), so it runs after the op is timed
+		defer func() {
+			if latency := time.Now().Sub(start); e.explainer.IsSlow(latency) {
+				e.explainer.Explain(op, coll, latency)
+			}
+		}()
+	}
+	// taken before the op is timed, so waiting for a DDL op doesn't add up to
+	// the latency
+	release := e.ddl.hold(op.Type)
+	if e.labeler != nil {
+		e.statsCollector.StartLabeledOp(op.Type, e.labeler(op))
+	} else {
+		e.statsCollector.StartOp(op.Type)
+	}
+	// the error the op is counted as failed with, like by RecordErrorCode()
+	var failure error
+	defer func() { e.statsCollector.EndOpWithError(failure) }()
+
+	execute, ok := e.subExecutes[op.Type]
+	if !ok {
+		// custom op types added with RegisterOpType()
+		execute = e.execCommandNamed(commandName(op.Type))
+	}
+	if e.cursors != nil {
+		execute = e.cursorExecute(op, execute)
+	}
+	timeout := e.socketTimeout
+	if e.timeouts != nil {
+		timeout = e.applyTimeout(op.Type)
+	}
+	start := time.Now()
+	err := execute(content, coll)
+	release()
+	// The failover shows as a latency blip rather than a burst of errors: the
+	// driver waits up to its server selection timeout for a new primary.
+	backoff := 100 * time.Millisecond
+	for deadline := start.Add(e.stepdownWait); isStepdown(err) && time.Now().Before(deadline); {
+		e.statsCollector.RecordStepdownRetry()
+		time.Sleep(backoff)
+		if backoff < 2*time.Second {
+			backoff *= 2
+		}
+		e.session.Refresh()
+		release = e.ddl.hold(op.Type)
+		err = execute(content, coll)
+		release()
+	}
+	e.lastLatency, e.lastStart = time.Now().Sub(start), start
+	e.statsCollector.RecordServiceTime(e.lastLatency)
+	if e.maxTime > 0 && ErrorCode(err) == maxTimeMSExpired {
+		e.statsCollector.RecordMaxTimeExpired(op.Type)
+	}
+	if isTimeout(err) {
+		e.statsCollector.RecordTimeout(op.Type)
+		// the driver drops the connection that timed out
+		e.session.Refresh()
+		err = &TimeoutError{Timeout: timeout, Err: err}
+	}
+	e.lastWrite = err == nil && op.Type.IsWrite()
+	if e.comparator != nil && err == nil && (op.Type == Query || op.Type == FindAndModify) {
+		if !e.comparator.Compare(op, e.lastResult) {
+			e.statsCollector.RecordResultMismatch(op.Type)
+		}
+	}
+	if op.Type == GetMore && !e.failOrphanGetMores && err != nil && isOrphanCursor(err) {
+		e.statsCollector.RecordOrphanGetMore()
+		return nil
+	}
+	// the cursor of a query can only be missing if it expired mid-way
+	if op.Type == Query && err != nil && isOrphanCursor(err) {
+		e.statsCollector.RecordCursorTimeout()
+	}
+	if err == nil {
+		return nil
+	}
+	// Not finding a document to update or modify is not a failure.
+	if err != mgo.ErrNotFound {
+		e.statsCollector.RecordErrorCode(ErrorCode(err))
+		failure = err
+	}
+	return &ExecError{OpType: op.Type, Code: ErrorCode(err), Err: err}
 }
@@ -1,10 +1,14 @@
 package replay
 
 import (
+	"errors"
 	"fmt"
+	"github.com/globalsign/mgo"
 	. "gopkg.in/check.v1"
-	"labix.org/v2/mgo"
+	"io"
+	"strings"
 	"testing"
+	"time"
 )
 
 // Hook up gocheck into the "go test" runner.
@@ -107,3 +111,229 @@ func (s *TestExecutorSuite) TestExecution(c *C) {
 	findResult = exec.lastResult.(*[]Document)
 	c.Assert(len(*findResult), Equals, 0)
 }
+
+func (s *TestExecutorSuite) TestCustomOpType(c *C) {
+	defer func(opTypes []OpType, registered []registeredOpType) {
+		AllOpTypes, registeredOpTypes = opTypes, registered
+	}(AllOpTypes, registeredOpTypes)
+
+	compact := OpType("command.compact")
+	err := RegisterOpType(compact, func(cmd Document) bool {
+		return cmd["compact"] != nil
+	})
+	c.Assert(err, IsNil)
+	c.Assert(AllOpTypes[len(AllOpTypes)-1], Equals, compact)
+	c.Assert(RegisterOpType(compact, nil), NotNil)
+	c.Assert(NewStatsCollector().Count(compact), Equals, int64(0))
+
+	cmd, err := parseJson(`{"ts": {"$date": 1396456709472}, "ns": "db.$cmd", ` +
+		`"command": {"compact": "c1"}, "op": "command"}`)
+	c.Assert(err, IsNil)
+	op := canonicalizeOp(makeOp(cmd))
+	c.Assert(op, NotNil)
+	c.Assert(op.Type, Equals, compact)
+
+	cmd, err = parseJson(`{"ts": {"$date": 1396456709472}, "ns": "db.$cmd", ` +
+		`"command": {"repairDatabase": 1}, "op": "command"}`)
+	c.Assert(err, IsNil)
+	c.Assert(canonicalizeOp(makeOp(cmd)), IsNil)
+}
+
+func (s *TestExecutorSuite) TestCanonicalizeDDL(c *C) {
+	cmd, err := parseJson(`{"ts": {"$date": 1396456709472}, "ns": "db.system.indexes", ` +
+		`"o": {"key": {"a": 1}, "name": "a_1", "ns": "db.c1"}, "op": "insert"}`)
+	c.Assert(err, IsNil)
+	op := canonicalizeOp(makeOp(cmd))
+	c.Assert(op.Type, Equals, CreateIndexes)
+	c.Assert(op.Collection, Equals, "c1")
+	c.Assert(op.Content["createIndexes"], Equals, "c1")
+	spec := op.Content["indexes"].([]interface{})[0].(Document)
+	c.Assert(spec["name"], Equals, "a_1")
+	c.Assert(spec["ns"], IsNil)
+
+	cmd, err = parseJson(`{"ts": {"$date": 1396456709472}, "ns": "db.$cmd", ` +
+		`"command": {"deleteIndexes": "c1", "index": "a_1"}, "op": "command"}`)
+	c.Assert(err, IsNil)
+	op = canonicalizeOp(makeOp(cmd))
+	c.Assert(op.Type, Equals, DropIndexes)
+	c.Assert(op.Collection, Equals, "c1")
+
+	cmd, err = parseJson(`{"ts": {"$date": 1396456709472}, "ns": "db.$cmd", ` +
+		`"command": {"listCollections": 1}, "op": "command"}`)
+	c.Assert(err, IsNil)
+	c.Assert(canonicalizeOp(makeOp(cmd)).Type, Equals, ListCollections)
+}
+
+func (s *TestExecutorSuite) TestDDLBarrier(c *C) {
+	barrier := NewDDLBarrier()
+	release := barrier.hold(Query)
+	// the data ops run together, the DDL ops wait for them
+	barrier.hold(Insert)()
+	held := make(chan struct{})
+	go func() {
+		defer close(held)
+		barrier.hold(CreateIndexes)()
+	}()
+	select {
+	case <-held:
+		c.Fatal("a DDL op ran along with a data op")
+	case <-time.After(10 * time.Millisecond):
+	}
+	// the barriers of other replays are apart
+	NewDDLBarrier().hold(DropCollection)()
+	release()
+	<-held
+
+	var none *DDLBarrier
+	none.hold(DropCollection)()
+}
+
+func (s *TestExecutorSuite) TestCanonicalizeUpsert(c *C) {
+	for _, upsert := range []bool{true, false} {
+		cmd, err := parseJson(fmt.Sprintf(`{"ts": {"$date": 1396456709472}, "ns": "db.c1", `+
+			`"op": "update", "query": {"a": 1}, "updateobj": {"$set": {"b": 1}}, "upsert": %v}`, upsert))
+		c.Assert(err, IsNil)
+		op := canonicalizeOp(makeOp(cmd))
+		if upsert {
+			c.Assert(op.Type, Equals, Upsert)
+		} else {
+			c.Assert(op.Type, Equals, Update)
+		}
+	}
+	c.Assert(Upsert.IsWrite(), Equals, true)
+}
+
+func (s *TestExecutorSuite) TestExecError(c *C) {
+	err := error(&ExecError{OpType: Insert, Code: 11000, Err: &mgo.LastError{Code: 11000}})
+	var execErr *ExecError
+	c.Assert(errors.As(err, &execErr), Equals, true)
+	c.Assert(execErr.ServerError(), Equals, true)
+	var lastErr *mgo.LastError
+	c.Assert(errors.As(err, &lastErr), Equals, true)
+
+	execErr = &ExecError{OpType: Query, Err: io.EOF}
+	c.Assert(execErr.ServerError(), Equals, false)
+	c.Assert(NotSupported, Equals, ErrUnsupportedOp)
+}
+
+func (s *TestExecutorSuite) TestErrorCode(c *C) {
+	c.Assert(ErrorCode(&mgo.QueryError{Code: 13, Message: "not authorized"}), Equals, 13)
+	c.Assert(ErrorCode(&mgo.LastError{Code: 11000, Err: "E11000 duplicate key error"}), Equals, 11000)
+	// the errors that didn't come from the server have no code
+	c.Assert(ErrorCode(io.EOF), Equals, 0)
+	c.Assert(ErrorCode(mgo.ErrNotFound), Equals, 0)
+	c.Assert(ErrorCode(nil), Equals, 0)
+
+	first, second := NewStatsCollector(), NewStatsCollector()
+	for _, err := range []error{&mgo.LastError{Code: 11000}, io.EOF, &mgo.QueryError{Code: 50}} {
+		first.RecordErrorCode(ErrorCode(err))
+	}
+	second.RecordErrorCode(ErrorCode(&mgo.LastError{Code: 11000}))
+	combined := CombineStats(first, second)
+	c.Assert(combined.ErrorCodes(), DeepEquals, map[int]int64{11000: 2, 50: 1, 0: 1})
+	c.Assert(FormatErrorCodes(combined.ErrorCodes()), Equals, "11000: 2, client: 1, 50: 1")
+	// the collectors combined are left as they were
+	c.Assert(first.ErrorCodes(), DeepEquals, map[int]int64{11000: 1, 50: 1, 0: 1})
+}
+
+func (s *TestExecutorSuite) TestIdConflict(c *C) {
+	c.Assert(isIdConflict(&mgo.LastError{Code: 11000,
+		Err: "E11000 duplicate key error collection: db.c1 index: _id_ dup key: { : 1 }"}), Equals, true)
+	c.Assert(isIdConflict(&mgo.LastError{Code: 11000,
+		Err: "E11000 duplicate key error index: db.c1.$_id_  dup key: { : 1 }"}), Equals, true)
+	c.Assert(isIdConflict(&mgo.LastError{Code: 11000,
+		Err: "E11000 duplicate key error collection: db.c1 index: email_1 dup key: { : 1 }"}), Equals, false)
+	// other indexes ending in _id_, and other errors naming _id_
+	c.Assert(isIdConflict(&mgo.LastError{Code: 11000,
+		Err: "E11000 duplicate key error collection: db.c1 index: owner_id_ dup key: { : 1 }"}), Equals, false)
+	c.Assert(isIdConflict(&mgo.LastError{Code: 11000,
+		Err: "E11000 duplicate key error index: db.c1.$owner_id_  dup key: { : 1 }"}), Equals, false)
+	c.Assert(isIdConflict(&mgo.QueryError{Code: 2, Message: "bad index: _id_ spec"}), Equals, false)
+	c.Assert(isIdConflict(&mgo.QueryError{Code: 11000,
+		Message: "E11000 duplicate key error collection: db.c1 index: _id_ dup key: { : 1 }"}), Equals, true)
+	c.Assert(isIdConflict(nil), Equals, false)
+}
+
+func (s *TestExecutorSuite) TestOrphanGetMore(c *C) {
+	cmd, err := parseJson(`{"ts": {"$date": 1396456709472}, "ns": "db.$cmd", ` +
+		`"command": {"getMore": 12345, "collection": "c1"}, "op": "command"}`)
+	c.Assert(err, IsNil)
+	op := canonicalizeOp(makeOp(cmd))
+	c.Assert(op.Type, Equals, GetMore)
+	c.Assert(op.Collection, Equals, "c1")
+
+	c.Assert(isOrphanCursor(&mgo.QueryError{Code: cursorNotFound}), Equals, true)
+	c.Assert(isOrphanCursor(mgo.ErrCursor), Equals, true)
+	c.Assert(isOrphanCursor(&mgo.QueryError{Code: 11000}), Equals, false)
+}
+
+func (s *TestExecutorSuite) TestMalformedOps(c *C) {
+	stats := NewStatsCollector()
+	exec := OpsExecutorWithStats(nil, stats)
+	_, reader := NewByLineOpsReader(strings.NewReader(
+		`{"ts": {"$date": 1396456709472}, "o": {"a": 1}, "op": "insert"}`+"\n"+
+			`{"ts": {"$date": 1396456709473}, "ns": "db", "o": {"a": 1}, "op": "insert"}`+"\n"+
+			`{"ts": {"$date": 1396456709474}, "ns": "my db.c1", "o": {"a": 1}, "op": "insert"}`+"\n"), logger)
+	for offset, namespace := range []string{"", "db", "my db.c1"} {
+		op := reader.Next()
+		c.Assert(op, NotNil)
+		c.Assert(op.Offset, Equals, offset+1)
+		var malformed *MalformedOpError
+		c.Assert(errors.As(exec.Execute(op), &malformed), Equals, true)
+		c.Assert(malformed.Offset, Equals, offset+1)
+		c.Assert(malformed.Namespace, Equals, namespace)
+	}
+	c.Assert(stats.Malformed(), Equals, int64(3))
+	c.Assert(stats.Count(Insert), Equals, int64(0))
+
+	// commands are replayed on "$cmd"
+	c.Assert((&Op{Database: "db", Collection: "$cmd"}).HasValidNamespace(), Equals, true)
+}
+
+func (s *TestExecutorSuite) TestOnResult(c *C) {
+	exec := NewOpsExecutor(nil)
+	results := []error{}
+	exec.OnResult(func(op *Op, latency time.Duration, err error) {
+		c.Assert(op.Collection, Equals, "")
+		c.Assert(latency, Equals, time.Duration(0))
+		results = append(results, err)
+	})
+	err := exec.Execute(&Op{Database: "db", Type: Insert})
+	c.Assert(results, DeepEquals, []error{err})
+
+	exec.OnResult(nil)
+	exec.Execute(&Op{Database: "db", Type: Insert})
+	c.Assert(results, HasLen, 1)
+}
+
+func (s *TestExecutorSuite) TestKillCursors(c *C) {
+	cmd, err := parseJson(`{"ts": {"$date": 1396456709472}, "ns": "db.$cmd", ` +
+		`"command": {"killCursors": "c1", "cursors": [12345, 678]}, "op": "command"}`)
+	c.Assert(err, IsNil)
+	op := canonicalizeOp(makeOp(cmd))
+	c.Assert(op.Type, Equals, KillCursors)
+	c.Assert(op.Collection, Equals, "c1")
+
+	cursors := NewCursorMap()
+	cursors.Add(12345, 999)
+	exec := NewOpsExecutor(nil)
+	exec.MapCursors(cursors)
+	mapped := exec.mapKilledCursors(op.Content)
+	c.Assert(mapped["cursors"], DeepEquals, []interface{}{int64(999), int64(678)})
+	c.Assert(cursors.Len(), Equals, 0)
+	// the recorded op is left as is
+	c.Assert(op.Content["cursors"], DeepEquals, []interface{}{12345.0, 678.0})
+
+	c.Assert(cursorId(map[string]interface{}{"$numberLong": "9007199254740993"}),
+		Equals, int64(9007199254740993))
+	c.Assert(cursorId(nil), Equals, int64(0))
+}
+
+func (s *TestExecutorSuite) TestStepdown(c *C) {
+	c.Assert(isStepdown(&mgo.QueryError{Code: 11602, Message: "operation was interrupted"}), Equals, true)
+	c.Assert(isStepdown(&mgo.LastError{Code: 10107, Err: "not primary"}), Equals, true)
+	c.Assert(isStepdown(errors.New("not master")), Equals, true)
+	c.Assert(isStepdown(&mgo.QueryError{Code: 11000}), Equals, false)
+	c.Assert(isStepdown(io.EOF), Equals, false)
+	c.Assert(isStepdown(nil), Equals, false)
+}
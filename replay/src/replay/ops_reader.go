@@ -5,9 +5,11 @@ import (
 	"encoding/json"
 	"errors"
 	"io"
-	"gopkg.in/mgo.v2/bson"
+	"github.com/globalsign/mgo/bson"
+	"math/rand"
 	"os"
 	"strings"
+	"sync/atomic"
 	"time"
 )
 
@@ -69,7 +71,7 @@ func NewFileByLineOpsReader(filename string, logger *Logger) (error, *ByLineOpsR
 	if err != nil {
 		return err, nil
 	}
-	err, reader := NewByLineOpsReader(file, logger)
+	err, reader := NewByLineOpsReader(trackOpsFile(file), logger)
 	if err != nil {
 		return err, reader
 	}
@@ -109,7 +111,7 @@ func (loader *ByLineOpsReader) SetStartTime(startTime int64) (int64, error) {
 
 		rawObj, err := parseJson(jsonText)
 		if err != nil {
-			return numSkipped, err
+			return numSkipped, &ParseError{Offset: int(numSkipped), Err: err}
 		}
 
 		timestamp := rawObj["ts"].(time.Time)
@@ -132,10 +134,14 @@ func (loader *ByLineOpsReader) Next() *Op {
 		if err != nil && err != io.EOF {
 			return nil
 		}
+		// nothing left after the last line
+		if err == io.EOF && strings.TrimSpace(jsonText) == "" {
+			return nil
+		}
 
 		rawObj, err := parseJson(jsonText)
-		loader.err = err
 		if err != nil {
+			loader.err = &ParseError{Offset: loader.opsRead + 1, Err: err}
 			return nil
 		}
 		loader.opsRead++
@@ -143,6 +149,7 @@ func (loader *ByLineOpsReader) Next() *Op {
 		if op == nil {
 			continue
 		}
+		op.Offset = loader.opsRead
 
 		return op
 	}
@@ -271,18 +278,120 @@ func PruneEmptyUpdateObj(doc Document, opType string) {
 	}
 }
 
+// The fields that describe how an op behaved when it was recorded.
+var outcomeFields = []string{"result", "nreturned", "cursorid", "ndeleted", "errCode", "errMsg",
+	"exceptionCode", "exception"}
+
+func recordedOutcome(rawDoc Document) Document {
+	var recorded Document
+	for _, field := range outcomeFields {
+		if value, ok := rawDoc[field]; ok {
+			if recorded == nil {
+				recorded = Document{}
+			}
+			recorded[field] = value
+		}
+	}
+	return recorded
+}
+
+// Servers that take OP_MSG, from MongoDB 3.6 on, profile the CRUD ops by the
+// command that carried them rather than by the fields of the legacy
+// OP_QUERY, OP_INSERT, etc. messages. A recording that spans an upgrade holds
+// both shapes, so the command shape is translated into the legacy fields, and
+// the ops are replayed and counted alike whatever their wire format. Returns
+// the op type to read the op as, which is empty for the ops that have no
+// legacy equivalent, e.g. updates with an aggregation pipeline.
+func legacyShape(opType string, rawDoc Document) (string, Document) {
+	cmd, ok := rawDoc["command"].(map[string]interface{})
+	if !ok || opType == "command" {
+		return opType, rawDoc
+	}
+	doc := Document{}
+	for key, value := range rawDoc {
+		doc[key] = value
+	}
+	switch opType {
+	case "insert":
+		docs, _ := cmd["documents"].([]interface{})
+		switch len(docs) {
+		case 0:
+			return "", rawDoc
+		case 1:
+			doc["o"] = docs[0]
+		default:
+			doc["o"] = docs
+		}
+	case "query":
+		doc["query"] = cmd["filter"]
+		doc["ntoreturn"] = legacyNumber(cmd["limit"])
+		doc["ntoskip"] = legacyNumber(cmd["skip"])
+	case "update":
+		if _, ok := cmd["u"].(map[string]interface{}); !ok {
+			return "", rawDoc
+		}
+		doc["query"] = cmd["q"]
+		doc["updateobj"] = cmd["u"]
+		doc["upsert"] = cmd["upsert"]
+	case "remove":
+		doc["query"] = cmd["q"]
+		// a limit of 0 removes all the matching documents
+		doc["justOne"] = legacyNumber(cmd["limit"]) == 1.0
+	case "getmore":
+		// replayed like the getMore commands of the older recordings
+		return "command", doc
+	}
+	return opType, doc
+}
+
+// The legacy fields hold numbers as float64, whichever type the command
+// held them as. Returns nil if `val` isn't a number.
+func legacyNumber(val interface{}) interface{} {
+	switch n := val.(type) {
+	case float64:
+		return n
+	case int:
+		return float64(n)
+	case int64:
+		return float64(n)
+	}
+	return nil
+}
+
+// Whether a recorded remove deleted all the matching documents rather than
+// the first one. The recordings of the servers that take OP_MSG tell; the
+// older ones only tell how many documents were deleted, which is enough to
+// delete the same documents from the same data. Removes that tell neither
+// are replayed as removing the first one.
+func removesMany(rawDoc Document) bool {
+	if justOne, ok := rawDoc["justOne"].(bool); ok {
+		return !justOne
+	}
+	ndeleted, ok := legacyNumber(rawDoc["ndeleted"]).(float64)
+	return ok && ndeleted > 1
+}
+
 func makeOp(rawDoc Document) *Op {
-	opType := rawDoc["op"].(string)
+	opType, rawDoc := legacyShape(rawDoc["op"].(string), rawDoc)
 	ts := rawDoc["ts"].(time.Time)
-	ns := rawDoc["ns"].(string)
+	// malformed captures may have no namespace, which the executor rejects
+	ns, _ := rawDoc["ns"].(string)
 	parts := strings.SplitN(ns, ".", 2)
-	dbName, collName := parts[0], parts[1]
+	dbName, collName := parts[0], ""
+	if len(parts) == 2 {
+		collName = parts[1]
+	}
 
 	var content Document
 	// we only handpick the fields that will be of useful for a given op type.
 	switch opType {
 	case "insert":
-		content = Document{"o": rawDoc["o"].(map[string]interface{})}
+		// only OP_MSG servers record inserts of several documents at once
+		if docs, ok := rawDoc["o"].([]interface{}); ok {
+			content = Document{"o": docs}
+		} else {
+			content = Document{"o": rawDoc["o"].(map[string]interface{})}
+		}
 	case "query":
 		content = Document{
 			"query":     rawDoc["query"],
@@ -294,6 +403,9 @@ func makeOp(rawDoc Document) *Op {
 			"query":     rawDoc["query"],
 			"updateobj": rawDoc["updateobj"],
 		}
+		if upsert, _ := rawDoc["upsert"].(bool); upsert {
+			content["upsert"] = true
+		}
 
 		PruneEmptyUpdateObj(content, opType)
 	case "command":
@@ -301,10 +413,20 @@ func makeOp(rawDoc Document) *Op {
 		PruneEmptyUpdateObj(content, opType)
 	case "remove":
 		content = Document{"query": rawDoc["query"]}
+		if removesMany(rawDoc) {
+			content["multi"] = true
+		}
 	default:
 		return nil
 	}
-	return &Op{dbName, collName, OpType(opType), ts, content}
+	return &Op{
+		Database:   dbName,
+		Collection: collName,
+		Type:       OpType(opType),
+		Timestamp:  ts,
+		Content:    content,
+		Recorded:   recordedOutcome(rawDoc),
+	}
 }
 
 type CyclicOpsReader struct {
@@ -372,3 +494,435 @@ func (self *CyclicOpsReader) Err() error {
 func (self *CyclicOpsReader) Close() {
 	self.reader.Close()
 }
+
+// MergedOpsReader merges the ops of several readers, e.g. recordings of
+// different servers, into a single stream ordered by timestamp.
+//
+// Ops with the very same timestamp are ordered by the index of their reader,
+// then by their position within that reader, so the merged order is always
+// the same for the same inputs.
+type MergedOpsReader struct {
+	readers []OpsReader
+	// the next op of each reader
+	heads   []*Op
+	started bool
+	logger  *Logger
+}
+
+func NewMergedOpsReader(readers []OpsReader, logger *Logger) *MergedOpsReader {
+	return &MergedOpsReader{
+		readers: readers,
+		heads:   make([]*Op, len(readers)),
+		logger:  logger,
+	}
+}
+
+func (self *MergedOpsReader) Next() *Op {
+	if !self.started {
+		self.started = true
+		for i, reader := range self.readers {
+			self.heads[i] = reader.Next()
+		}
+	}
+
+	next := -1
+	for i, head := range self.heads {
+		if head == nil {
+			continue
+		}
+		// Strictly earlier only: on equal timestamps the lower reader index
+		// wins, and each reader yields its own ops in order.
+		if next == -1 || head.Timestamp.Before(self.heads[next].Timestamp) {
+			next = i
+		}
+	}
+	if next == -1 {
+		return nil
+	}
+	op := self.heads[next]
+	self.heads[next] = self.readers[next].Next()
+	return op
+}
+
+func (self *MergedOpsReader) SkipOps(numSkipOps int) error {
+	for numSkipped := 0; numSkipped < numSkipOps; numSkipped++ {
+		if self.Next() == nil {
+			if err := self.Err(); err != nil {
+				return err
+			}
+			return io.EOF
+		}
+	}
+	self.logger.Infof("Done skipping %d ops.\n", numSkipOps)
+	return nil
+}
+
+func (self *MergedOpsReader) SetStartTime(startTime int64) (int64, error) {
+	var (
+		numSkipped int64
+		lastErr    error
+		found      bool
+	)
+	for _, reader := range self.readers {
+		skipped, err := reader.SetStartTime(startTime)
+		numSkipped += skipped
+		if err != nil {
+			lastErr = err
+		} else {
+			found = true
+		}
+	}
+	if !found {
+		return numSkipped, lastErr
+	}
+	return numSkipped, nil
+}
+
+func (self *MergedOpsReader) OpsRead() int {
+	opsRead := 0
+	for _, reader := range self.readers {
+		opsRead += reader.OpsRead()
+	}
+	return opsRead
+}
+
+func (self *MergedOpsReader) AllLoaded() bool {
+	for i, reader := range self.readers {
+		if !reader.AllLoaded() || (self.started && self.heads[i] != nil) {
+			return false
+		}
+	}
+	return true
+}
+
+func (self *MergedOpsReader) Err() error {
+	for _, reader := range self.readers {
+		if err := reader.Err(); err != nil && err != io.EOF {
+			return err
+		}
+	}
+	return nil
+}
+
+func (self *MergedOpsReader) Close() {
+	for _, reader := range self.readers {
+		reader.Close()
+	}
+}
+
+// SliceOpsReader reads ops from memory, which allows tools embedding the
+// replay engine to replay ops they generate themselves.
+type SliceOpsReader struct {
+	ops []Op
+	// the next op to read
+	pos     int
+	opsRead int
+}
+
+func NewSliceOpsReader(ops []Op) *SliceOpsReader {
+	return &SliceOpsReader{ops: ops}
+}
+
+func (self *SliceOpsReader) Next() *Op {
+	if self.AllLoaded() {
+		return nil
+	}
+	// hand out copies, as consumers may rewrite the ops they execute.
+	op := self.ops[self.pos]
+	self.pos++
+	self.opsRead++
+	return &op
+}
+
+func (self *SliceOpsReader) SkipOps(numSkipOps int) error {
+	self.pos += numSkipOps
+	if self.pos > len(self.ops) {
+		self.pos = len(self.ops)
+		return io.EOF
+	}
+	return nil
+}
+
+// SetStartTime skips the ops before `startTime`; unlike ByLineOpsReader, the
+// first op at or after `startTime` is kept.
+func (self *SliceOpsReader) SetStartTime(startTime int64) (int64, error) {
+	searchTime := time.Unix(startTime/1000, startTime%1000*1000000)
+	numSkipped := int64(0)
+	for ; !self.AllLoaded(); self.pos++ {
+		if !self.ops[self.pos].Timestamp.Before(searchTime) {
+			return numSkipped, nil
+		}
+		numSkipped++
+	}
+	return numSkipped, errors.New("no ops found after specified start_time")
+}
+
+func (self *SliceOpsReader) OpsRead() int {
+	return self.opsRead
+}
+
+func (self *SliceOpsReader) AllLoaded() bool {
+	return self.pos >= len(self.ops)
+}
+
+func (self *SliceOpsReader) Err() error {
+	return nil
+}
+
+func (self *SliceOpsReader) Close() {
+}
+
+// OpFilter drops the ops that Keep rejects, and counts them under Reason.
+type OpFilter struct {
+	Reason  string
+	Keep    func(op *Op) bool
+	skipped int64
+}
+
+// Skipped returns how many ops the filter dropped.
+func (f *OpFilter) Skipped() int64 {
+	return atomic.LoadInt64(&f.skipped)
+}
+
+// SucceededWhenRecorded keeps the ops that didn't fail on the source.
+func SucceededWhenRecorded(op *Op) bool {
+	return !op.FailedWhenRecorded()
+}
+
+// FilteredOpsReader passes on the ops of another reader that all of its
+// filters keep. Filters can be shared by several readers, e.g. the ones
+// created by a CyclicOpsReader, to count the dropped ops over all of them.
+type FilteredOpsReader struct {
+	reader  OpsReader
+	filters []*OpFilter
+}
+
+func NewFilteredOpsReader(reader OpsReader, filters ...*OpFilter) *FilteredOpsReader {
+	return &FilteredOpsReader{reader, filters}
+}
+
+func (self *FilteredOpsReader) Next() *Op {
+	for {
+		op := self.reader.Next()
+		if op == nil || self.keep(op) {
+			return op
+		}
+	}
+}
+
+func (self *FilteredOpsReader) keep(op *Op) bool {
+	for _, filter := range self.filters {
+		if !filter.Keep(op) {
+			atomic.AddInt64(&filter.skipped, 1)
+			return false
+		}
+	}
+	return true
+}
+
+func (self *FilteredOpsReader) SkipOps(numSkipOps int) error {
+	return self.reader.SkipOps(numSkipOps)
+}
+
+func (self *FilteredOpsReader) SetStartTime(startTime int64) (int64, error) {
+	return self.reader.SetStartTime(startTime)
+}
+
+func (self *FilteredOpsReader) OpsRead() int {
+	return self.reader.OpsRead()
+}
+
+func (self *FilteredOpsReader) AllLoaded() bool {
+	return self.reader.AllLoaded()
+}
+
+func (self *FilteredOpsReader) Err() error {
+	return self.reader.Err()
+}
+
+func (self *FilteredOpsReader) Close() {
+	self.reader.Close()
+}
+
+// TargetDbOpsReader moves the ops of another reader into a single database,
+// e.g. a scratch database of the target, keeping their collections. The
+// stats broken down by namespace or database key on it too.
+type TargetDbOpsReader struct {
+	reader   OpsReader
+	database string
+}
+
+func NewTargetDbOpsReader(reader OpsReader, database string) *TargetDbOpsReader {
+	return &TargetDbOpsReader{reader, database}
+}
+
+func (self *TargetDbOpsReader) Next() *Op {
+	op := self.reader.Next()
+	if op != nil {
+		op.Database = self.database
+	}
+	return op
+}
+
+func (self *TargetDbOpsReader) SkipOps(numSkipOps int) error {
+	return self.reader.SkipOps(numSkipOps)
+}
+
+func (self *TargetDbOpsReader) SetStartTime(startTime int64) (int64, error) {
+	return self.reader.SetStartTime(startTime)
+}
+
+func (self *TargetDbOpsReader) OpsRead() int {
+	return self.reader.OpsRead()
+}
+
+func (self *TargetDbOpsReader) AllLoaded() bool {
+	return self.reader.AllLoaded()
+}
+
+func (self *TargetDbOpsReader) Err() error {
+	return self.reader.Err()
+}
+
+func (self *TargetDbOpsReader) Close() {
+	self.reader.Close()
+}
+
+// LimitedOpsReader passes on the first `limit` ops of another reader, not
+// counting the ones skipped by SkipOps() and SetStartTime().
+type LimitedOpsReader struct {
+	reader OpsReader
+	limit  int
+	// the ops passed on so far
+	read int
+}
+
+func NewLimitedOpsReader(reader OpsReader, limit int) *LimitedOpsReader {
+	return &LimitedOpsReader{reader: reader, limit: limit}
+}
+
+func (self *LimitedOpsReader) Next() *Op {
+	if self.read >= self.limit {
+		return nil
+	}
+	op := self.reader.Next()
+	if op != nil {
+		self.read++
+	}
+	return op
+}
+
+func (self *LimitedOpsReader) SkipOps(numSkipOps int) error {
+	return self.reader.SkipOps(numSkipOps)
+}
+
+func (self *LimitedOpsReader) SetStartTime(startTime int64) (int64, error) {
+	return self.reader.SetStartTime(startTime)
+}
+
+func (self *LimitedOpsReader) OpsRead() int {
+	return self.reader.OpsRead()
+}
+
+func (self *LimitedOpsReader) AllLoaded() bool {
+	return self.read >= self.limit || self.reader.AllLoaded()
+}
+
+func (self *LimitedOpsReader) Err() error {
+	return self.reader.Err()
+}
+
+func (self *LimitedOpsReader) Close() {
+	self.reader.Close()
+}
+
+// ShuffledOpsReader shuffles the ops of another reader within consecutive
+// windows of recorded time, to approximate the interleaving of many
+// independent clients rather than the exact order of a recording. The
+// timestamps stay in place, so the cadence of the replay is preserved; the
+// causal order of the ops within a window is not.
+type ShuffledOpsReader struct {
+	reader OpsReader
+	window time.Duration
+	rng    *rand.Rand
+	// the shuffled ops of the current window, and the first op of the next
+	shuffled []*Op
+	next     *Op
+}
+
+// NewShuffledOpsReader shuffles with `rng`, so a seeded generator replays the
+// same order every time.
+func NewShuffledOpsReader(reader OpsReader, window time.Duration, rng *rand.Rand) *ShuffledOpsReader {
+	return &ShuffledOpsReader{reader: reader, window: window, rng: rng}
+}
+
+func (self *ShuffledOpsReader) Next() *Op {
+	if len(self.shuffled) == 0 {
+		self.fill()
+	}
+	if len(self.shuffled) == 0 {
+		return nil
+	}
+	op := self.shuffled[0]
+	self.shuffled = self.shuffled[1:]
+	return op
+}
+
+// Read and shuffle the ops of the next window.
+func (self *ShuffledOpsReader) fill() {
+	first := self.next
+	self.next = nil
+	if first == nil {
+		if first = self.reader.Next(); first == nil {
+			return
+		}
+	}
+	ops := []*Op{first}
+	for {
+		op := self.reader.Next()
+		if op == nil {
+			break
+		}
+		if op.Timestamp.Sub(first.Timestamp) >= self.window {
+			self.next = op
+			break
+		}
+		ops = append(ops, op)
+	}
+
+	timestamps := make([]time.Time, len(ops))
+	for i, op := range ops {
+		timestamps[i] = op.Timestamp
+	}
+	self.rng.Shuffle(len(ops), func(i, j int) {
+		ops[i], ops[j] = ops[j], ops[i]
+	})
+	for i, op := range ops {
+		op.Timestamp = timestamps[i]
+	}
+	self.shuffled = ops
+}
+
+func (self *ShuffledOpsReader) SkipOps(numSkipOps int) error {
+	return self.reader.SkipOps(numSkipOps)
+}
+
+func (self *ShuffledOpsReader) SetStartTime(startTime int64) (int64, error) {
+	return self.reader.SetStartTime(startTime)
+}
+
+func (self *ShuffledOpsReader) OpsRead() int {
+	return self.reader.OpsRead()
+}
+
+func (self *ShuffledOpsReader) AllLoaded() bool {
+	return self.reader.AllLoaded() && len(self.shuffled) == 0 && self.next == nil
+}
+
+func (self *ShuffledOpsReader) Err() error {
+	return self.reader.Err()
+}
+
+func (self *ShuffledOpsReader) Close() {
+	self.reader.Close()
+}
@@ -2,9 +2,13 @@ package replay
 
 import (
 	"bytes"
+	"errors"
 	"fmt"
+	"github.com/globalsign/mgo/bson"
 	. "gopkg.in/check.v1"
-	"labix.org/v2/mgo/bson"
+	"io"
+	"math/rand"
+	"strings"
 	"testing"
 	"time"
 )
@@ -182,3 +186,366 @@ func (s *TestFileByLineOpsReaderSuite) TestComplexnormalizeObj(c *C) {
 	doc5 := complicatedItem["doc5"].(bson.ObjectId)
 	c.Assert(doc5, Equals, bson.ObjectIdHex("533c3d03c23fffd217678ee7"))
 }
+
+func (s *TestFileByLineOpsReaderSuite) TestMergedOpsReader(c *C) {
+	logger, _ = NewLogger("", "")
+	file1 :=
+		`{ "ts": {"$date": 1396456709421}, "ns": "db.coll", "op": "insert", "o": {"message": "a1"} }
+        { "ts": {"$date": 1396456709422}, "ns": "db.coll", "op": "insert", "o": {"message": "a2"} }
+        { "ts": {"$date": 1396456709422}, "ns": "db.coll", "op": "insert", "o": {"message": "a3"} }
+        { "ts": {"$date": 1396456709424}, "ns": "db.coll", "op": "insert", "o": {"message": "a4"} }`
+	file2 :=
+		`{ "ts": {"$date": 1396456709420}, "ns": "db.coll", "op": "insert", "o": {"message": "b1"} }
+        { "ts": {"$date": 1396456709422}, "ns": "db.coll", "op": "insert", "o": {"message": "b2"} }
+        { "ts": {"$date": 1396456709424}, "ns": "db.coll", "op": "insert", "o": {"message": "b3"} }`
+	expected := []string{"b1", "a1", "a2", "a3", "b2", "a4", "b3"}
+
+	// The order must not change from one run to another.
+	for run := 0; run < 3; run++ {
+		_, reader1 := NewByLineOpsReader(bytes.NewReader([]byte(file1)), logger)
+		_, reader2 := NewByLineOpsReader(bytes.NewReader([]byte(file2)), logger)
+		merged := NewMergedOpsReader([]OpsReader{reader1, reader2}, logger)
+
+		messages := []string{}
+		for op := merged.Next(); op != nil; op = merged.Next() {
+			messages = append(messages, op.Content["o"].(map[string]interface{})["message"].(string))
+		}
+		c.Assert(messages, DeepEquals, expected)
+	}
+}
+
+func (s *TestFileByLineOpsReaderSuite) TestSliceOpsReader(c *C) {
+	ops := []Op{}
+	for i := 1; i <= 5; i++ {
+		rawObj, err := parseJson(fmt.Sprintf(`{ "ts": {"$date": %d}, "ns": "db.coll", `+
+			`"op": "insert", "o": {"logType%d": "warning", "message": "m%d"} }`,
+			1396456709420+i, i, i))
+		c.Assert(err, IsNil)
+		ops = append(ops, *makeOp(rawObj))
+	}
+	CheckOpsReader(c, NewSliceOpsReader(ops))
+	CheckSkipOps(c, NewSliceOpsReader(ops))
+
+	reader := NewSliceOpsReader(ops)
+	numSkipped, err := reader.SetStartTime(1396456709424)
+	c.Assert(err, IsNil)
+	c.Assert(numSkipped, Equals, int64(3))
+	c.Assert(reader.Next().Content["o"].(map[string]interface{})["message"], Equals, "m4")
+
+	// the ops handed out are copies
+	reader = NewSliceOpsReader(ops)
+	reader.Next().Collection = "other"
+	c.Assert(ops[0].Collection, Equals, "coll")
+}
+
+func (s *TestFileByLineOpsReaderSuite) TestInspect(c *C) {
+	ops := []Op{}
+	for i, raw := range []string{
+		`"ns": "db.b", "op": "insert", "o": {"a": 1}`,
+		`"ns": "db.a", "op": "query", "query": {"a": 1}`,
+		`"ns": "db.$cmd", "op": "command", "command": {"count": "a"}`,
+		`"ns": "db.b", "op": "insert", "o": {"a": 2}`,
+		`"ns": "db.a", "op": "remove", "query": {"$or": [{"a": 1}, {"b": 2}]}`,
+	} {
+		rawObj, err := parseJson(fmt.Sprintf(`{"ts": {"$date": %d}, %s}`, 1396456709420+i, raw))
+		c.Assert(err, IsNil)
+		ops = append(ops, *makeOp(rawObj))
+	}
+	inventory, err := Inspect(NewSliceOpsReader(ops))
+	c.Assert(err, IsNil)
+	c.Assert(inventory.Total, Equals, int64(5))
+	c.Assert(inventory.Last.Sub(inventory.First), Equals, 4*time.Millisecond)
+	c.Assert(inventory.Namespaces, HasLen, 2)
+	c.Assert(inventory.Namespaces[0].Namespace, Equals, "db.a")
+	c.Assert(inventory.Namespaces[0].Counts, DeepEquals,
+		map[OpType]int64{Query: 1, Count: 1, Remove: 1})
+	c.Assert(inventory.Namespaces[0].QueriedFields, DeepEquals, map[string]int64{"a": 2, "b": 1})
+	c.Assert(inventory.Namespaces[1].Counts, DeepEquals, map[OpType]int64{Insert: 2})
+}
+
+func (s *TestFileByLineOpsReaderSuite) TestExtJSONOpsReader(c *C) {
+	recording := `
+{"ts": {"$date": {"$numberLong": "1396456709421"}}, "ns": "db.c1", "op": "insert",
+ "o": {"_id": {"$oid": "533c3d03c23fffd217678ee8"}, "n": {"$numberLong": "5"},
+       "i": {"$numberInt": "3"}, "d": {"$numberDouble": "1.5"},
+       "b": {"$binary": {"base64": "AQI=", "subType": "00"}},
+       "a": [{"r": {"$regularExpression": {"pattern": "^a", "options": "i"}}}]}}
+{"ts": {"$date": "2014-04-02T16:38:29.422Z"}, "ns": "db.c1", "op": "query",
+ "query": {"ts": {"$timestamp": {"t": 1, "i": 2}}}}
+{"ts": {"$date": 1396456709423}, "ns": "db.c1", "op": "remove", "query": {"k": {"$minKey": 1}}}
+`
+	logger, _ = NewLogger("", "")
+	err, reader := NewExtJSONOpsReader(strings.NewReader(recording), logger)
+	c.Assert(err, IsNil)
+	op := reader.Next()
+	c.Assert(op.Type, Equals, Insert)
+	CheckTime(c, 1396456709421, op.Timestamp)
+	content := op.Content["o"].(map[string]interface{})
+	c.Assert(content["_id"], Equals, bson.ObjectIdHex("533c3d03c23fffd217678ee8"))
+	c.Assert(content["n"], Equals, int64(5))
+	c.Assert(content["i"], Equals, 3)
+	c.Assert(content["d"], Equals, 1.5)
+	c.Assert(content["b"], DeepEquals, bson.Binary{Kind: 0, Data: []byte{1, 2}})
+	c.Assert(content["a"].([]interface{})[0].(map[string]interface{})["r"], Equals,
+		bson.RegEx{Pattern: "^a", Options: "i"})
+
+	op = reader.Next()
+	c.Assert(op.Type, Equals, Query)
+	CheckTime(c, 1396456709422, op.Timestamp)
+	query := op.Content["query"].(map[string]interface{})
+	c.Assert(query["ts"], Equals, bson.MongoTimestamp(1<<32|2))
+
+	op = reader.Next()
+	c.Assert(op.Type, Equals, Remove)
+	c.Assert(op.Content["query"].(map[string]interface{})["k"], Equals, bson.MinKey)
+	c.Assert(reader.Next(), IsNil)
+	c.Assert(reader.AllLoaded(), Equals, true)
+	c.Assert(reader.OpsRead(), Equals, 3)
+
+	_, reader = NewExtJSONOpsReader(strings.NewReader(recording), logger)
+	numSkipped, err := reader.SetStartTime(1396456709422)
+	c.Assert(err, IsNil)
+	c.Assert(numSkipped, Equals, int64(1))
+	c.Assert(reader.Next().Type, Equals, Query)
+}
+
+func (s *TestFileByLineOpsReaderSuite) TestMixedWireFormats(c *C) {
+	// the same ops, as profiled by a legacy server then by an OP_MSG one
+	recording := `
+{"ts": {"$date": 1396456709421}, "ns": "db.c1", "op": "insert", "o": {"_id": 1}}
+{"ts": {"$date": 1396456709422}, "ns": "db.c1", "op": "query", "query": {"a": 1},
+ "ntoreturn": 5, "ntoskip": 2}
+{"ts": {"$date": 1396456709423}, "ns": "db.c1", "op": "update", "query": {"_id": 1},
+ "updateobj": {"$set": {"a": 2}}, "upsert": true}
+{"ts": {"$date": 1396456709424}, "ns": "db.c1", "op": "remove", "query": {"_id": 1}}
+{"ts": {"$date": 1396456709425}, "ns": "db.$cmd", "op": "command",
+ "command": {"getMore": 12345, "collection": "c1"}}
+{"ts": {"$date": 1396456709431}, "ns": "db.c1", "op": "insert",
+ "command": {"insert": "c1", "documents": [{"_id": 1}], "ordered": true}}
+{"ts": {"$date": 1396456709432}, "ns": "db.c1", "op": "query",
+ "command": {"find": "c1", "filter": {"a": 1}, "limit": {"$numberInt": "5"}, "skip": 2}}
+{"ts": {"$date": 1396456709433}, "ns": "db.c1", "op": "update",
+ "command": {"q": {"_id": 1}, "u": {"$set": {"a": 2}}, "multi": false, "upsert": true}}
+{"ts": {"$date": 1396456709434}, "ns": "db.c1", "op": "remove",
+ "command": {"q": {"_id": 1}, "limit": 1}}
+{"ts": {"$date": 1396456709435}, "ns": "db.c1", "op": "getmore",
+ "command": {"getMore": 12345, "collection": "c1"}}
+{"ts": {"$date": 1396456709436}, "ns": "db.c1", "op": "insert",
+ "command": {"insert": "c1", "documents": [{"_id": 2}, {"_id": 3}]}}
+{"ts": {"$date": 1396456709437}, "ns": "db.c1", "op": "update",
+ "command": {"q": {"_id": 1}, "u": [{"$set": {"a": 2}}]}}
+`
+	logger, _ = NewLogger("", "")
+	_, reader := NewExtJSONOpsReader(strings.NewReader(recording), logger)
+	ops := []*Op{}
+	for op := reader.Next(); op != nil; op = reader.Next() {
+		ops = append(ops, canonicalizeOp(op))
+	}
+	c.Assert(reader.Err(), Equals, io.EOF)
+	c.Assert(ops, HasLen, 11)
+	stats := NewStatsCollector()
+	for i := 0; i < 5; i++ {
+		legacy, modern := ops[i], ops[i+5]
+		c.Assert(modern.Type, Equals, legacy.Type)
+		c.Assert(modern.Collection, Equals, legacy.Collection)
+		c.Assert(modern.Content, DeepEquals, legacy.Content)
+		stats.StartOp(legacy.Type)
+		stats.EndOp()
+		stats.StartOp(modern.Type)
+		stats.EndOp()
+	}
+	for _, opType := range []OpType{Insert, Query, Upsert, Remove, GetMore} {
+		c.Assert(stats.Count(opType), Equals, int64(2))
+	}
+	c.Assert(ops[10].Type, Equals, Insert)
+	c.Assert(ops[10].Content["o"], DeepEquals,
+		[]interface{}{map[string]interface{}{"_id": 2.0}, map[string]interface{}{"_id": 3.0}})
+	c.Assert(docSize(ops[10]), Equals, 2*docSize(ops[0]))
+}
+
+func (s *TestFileByLineOpsReaderSuite) TestRemoveMulti(c *C) {
+	for raw, opType := range map[string]OpType{
+		`"query": {"a": 1}`:                                 Remove,
+		`"query": {"a": 1}, "ndeleted": 1`:                  Remove,
+		`"query": {"a": 1}, "ndeleted": 3`:                  RemoveMulti,
+		`"query": {"a": 1}, "ndeleted": 3, "justOne": true`: Remove,
+		`"command": {"q": {"a": 1}, "limit": 1}`:            Remove,
+		`"command": {"q": {"a": 1}, "limit": 0}`:            RemoveMulti,
+	} {
+		rawObj, err := parseJson(`{"ts": {"$date": 1396456709420}, "ns": "db.a", "op": "remove", ` +
+			raw + `}`)
+		c.Assert(err, IsNil)
+		op := canonicalizeOp(makeOp(rawObj))
+		c.Assert(op.Type, Equals, opType, Commentf("%s", raw))
+		c.Assert(op.Content["query"], DeepEquals, map[string]interface{}{"a": 1.0})
+	}
+	c.Assert(RemoveMulti.Category(), Equals, "write")
+}
+
+func (s *TestFileByLineOpsReaderSuite) TestFilteredOpsReader(c *C) {
+	ops := []Op{}
+	for i, outcome := range []string{``, `, "errCode": 11000, "errMsg": "E11000"`, ``,
+		`, "exceptionCode": 17, "exception": "failed"`} {
+		rawObj, err := parseJson(fmt.Sprintf(`{"ts": {"$date": %d}, "ns": "db.c1", `+
+			`"op": "insert", "o": {"n": %d}%s}`, 1396456709420+i, i, outcome))
+		c.Assert(err, IsNil)
+		ops = append(ops, *makeOp(rawObj))
+	}
+	filter := &OpFilter{Reason: "failed when recorded", Keep: SucceededWhenRecorded}
+	reader := NewFilteredOpsReader(NewSliceOpsReader(ops), filter)
+	kept := []float64{}
+	for op := reader.Next(); op != nil; op = reader.Next() {
+		kept = append(kept, op.Content["o"].(map[string]interface{})["n"].(float64))
+	}
+	c.Assert(kept, DeepEquals, []float64{0, 2})
+	c.Assert(filter.Skipped(), Equals, int64(2))
+}
+
+func (s *TestFileByLineOpsReaderSuite) TestMatchesAll(c *C) {
+	_, err := ParseFieldPredicates("status=active,=1")
+	c.Assert(err, NotNil)
+	predicates, err := ParseFieldPredicates("status=active,owner.id,n=5")
+	c.Assert(err, IsNil)
+	c.Assert(predicates, DeepEquals, []FieldPredicate{{Path: "status", Value: "active", HasValue: true},
+		{Path: "owner.id"}, {Path: "n", Value: 5.0, HasValue: true}})
+
+	ops := []Op{}
+	for i, raw := range []string{
+		`"ns": "db.a", "op": "query", "query": {"status": "active", "owner": {"id": 1}, "n": 5}`,
+		`"ns": "db.a", "op": "query", "query": {"$query": {"status": ["active"], "owner.id": 2, "n": 5}}`,
+		`"ns": "db.a", "op": "remove", "query": {"$and": [{"status": "active"}, {"owner.id": 1}, {"n": 5}]}`,
+		`"ns": "db.$cmd", "op": "command", "command": {"count": "a", "query": {"status": "active", ` +
+			`"owner.id": {"$gt": 1}, "n": 5}}`,
+		`"ns": "db.a", "op": "query", "query": {"status": "done", "owner.id": 1, "n": 5}`,
+		`"ns": "db.a", "op": "query", "query": {"status": "active", "n": 5}`,
+		`"ns": "db.a", "op": "insert", "o": {"status": "active", "owner": {"id": 1}, "n": 5}`,
+	} {
+		rawObj, err := parseJson(fmt.Sprintf(`{"ts": {"$date": %d}, %s}`, 1396456709420+i, raw))
+		c.Assert(err, IsNil)
+		ops = append(ops, *makeOp(rawObj))
+	}
+	filter := &OpFilter{Reason: "don't match", Keep: MatchesAll(predicates)}
+	reader := NewFilteredOpsReader(NewSliceOpsReader(ops), filter)
+	for i := 0; i < 4; i++ {
+		c.Assert(reader.Next().Timestamp, Equals, ops[i].Timestamp)
+	}
+	c.Assert(reader.Next(), IsNil)
+	c.Assert(filter.Skipped(), Equals, int64(3))
+}
+
+func (s *TestFileByLineOpsReaderSuite) TestTargetDbOpsReader(c *C) {
+	ops := []Op{{Database: "db1", Collection: "c1", Type: Insert},
+		{Database: "db2", Collection: "$cmd", Type: Command}}
+	reader := NewTargetDbOpsReader(NewSliceOpsReader(ops), "staging")
+	op := reader.Next()
+	c.Assert(op.Database+"."+op.Collection, Equals, "staging.c1")
+	op = reader.Next()
+	c.Assert(op.Database+"."+op.Collection, Equals, "staging.$cmd")
+	c.Assert(reader.Next(), IsNil)
+}
+
+func (s *TestFileByLineOpsReaderSuite) TestLimitedOpsReader(c *C) {
+	ops := []Op{{Type: Insert}, {Type: Query}, {Type: Update}, {Type: Remove}}
+	reader := NewLimitedOpsReader(NewSliceOpsReader(ops), 2)
+	// the skipped ops don't count
+	c.Assert(reader.SkipOps(1), IsNil)
+	c.Assert(reader.Next().Type, Equals, Query)
+	c.Assert(reader.AllLoaded(), Equals, false)
+	c.Assert(reader.Next().Type, Equals, Update)
+	c.Assert(reader.AllLoaded(), Equals, true)
+	c.Assert(reader.Next(), IsNil)
+}
+
+func (s *TestFileByLineOpsReaderSuite) TestRedactingOpsReader(c *C) {
+	rules, err := ParseRedactRules("email=hash,address.zip=remove,name=constant:redacted")
+	c.Assert(err, IsNil)
+	ops := []Op{}
+	for _, line := range []string{
+		`{"ts": {"$date": 1396456709420}, "ns": "db.c1", "op": "insert", "o": ` +
+			`{"email": "a@b.c", "name": "Ann", "address": {"zip": "12345", "city": "X"}}}`,
+		`{"ts": {"$date": 1396456709421}, "ns": "db.c1", "op": "update", "query": {}, ` +
+			`"updateobj": {"$set": {"email": "a@b.c", "address.zip": "12345"}}}`,
+		`{"ts": {"$date": 1396456709422}, "ns": "db.c1", "op": "insert", "o": {"n": 1}}`,
+	} {
+		rawObj, err := parseJson(line)
+		c.Assert(err, IsNil)
+		ops = append(ops, *makeOp(rawObj))
+	}
+	redactor := NewRedactor(rules...)
+	reader := NewRedactingOpsReader(NewSliceOpsReader(ops), redactor)
+
+	inserted := reader.Next().Content["o"].(map[string]interface{})
+	c.Assert(inserted["name"], Equals, "redacted")
+	c.Assert(inserted["address"], DeepEquals, map[string]interface{}{"city": "X"})
+	hashed := inserted["email"]
+	c.Assert(hashed, Not(Equals), "a@b.c")
+	updated := reader.Next().Content["updateobj"].(map[string]interface{})
+	// equal values hash to the same value
+	c.Assert(updated["$set"], DeepEquals, map[string]interface{}{"email": hashed})
+	c.Assert(reader.Next().Content["o"], DeepEquals, map[string]interface{}{"n": 1.0})
+	c.Assert(reader.Next(), IsNil)
+	c.Assert(redactor.Redacted(), Equals, int64(2))
+
+	_, err = ParseRedactRules("email=scramble")
+	c.Assert(err, NotNil)
+	_, err = ParseRedactRules("email")
+	c.Assert(err, NotNil)
+}
+
+func (s *TestFileByLineOpsReaderSuite) TestShuffledOpsReader(c *C) {
+	read := func(seed int64) ([]float64, []int64) {
+		ops := []Op{}
+		for i := 0; i < 20; i++ {
+			// two windows of 10 ops, 10ms apart
+			rawObj, err := parseJson(fmt.Sprintf(`{"ts": {"$date": %d}, "ns": "db.c1", `+
+				`"op": "insert", "o": {"n": %d}}`, 1396456709000+i*10, i))
+			c.Assert(err, IsNil)
+			ops = append(ops, *makeOp(rawObj))
+		}
+		reader := NewShuffledOpsReader(NewSliceOpsReader(ops), 100*time.Millisecond,
+			rand.New(rand.NewSource(seed)))
+		order, timestamps := []float64{}, []int64{}
+		for op := reader.Next(); op != nil; op = reader.Next() {
+			order = append(order, op.Content["o"].(map[string]interface{})["n"].(float64))
+			timestamps = append(timestamps, op.Timestamp.UnixNano()/int64(time.Millisecond))
+		}
+		c.Assert(reader.AllLoaded(), Equals, true)
+		return order, timestamps
+	}
+
+	order, timestamps := read(1)
+	c.Assert(order, HasLen, 20)
+	for i, n := range order {
+		// shuffled within their window, with the cadence untouched
+		c.Assert(int(n)/10, Equals, i/10)
+		c.Assert(timestamps[i], Equals, int64(1396456709000+i*10))
+	}
+	c.Assert(order, Not(DeepEquals), []float64{0, 1, 2, 3, 4, 5, 6, 7, 8, 9,
+		10, 11, 12, 13, 14, 15, 16, 17, 18, 19})
+	again, _ := read(1)
+	c.Assert(again, DeepEquals, order)
+}
+
+func (s *TestFileByLineOpsReaderSuite) TestParseError(c *C) {
+	logger, _ = NewLogger("", "")
+	line := `{"ts": {"$date": 1396456709420}, "ns": "db.c1", "op": "remove", "query": {}}` + "\n"
+
+	// reaching the end of the ops is not an error
+	_, reader := NewByLineOpsReader(strings.NewReader(line+line), logger)
+	for op := reader.Next(); op != nil; op = reader.Next() {
+	}
+	c.Assert(reader.AllLoaded(), Equals, true)
+	c.Assert(reader.Err(), Equals, io.EOF)
+
+	_, reader = NewByLineOpsReader(strings.NewReader(line+"{not json\n"+line), logger)
+	c.Assert(reader.Next(), NotNil)
+	c.Assert(reader.Next(), IsNil)
+	var parseErr *ParseError
+	c.Assert(errors.As(reader.Err(), &parseErr), Equals, true)
+	c.Assert(parseErr.Offset, Equals, 2)
+
+	_, extReader := NewExtJSONOpsReader(strings.NewReader(`{"ts": {"$oid": "nope"}}`), logger)
+	c.Assert(extReader.Next(), IsNil)
+	c.Assert(errors.As(extReader.Err(), &parseErr), Equals, true)
+	c.Assert(parseErr.Offset, Equals, 1)
+}
@@ -0,0 +1,449 @@
+package replay
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+// OutputOptions are the files and the exporters the stats of a replay are
+// written to; the zero value writes none of them. See OpenStatsOutputs().
+type OutputOptions struct {
+	// The run the outputs are about, for the final report and the manifest,
+	// which also records the settings of the run.
+	RunId     string
+	StartTime time.Time
+	Config    map[string]string
+	// The number of workers shown on the dashboard.
+	Workers int
+	// Where the dashboard and the interval reports are printed. Defaults to
+	// os.Stdout.
+	Stdout io.Writer
+
+	// A CSV line with the ops and ops/sec of each op type at each report.
+	StatsFile string
+	// The sampled latencies; see LatencyFile.
+	LatencyFile string
+	// The failed ops, along with their content if ErrorLogOps; see ErrorLog.
+	ErrorLogFile string
+	ErrorLogOps  bool
+	// The ops that took SlowOpMin or longer, their queries redacted by
+	// Redactor; see SlowOpLog.
+	SlowOpFile string
+	SlowOpMin  time.Duration
+	Redactor   *Redactor
+
+	// A TimeSeriesPoint every TimeSeriesEvery, to TimeSeriesFile, and to
+	// Stdout as lines of JSON every IntervalEvery, if set.
+	TimeSeriesFile  string
+	TimeSeriesEvery time.Duration
+	IntervalEvery   time.Duration
+	// The latency histograms of every HdrLogEvery; see HdrLogWriter.
+	HdrLogFile  string
+	HdrLogEvery time.Duration
+	// Redraw the stats on Stdout every second, which stands in for all the
+	// reports but the last one.
+	Dashboard bool
+
+	// Serve the control endpoints of the replay, the live stats included,
+	// and the Prometheus metrics on ControlAddr; see ControlHandler.
+	ControlAddr string
+	// Push the live stats to the unix socket StatsSocket every SocketEvery;
+	// see PushSnapshot.
+	StatsSocket string
+	SocketEvery time.Duration
+	// Send the sampled latencies, and the stats every StatsDEvery, to the
+	// StatsD agent at StatsDAddr; see StatsDEmitter.
+	StatsDAddr   string
+	StatsDPrefix string
+	StatsDTags   []string
+	StatsDEvery  time.Duration
+
+	// Written once the replay is over, see Finish(): the latency histograms
+	// (see ExportHistograms), the final report in ReportFormat, and the
+	// manifest of the run.
+	HistogramFile string
+	ReportFile    string
+	ReportFormat  string
+	ManifestFile  string
+}
+
+// StatsOutputs follows the stats of the workers of a replay while they run,
+// for the time series, the dashboards and the exporters: each output gets the
+// stats at its own pace from its own goroutine, and can get them one last time
+// once the workers are done. The files the outputs write to are closed
+// together once the replay is over.
+type StatsOutputs struct {
+	opts      OutputOptions
+	logger    *Logger
+	followers []func(stop <-chan struct{}, collectors []*StatsCollector)
+	closers   []namedCloser
+	// closed by Stop(), once the workers are done
+	stop    chan struct{}
+	running sync.WaitGroup
+	// the gate of the replay, paused by the control endpoints
+	gate *PauseGate
+
+	// the outputs written as the replay goes rather than periodically
+	statsFile *os.File
+	latencies *LatencyFile
+	errorLog  *ErrorLog
+	slowOps   *SlowOpLog
+	statsd    *StatsDEmitter
+}
+
+type namedCloser struct {
+	name   string
+	closer io.Closer
+}
+
+// NewStatsOutputs logs the errors of the outputs to `logger`. It has no
+// outputs until some are added.
+func NewStatsOutputs(logger *Logger) *StatsOutputs {
+	return &StatsOutputs{logger: logger, stop: make(chan struct{})}
+}
+
+// OpenStatsOutputs creates the files and dials the exporters of `opts`. The
+// replay writes to them once the outputs are set as ReplayOptions.Outputs,
+// and Close() closes them.
+func OpenStatsOutputs(opts OutputOptions, logger *Logger) (*StatsOutputs, error) {
+	o := NewStatsOutputs(logger)
+	o.opts = opts
+	if o.opts.Stdout == nil {
+		o.opts.Stdout = os.Stdout
+	}
+	if err := o.open(); err != nil {
+		o.Close()
+		return nil, err
+	}
+	return o, nil
+}
+
+func (o *StatsOutputs) open() (err error) {
+	opts := o.opts
+	if opts.StatsFile != "" {
+		if o.statsFile, err = os.Create(opts.StatsFile); err != nil {
+			return err
+		}
+		o.Closing("the stats file", o.statsFile)
+	}
+	if opts.LatencyFile != "" {
+		if o.latencies, err = CreateLatencyFile(opts.LatencyFile); err != nil {
+			return err
+		}
+		o.Closing("the latency file", o.latencies)
+	}
+	if opts.ErrorLogFile != "" {
+		if o.errorLog, err = CreateErrorLog(opts.ErrorLogFile, opts.ErrorLogOps); err != nil {
+			return err
+		}
+		o.Closing("the error log", o.errorLog)
+	}
+	if opts.SlowOpFile != "" {
+		if o.slowOps, err = CreateSlowOpLog(opts.SlowOpFile, opts.SlowOpMin, opts.Redactor); err != nil {
+			return err
+		}
+		o.Closing("the slow op log", o.slowOps)
+	}
+
+	// The time series, the interval reports and the histograms of the HdrLog
+	// end with a last, partial interval once all the workers are done.
+	if opts.TimeSeriesFile != "" {
+		file, err := os.Create(opts.TimeSeriesFile)
+		if err != nil {
+			return err
+		}
+		o.Closing("the time series", file)
+		series, err := NewTimeSeriesWriter(file, TimeSeriesFormat(opts.TimeSeriesFile), time.Now())
+		if err != nil {
+			return err
+		}
+		o.Every("the time series", opts.TimeSeriesEvery, true, series.Write)
+	}
+	if opts.IntervalEvery > 0 {
+		reporter, _ := NewTimeSeriesWriter(opts.Stdout, "ndjson", time.Now())
+		o.Every("the interval report", opts.IntervalEvery, true, reporter.Write)
+	}
+	if opts.HdrLogFile != "" {
+		file, err := os.Create(opts.HdrLogFile)
+		if err != nil {
+			return err
+		}
+		o.Closing("the HdrHistogram log", file)
+		o.Every("the HdrHistogram log", opts.HdrLogEvery, true, NewHdrLogWriter(file, time.Now()).Write)
+	}
+	// The last draw shows the final stats above the final report.
+	if opts.Dashboard {
+		o.Every("the dashboard", time.Second, true,
+			NewDashboard(opts.Stdout, opts.Workers, time.Now()).Draw)
+	}
+
+	// The snapshots served by /stats and pushed to the stats socket also tell
+	// the ops/sec and latencies of the last 10s.
+	live := NewLiveStats(time.Now(), RecentOpsSecWindow)
+	if opts.ControlAddr != "" || opts.StatsSocket != "" {
+		o.Every("the live stats", time.Second, false, func(now time.Time, stats *StatsCollector) error {
+			live.Update(now, stats)
+			return nil
+		})
+	}
+	if opts.ControlAddr != "" {
+		o.Follow(func(stop <-chan struct{}, collectors []*StatsCollector) {
+			mux := http.NewServeMux()
+			mux.Handle("/", ControlHandler(o.gate, func() StatsSnapshot {
+				return live.Snapshot(CombineStats(collectors...))
+			}))
+			mux.Handle("/metrics", MetricsHandler(func() *StatsCollector {
+				return CombineStats(collectors...)
+			}))
+			server := &http.Server{Addr: opts.ControlAddr, Handler: mux}
+			go func() {
+				<-stop
+				server.Close()
+			}()
+			if err := server.ListenAndServe(); err != http.ErrServerClosed {
+				o.logger.Errorf("Control endpoints stopped: %v", err)
+			}
+		})
+	}
+	// The sidecar gets one last snapshot once all the workers are done.
+	if opts.StatsSocket != "" {
+		o.Every("the stats to "+opts.StatsSocket, opts.SocketEvery, true,
+			func(now time.Time, stats *StatsCollector) error {
+				return PushSnapshot(opts.StatsSocket, live.Snapshot(stats), 5*time.Second)
+			})
+	}
+
+	// The last flush waits for the replay to return, with all the latencies
+	// sampled. A failed flush only loses the metrics of an interval, so the
+	// replay goes on.
+	if opts.StatsDAddr != "" {
+		if o.statsd, err = DialStatsD(opts.StatsDAddr, opts.StatsDPrefix, opts.StatsDTags); err != nil {
+			return err
+		}
+		o.Every("the stats to "+opts.StatsDAddr, opts.StatsDEvery, false,
+			func(now time.Time, stats *StatsCollector) error {
+				return o.statsd.Flush(stats)
+			})
+	}
+	return nil
+}
+
+// SlowOps returns the log the workers write the slow ops to, if any; see
+// ReplayOptions.SlowOps.
+func (o *StatsOutputs) SlowOps() *SlowOpLog {
+	return o.slowOps
+}
+
+// Follow runs `follow` in its own goroutine once the workers start, with their
+// collectors. It's expected to return soon after `stop` is closed.
+func (o *StatsOutputs) Follow(follow func(stop <-chan struct{}, collectors []*StatsCollector)) {
+	o.followers = append(o.followers, follow)
+}
+
+// Every hands the combined stats of the workers to `update` every `interval`,
+// and once more when they are done if `final` is set, e.g. for the last,
+// partial interval of a time series. The errors of `update` are logged as
+// failures to write `name`, and the output goes on.
+func (o *StatsOutputs) Every(name string, interval time.Duration, final bool,
+	update func(now time.Time, stats *StatsCollector) error) {
+	o.Follow(func(stop <-chan struct{}, collectors []*StatsCollector) {
+		write := func() {
+			if err := update(time.Now(), CombineStats(collectors...)); err != nil {
+				o.logger.Errorf("Failed to write %s: %v", name, err)
+			}
+		}
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-stop:
+				if final {
+					write()
+				}
+				return
+			case <-ticker.C:
+				write()
+			}
+		}
+	})
+}
+
+// Closing has Close() close `closer`, e.g. the file of an output, after the
+// ones added before it.
+func (o *StatsOutputs) Closing(name string, closer io.Closer) {
+	o.closers = append(o.closers, namedCloser{name, closer})
+}
+
+// Start starts the outputs on the stats of `collectors`, see Hooks.Started.
+func (o *StatsOutputs) Start(collectors []*StatsCollector) {
+	for _, follow := range o.followers {
+		o.running.Add(1)
+		go func(follow func(<-chan struct{}, []*StatsCollector)) {
+			defer o.running.Done()
+			follow(o.stop, collectors)
+		}(follow)
+	}
+}
+
+// Stopped is closed once the workers are done.
+func (o *StatsOutputs) Stopped() <-chan struct{} {
+	return o.stop
+}
+
+// Stop has the outputs get the final stats, and waits until they are done
+// with them, see Hooks.Done.
+func (o *StatsOutputs) Stop() {
+	close(o.stop)
+	o.running.Wait()
+}
+
+// The hooks of the replay paused by `gate` writing to the outputs, and then
+// calling the ones of `hooks`. While the dashboard is drawn, the Report hook
+// only gets the last status.
+func (o *StatsOutputs) hook(hooks ReplayHooks, gate *PauseGate) ReplayHooks {
+	o.gate = gate
+	hooked := hooks
+	if o.latencies != nil || o.statsd != nil {
+		hooked.Sampled = func(latency Latency) {
+			if o.latencies != nil {
+				if err := o.latencies.Write(latency); err != nil {
+					o.logger.Errorf("Failed to write latency: %v", err)
+				}
+			}
+			if o.statsd != nil {
+				if err := o.statsd.Timing(latency); err != nil {
+					o.logger.Errorf("Failed to send the latency to %s: %v", o.opts.StatsDAddr, err)
+				}
+			}
+			if hooks.Sampled != nil {
+				hooks.Sampled(latency)
+			}
+		}
+	}
+	if o.errorLog != nil {
+		hooked.Executed = func(op *Op, err error) {
+			if err != nil {
+				if err := o.errorLog.Write(op, err); err != nil {
+					o.logger.Errorf("Failed to write to the error log: %v", err)
+				}
+			}
+			if hooks.Executed != nil {
+				hooks.Executed(op, err)
+			}
+		}
+	}
+	hooked.Started = func(workers []*StatsCollector, shadow []*StatsCollector) {
+		if hooks.Started != nil {
+			hooks.Started(workers, shadow)
+		}
+		o.Start(workers)
+	}
+	hooked.Report = func(status *ExecutionStatus) {
+		if o.statsFile != nil {
+			o.writeStatsLine(status)
+		}
+		if o.opts.Dashboard {
+			select {
+			case <-o.Stopped():
+			default:
+				return
+			}
+		}
+		if hooks.Report != nil {
+			hooks.Report(status)
+		}
+	}
+	hooked.Done = func() {
+		if hooks.Done != nil {
+			hooks.Done()
+		}
+		o.Stop()
+	}
+	return hooked
+}
+
+// Write stats to disk at each interval for analysis later
+// Format is:
+// time,  ops, ops/sec, insert ops, inserts/sec, update ops, update/sec, remove ops, remove/sec,
+// query ops, query/sec, count ops, count/sec, fam ops, fam/sec
+func (o *StatsOutputs) writeStatsLine(status *ExecutionStatus) {
+	timestamp := time.Now().Format("2006-01-02 15:04:05 -0700")
+	statsLineOutput := fmt.Sprintf("%s,%d,%.2f", timestamp, (status.OpsExecuted - status.OpsExecutedLast), status.OpsPerSecLast)
+	for _, opType := range AllOpTypes {
+		statsLineOutput = fmt.Sprintf("%s,%d,%.2f", statsLineOutput,
+			(status.Counts[opType] - status.CountsLast[opType]), status.TypeOpsSecLast[opType])
+	}
+	o.statsFile.WriteString(statsLineOutput + "\n")
+}
+
+// Finish writes the outputs of the final `stats` of the replay, once it's
+// over: the last flush to StatsD, the histograms, the final report and the
+// manifest.
+func (o *StatsOutputs) Finish(stats *StatsCollector) error {
+	opts := o.opts
+	if o.statsd != nil {
+		if err := o.statsd.Flush(stats); err != nil {
+			o.logger.Errorf("Failed to send the stats to %s: %v", opts.StatsDAddr, err)
+		}
+	}
+	if opts.HistogramFile != "" {
+		err := writeFile(opts.HistogramFile, func(w io.Writer) error {
+			return ExportHistograms(w, opts.RunId, stats)
+		})
+		if err != nil {
+			return err
+		}
+	}
+	if opts.ReportFile != "" {
+		report := NewFinalReport(opts.RunId, time.Now().Sub(opts.StartTime), stats)
+		err := writeFile(opts.ReportFile, func(w io.Writer) error {
+			return WriteFinalReport(w, opts.ReportFormat, report)
+		})
+		if err != nil {
+			return err
+		}
+	}
+	if opts.ManifestFile != "" {
+		manifest := &Manifest{
+			RunId:     opts.RunId,
+			Version:   Version,
+			StartTime: opts.StartTime,
+			EndTime:   time.Now(),
+			Config:    opts.Config,
+			Stats:     stats.Snapshot(),
+		}
+		err := writeFile(opts.ManifestFile, func(w io.Writer) error {
+			return WriteManifest(w, manifest)
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Creates `filename`, has `write` write it and closes it.
+func writeFile(filename string, write func(w io.Writer) error) error {
+	file, err := os.Create(filename)
+	if err != nil {
+		return err
+	}
+	if err := write(file); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+// Close closes all the files of the outputs, logging the ones that failed.
+func (o *StatsOutputs) Close() {
+	for _, closer := range o.closers {
+		if err := closer.closer.Close(); err != nil {
+			o.logger.Errorf("Failed to finish %s: %v", closer.name, err)
+		}
+	}
+}
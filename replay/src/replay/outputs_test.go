@@ -0,0 +1,122 @@
+package replay
+
+import (
+	"bytes"
+	"errors"
+	. "gopkg.in/check.v1"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+type TestStatsOutputsSuite struct{}
+
+var _ = Suite(&TestStatsOutputsSuite{})
+
+type closeRecorder struct {
+	closed *[]string
+	name   string
+	err    error
+}
+
+func (r *closeRecorder) Close() error {
+	*r.closed = append(*r.closed, r.name)
+	return r.err
+}
+
+func (s *TestStatsOutputsSuite) TestStatsOutputs(c *C) {
+	logger, _ := NewLogger("", "")
+	outputs := NewStatsOutputs(logger)
+	stats := NewStatsCollector()
+	stats.StartOp(Query)
+	stats.EndOp()
+
+	ticks := make(chan int64, 100)
+	final := make(chan int64, 1)
+	outputs.Every("the ticks", time.Millisecond, false, func(now time.Time, stats *StatsCollector) error {
+		ticks <- stats.Count(Query)
+		return errors.New("logged, and the output goes on")
+	})
+	outputs.Every("the final stats", time.Hour, true, func(now time.Time, stats *StatsCollector) error {
+		final <- stats.Count(Query)
+		return nil
+	})
+	stopped := false
+	outputs.Follow(func(stop <-chan struct{}, collectors []*StatsCollector) {
+		c.Assert(collectors, HasLen, 1)
+		<-stop
+		stopped = true
+	})
+	closed := []string{}
+	outputs.Closing("the first file", &closeRecorder{&closed, "first", errors.New("logged")})
+	outputs.Closing("the second file", &closeRecorder{&closed, "second", nil})
+
+	outputs.Start([]*StatsCollector{stats})
+	c.Assert(<-ticks, Equals, int64(1))
+	c.Assert(<-ticks, Equals, int64(1))
+	select {
+	case <-outputs.Stopped():
+		c.Fatal("stopped before the workers are done")
+	default:
+	}
+	outputs.Stop()
+	c.Assert(stopped, Equals, true)
+	// only the outputs that asked for it get the final stats
+	c.Assert(<-final, Equals, int64(1))
+	c.Assert(final, HasLen, 0)
+
+	outputs.Close()
+	c.Assert(closed, DeepEquals, []string{"first", "second"})
+}
+
+func (s *TestStatsOutputsSuite) TestOpenStatsOutputs(c *C) {
+	dir := c.MkDir()
+	var stdout bytes.Buffer
+	logger, _ := NewLogger("", "")
+	outputs, err := OpenStatsOutputs(OutputOptions{
+		RunId:           "run",
+		StartTime:       time.Now(),
+		Workers:         1,
+		Stdout:          &stdout,
+		StatsFile:       filepath.Join(dir, "stats.csv"),
+		ErrorLogFile:    filepath.Join(dir, "errors.json"),
+		TimeSeriesFile:  filepath.Join(dir, "series.csv"),
+		TimeSeriesEvery: time.Hour,
+		Dashboard:       true,
+		ReportFile:      filepath.Join(dir, "report.json"),
+		ReportFormat:    "json",
+	}, logger)
+	c.Assert(err, IsNil)
+
+	reports := 0
+	hooks := outputs.hook(ReplayHooks{Report: func(status *ExecutionStatus) { reports++ }}, nil)
+	stats := NewStatsCollector()
+	hooks.Started([]*StatsCollector{stats}, nil)
+	stats.StartOp(Query)
+	stats.EndOpWithError(errors.New("failed"))
+	hooks.Executed(&Op{Type: Query, Database: "db", Collection: "c"}, errors.New("failed"))
+	// the dashboard stands in for the reports until the last one
+	hooks.Report(&ExecutionStatus{})
+	c.Assert(reports, Equals, 0)
+	hooks.Done()
+	hooks.Report(&ExecutionStatus{})
+	c.Assert(reports, Equals, 1)
+	c.Assert(stdout.Len() > 0, Equals, true)
+
+	c.Assert(outputs.Finish(stats), IsNil)
+	outputs.Close()
+	read := func(name string) string {
+		content, err := ioutil.ReadFile(filepath.Join(dir, name))
+		c.Assert(err, IsNil)
+		return string(content)
+	}
+	c.Assert(strings.Count(read("stats.csv"), "\n"), Equals, 2)
+	c.Assert(read("errors.json"), Matches, `(?s).*"db\.c".*`)
+	// the header, and the last, partial interval
+	c.Assert(strings.Count(read("series.csv"), "\n"), Equals, 2)
+	c.Assert(read("report.json"), Matches, `(?s).*"run".*`)
+
+	_, err = OpenStatsOutputs(OutputOptions{LatencyFile: filepath.Join(dir, "missing", "file")}, logger)
+	c.Assert(err, NotNil)
+}
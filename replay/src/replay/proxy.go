@@ -0,0 +1,176 @@
+package replay
+
+import (
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+// Socks5Proxy dials the servers through a SOCKS5 proxy, e.g. to reach a
+// cluster only reachable through a bastion. A dynamic SSH forward, as opened
+// by `ssh -D 1080 bastion`, is such a proxy, so it also serves as an SSH
+// tunnel.
+type Socks5Proxy struct {
+	// the proxy's <host>:<port>
+	Addr string
+	// optional, for the proxies that require a username/password login
+	Username string
+	Password string
+	Timeout  time.Duration
+}
+
+// ParseProxyURL parses a proxy in the format of
+// socks5://[<user>:<password>@]<host>:<port>.
+func ParseProxyURL(proxyURL string) (*Socks5Proxy, error) {
+	parsed, err := url.Parse(proxyURL)
+	if err != nil {
+		return nil, err
+	}
+	if parsed.Scheme != "socks5" {
+		return nil, fmt.Errorf("unsupported proxy scheme %q, expected socks5", parsed.Scheme)
+	}
+	if parsed.Port() == "" {
+		return nil, fmt.Errorf("missing port in proxy %q", proxyURL)
+	}
+	proxy := &Socks5Proxy{Addr: parsed.Host}
+	if parsed.User != nil {
+		proxy.Username = parsed.User.Username()
+		proxy.Password, _ = parsed.User.Password()
+	}
+	return proxy, nil
+}
+
+const (
+	socks5Version     = 5
+	socks5NoAuth      = 0
+	socks5UserPass    = 2
+	socks5NoMethod    = 0xff
+	socks5Connect     = 1
+	socks5DomainName  = 3
+	socks5IPv4        = 1
+	socks5IPv6        = 4
+	socks5Succeeded   = 0
+	socks5AuthVersion = 1
+)
+
+// Dial opens a connection to `addr`, a <host>:<port>, through the proxy. The
+// host is resolved by the proxy, so names only known behind the bastion work.
+func (p *Socks5Proxy) Dial(addr string) (net.Conn, error) {
+	host, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	port, err := strconv.Atoi(portStr)
+	if err != nil {
+		return nil, err
+	}
+	if len(host) > 255 {
+		return nil, fmt.Errorf("host name %q is too long for SOCKS5", host)
+	}
+
+	conn, err := net.DialTimeout("tcp", p.Addr, p.Timeout)
+	if err != nil {
+		return nil, err
+	}
+	if p.Timeout > 0 {
+		conn.SetDeadline(time.Now().Add(p.Timeout))
+	}
+	if err := p.handshake(conn, host, port); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("SOCKS5 proxy %s can't connect to %s: %v", p.Addr, addr, err)
+	}
+	conn.SetDeadline(time.Time{})
+	return conn, nil
+}
+
+// Negotiate the authentication, then ask for a connection to host:port
+// (RFC 1928 and 1929).
+func (p *Socks5Proxy) handshake(conn net.Conn, host string, port int) error {
+	method := byte(socks5NoAuth)
+	if p.Username != "" {
+		method = socks5UserPass
+	}
+	if _, err := conn.Write([]byte{socks5Version, 1, method}); err != nil {
+		return err
+	}
+	reply := make([]byte, 2)
+	if _, err := io.ReadFull(conn, reply); err != nil {
+		return err
+	}
+	if reply[0] != socks5Version {
+		return fmt.Errorf("unexpected SOCKS version %d", reply[0])
+	}
+	if reply[1] == socks5NoMethod || reply[1] != method {
+		return errors.New("no acceptable authentication method")
+	}
+
+	if method == socks5UserPass {
+		login := []byte{socks5AuthVersion, byte(len(p.Username))}
+		login = append(login, p.Username...)
+		login = append(login, byte(len(p.Password)))
+		login = append(login, p.Password...)
+		if _, err := conn.Write(login); err != nil {
+			return err
+		}
+		if _, err := io.ReadFull(conn, reply); err != nil {
+			return err
+		}
+		if reply[1] != socks5Succeeded {
+			return errors.New("authentication failed")
+		}
+	}
+
+	request := []byte{socks5Version, socks5Connect, 0, socks5DomainName, byte(len(host))}
+	request = append(request, host...)
+	request = append(request, 0, 0)
+	binary.BigEndian.PutUint16(request[len(request)-2:], uint16(port))
+	if _, err := conn.Write(request); err != nil {
+		return err
+	}
+	// version, status, reserved and address type, then the bound address
+	header := make([]byte, 4)
+	if _, err := io.ReadFull(conn, header); err != nil {
+		return err
+	}
+	if header[1] != socks5Succeeded {
+		return fmt.Errorf("connect failed with status %d", header[1])
+	}
+	var boundLen int
+	switch header[3] {
+	case socks5IPv4:
+		boundLen = net.IPv4len
+	case socks5IPv6:
+		boundLen = net.IPv6len
+	case socks5DomainName:
+		size := make([]byte, 1)
+		if _, err := io.ReadFull(conn, size); err != nil {
+			return err
+		}
+		boundLen = int(size[0])
+	default:
+		return fmt.Errorf("unexpected address type %d", header[3])
+	}
+	// the bound address and port aren't needed
+	_, err := io.ReadFull(conn, make([]byte, boundLen+2))
+	return err
+}
+
+// Connect over TLS on top of a proxied connection.
+func tlsOverProxy(conn net.Conn, addr string) (net.Conn, error) {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	tlsConn := tls.Client(conn, &tls.Config{ServerName: host})
+	if err := tlsConn.Handshake(); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return tlsConn, nil
+}
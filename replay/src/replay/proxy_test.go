@@ -0,0 +1,61 @@
+package replay
+
+import (
+	"fmt"
+	. "gopkg.in/check.v1"
+	"io"
+	"net"
+)
+
+type TestProxySuite struct{}
+
+var _ = Suite(&TestProxySuite{})
+
+func (s *TestProxySuite) TestSocks5Proxy(c *C) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	c.Assert(err, IsNil)
+	defer listener.Close()
+	// a proxy that only accepts a login, then echoes what the client sends
+	requested := make(chan string, 1)
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		read := func(n int) []byte {
+			buf := make([]byte, n)
+			io.ReadFull(conn, buf)
+			return buf
+		}
+		read(3)
+		conn.Write([]byte{5, 2})
+		user := string(read(int(read(2)[1])))
+		password := string(read(int(read(1)[0])))
+		conn.Write([]byte{1, 0})
+		host := string(read(int(read(5)[4])))
+		port := read(2)
+		requested <- fmt.Sprintf("%s:%s@%s:%d", user, password, host, int(port[0])<<8|int(port[1]))
+		conn.Write([]byte{5, 0, 0, 1, 127, 0, 0, 1, 0, 0})
+		io.Copy(conn, conn)
+	}()
+
+	proxy, err := ParseProxyURL("socks5://user:secret@" + listener.Addr().String())
+	c.Assert(err, IsNil)
+	c.Assert(proxy.Username, Equals, "user")
+	c.Assert(proxy.Password, Equals, "secret")
+	conn, err := proxy.Dial("mongo.internal:27017")
+	c.Assert(err, IsNil)
+	defer conn.Close()
+	c.Assert(<-requested, Equals, "user:secret@mongo.internal:27017")
+	conn.Write([]byte("ping"))
+	reply := make([]byte, 4)
+	_, err = io.ReadFull(conn, reply)
+	c.Assert(err, IsNil)
+	c.Assert(string(reply), Equals, "ping")
+
+	_, err = ParseProxyURL("http://proxy:8080")
+	c.Assert(err, NotNil)
+	_, err = ParseProxyURL("socks5://proxy")
+	c.Assert(err, NotNil)
+}
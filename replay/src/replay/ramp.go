@@ -0,0 +1,115 @@
+package replay
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Ramp steps up the number of active workers over the replay: Start workers
+// replay the ops at first, and one more joins them every Every, up to Max.
+// It finds the concurrency latencies start to degrade at.
+type Ramp struct {
+	Start int
+	Max   int
+	Every time.Duration
+}
+
+// ParseRamp parses a ramp in the format of <start>:<max>:<every>, e.g.
+// "1:64:30s".
+func ParseRamp(spec string) (*Ramp, error) {
+	parts := strings.Split(spec, ":")
+	if len(parts) != 3 {
+		return nil, fmt.Errorf("invalid ramp %q, expected <start>:<max>:<every>", spec)
+	}
+	start, err := strconv.Atoi(parts[0])
+	if err != nil || start <= 0 {
+		return nil, fmt.Errorf("invalid start %q in ramp %q, expected a positive number", parts[0], spec)
+	}
+	max, err := strconv.Atoi(parts[1])
+	if err != nil || max < start {
+		return nil, fmt.Errorf("invalid max %q in ramp %q, expected a number of at least %d",
+			parts[1], spec, start)
+	}
+	every, err := time.ParseDuration(parts[2])
+	if err != nil || every <= 0 {
+		return nil, fmt.Errorf("invalid step %q in ramp %q, expected a positive duration", parts[2], spec)
+	}
+	return &Ramp{Start: start, Max: max, Every: every}, nil
+}
+
+// Workers returns how many workers are active `elapsed` into the replay.
+func (r *Ramp) Workers(elapsed time.Duration) int {
+	workers := r.Start + int(elapsed/r.Every)
+	if workers > r.Max {
+		return r.Max
+	}
+	return workers
+}
+
+// Delay returns how long after the start of the replay the worker numbered
+// `worker`, starting at 0, becomes active.
+func (r *Ramp) Delay(worker int) time.Duration {
+	if worker < r.Start {
+		return 0
+	}
+	return time.Duration(worker-r.Start+1) * r.Every
+}
+
+// RampStep holds the throughput and the latencies of the ops replayed while a
+// given number of workers were active.
+type RampStep struct {
+	Workers     int
+	Duration    time.Duration
+	OpsSec      float64
+	LatencyInMs float64
+	P99         time.Duration
+}
+
+// RampRecorder breaks down the stats of a replay by the steps of its ramp.
+type RampRecorder struct {
+	steps []RampStep
+	// the stats at the end of the previous step
+	last     *StatsCollector
+	lastTime time.Time
+}
+
+// NewRampRecorder starts the first step at `start`.
+func NewRampRecorder(start time.Time) *RampRecorder {
+	return &RampRecorder{
+		last:     NewStatsCollector(),
+		lastTime: start,
+	}
+}
+
+// EndStep ends, at `now`, the step during which `workers` workers were active,
+// out of the stats collected since the start of the run.
+func (r *RampRecorder) EndStep(workers int, now time.Time, stats *StatsCollector) RampStep {
+	current := NewStatsCollector()
+	current.Add(stats)
+	step := RampStep{
+		Workers:  workers,
+		Duration: now.Sub(r.lastTime),
+		P99:      intervalPercentile(r.last, current, 0.99),
+	}
+	if step.Duration > 0 {
+		step.OpsSec = float64(current.total-r.last.total) / step.Duration.Seconds()
+	}
+	sampled, total := int64(0), time.Duration(0)
+	for _, opType := range AllOpTypes {
+		sampled += current.sampled[opType] - r.last.sampled[opType]
+		total += current.durations[opType] - r.last.durations[opType]
+	}
+	if sampled > 0 {
+		step.LatencyInMs = total.Seconds() / float64(sampled) * 1000
+	}
+	r.steps = append(r.steps, step)
+	r.last, r.lastTime = current, now
+	return step
+}
+
+// Steps returns the steps ended so far.
+func (r *RampRecorder) Steps() []RampStep {
+	return r.steps
+}
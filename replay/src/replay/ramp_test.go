@@ -0,0 +1,42 @@
+package replay
+
+import (
+	. "gopkg.in/check.v1"
+	"time"
+)
+
+type TestRampSuite struct{}
+
+var _ = Suite(&TestRampSuite{})
+
+func (s *TestRampSuite) TestRamp(c *C) {
+	ramp, err := ParseRamp("2:4:30s")
+	c.Assert(err, IsNil)
+	c.Assert(*ramp, Equals, Ramp{Start: 2, Max: 4, Every: 30 * time.Second})
+	c.Assert(ramp.Workers(0), Equals, 2)
+	c.Assert(ramp.Workers(45*time.Second), Equals, 3)
+	c.Assert(ramp.Workers(time.Hour), Equals, 4)
+	c.Assert(ramp.Delay(1), Equals, time.Duration(0))
+	c.Assert(ramp.Delay(2), Equals, 30*time.Second)
+	c.Assert(ramp.Delay(3), Equals, time.Minute)
+	for _, spec := range []string{"", "1:64", "0:4:1s", "4:2:1s", "1:4:0s", "1:4:x"} {
+		_, err := ParseRamp(spec)
+		c.Assert(err, NotNil)
+	}
+
+	start := time.Unix(1500000000, 0)
+	stats := NewStatsCollector()
+	recorder := NewRampRecorder(start)
+	replayOps(stats, Query, 10, 0)
+	step := recorder.EndStep(2, start.Add(2*time.Second), stats)
+	c.Assert(step.Workers, Equals, 2)
+	c.Assert(step.OpsSec, Equals, 5.0)
+	c.Assert(step.LatencyInMs > 0, Equals, true)
+	c.Assert(step.P99 > 0, Equals, true)
+	// nothing replayed in the next step
+	step = recorder.EndStep(3, start.Add(3*time.Second), stats)
+	c.Assert(step.OpsSec, Equals, 0.0)
+	c.Assert(step.LatencyInMs, Equals, 0.0)
+	c.Assert(step.P99, Equals, time.Duration(0))
+	c.Assert(recorder.Steps(), HasLen, 2)
+}
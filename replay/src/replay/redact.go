@@ -0,0 +1,254 @@
+package replay
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"strings"
+	"sync/atomic"
+)
+
+// RedactStrategy says how a redacted field is rewritten.
+type RedactStrategy string
+
+const (
+	// replace the value with a hash of it, so equal values stay equal
+	RedactHash RedactStrategy = "hash"
+	// drop the field
+	RedactRemove RedactStrategy = "remove"
+	// replace the value with a fixed string
+	RedactConstant RedactStrategy = "constant"
+)
+
+// RedactRule rewrites the field at Path, a dotted path such as
+// "address.zip", of the documents written by the ops.
+type RedactRule struct {
+	Path     string
+	Strategy RedactStrategy
+	// the replacement of RedactConstant
+	Value string
+}
+
+// ParseRedactRules parses rules in the format of
+// <path>=hash|remove|constant:<value>[,...], e.g.
+// "email=hash,ssn=remove,name=constant:redacted".
+func ParseRedactRules(spec string) ([]RedactRule, error) {
+	rules := []RedactRule{}
+	if spec == "" {
+		return rules, nil
+	}
+	for _, target := range strings.Split(spec, ",") {
+		parts := strings.SplitN(target, "=", 2)
+		if len(parts) != 2 || strings.TrimSpace(parts[0]) == "" {
+			return nil, fmt.Errorf("invalid redaction %q, expected <path>=<strategy>", target)
+		}
+		rule := RedactRule{Path: strings.TrimSpace(parts[0])}
+		strategy := strings.SplitN(strings.TrimSpace(parts[1]), ":", 2)
+		rule.Strategy = RedactStrategy(strategy[0])
+		switch rule.Strategy {
+		case RedactHash, RedactRemove:
+		case RedactConstant:
+			if len(strategy) == 2 {
+				rule.Value = strategy[1]
+			}
+		default:
+			return nil, fmt.Errorf("unknown strategy %q in redaction %q, expected hash, remove or constant",
+				strategy[0], target)
+		}
+		rules = append(rules, rule)
+	}
+	return rules, nil
+}
+
+// Redactor rewrites the fields of the documents inserted or updated by ops,
+// e.g. to keep personal data out of a staging target. It can be shared by
+// several readers, to count the redacted ops over all of them.
+type Redactor struct {
+	rules    []RedactRule
+	redacted int64
+}
+
+func NewRedactor(rules ...RedactRule) *Redactor {
+	return &Redactor{rules: rules}
+}
+
+// Redacted returns how many ops had at least one field rewritten.
+func (r *Redactor) Redacted() int64 {
+	return atomic.LoadInt64(&r.redacted)
+}
+
+// Redact rewrites the fields of the documents written by `op` in place. The
+// rules apply to inserted documents, to replacement documents, and to the
+// fields set by update operators such as $set.
+func (r *Redactor) Redact(op *Op) {
+	redacted := false
+	for _, doc := range writtenDocs(op) {
+		for _, rule := range r.rules {
+			if redactPath(doc, strings.Split(rule.Path, "."), rule) {
+				redacted = true
+			}
+			// update operators, e.g. {"$set": {"address.zip": ...}}
+			for key, val := range doc {
+				fields, ok := val.(map[string]interface{})
+				if !ok || !strings.HasPrefix(key, "$") {
+					continue
+				}
+				if _, exist := fields[rule.Path]; exist {
+					redactField(fields, rule.Path, rule)
+					redacted = true
+				} else if redactPath(fields, strings.Split(rule.Path, "."), rule) {
+					redacted = true
+				}
+			}
+		}
+	}
+	if redacted {
+		atomic.AddInt64(&r.redacted, 1)
+	}
+}
+
+// RedactQuery returns a copy of the query document of an op, e.g. its filter,
+// with the fields of the rules rewritten, including the dotted ones such as
+// {"address.zip": ...}. The query itself is left alone.
+func (r *Redactor) RedactQuery(query map[string]interface{}) map[string]interface{} {
+	redacted := copyValue(query).(map[string]interface{})
+	for _, rule := range r.rules {
+		if _, exist := redacted[rule.Path]; exist {
+			redactField(redacted, rule.Path, rule)
+		} else {
+			redactPath(redacted, strings.Split(rule.Path, "."), rule)
+		}
+	}
+	return redacted
+}
+
+// A deep copy of the documents and arrays of a recorded value.
+func copyValue(val interface{}) interface{} {
+	switch typedVal := val.(type) {
+	case map[string]interface{}:
+		copied := make(map[string]interface{}, len(typedVal))
+		for key, item := range typedVal {
+			copied[key] = copyValue(item)
+		}
+		return copied
+	case Document:
+		return copyValue(map[string]interface{}(typedVal))
+	case []interface{}:
+		copied := make([]interface{}, len(typedVal))
+		for i, item := range typedVal {
+			copied[i] = copyValue(item)
+		}
+		return copied
+	}
+	return val
+}
+
+// The documents an op writes, as recorded, i.e. before canonicalizeOp().
+func writtenDocs(op *Op) []map[string]interface{} {
+	docs := []map[string]interface{}{}
+	add := func(val interface{}) {
+		if doc, ok := val.(map[string]interface{}); ok {
+			docs = append(docs, doc)
+		}
+	}
+	// the inserts of several documents at once
+	if many, ok := op.Content["o"].([]interface{}); ok && op.Type == Insert {
+		for _, doc := range many {
+			add(doc)
+		}
+		return docs
+	}
+	switch op.Type {
+	case Insert:
+		add(op.Content["o"])
+	case Update:
+		add(op.Content["updateobj"])
+	case Command:
+		cmd, _ := op.Content["command"].(map[string]interface{})
+		if _, ok := cmd["findandmodify"]; ok {
+			add(cmd["update"])
+		}
+	}
+	return docs
+}
+
+// Redact the field at `path` of `doc`. Returns false if there is no such
+// field.
+func redactPath(doc map[string]interface{}, path []string, rule RedactRule) bool {
+	val, exist := doc[path[0]]
+	if !exist {
+		return false
+	}
+	if len(path) == 1 {
+		redactField(doc, path[0], rule)
+		return true
+	}
+	switch typedVal := val.(type) {
+	case map[string]interface{}:
+		return redactPath(typedVal, path[1:], rule)
+	case []interface{}:
+		// the path applies to the sub-documents of arrays
+		redacted := false
+		for _, item := range typedVal {
+			if subDoc, ok := item.(map[string]interface{}); ok && redactPath(subDoc, path[1:], rule) {
+				redacted = true
+			}
+		}
+		return redacted
+	}
+	return false
+}
+
+func redactField(doc map[string]interface{}, key string, rule RedactRule) {
+	switch rule.Strategy {
+	case RedactRemove:
+		delete(doc, key)
+	case RedactConstant:
+		doc[key] = rule.Value
+	case RedactHash:
+		sum := sha256.Sum256([]byte(fmt.Sprint(doc[key])))
+		doc[key] = hex.EncodeToString(sum[:16])
+	}
+}
+
+// RedactingOpsReader redacts the ops of another reader before passing them on.
+type RedactingOpsReader struct {
+	reader   OpsReader
+	redactor *Redactor
+}
+
+func NewRedactingOpsReader(reader OpsReader, redactor *Redactor) *RedactingOpsReader {
+	return &RedactingOpsReader{reader, redactor}
+}
+
+func (self *RedactingOpsReader) Next() *Op {
+	op := self.reader.Next()
+	if op != nil {
+		self.redactor.Redact(op)
+	}
+	return op
+}
+
+func (self *RedactingOpsReader) SkipOps(numSkipOps int) error {
+	return self.reader.SkipOps(numSkipOps)
+}
+
+func (self *RedactingOpsReader) SetStartTime(startTime int64) (int64, error) {
+	return self.reader.SetStartTime(startTime)
+}
+
+func (self *RedactingOpsReader) OpsRead() int {
+	return self.reader.OpsRead()
+}
+
+func (self *RedactingOpsReader) AllLoaded() bool {
+	return self.reader.AllLoaded()
+}
+
+func (self *RedactingOpsReader) Err() error {
+	return self.reader.Err()
+}
+
+func (self *RedactingOpsReader) Close() {
+	self.reader.Close()
+}
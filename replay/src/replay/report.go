@@ -0,0 +1,299 @@
+package replay
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Sampled latencies are distorted when sampling itself takes more than this
+// share of them.
+const maxTimingOverhead = 0.1
+
+// GC pauses are worth a warning past this share of the run.
+const maxGCShare = 0.01
+
+// SLA sets, for some op types, the P99 latency they are expected to stay
+// under.
+type SLA map[OpType]time.Duration
+
+// ParseSLA parses SLA targets in the format of
+// "<op type>=<duration>[,<op type>=<duration>...]", e.g. "query=50ms,update=0.1s".
+func ParseSLA(spec string) (SLA, error) {
+	sla := SLA{}
+	if spec == "" {
+		return sla, nil
+	}
+	for _, target := range strings.Split(spec, ",") {
+		parts := strings.SplitN(target, "=", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("invalid SLA target %q, expected <op type>=<duration>", target)
+		}
+		opType := OpType(strings.TrimSpace(parts[0]))
+		if !isKnownOpType(opType) {
+			return nil, fmt.Errorf("unknown op type %q in SLA target %q", opType, target)
+		}
+		duration, err := time.ParseDuration(strings.TrimSpace(parts[1]))
+		if err != nil {
+			return nil, fmt.Errorf("invalid duration in SLA target %q: %v", target, err)
+		}
+		sla[opType] = duration
+	}
+	return sla, nil
+}
+
+func isKnownOpType(opType OpType) bool {
+	for _, known := range AllOpTypes {
+		if known == opType {
+			return true
+		}
+	}
+	return false
+}
+
+// Report logs the execution status: the overall throughput, the op mix and
+// the latency percentiles of each op type the stats are broken down by. Op
+// types with a target in `sla` are marked as passing or failing it.
+func Report(status *ExecutionStatus, sla SLA, logger *Logger) {
+	logger.Infof("Executed %d ops, %.2f ops/sec (avg), %.2f ops/sec (last)", status.OpsExecuted,
+		status.OpsPerSec, status.OpsPerSecLast)
+	logger.Infof("Ops waiting for a worker: %d", status.QueueDepth)
+	if status.TimeToFirstOp > 0 {
+		logger.Infof("First op ran %v after the start; the slowest session took %v to connect, "+
+			"authenticate and discover the topology", status.TimeToFirstOp, status.SlowestDial)
+	}
+	if waits := status.PoolWaits; waits.Count > 0 {
+		logger.Infof("Waited for a free connection %d times, %v in total, %d timeouts; "+
+			"consider raising maxPoolSize in the url", waits.Count, waits.Time, waits.Timeouts)
+	}
+	if pauses := status.GCPauses; pauses.Count > 0 && status.Duration > 0 {
+		share := float64(pauses.Time) / float64(status.Duration)
+		logger.Infof("GC paused flashback %d times, %v in total (%.1f%% of the run), at most %v",
+			pauses.Count, pauses.Time, share*100, pauses.Max)
+		if share > maxGCShare {
+			logger.Errorf("Warning: GC pauses take a significant share of the run, so some latency " +
+				"spikes are flashback's own; consider lowering the sample rate")
+		}
+	}
+	logger.Infof("Op mix: %s (%.0f%% writes)", FormatOpMix(status.OpMix),
+		status.WriteRatio*100)
+	if len(status.ErrorCodes) > 0 {
+		logger.Infof("Error codes: %s", FormatErrorCodes(status.ErrorCodes))
+	}
+	for _, resolution := range []IdConflict{IdConflictSkip, IdConflictReplace} {
+		if count := status.IdConflicts[resolution]; count > 0 {
+			logger.Infof("Inserts with an existing _id (%s): %d", resolution, count)
+		}
+	}
+	if status.OrphanGetMores > 0 {
+		logger.Infof("GetMores on cursors not opened by the replay: %d", status.OrphanGetMores)
+	}
+	if workers := len(status.WorkerCounts); status.Duration > 0 && workers > 0 {
+		busy := float64(status.ServiceTime) / float64(status.Duration*time.Duration(workers)) * 100
+		if status.IdleTime > 0 {
+			logger.Infof("Slept %v waiting for the ops to be due (%.0f%% of the run); "+
+				"the workers were busy serving ops %.0f%% of the time", status.IdleTime,
+				float64(status.IdleTime)/float64(status.Duration)*100, busy)
+		} else {
+			logger.Infof("The workers were busy serving ops %.0f%% of the time", busy)
+		}
+	}
+	if status.MaxScheduleDriftInMs > 0 {
+		logger.Infof("Schedule drift: avg %.2fms, max %.2fms behind the recorded timing",
+			status.ScheduleDriftInMs, status.MaxScheduleDriftInMs)
+	}
+	if status.CursorTimeouts > 0 {
+		logger.Infof("Queries whose cursor timed out: %d", status.CursorTimeouts)
+	}
+	if status.StepdownRetries > 0 {
+		logger.Infof("Ops retried after a primary stepdown: %d", status.StepdownRetries)
+	}
+	if status.Malformed > 0 {
+		logger.Infof("Malformed ops skipped: %d", status.Malformed)
+	}
+
+	opTypes := status.OpTypes
+	if opTypes == nil {
+		opTypes = AllOpTypes
+	}
+	for _, opType := range opTypes {
+		allTime := status.AllTimeLatencies[opType]
+		sinceLast := status.SinceLastLatencies[opType]
+		logger.Infof("  Op type: %s, count: %d, avg ops/sec: %.2f, last ops/sec: %.2f, avg queue time: %.2fms, sampled: %.1f%%",
+			opType, status.Counts[opType],
+			status.TypeOpsSec[opType], status.TypeOpsSecLast[opType],
+			status.QueueTimeInMs[opType], status.SampleRates[opType]*100)
+		template := "   %s: P50: %.2fms, P70: %.2fms, P90: %.2fms, " +
+			"P95 %.2fms, P99 %.2fms, Max %.2fms\n"
+		logger.Infof(template, "Total", nanoToMs(allTime[P50]),
+			nanoToMs(allTime[P70]), nanoToMs(allTime[P90]),
+			nanoToMs(allTime[P95]), nanoToMs(allTime[P99]),
+			nanoToMs(allTime[P100]))
+		logger.Infof(template, "Last ", nanoToMs(sinceLast[P50]),
+			nanoToMs(sinceLast[P70]), nanoToMs(sinceLast[P90]),
+			nanoToMs(sinceLast[P95]), nanoToMs(sinceLast[P99]),
+			nanoToMs(sinceLast[P100]))
+		if tail := status.TailLatenciesInMs[opType]; len(tail) == 2 && tail[0] > 0 {
+			logger.Infof("   Tail: P99.9 <= %.2fms, P99.99 <= %.2fms", tail[0], tail[1])
+		}
+		if errors := status.Errors[opType]; len(errors) > 0 {
+			logger.Infof("   Errors: %s", FormatErrors(errors))
+		}
+		if timeouts := status.Timeouts[opType]; timeouts > 0 {
+			logger.Infof("   Timed out: %d", timeouts)
+		}
+		if expired := status.MaxTimeExpired[opType]; expired > 0 {
+			logger.Infof("   Aborted by the server past maxTimeMS: %d", expired)
+		}
+		if mismatches := status.ResultMismatches[opType]; mismatches > 0 {
+			logger.Infof("   Result mismatches: %d", mismatches)
+		}
+		if sizes := status.DocSizes[opType]; sizes != nil {
+			logger.Infof("   Doc sizes: P50 <= %s, P90 <= %s, P99 <= %s, Max <= %s",
+				formatBytes(SizePercentile(sizes, 0.5)), formatBytes(SizePercentile(sizes, 0.9)),
+				formatBytes(SizePercentile(sizes, 0.99)), formatBytes(SizePercentile(sizes, 1)))
+		}
+		if p50 := time.Duration(allTime[P50]); p50 > 0 &&
+			float64(status.TimingOverhead) > maxTimingOverhead*float64(p50) {
+			logger.Errorf("   Warning: sampling takes %.4fms per op, %.0f%% of the %s P50 latency; "+
+				"consider lowering the sample rate", nanoToMs(int64(status.TimingOverhead)),
+				100*float64(status.TimingOverhead)/float64(p50), opType)
+		}
+		if target, ok := sla[opType]; ok {
+			logger.Infof("   SLA: %s", slaMarker(time.Duration(allTime[P99]), target))
+		}
+	}
+}
+
+// ReportLabels logs the count, throughput and latency of the ops of each
+// label, e.g. of each namespace, in alphabetical order. With `slowest` above 0,
+// only that many labels are logged, the slowest first.
+func ReportLabels(status *ExecutionStatus, slowest int, logger *Logger) {
+	for _, label := range SortLabels(status.LabelLatencyInMs, slowest) {
+		logger.Infof("  Label: %s, count: %d, %.2f ops/sec, avg latency: %.2fms", label,
+			status.LabelCounts[label], status.LabelOpsSec[label], status.LabelLatencyInMs[label])
+	}
+}
+
+// SortLabels returns the labels of `latencies` in alphabetical order, or the
+// `slowest` ones by latency, the slowest first, if `slowest` is above 0.
+func SortLabels(latencies map[string]float64, slowest int) []string {
+	labels := make([]string, 0, len(latencies))
+	for label := range latencies {
+		labels = append(labels, label)
+	}
+	sort.Strings(labels)
+	if slowest <= 0 {
+		return labels
+	}
+	sort.SliceStable(labels, func(i, j int) bool {
+		return latencies[labels[i]] > latencies[labels[j]]
+	})
+	if len(labels) > slowest {
+		labels = labels[:slowest]
+	}
+	return labels
+}
+
+// ReportShadow logs, for each op type, how the average and P99 latencies of
+// the shadow of a shadow replay compare with the target's, and how many ops
+// the two served differently.
+func ReportShadow(target *StatsCollector, shadow *StatsCollector, diffs *ShadowDiffs, logger *Logger) {
+	counts := diffs.Counts()
+	logger.Infof("Shadow replay: %d ops on the target, %d on the shadow", target.Total(), shadow.Total())
+	for _, opType := range target.OpTypes() {
+		if target.Count(opType) == 0 && shadow.Count(opType) == 0 {
+			continue
+		}
+		avg, shadowAvg := target.LatencyInMs(opType), shadow.LatencyInMs(opType)
+		p99, shadowP99 := target.LatencyPercentileInMs(opType, 0.99), shadow.LatencyPercentileInMs(opType, 0.99)
+		logger.Infof("  Op type: %s, avg: %.2fms -> %.2fms (%s), P99: %.2fms -> %.2fms (%s), mismatches: %d",
+			opType, avg, shadowAvg, formatDelta(avg, shadowAvg), p99, shadowP99,
+			formatDelta(p99, shadowP99), counts[opType])
+	}
+}
+
+// Format the change from `before` to `after`, e.g. "+12%".
+func formatDelta(before float64, after float64) string {
+	if before == 0 || math.IsInf(before, 0) || math.IsInf(after, 0) {
+		return "n/a"
+	}
+	return fmt.Sprintf("%+.0f%%", (after-before)/before*100)
+}
+
+// Format a document size bucket bound, e.g. "4KB".
+func formatBytes(size int64) string {
+	switch {
+	case size == math.MaxInt64:
+		return "+Inf"
+	case size >= 1<<20:
+		return fmt.Sprintf("%dMB", size>>20)
+	case size >= 1<<10:
+		return fmt.Sprintf("%dKB", size>>10)
+	}
+	return fmt.Sprintf("%dB", size)
+}
+
+// ReportWorkers logs the throughput and latency of each worker, so a worker
+// lagging behind the others stands out.
+func ReportWorkers(status *ExecutionStatus, logger *Logger) {
+	for i := range status.WorkerCounts {
+		logger.Infof("  Worker #%d: %d ops, %.2f ops/sec, avg latency: %.2fms", i,
+			status.WorkerCounts[i], status.WorkerOpsSec[i], status.WorkerLatencyInMs[i])
+	}
+}
+
+// FormatErrors renders the failed ops of an op type as
+// "5 (network: 1, timeout: 4)", in the order of ErrorClasses.
+func FormatErrors(errors map[ErrorClass]int64) string {
+	total := int64(0)
+	parts := []string{}
+	for _, class := range ErrorClasses {
+		if count := errors[class]; count > 0 {
+			total += count
+			parts = append(parts, fmt.Sprintf("%s: %d", class, count))
+		}
+	}
+	return fmt.Sprintf("%d (%s)", total, strings.Join(parts, ", "))
+}
+
+// FormatErrorCodes renders error code counts as "11000: 12, 50: 3, client: 1",
+// most frequent first. Errors that didn't come from the server are counted as
+// "client".
+func FormatErrorCodes(errorCodes map[int]int64) string {
+	codes := make([]int, 0, len(errorCodes))
+	for code := range errorCodes {
+		codes = append(codes, code)
+	}
+	sort.Slice(codes, func(i, j int) bool {
+		if errorCodes[codes[i]] != errorCodes[codes[j]] {
+			return errorCodes[codes[i]] > errorCodes[codes[j]]
+		}
+		return codes[i] < codes[j]
+	})
+	parts := make([]string, 0, len(codes))
+	for _, code := range codes {
+		name := strconv.Itoa(code)
+		if code == 0 {
+			name = "client"
+		}
+		parts = append(parts, fmt.Sprintf("%s: %d", name, errorCodes[code]))
+	}
+	return strings.Join(parts, ", ")
+}
+
+func slaMarker(p99 time.Duration, target time.Duration) string {
+	if p99 <= target {
+		return fmt.Sprintf("PASS, P99 %.2fms <= %.2fms", nanoToMs(int64(p99)),
+			nanoToMs(int64(target)))
+	}
+	return fmt.Sprintf("FAIL, P99 %.2fms over %.2fms by %.2fms", nanoToMs(int64(p99)),
+		nanoToMs(int64(target)), nanoToMs(int64(p99-target)))
+}
+
+func nanoToMs(nano int64) float64 {
+	return float64(nano) / float64(1e6)
+}
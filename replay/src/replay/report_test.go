@@ -0,0 +1,62 @@
+package replay
+
+import (
+	. "gopkg.in/check.v1"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+type TestReportSuite struct{}
+
+var _ = Suite(&TestReportSuite{})
+
+func (s *TestReportSuite) TestSLA(c *C) {
+	sla, err := ParseSLA("query=50ms, insert=0.1s")
+	c.Assert(err, IsNil)
+	c.Assert(sla, DeepEquals, SLA{Query: 50 * time.Millisecond, Insert: 100 * time.Millisecond})
+	for _, spec := range []string{"query", "nosuchop=1s", "query=fast"} {
+		_, err := ParseSLA(spec)
+		c.Assert(err, NotNil, Commentf(spec))
+	}
+
+	latencies := func(p99 time.Duration) []int64 {
+		latencies := make([]int64, P100+1)
+		latencies[P99] = int64(p99)
+		return latencies
+	}
+	// the queries stay under their target, the inserts don't, and the updates
+	// have none
+	status := &ExecutionStatus{
+		OpTypes: []OpType{Query, Insert, Update},
+		AllTimeLatencies: map[OpType][]int64{
+			Query:  latencies(40 * time.Millisecond),
+			Insert: latencies(150 * time.Millisecond),
+			Update: latencies(time.Second),
+		},
+		SinceLastLatencies: map[OpType][]int64{
+			Query:  latencies(0),
+			Insert: latencies(0),
+			Update: latencies(0),
+		},
+	}
+	filename := filepath.Join(c.MkDir(), "report.log")
+	logger, err := NewLogger(filename, "")
+	c.Assert(err, IsNil)
+	Report(status, sla, logger)
+	logger.Close()
+
+	content, err := ioutil.ReadFile(filename)
+	c.Assert(err, IsNil)
+	results := []string{}
+	for _, line := range strings.Split(string(content), "\n") {
+		if i := strings.Index(line, "SLA: "); i >= 0 {
+			results = append(results, line[i:])
+		}
+	}
+	c.Assert(results, DeepEquals, []string{
+		"SLA: PASS, P99 40.00ms <= 50.00ms",
+		"SLA: FAIL, P99 150.00ms over 100.00ms by 50.00ms",
+	})
+}
@@ -0,0 +1,79 @@
+package replay
+
+import (
+	"encoding/json"
+	"sync/atomic"
+)
+
+// ResultComparator checks the results of replayed queries and findAndModify
+// commands against the results captured in the recording. It can be shared
+// by the executors of all the workers.
+type ResultComparator struct {
+	logger *Logger
+	// how many mismatches are logged in detail, and how many were so far
+	maxLogged int64
+	logged    int64
+}
+
+// The longest document dump included in a mismatch log message.
+const maxLoggedResultLen = 512
+
+func NewResultComparator(logger *Logger, maxLogged int) *ResultComparator {
+	return &ResultComparator{
+		logger:    logger,
+		maxLogged: int64(maxLogged),
+	}
+}
+
+// Compare reports whether a replayed result matches the recorded one. Ops
+// whose result wasn't recorded always match. When only the number of
+// returned documents was recorded, just that number is compared.
+func (c *ResultComparator) Compare(op *Op, result interface{}) bool {
+	if recorded, ok := op.Recorded["result"]; ok {
+		recordedJson, replayedJson := canonicalJson(recorded), canonicalJson(result)
+		if recordedJson == replayedJson {
+			return true
+		}
+		c.logMismatch(op, recordedJson, replayedJson)
+		return false
+	}
+
+	nreturned, ok := op.Recorded["nreturned"].(float64)
+	docs, isList := result.(*[]Document)
+	if !ok || !isList || int(nreturned) == len(*docs) {
+		return true
+	}
+	c.logMismatch(op, canonicalJson(int(nreturned))+" documents",
+		canonicalJson(len(*docs))+" documents")
+	return false
+}
+
+func (c *ResultComparator) logMismatch(op *Op, recorded string, replayed string) {
+	if c.logger == nil || atomic.AddInt64(&c.logged, 1) > c.maxLogged {
+		return
+	}
+	c.logger.Errorf("result mismatch - type:%s,database:%s,collection:%s\n"+
+		"  recorded: %s\n  replayed: %s", op.Type, op.Database, op.Collection,
+		truncate(recorded, maxLoggedResultLen), truncate(replayed, maxLoggedResultLen))
+}
+
+// canonicalJson renders a result in a form that compares equal for equal
+// documents, whether they were parsed from the recording or read from the
+// server: map keys are sorted, and all numbers are rendered alike.
+func canonicalJson(result interface{}) string {
+	if docs, ok := result.(*[]Document); ok {
+		result = *docs
+	}
+	text, err := json.Marshal(result)
+	if err != nil {
+		return err.Error()
+	}
+	return string(text)
+}
+
+func truncate(text string, length int) string {
+	if len(text) <= length {
+		return text
+	}
+	return text[:length] + "..."
+}
@@ -0,0 +1,38 @@
+package replay
+
+import (
+	"github.com/globalsign/mgo/bson"
+	. "gopkg.in/check.v1"
+)
+
+type TestResultComparatorSuite struct{}
+
+var _ = Suite(&TestResultComparatorSuite{})
+
+func (s *TestResultComparatorSuite) TestCompareResults(c *C) {
+	cmd, err := parseJson(`{"ts": {"$date": 1396456709472}, "ns": "db.c1", "op": "query", ` +
+		`"query": {"a": 1}, "result": [{"_id": {"$oid": "533c3d03c23fffd217678ee8"}, ` +
+		`"a": 1, "b": {"c": "d"}}]}`)
+	c.Assert(err, IsNil)
+	op := makeOp(cmd)
+	comparator := NewResultComparator(nil, 0)
+
+	// numbers and sub-documents decoded from BSON compare equal to the
+	// recorded ones
+	replayed := []Document{{
+		"b":   bson.M{"c": "d"},
+		"a":   1,
+		"_id": bson.ObjectIdHex("533c3d03c23fffd217678ee8"),
+	}}
+	c.Assert(comparator.Compare(op, &replayed), Equals, true)
+	replayed[0]["a"] = 2
+	c.Assert(comparator.Compare(op, &replayed), Equals, false)
+
+	cmd, err = parseJson(`{"ts": {"$date": 1396456709472}, "ns": "db.c1", "op": "query", ` +
+		`"query": {"a": 1}, "nreturned": 1}`)
+	c.Assert(err, IsNil)
+	op = makeOp(cmd)
+	c.Assert(comparator.Compare(op, &replayed), Equals, true)
+	replayed = append(replayed, Document{})
+	c.Assert(comparator.Compare(op, &replayed), Equals, false)
+}
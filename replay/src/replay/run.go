@@ -0,0 +1,538 @@
+package replay
+
+import (
+	"context"
+	"errors"
+	"github.com/globalsign/mgo"
+	"math"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ReplayOptions configures Replay. The zero value of each field leaves its
+// feature off, or picks the default it mentions.
+type ReplayOptions struct {
+	// The target, and the timeouts of the sessions to it.
+	Session SessionOptions
+
+	// How many workers replay the ops concurrently. Defaults to 1, or to the
+	// max of the ramp.
+	Workers int
+	// Step up the number of active workers over the replay.
+	Ramp *Ramp
+
+	// "real" replays the ops at the pace they were recorded, "stress" as fast
+	// as possible. Defaults to "real".
+	Style string
+	// How many times as fast as recorded the real style replays the ops.
+	// Defaults to 1.
+	Speed float64
+	// Computes the wait between two ops in the real style in place of Speed,
+	// e.g. to cap the idle gaps of the recording.
+	Scaler TimeScaler
+	// How many ops the stress style reads ahead of the workers; 0 to read
+	// them as fast as possible.
+	QueueSize int
+	// Read at most MaxOps ops, counted before the Filters. Defaults to all
+	// of them.
+	MaxOps int
+	// Dispatch at most Limit ops, counted after the Filters, then stop as if
+	// the ops ran out, e.g. for quick smoke tests. Defaults to all of them.
+	Limit int
+	// Start from the first op at or after this time, in seconds since the
+	// epoch, then skip the first SkipOps ops.
+	StartTime int64
+	SkipOps   int
+
+	// The ops dropped before the replay. The filters see the ops as
+	// recorded, before they are redacted or moved into TargetDb.
+	Filters []*OpFilter
+	// Redacts the fields of the documents of the ops.
+	Redactor *Redactor
+	// Replay all the ops into this database.
+	TargetDb string
+
+	// The latencies sampled per op type, and how many of them the analysis
+	// keeps; defaults to every one of them. See StatsCollector.
+	SampleRate    float64
+	SampleRates   map[OpType]float64
+	Downsample    int
+	Deterministic bool
+
+	// How long each op type may take before its op is abandoned, and the
+	// maxTimeMS set on the reads. See OpsExecutor.
+	Timeouts     OpTimeouts
+	MaxTime      time.Duration
+	StepdownWait time.Duration
+
+	// The settings of the workers' executors; see OpsExecutor.
+	IdConflict         IdConflict
+	FailOrphanGetMores bool
+	MapCursors         bool
+	CausalConsistency  bool
+	Comment            string
+	Labeler            OpLabeler
+	Comparator         *ResultComparator
+	Explainer          *SlowOpExplainer
+	Tracer             *OpTracer
+	SlowOps            *SlowOpLog
+	Inserts            *InsertCounts
+
+	// Also replay each op against this server, and compare the outcomes in
+	// ShadowDiffs, made by Replay if nil.
+	ShadowURL   string
+	ShadowDiffs *ShadowDiffs
+
+	// Stop the replay at the first malformed op, and return it as the error.
+	// Otherwise malformed ops are logged and skipped.
+	Strict bool
+
+	// Holds the workers back from taking new ops while paused.
+	Gate *PauseGate
+	// Measures how long the replay took to get going; made by Replay, from the
+	// start of the run, if nil.
+	Readiness *Readiness
+
+	// How often the status of the replay is reported. Defaults to 5s.
+	ReportEvery time.Duration
+	Hooks       ReplayHooks
+	// The files and the exporters the stats are written to as the replay
+	// goes, see OpenStatsOutputs.
+	Outputs *StatsOutputs
+	// Defaults to logging to stdout and stderr.
+	Logger *Logger
+}
+
+// ReplayHooks are called by Replay as the replay goes. Each of them is optional.
+type ReplayHooks struct {
+	// Once the workers are started, with the stats collectors the workers
+	// record into, and the one of each worker's shadow replay if any, to
+	// follow the replay as it goes.
+	Started func(workers []*StatsCollector, shadow []*StatsCollector)
+	// With each sampled latency, before it's analyzed.
+	Sampled func(latency Latency)
+	// After each op, with the error it failed with.
+	Executed func(op *Op, err error)
+	// Every ReportEvery with the status of the replay, and once more at the
+	// end.
+	Report func(status *ExecutionStatus)
+	// Once all the workers are done, before the last report.
+	Done func()
+}
+
+// Replay replays the ops of `reader` according to `opts`, until they run out or
+// `ctx` is done. It returns the combined stats of the workers.
+func Replay(ctx context.Context, reader OpsReader, opts ReplayOptions) (*StatsCollector, error) {
+	logger := opts.Logger
+	if logger == nil {
+		var err error
+		if logger, err = NewLogger("", ""); err != nil {
+			return nil, err
+		}
+	}
+	workers := opts.Workers
+	if opts.Ramp != nil {
+		workers = opts.Ramp.Max
+	}
+	if workers <= 0 {
+		workers = 1
+	}
+	// no more than MaxOps ops are read, so no more are dispatched either
+	limit := opts.Limit
+	if limit <= 0 || opts.MaxOps > 0 && opts.MaxOps < limit {
+		limit = opts.MaxOps
+	}
+	if limit <= 0 {
+		limit = math.MaxUint32
+	}
+	downsample := opts.Downsample
+	if downsample <= 0 {
+		downsample = 1
+	}
+	reportEvery := opts.ReportEvery
+	if reportEvery <= 0 {
+		reportEvery = 5 * time.Second
+	}
+	readiness := opts.Readiness
+	if readiness == nil {
+		readiness = NewReadiness(time.Now())
+	}
+	gate := opts.Gate
+	if gate == nil {
+		gate = NewPauseGate()
+	}
+	hooks := opts.Hooks
+	if opts.Outputs != nil {
+		hooks = opts.Outputs.hook(hooks, gate)
+	}
+
+	// Malformed ops in strict mode, and failed dials, stop the replay
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	var failure error
+	var failOnce sync.Once
+	fail := func(err error) {
+		failOnce.Do(func() {
+			failure = err
+			cancel()
+		})
+	}
+
+	opsChan, idle, err := dispatchOps(ctx, reader, opts, limit, logger)
+	if err != nil {
+		return nil, err
+	}
+
+	latencyChan := make(chan Latency, workers)
+	// The analyzer reads the latencies from here; they go through the
+	// Sampled hook first if there's one.
+	analyzedChan := latencyChan
+	latenciesHooked := make(chan struct{})
+	if hooks.Sampled != nil {
+		analyzedChan = make(chan Latency, workers)
+		go func() {
+			defer close(latenciesHooked)
+			for latency := range latencyChan {
+				hooks.Sampled(latency)
+				analyzedChan <- latency
+			}
+			close(analyzedChan)
+		}()
+	} else {
+		close(latenciesHooked)
+	}
+
+	var cursors, shadowCursors *CursorMap
+	if opts.MapCursors {
+		cursors, shadowCursors = NewCursorMap(), NewCursorMap()
+	}
+	var clock *ClusterClock
+	if opts.CausalConsistency {
+		clock = NewClusterClock()
+	}
+	shadowDiffs := opts.ShadowDiffs
+	if opts.ShadowURL != "" && shadowDiffs == nil {
+		shadowDiffs = NewShadowDiffs(logger, 10)
+	}
+	// the shadow target runs its DDL ops apart from the target's
+	ddl, shadowDDL := NewDDLBarrier(), NewDDLBarrier()
+	configure := func(exec *OpsExecutor, cursors *CursorMap, ddl *DDLBarrier) {
+		exec.OrderDDL(ddl)
+		exec.RetryStepdowns(opts.StepdownWait)
+		if len(opts.Timeouts) > 0 {
+			exec.SetTimeouts(opts.Timeouts, opts.Session.SocketTimeout)
+		}
+		exec.SetMaxTime(opts.MaxTime)
+		if opts.IdConflict != "" {
+			exec.SetIdConflict(opts.IdConflict)
+		}
+		if cursors != nil {
+			exec.MapCursors(cursors)
+		}
+		if opts.Comment != "" {
+			exec.SetComment(opts.Comment)
+		}
+		if opts.Labeler != nil {
+			exec.LabelOps(opts.Labeler)
+		}
+	}
+	dial := func(options SessionOptions) (*mgo.Session, error) {
+		dialStart := time.Now()
+		session, err := DialSession(options)
+		if err == nil {
+			readiness.Dialed(time.Since(dialStart))
+		}
+		return session, err
+	}
+
+	exit := make(chan int)
+	opsExecuted := int64(0)
+	// closed once the ops run out, so the workers still waiting for their
+	// step of the ramp stop waiting
+	drained := make(chan struct{})
+	var drainOnce sync.Once
+	rampStart := time.Now()
+	fetch := func(id int, statsCollector IStatsCollector, shadowStats IStatsCollector) error {
+		logger.Infof("Worker #%d report for duty\n", id)
+
+		session, err := dial(opts.Session)
+		if err != nil {
+			return err
+		}
+		defer session.Close()
+		if id == 0 {
+			if mongos, err := IsMongos(session); err == nil && mongos {
+				logger.Info("Replaying through mongos; stats are not broken down by shard")
+			}
+		}
+
+		exec := OpsExecutorWithStats(session, statsCollector)
+		configure(exec, cursors, ddl)
+		if opts.Comparator != nil {
+			exec.CompareResults(opts.Comparator)
+		}
+		if opts.Explainer != nil {
+			exec.ExplainSlowOps(opts.Explainer)
+		}
+		if opts.Tracer != nil {
+			exec.TraceOps(opts.Tracer)
+		}
+		if opts.SlowOps != nil {
+			exec.LogSlowOps(opts.SlowOps)
+		}
+		exec.FailOrphanGetMores(opts.FailOrphanGetMores)
+		if opts.Inserts != nil {
+			exec.CountInserts(opts.Inserts)
+		}
+		if clock != nil {
+			exec.CausalConsistency(clock)
+		}
+		var shadow *OpsExecutor
+		if opts.ShadowURL != "" {
+			options := opts.Session
+			options.URL = opts.ShadowURL
+			shadowSession, err := dial(options)
+			if err != nil {
+				return err
+			}
+			defer shadowSession.Close()
+			shadow = OpsExecutorWithStats(shadowSession, shadowStats)
+			configure(shadow, shadowCursors, shadowDDL)
+		}
+		if opts.Ramp != nil {
+			select {
+			case <-time.After(time.Until(rampStart.Add(opts.Ramp.Delay(id)))):
+			case <-drained:
+			case <-ctx.Done():
+			}
+		}
+		for {
+			// a paused replay still stops at its max duration
+			if gate.Wait(ctx) != nil {
+				break
+			}
+			var op *Op
+			select {
+			case op = <-opsChan:
+			case <-ctx.Done():
+			}
+			if op == nil {
+				break
+			}
+			readiness.OpStarted(time.Now())
+			block := func() error {
+				return exec.Execute(op)
+			}
+			err := retryOnSocketFailure(block, session, logger)
+			if shadow != nil {
+				shadowDiffs.Replay(op, exec, err, shadow)
+			}
+			var malformed *MalformedOpError
+			if errors.As(err, &malformed) {
+				if opts.Strict {
+					return err
+				}
+				logger.Errorf("Skipped malformed op: %v", err)
+			}
+			if hooks.Executed != nil {
+				hooks.Executed(op, err)
+			}
+			atomic.AddInt64(&opsExecuted, 1)
+		}
+		drainOnce.Do(func() { close(drained) })
+		logger.Infof("Worker #%d done!\n", id)
+		return nil
+	}
+
+	sampleRate := opts.SampleRate
+	// the workers share a shard per CPU, as more of them would hardly wait
+	// less for one another, and the shared collector keeps the ops and
+	// latencies of each worker along
+	shards := runtime.GOMAXPROCS(0)
+	if shards > workers {
+		shards = workers
+	}
+	sharedStats := NewSharedStatsCollector(shards)
+	statsCollectorList := sharedStats.Shards()
+	for _, collector := range statsCollectorList {
+		collector.SetLogger(logger)
+		collector.SampleLatencies(sampleRate, latencyChan)
+		collector.SetSampleRates(opts.SampleRates)
+		collector.DownsampleLatencies(downsample)
+		if opts.Deterministic {
+			collector.SampleEvenly()
+		}
+	}
+	// made before the workers start, so the timing overhead is measured on
+	// an idle process
+	statsAnalyzer := NewStatsAnalyzer(statsCollectorList, &opsExecuted,
+		analyzedChan, int(sampleRate*float64(limit)/float64(downsample)))
+	statsAnalyzer.BreakDownByWorker(sharedStats)
+	var shadowStatsList []*StatsCollector
+	if opts.ShadowURL != "" {
+		shadowStatsList = make([]*StatsCollector, workers)
+	}
+	for i := 0; i < workers; i++ {
+		var shadowStats IStatsCollector
+		if shadowStatsList != nil {
+			// sampled like the target's, without feeding the latency analysis
+			shadowStatsList[i] = NewStatsCollector()
+			shadowStatsList[i].SampleLatencies(sampleRate, nil)
+			shadowStatsList[i].SetSampleRates(opts.SampleRates)
+			if opts.Deterministic {
+				shadowStatsList[i].SampleEvenly()
+			}
+			shadowStats = shadowStatsList[i]
+		}
+		// taken in order, so the worker i comes i-th in the breakdown
+		workerStats := sharedStats.Worker()
+		go func(id int, stats IStatsCollector) {
+			if err := fetch(id, workerStats, stats); err != nil {
+				fail(err)
+				drainOnce.Do(func() { close(drained) })
+			}
+			exit <- 1
+		}(i, shadowStats)
+	}
+	if hooks.Started != nil {
+		hooks.Started(statsCollectorList, shadowStatsList)
+	}
+
+	// Periodically report execution status
+	report := func() {
+		status := statsAnalyzer.GetStatus()
+		status.QueueDepth = len(opsChan)
+		if idle != nil {
+			status.IdleTime = idle.Slept()
+		}
+		status.TimeToFirstOp = readiness.TimeToFirstOp()
+		status.SlowestDial = readiness.SlowestDial()
+		if hooks.Report != nil {
+			hooks.Report(status)
+		}
+	}
+
+	// The reporter reports one last time once all the workers are done, so
+	// the final stats are always reported.
+	workersDone := make(chan struct{})
+	reporterDone := make(chan struct{})
+	go func() {
+		defer close(reporterDone)
+		ticker := time.NewTicker(reportEvery)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-workersDone:
+				report()
+				return
+			case <-ticker.C:
+				report()
+			}
+		}
+	}()
+
+	// Wait for workers
+	received := 0
+	for received < workers {
+		<-exit
+		received += 1
+	}
+	// and for the dispatcher, so nothing reads from `reader` past this call
+	cancel()
+	for range opsChan {
+	}
+	// Nothing is recorded past this point, so the final report is stable
+	for _, collector := range statsCollectorList {
+		collector.Close()
+	}
+	for _, filter := range opts.Filters {
+		logger.Infof("Skipped %d ops that %s", filter.Skipped(), filter.Reason)
+	}
+	if opts.Redactor != nil {
+		logger.Infof("Redacted %d ops", opts.Redactor.Redacted())
+	}
+	if hooks.Done != nil {
+		hooks.Done()
+	}
+	close(workersDone)
+	<-reporterDone
+	// no more latencies are sampled once the workers are done
+	close(latencyChan)
+	<-latenciesHooked
+
+	if opts.ShadowURL != "" {
+		ReportShadow(CombineStats(statsCollectorList...), CombineStats(shadowStatsList...),
+			shadowDiffs, logger)
+	}
+	return CombineStats(statsCollectorList...), failure
+}
+
+// Read the ops of `reader` through the filters, the redactor and into the
+// target database of `opts`, from its start time on, and dispatch up to `limit`
+// of them to the workers in its style. The idle time is only tracked by the real style.
+func dispatchOps(ctx context.Context, reader OpsReader, opts ReplayOptions, limit int,
+	logger *Logger) (chan *Op, *IdleTime, error) {
+	if opts.MaxOps > 0 {
+		reader = NewLimitedOpsReader(reader, opts.MaxOps)
+	}
+	if len(opts.Filters) > 0 {
+		reader = NewFilteredOpsReader(reader, opts.Filters...)
+	}
+	if opts.Redactor != nil {
+		reader = NewRedactingOpsReader(reader, opts.Redactor)
+	}
+	if opts.TargetDb != "" {
+		reader = NewTargetDbOpsReader(reader, opts.TargetDb)
+	}
+	if opts.StartTime > 0 {
+		if _, err := reader.SetStartTime(opts.StartTime); err != nil {
+			return nil, nil, err
+		}
+	}
+	if opts.SkipOps > 0 {
+		if err := reader.SkipOps(opts.SkipOps); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	switch opts.Style {
+	case "stress":
+		if opts.QueueSize > 0 {
+			return NewBoundedOpsDispatcher(ctx, reader, limit, opts.QueueSize, logger), nil, nil
+		}
+		return NewBestEffortOpsDispatcher(ctx, reader, limit, logger), nil, nil
+	case "", "real":
+		scaler := opts.Scaler
+		if scaler == nil && opts.Speed > 0 {
+			scaler = ConstantSpeed(opts.Speed)
+		}
+		idle := &IdleTime{}
+		return NewByTimeOpsDispatcher(ctx, reader, limit, scaler, idle, logger), idle, nil
+	}
+	return nil, nil, errors.New("invalid style " + opts.Style + ", expected real or stress")
+}
+
+func retryOnSocketFailure(block func() error, session *mgo.Session, logger *Logger) error {
+	err := block()
+	if err == nil {
+		return nil
+	}
+
+	var execErr *ExecError
+	if errors.As(err, &execErr) && execErr.ServerError() {
+		return err
+	}
+	var malformed *MalformedOpError
+	var timeout *TimeoutError
+	if err == ErrUnsupportedOp || errors.As(err, &malformed) || errors.As(err, &timeout) {
+		return err
+	}
+
+	// Otherwise it's probably a socket error so we refresh the connection,
+	// and try again
+	session.Refresh()
+	logger.Error("retrying mongo query after error: ", err)
+	return block()
+}
@@ -0,0 +1,118 @@
+package replay
+
+import (
+	"fmt"
+	"github.com/globalsign/mgo"
+	"sort"
+	"strings"
+)
+
+// SchemaCheck compares a namespace of a recording with the target, to tell
+// ahead of a replay whether its latencies would be meaningful.
+type SchemaCheck struct {
+	Namespace string
+	// whether the collection exists on the target
+	Exists bool
+	// the names of the target's indexes, e.g. "a_1_b_-1"
+	Indexes []string
+	// the fields the recorded ops filter on that no index of the target
+	// starts with, most queried first
+	Unindexed []string
+	// whether the recording creates the collection, e.g. by inserting into
+	// it, in which case it doesn't have to exist
+	Created bool
+}
+
+// CheckSchema checks the namespaces of `inventory` against the target of
+// `session`. Commands on `<db>.$cmd` and system collections are skipped.
+func CheckSchema(inventory *Inventory, session *mgo.Session) ([]*SchemaCheck, error) {
+	collections := map[string]map[string]bool{}
+	checks := []*SchemaCheck{}
+	for _, namespace := range inventory.Namespaces {
+		parts := strings.SplitN(namespace.Namespace, ".", 2)
+		if len(parts) != 2 || parts[1] == "$cmd" || strings.HasPrefix(parts[1], "system.") {
+			continue
+		}
+		dbName, collName := parts[0], parts[1]
+		if _, ok := collections[dbName]; !ok {
+			names, err := session.DB(dbName).CollectionNames()
+			if err != nil {
+				return nil, err
+			}
+			collections[dbName] = map[string]bool{}
+			for _, name := range names {
+				collections[dbName][name] = true
+			}
+		}
+
+		check := &SchemaCheck{
+			Namespace: namespace.Namespace,
+			Exists:    collections[dbName][collName],
+			Created: namespace.Counts[CreateCollection] > 0 || namespace.Counts[Insert] > 0 ||
+				namespace.Counts[Upsert] > 0,
+		}
+		checks = append(checks, check)
+		if !check.Exists {
+			continue
+		}
+		indexes, err := session.DB(dbName).C(collName).Indexes()
+		if err != nil {
+			return nil, err
+		}
+		check.Indexes, check.Unindexed = indexCoverage(indexes, namespace.QueriedFields)
+	}
+	return checks, nil
+}
+
+// The names of `indexes`, and the fields of `queried` that none of them starts
+// with, most queried first.
+func indexCoverage(indexes []mgo.Index, queried map[string]int64) ([]string, []string) {
+	names := []string{}
+	prefixes := map[string]bool{"_id": true}
+	for _, index := range indexes {
+		names = append(names, index.Name)
+		if len(index.Key) > 0 {
+			prefixes[indexField(index.Key[0])] = true
+		}
+	}
+	unindexed := []string{}
+	for field := range queried {
+		if !prefixes[field] {
+			unindexed = append(unindexed, field)
+		}
+	}
+	sort.Slice(unindexed, func(i, j int) bool {
+		if queried[unindexed[i]] != queried[unindexed[j]] {
+			return queried[unindexed[i]] > queried[unindexed[j]]
+		}
+		return unindexed[i] < unindexed[j]
+	})
+	return names, unindexed
+}
+
+// The field of an index key as mgo reports it, e.g. "-a" or "$text:a".
+func indexField(key string) string {
+	if strings.HasPrefix(key, "$") {
+		if i := strings.Index(key, ":"); i >= 0 {
+			return key[i+1:]
+		}
+	}
+	return strings.TrimPrefix(key, "-")
+}
+
+// Warning describes what is wrong with the namespace on the target, or is
+// empty if nothing is.
+func (check *SchemaCheck) Warning() string {
+	if !check.Exists {
+		if check.Created {
+			return ""
+		}
+		return fmt.Sprintf("%s doesn't exist on the target", check.Namespace)
+	}
+	if len(check.Unindexed) == 0 {
+		return ""
+	}
+	return fmt.Sprintf("%s has no index starting with %s (indexes: %s); "+
+		"queries on these fields will scan the collection", check.Namespace,
+		strings.Join(check.Unindexed, ", "), strings.Join(check.Indexes, ", "))
+}
@@ -0,0 +1,31 @@
+package replay
+
+import (
+	"github.com/globalsign/mgo"
+	. "gopkg.in/check.v1"
+)
+
+type TestSchemaSuite struct{}
+
+var _ = Suite(&TestSchemaSuite{})
+
+func (s *TestSchemaSuite) TestSchemaCheck(c *C) {
+	indexes := []mgo.Index{
+		{Name: "_id_", Key: []string{"_id"}},
+		{Name: "a_-1_b_1", Key: []string{"-a", "b"}},
+		{Name: "t_text", Key: []string{"$text:t"}},
+	}
+	names, unindexed := indexCoverage(indexes,
+		map[string]int64{"_id": 5, "a": 4, "b": 3, "c": 1, "t": 1, "d": 3})
+	c.Assert(names, DeepEquals, []string{"_id_", "a_-1_b_1", "t_text"})
+	c.Assert(unindexed, DeepEquals, []string{"b", "d", "c"})
+
+	check := &SchemaCheck{Namespace: "db.c1", Exists: true, Indexes: names, Unindexed: unindexed}
+	c.Assert(check.Warning(), Matches, "db.c1 has no index starting with b, d, c .*")
+	check = &SchemaCheck{Namespace: "db.c1", Exists: true, Indexes: names}
+	c.Assert(check.Warning(), Equals, "")
+	check = &SchemaCheck{Namespace: "db.c2"}
+	c.Assert(check.Warning(), Equals, "db.c2 doesn't exist on the target")
+	check.Created = true
+	c.Assert(check.Warning(), Equals, "")
+}
@@ -0,0 +1,192 @@
+package replay
+
+import (
+	"github.com/globalsign/mgo"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// DefaultAppName is how replayed connections are named on the server by
+// default, so they are easy to spot in `currentOp`.
+const DefaultAppName = "flashback"
+
+// SessionOptions configures the sessions used to replay the ops.
+type SessionOptions struct {
+	// The database server's url, in the format of <host>[:<port>]. Defaults
+	// to localhost:27017. To replay against a sharded cluster, list one or
+	// several of its mongos routers, comma-separated; ops keep going through
+	// the others if one of them goes down.
+	URL string
+
+	SocketTimeout time.Duration
+
+	// How long an op waits for a suitable server, e.g. for a new primary to
+	// be elected after a stepdown, before failing. Defaults to one minute.
+	// The driver's server monitoring cadence itself isn't configurable: mgo
+	// pings each server every 15s and resyncs the topology every 30s, or
+	// immediately once an op hits a dead connection.
+	ServerSelectionTimeout time.Duration
+
+	// The application name reported to the server for each connection.
+	AppName string
+
+	// Keep the cursors of queries open on the server until they are
+	// exhausted. Otherwise a query whose batches are fetched slower than the
+	// server's cursor timeout, e.g. during a slow replay, fails.
+	NoCursorTimeout bool
+
+	// Reach the servers through this SOCKS5 proxy, in the format of
+	// socks5://[<user>:<password>@]<host>:<port>, e.g. an `ssh -D` tunnel
+	// through a bastion. Empty to connect directly.
+	Proxy string
+}
+
+// DialSession connects to the server described by `options`.
+func DialSession(options SessionOptions) (*mgo.Session, error) {
+	url := options.URL
+	if url == "" {
+		url = "localhost"
+	}
+	info, err := mgo.ParseURL(url)
+	if err != nil {
+		return nil, err
+	}
+	// same defaults as mgo.Dial()
+	info.Timeout = 10 * time.Second
+	// the reason for the globalsign fork: gopkg.in/mgo.v2 has no AppName,
+	// nor the pool stats of GetPoolWaits()
+	info.AppName = options.AppName
+	if info.AppName == "" {
+		info.AppName = DefaultAppName
+	}
+	if options.Proxy != "" {
+		proxy, err := ParseProxyURL(options.Proxy)
+		if err != nil {
+			return nil, err
+		}
+		proxy.Timeout = info.Timeout
+		// ParseURL only sets a dialer for ssl=true
+		useTLS := info.DialServer != nil
+		info.DialServer = func(addr *mgo.ServerAddr) (net.Conn, error) {
+			conn, err := proxy.Dial(addr.String())
+			if err != nil || !useTLS {
+				return conn, err
+			}
+			return tlsOverProxy(conn, addr.String())
+		}
+	}
+
+	session, err := mgo.DialWithInfo(info)
+	if err != nil {
+		return nil, err
+	}
+	session.SetSyncTimeout(1 * time.Minute)
+	session.SetSocketTimeout(1 * time.Minute)
+	if options.ServerSelectionTimeout > 0 {
+		session.SetSyncTimeout(options.ServerSelectionTimeout)
+	}
+	if options.SocketTimeout > 0 {
+		session.SetSocketTimeout(options.SocketTimeout)
+	}
+	if options.NoCursorTimeout {
+		session.SetCursorTimeout(0)
+	}
+	return session, nil
+}
+
+// Readiness records how long the replay took to get going: how long dialing
+// the target took, which connects, authenticates and discovers the topology,
+// and how long after the process started the first op ran. Reported apart
+// from the latencies of the ops, it tells a slow start of flashback from a
+// slow target.
+type Readiness struct {
+	start time.Time
+	// the unix time in nanoseconds the first op started at, 0 until then
+	firstOp int64
+
+	lock        sync.Mutex
+	dials       int
+	slowestDial time.Duration
+}
+
+// NewReadiness measures the time to the first op from `start`.
+func NewReadiness(start time.Time) *Readiness {
+	return &Readiness{start: start}
+}
+
+// Dialed records that dialing a session took `took`.
+func (r *Readiness) Dialed(took time.Duration) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.dials++
+	if took > r.slowestDial {
+		r.slowestDial = took
+	}
+}
+
+// OpStarted records that an op started at `now`; only the first one counts.
+// It's cheap enough to call before each op.
+func (r *Readiness) OpStarted(now time.Time) {
+	if atomic.LoadInt64(&r.firstOp) == 0 {
+		atomic.CompareAndSwapInt64(&r.firstOp, 0, now.UnixNano())
+	}
+}
+
+// SlowestDial returns how long the slowest of the sessions took to dial.
+func (r *Readiness) SlowestDial() time.Duration {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return r.slowestDial
+}
+
+// TimeToFirstOp returns how long after the start the first op started, or 0
+// if none did yet.
+func (r *Readiness) TimeToFirstOp() time.Duration {
+	firstOp := atomic.LoadInt64(&r.firstOp)
+	if firstOp == 0 {
+		return 0
+	}
+	return time.Unix(0, firstOp).Sub(r.start)
+}
+
+// PoolWaits sums up the times ops waited for a free connection of the
+// driver's pools, which adds to their latency without the target being slow.
+type PoolWaits struct {
+	Count    int
+	Time     time.Duration
+	Timeouts int
+}
+
+// EnablePoolWaits makes the driver track the waits for a free connection, at
+// the cost of a lock shared by all the sessions, which GetPoolWaits() then
+// reports.
+func EnablePoolWaits() {
+	mgo.SetStats(true)
+}
+
+// GetPoolWaits returns the connection waits of all the sessions since
+// EnablePoolWaits() was called.
+func GetPoolWaits() PoolWaits {
+	stats := mgo.GetStats()
+	return PoolWaits{
+		Count:    stats.TimesWaitedForPool,
+		Time:     stats.TotalPoolWaitTime,
+		Timeouts: stats.PoolTimeouts,
+	}
+}
+
+// IsMongos tells whether `session` is connected to the mongos router of a
+// sharded cluster. The driver routes ops through mongos like through a
+// primary, but doesn't tell which shard served an op, so the stats of a
+// sharded replay are not broken down by shard.
+func IsMongos(session *mgo.Session) (bool, error) {
+	result := struct {
+		Msg string `bson:"msg"`
+	}{}
+	if err := session.Run("isMaster", &result); err != nil {
+		return false, err
+	}
+	return result.Msg == "isdbgrid", nil
+}
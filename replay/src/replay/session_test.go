@@ -0,0 +1,23 @@
+package replay
+
+import (
+	. "gopkg.in/check.v1"
+	"time"
+)
+
+type TestSessionSuite struct{}
+
+var _ = Suite(&TestSessionSuite{})
+
+func (s *TestSessionSuite) TestReadiness(c *C) {
+	start := time.Now()
+	readiness := NewReadiness(start)
+	c.Assert(readiness.TimeToFirstOp(), Equals, time.Duration(0))
+
+	readiness.Dialed(2 * time.Second)
+	readiness.Dialed(time.Second)
+	c.Assert(readiness.SlowestDial(), Equals, 2*time.Second)
+	readiness.OpStarted(start.Add(3 * time.Second))
+	readiness.OpStarted(start.Add(4 * time.Second))
+	c.Assert(readiness.TimeToFirstOp(), Equals, 3*time.Second)
+}
@@ -0,0 +1,80 @@
+package replay
+
+import (
+	"fmt"
+	"sync"
+)
+
+// ShadowDiffs compares how two targets, e.g. a cluster and its upgrade
+// candidate, served the same ops in a shadow replay: each op is replayed on
+// the target, then on its shadow, each with its own executor and stats. It
+// counts the ops the two served differently, because only one of them failed
+// or because they returned different results. It can be shared by the
+// workers.
+type ShadowDiffs struct {
+	lock   sync.Mutex
+	counts map[OpType]int64
+	logger *Logger
+	// how many differences are logged in detail, and how many were so far
+	maxLogged int
+	logged    int
+}
+
+func NewShadowDiffs(logger *Logger, maxLogged int) *ShadowDiffs {
+	return &ShadowDiffs{
+		counts:    map[OpType]int64{},
+		logger:    logger,
+		maxLogged: maxLogged,
+	}
+}
+
+// Replay replays on the shadow's executor an op that the target's executor
+// just ran, failing with `targetErr` or not, and compares the outcomes. The
+// ops are replayed one after the other rather than concurrently, so each is
+// timed on its own. Returns the shadow's error, which only shows in the
+// shadow's stats.
+func (d *ShadowDiffs) Replay(op *Op, target *OpsExecutor, targetErr error,
+	shadow *OpsExecutor) error {
+	err := shadow.Execute(op)
+	switch {
+	case (targetErr == nil) != (err == nil):
+		d.record(op, outcome(targetErr), outcome(err))
+	case err == nil && (op.Type == Query || op.Type == FindAndModify):
+		targetJson, shadowJson := canonicalJson(target.lastResult), canonicalJson(shadow.lastResult)
+		if targetJson != shadowJson {
+			d.record(op, targetJson, shadowJson)
+		}
+	}
+	return err
+}
+
+func outcome(err error) string {
+	if err == nil {
+		return "succeeded"
+	}
+	return fmt.Sprintf("failed: %v", err)
+}
+
+func (d *ShadowDiffs) record(op *Op, target string, shadow string) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	d.counts[op.Type]++
+	if d.logger == nil || d.logged >= d.maxLogged {
+		return
+	}
+	d.logged++
+	d.logger.Errorf("shadow mismatch - type:%s,database:%s,collection:%s\n"+
+		"  target: %s\n  shadow: %s", op.Type, op.Database, op.Collection,
+		truncate(target, maxLoggedResultLen), truncate(shadow, maxLoggedResultLen))
+}
+
+// Counts returns how many ops of each type the targets served differently.
+func (d *ShadowDiffs) Counts() map[OpType]int64 {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	counts := make(map[OpType]int64, len(d.counts))
+	for opType, count := range d.counts {
+		counts[opType] = count
+	}
+	return counts
+}
@@ -0,0 +1,24 @@
+package replay
+
+import (
+	"errors"
+	. "gopkg.in/check.v1"
+)
+
+type TestShadowSuite struct{}
+
+var _ = Suite(&TestShadowSuite{})
+
+func (s *TestShadowSuite) TestShadowDiffs(c *C) {
+	diffs := NewShadowDiffs(nil, 10)
+	target, shadow := NewOpsExecutor(nil), NewOpsExecutor(nil)
+	// an op that fails on the shadow
+	op := &Op{Database: "db", Type: Insert}
+	c.Assert(diffs.Replay(op, target, nil, shadow), NotNil)
+	c.Assert(diffs.Replay(op, target, errors.New("failed too"), shadow), NotNil)
+	c.Assert(diffs.Counts(), DeepEquals, map[OpType]int64{Insert: 1})
+
+	c.Assert(formatDelta(2, 3), Equals, "+50%")
+	c.Assert(formatDelta(2, 1), Equals, "-50%")
+	c.Assert(formatDelta(0, 1), Equals, "n/a")
+}
@@ -0,0 +1,258 @@
+package replay
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// How long the workers reuse the copy of the stats of all the shards, so
+// reading a few of them in a row only combines the shards once.
+const sharedStatsMaxAge = 100 * time.Millisecond
+
+// SharedStatsCollector is a single collector for all the workers, so the stats
+// of the whole replay can be read while it runs without combining the
+// collectors of the workers first. Each worker records through its own
+// Worker(). The workers are spread over a few shards, each a StatsCollector
+// with its own lock, so they seldom wait for one another; the counts of the
+// ops are also kept in atomic counters, which are read without any lock, as
+// are the ops and latencies of each worker.
+// Like a StatsCollector, it only breaks the stats down by the op types
+// registered when it's made, see RegisterOpType().
+type SharedStatsCollector struct {
+	shards []*StatsCollector
+	// the shard the next worker records into
+	next uint32
+	// only the op types the stats are broken down by have a counter, and
+	// the map itself is never written after it's made
+	counts map[OpType]*int64
+	total  int64
+	// guards workers, and the copy of the stats the workers read
+	lock     sync.Mutex
+	workers  []*sharedWorkerStats
+	stats    *StatsCollector
+	statsEnd time.Time
+}
+
+// NewSharedStatsCollector spreads the workers over `shards` shards, e.g. one
+// per CPU.
+func NewSharedStatsCollector(shards int) *SharedStatsCollector {
+	if shards <= 0 {
+		shards = 1
+	}
+	collector := &SharedStatsCollector{
+		shards: make([]*StatsCollector, shards),
+		counts: map[OpType]*int64{},
+	}
+	for i := range collector.shards {
+		collector.shards[i] = NewStatsCollector()
+	}
+	for _, opType := range AllOpTypes {
+		collector.counts[opType] = new(int64)
+	}
+	return collector
+}
+
+// Worker returns the collector a worker records its ops through. Each worker
+// needs its own, since it tracks the op being sampled.
+func (s *SharedStatsCollector) Worker() IStatsCollector {
+	shard := s.shards[int(atomic.AddUint32(&s.next, 1)-1)%len(s.shards)]
+	worker := &sharedWorkerStats{StatsCollector: shard, shared: s}
+	s.lock.Lock()
+	s.workers = append(s.workers, worker)
+	s.lock.Unlock()
+	return worker
+}
+
+// WorkerTotals returns how many ops each worker started so far, in the order
+// of the calls to Worker().
+func (s *SharedStatsCollector) WorkerTotals() []int64 {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	totals := make([]int64, len(s.workers))
+	for i, worker := range s.workers {
+		totals[i] = atomic.LoadInt64(&worker.total)
+	}
+	return totals
+}
+
+// WorkerLatenciesInMs returns the average sampled latency of each worker so
+// far, in the order of the calls to Worker().
+func (s *SharedStatsCollector) WorkerLatenciesInMs() []float64 {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	latencies := make([]float64, len(s.workers))
+	for i, worker := range s.workers {
+		if sampled := atomic.LoadInt64(&worker.sampled); sampled > 0 {
+			latency := time.Duration(atomic.LoadInt64(&worker.latency))
+			latencies[i] = latency.Seconds() / float64(sampled) * 1000
+		}
+	}
+	return latencies
+}
+
+// SampleLatencies sets the sample rate of the latencies of all the workers, and
+// the channel they are sent to.
+func (s *SharedStatsCollector) SampleLatencies(sampleRate float64, latencyChannel chan Latency) {
+	for _, shard := range s.shards {
+		shard.SampleLatencies(sampleRate, latencyChannel)
+	}
+}
+
+// SetSampleRates overrides the sample rate of some op types, see
+// StatsCollector.SetSampleRates().
+func (s *SharedStatsCollector) SetSampleRates(rates map[OpType]float64) {
+	for _, shard := range s.shards {
+		shard.SetSampleRates(rates)
+	}
+}
+
+// Count returns how many ops of a type were started so far, without taking any
+// lock.
+func (s *SharedStatsCollector) Count(opType OpType) int64 {
+	if count, ok := s.counts[opType]; ok {
+		return atomic.LoadInt64(count)
+	}
+	return 0
+}
+
+// Total returns how many ops of any type were started so far, without taking
+// any lock.
+func (s *SharedStatsCollector) Total() int64 {
+	return atomic.LoadInt64(&s.total)
+}
+
+// Shards returns the collectors the workers record into, e.g. to configure
+// them; the i-th call to Worker() records into the shard i modulo their
+// number.
+func (s *SharedStatsCollector) Shards() []*StatsCollector {
+	return s.shards
+}
+
+// Stats returns a copy of the stats collected so far. The shards are copied one
+// after the other, each under its own lock, so the workers of the other shards
+// keep recording meanwhile; the copy may hence miss a few of the ops counted
+// by Count() and Total().
+func (s *SharedStatsCollector) Stats() *StatsCollector {
+	return CombineStats(s.shards...)
+}
+
+// The stats the workers read: a copy like Stats(), reused for up to
+// sharedStatsMaxAge.
+func (s *SharedStatsCollector) recentStats() *StatsCollector {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if now := time.Now(); s.stats == nil || now.After(s.statsEnd) {
+		s.stats, s.statsEnd = CombineStats(s.shards...), now.Add(sharedStatsMaxAge)
+	}
+	return s.stats
+}
+
+// Close ends the collection, see StatsCollector.Close().
+func (s *SharedStatsCollector) Close() {
+	for _, shard := range s.shards {
+		shard.Close()
+	}
+}
+
+// The collector of one worker: it records into its shard, and reads the stats
+// of all the shards.
+type sharedWorkerStats struct {
+	// the ops started by this worker, and the total and number of its
+	// sampled latencies, first for their alignment as they are atomic
+	total   int64
+	latency int64
+	sampled int64
+	// the shard, which also records everything but the ops
+	*StatsCollector
+	shared *SharedStatsCollector
+	// the start and type of the op being sampled, epoch being zero when the
+	// current op isn't sampled
+	epoch  time.Time
+	lastOp OpType
+	label  string
+	// the type of the current op, sampled or not, for EndOpWithError()
+	currentOp OpType
+}
+
+func (w *sharedWorkerStats) StartOp(opType OpType) {
+	w.StartLabeledOp(opType, "")
+}
+
+func (w *sharedWorkerStats) StartLabeledOp(opType OpType, label string) {
+	shard := w.StatsCollector
+	shard.lock.Lock()
+	defer shard.lock.Unlock()
+	w.epoch = time.Time{}
+	if shard.closed {
+		return
+	}
+	w.currentOp = opType
+	atomic.AddInt64(&w.total, 1)
+	atomic.AddInt64(&w.shared.total, 1)
+	if count, ok := w.shared.counts[opType]; ok {
+		atomic.AddInt64(count, 1)
+	}
+	now := time.Now()
+	if shard.startOp(opType, label, now) {
+		w.epoch, w.lastOp, w.label = now, opType, label
+	}
+}
+
+func (w *sharedWorkerStats) EndOp() {
+	w.EndOpWithError(nil)
+}
+
+func (w *sharedWorkerStats) EndOpWithError(err error) {
+	shard := w.StatsCollector
+	shard.lock.Lock()
+	if !shard.closed {
+		shard.ended++
+		if err != nil {
+			shard.recordError(w.currentOp, err)
+		}
+	}
+	// not sampled, or the collector was closed since
+	if w.epoch.IsZero() || shard.closed {
+		shard.lock.Unlock()
+		return
+	}
+	latency := Latency{w.lastOp, time.Now().Sub(w.epoch)}
+	atomic.AddInt64(&w.latency, int64(latency.Latency))
+	atomic.AddInt64(&w.sampled, 1)
+	latencyChan, latencyDone := shard.endOp(latency, w.label)
+	w.epoch = time.Time{}
+	shard.lock.Unlock()
+
+	if latencyChan != nil {
+		shard.sendLatency(latencyChan, latencyDone, latency)
+	}
+}
+
+func (w *sharedWorkerStats) SampleLatencies(sampleRate float64, latencyChannel chan Latency) {
+	w.shared.SampleLatencies(sampleRate, latencyChannel)
+}
+
+func (w *sharedWorkerStats) Count(opType OpType) int64 { return w.shared.Count(opType) }
+func (w *sharedWorkerStats) Total() int64              { return w.shared.Total() }
+func (w *sharedWorkerStats) TotalTime(opType OpType) time.Duration {
+	return w.shared.recentStats().TotalTime(opType)
+}
+func (w *sharedWorkerStats) OpsSec(opType OpType) float64 {
+	return w.shared.recentStats().OpsSec(opType)
+}
+func (w *sharedWorkerStats) RecentOpsSec(opType OpType) float64 {
+	return w.shared.recentStats().RecentOpsSec(opType)
+}
+func (w *sharedWorkerStats) LatencyInMs(opType OpType) float64 {
+	return w.shared.recentStats().LatencyInMs(opType)
+}
+func (w *sharedWorkerStats) LatencyPercentileInMs(opType OpType, p float64) float64 {
+	return w.shared.recentStats().LatencyPercentileInMs(opType, p)
+}
+func (w *sharedWorkerStats) QueueTimeInMs(opType OpType) float64 {
+	return w.shared.recentStats().QueueTimeInMs(opType)
+}
+func (w *sharedWorkerStats) ScheduleDriftInMs() (float64, float64) {
+	return w.shared.recentStats().ScheduleDriftInMs()
+}
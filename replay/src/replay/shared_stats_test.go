@@ -0,0 +1,69 @@
+package replay
+
+import (
+	. "gopkg.in/check.v1"
+)
+
+type TestSharedStatsSuite struct{}
+
+var _ = Suite(&TestSharedStatsSuite{})
+
+func (s *TestSharedStatsSuite) TestSharedStatsCollector(c *C) {
+	shared := NewSharedStatsCollector(2)
+	latencies := make(chan Latency, 100)
+	shared.SampleLatencies(0.01, latencies)
+	shared.SetSampleRates(map[OpType]float64{Insert: 1})
+	opTypes := []OpType{Query, Insert, Update}
+	done := make(chan struct{})
+	for _, opType := range opTypes {
+		// three workers over two shards, so two of them share one
+		go func(worker IStatsCollector, opType OpType) {
+			defer func() { done <- struct{}{} }()
+			for i := 0; i < 2000; i++ {
+				worker.StartLabeledOp(opType, "db.c")
+				worker.EndOp()
+			}
+		}(shared.Worker(), opType)
+	}
+	go func() {
+		for range latencies {
+		}
+	}()
+
+	// the live stats of all the workers only ever go up
+	last := int64(0)
+	for running := len(opTypes); running > 0; {
+		select {
+		case <-done:
+			running--
+		default:
+		}
+		total := shared.Total()
+		c.Assert(total >= last, Equals, true)
+		last = total
+		stats := shared.Stats()
+		c.Assert(stats.Total() <= shared.Total(), Equals, true)
+	}
+	c.Assert(shared.Total(), Equals, int64(6000))
+	c.Assert(shared.Count(Update), Equals, int64(2000))
+	stats := shared.Stats()
+	c.Assert(stats.Total(), Equals, int64(6000))
+	c.Assert(stats.LabelCount("db.c"), Equals, int64(6000))
+	c.Assert(stats.SampledCount(Insert), Equals, int64(2000))
+	c.Assert(stats.LatencyInMs(Insert) > 0, Equals, true)
+	c.Assert(shared.WorkerTotals(), DeepEquals, []int64{2000, 2000, 2000})
+	workerLatencies := shared.WorkerLatenciesInMs()
+	c.Assert(workerLatencies[1] > 0, Equals, true)
+	worker := shared.Worker()
+	c.Assert(worker.Count(Query), Equals, int64(2000))
+	// the reads of a worker share one copy of the stats, for a while
+	c.Assert(worker.LatencyInMs(Insert), Equals, stats.LatencyInMs(Insert))
+	c.Assert(shared.recentStats(), Equals, shared.recentStats())
+
+	shared.Close()
+	worker = shared.Worker()
+	worker.StartOp(Query)
+	worker.EndOp()
+	c.Assert(shared.Total(), Equals, int64(6000))
+	close(latencies)
+}
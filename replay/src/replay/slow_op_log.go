@@ -0,0 +1,111 @@
+package replay
+
+import (
+	"bufio"
+	"encoding/json"
+	"os"
+	"sync"
+	"time"
+)
+
+// SlowOpRecord describes an op that took longer than the threshold of a
+// SlowOpLog.
+type SlowOpRecord struct {
+	Time       time.Time `json:"time"`
+	OpType     OpType    `json:"op_type"`
+	Namespace  string    `json:"ns"`
+	DurationMs float64   `json:"duration_ms"`
+	// the position of the op in its recording, see Op.Offset
+	Offset int `json:"offset,omitempty"`
+	// the filter of the op, if it has one
+	Query map[string]interface{} `json:"query,omitempty"`
+}
+
+// SlowOpLog writes the replayed ops slower than a threshold to a file as
+// newline-delimited JSON, one SlowOpRecord per line, so the outliers of a run
+// can be reproduced and explained afterwards. It's shared by all the workers.
+// Unlike the SlowOpExplainer, it doesn't send anything to the target.
+type SlowOpLog struct {
+	lock      sync.Mutex
+	file      *os.File
+	buffer    *bufio.Writer
+	encoder   *json.Encoder
+	threshold time.Duration
+	redactor  *Redactor
+	// the first write that failed, returned by Close()
+	err error
+}
+
+// CreateSlowOpLog creates the log `filename` of the ops that took at least
+// `threshold`. When `redactor` is set, its rules also apply to the logged
+// queries, which the readers don't redact.
+func CreateSlowOpLog(filename string, threshold time.Duration, redactor *Redactor) (*SlowOpLog, error) {
+	file, err := os.Create(filename)
+	if err != nil {
+		return nil, err
+	}
+	log := &SlowOpLog{
+		file:      file,
+		buffer:    bufio.NewWriter(file),
+		threshold: threshold,
+		redactor:  redactor,
+	}
+	log.encoder = json.NewEncoder(log.buffer)
+	return log, nil
+}
+
+// IsSlow tells whether an op that took `latency` is logged.
+func (l *SlowOpLog) IsSlow(latency time.Duration) bool {
+	return latency >= l.threshold
+}
+
+// Write logs that `op`, as replayed, took `latency`.
+func (l *SlowOpLog) Write(op *Op, latency time.Duration) {
+	record := SlowOpRecord{
+		Time:       time.Now(),
+		OpType:     op.Type,
+		Namespace:  op.Database + "." + op.Collection,
+		DurationMs: float64(latency) / float64(time.Millisecond),
+		Offset:     op.Offset,
+		Query:      slowOpQuery(op),
+	}
+	if record.Query != nil && l.redactor != nil {
+		record.Query = l.redactor.RedactQuery(record.Query)
+	}
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if err := l.encoder.Encode(record); err != nil && l.err == nil {
+		l.err = err
+	}
+}
+
+// Close flushes the buffered records, and returns the first error the log
+// hit, if any.
+func (l *SlowOpLog) Close() error {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	err := l.buffer.Flush()
+	if closeErr := l.file.Close(); err == nil {
+		err = closeErr
+	}
+	if l.err != nil {
+		err = l.err
+	}
+	return err
+}
+
+// The filter of an op once canonicalizeOp() ran, or nil if it has none.
+func slowOpQuery(op *Op) map[string]interface{} {
+	var query interface{}
+	switch op.Type {
+	case Query, Update, Upsert, Remove, RemoveMulti, Count, FindAndModify:
+		// the content of the commands is the command itself
+		query = op.Content["query"]
+	}
+	// legacy queries wrap the filter along with their modifiers
+	if wrapped, ok := query.(map[string]interface{}); ok && wrapped["$query"] != nil {
+		query = wrapped["$query"]
+	}
+	doc, _ := query.(map[string]interface{})
+	return doc
+}
@@ -0,0 +1,61 @@
+package replay
+
+import (
+	"encoding/json"
+	. "gopkg.in/check.v1"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+type TestSlowOpLogSuite struct{}
+
+var _ = Suite(&TestSlowOpLogSuite{})
+
+func (s *TestSlowOpLogSuite) TestSlowOpLog(c *C) {
+	filename := filepath.Join(c.MkDir(), "slow.json")
+	rules, err := ParseRedactRules("email=constant:redacted,address.zip=remove")
+	c.Assert(err, IsNil)
+	log, err := CreateSlowOpLog(filename, 100*time.Millisecond, NewRedactor(rules...))
+	c.Assert(err, IsNil)
+	c.Assert(log.IsSlow(99*time.Millisecond), Equals, false)
+	c.Assert(log.IsSlow(100*time.Millisecond), Equals, true)
+
+	query := map[string]interface{}{"email": "a@b.c", "address.zip": "12345",
+		"age": map[string]interface{}{"$gt": 21.0}}
+	op := &Op{Database: "db", Collection: "c1", Type: Query, Offset: 7,
+		Content: Document{"query": map[string]interface{}{"$query": query}}}
+	log.Write(op, 150*time.Millisecond)
+	count := &Op{Database: "db", Collection: "c1", Type: Count,
+		Content: Document{"count": "c1", "query": map[string]interface{}{"age": 30.0}}}
+	log.Write(count, 2*time.Second)
+	log.Write(&Op{Database: "db", Collection: "c1", Type: Insert,
+		Content: Document{"o": map[string]interface{}{"_id": 1.0}}}, time.Second)
+	c.Assert(log.Close(), IsNil)
+	// the op itself isn't redacted
+	c.Assert(query["email"], Equals, "a@b.c")
+
+	file, err := os.Open(filename)
+	c.Assert(err, IsNil)
+	defer file.Close()
+	decoder := json.NewDecoder(file)
+	var record SlowOpRecord
+	c.Assert(decoder.Decode(&record), IsNil)
+	c.Assert(record.OpType, Equals, Query)
+	c.Assert(record.Namespace, Equals, "db.c1")
+	c.Assert(record.DurationMs, Equals, 150.0)
+	c.Assert(record.Offset, Equals, 7)
+	c.Assert(record.Query, DeepEquals, map[string]interface{}{"email": "redacted",
+		"age": map[string]interface{}{"$gt": 21.0}})
+	record = SlowOpRecord{}
+	c.Assert(decoder.Decode(&record), IsNil)
+	c.Assert(record.OpType, Equals, Count)
+	c.Assert(record.DurationMs, Equals, 2000.0)
+	c.Assert(record.Query, DeepEquals, map[string]interface{}{"age": 30.0})
+	record = SlowOpRecord{}
+	c.Assert(decoder.Decode(&record), IsNil)
+	c.Assert(record.OpType, Equals, Insert)
+	c.Assert(record.Query, IsNil)
+	c.Assert(decoder.Decode(&record), Equals, io.EOF)
+}
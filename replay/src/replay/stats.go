@@ -1,154 +1,1610 @@
 package replay
 
 import (
+	"errors"
+	"fmt"
+	"math"
 	"math/rand"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
 	"time"
 )
 
 // Latency of the mongo ops
 type Latency struct {
-	OpType  OpType
-	Latency time.Duration
+	OpType  OpType        `json:"op_type"`
+	Latency time.Duration `json:"latency_ns"`
 }
 
 type IStatsCollector interface {
 	StartOp(opType OpType)
 
+	// Like StartOp(), but also counts the op under a caller-supplied label,
+	// e.g. its namespace, so the stats can be broken down along another
+	// axis than the op type. An empty label is the same as StartOp().
+	StartLabeledOp(opType OpType, label string)
+
 	EndOp()
 
+	// Like EndOp(), but also counts the op as failed with `err`, by op type
+	// and ErrorClass, unless `err` is nil.
+	EndOpWithError(err error)
+
+	// Record how long an op waited between being dispatched and being picked
+	// up for execution. This is kept apart from the op's latency, which only
+	// measures the time the server took to serve it.
+	RecordQueueTime(opType OpType, queueTime time.Duration)
+
+	// Record how late an op started compared to its recorded timing.
+	RecordScheduleDrift(drift time.Duration)
+
+	// Tally the server error code of a failed op; 0 stands for errors that
+	// didn't come from the server.
+	RecordErrorCode(code int)
+
+	// Count a replayed op whose result differs from the recorded one.
+	RecordResultMismatch(opType OpType)
+
+	// Count an op that took longer than the timeout of its type.
+	RecordTimeout(opType OpType)
+
+	// Count a read the server aborted because it ran past its maxTimeMS.
+	RecordMaxTimeExpired(opType OpType)
+
+	// Count a getMore on a cursor that was never opened on the target.
+	RecordOrphanGetMore()
+
+	// Count a query that failed because the server timed out its cursor.
+	RecordCursorTimeout()
+
+	// Count an op that was skipped because its recorded namespace is invalid.
+	RecordMalformed()
+
+	// Count a retry of an op that failed because the primary stepped down.
+	RecordStepdownRetry()
+
+	// Record how long the target took to serve an op, retries included. Unlike
+	// the latencies, it's recorded for every op, sampled or not.
+	RecordServiceTime(serviceTime time.Duration)
+
+	// Count the size in bytes of a document written by an op.
+	RecordDocSize(opType OpType, size int64)
+
+	// Count an insert whose _id already existed, under how it was resolved.
+	RecordIdConflict(resolution IdConflict)
+
 	// How many ops have been captured.
 	Count(opType OpType) int64
 
-	// ops/sec for a given op type.
+	// How many ops have been captured overall, of any op type.
+	Total() int64
+
+	// ops/sec for a given op type, over the wall-clock time from the first op
+	// to the last one of any type.
 	OpsSec(opType OpType) float64
 
+	// ops/sec for a given op type over the last RecentOpsSecWindow.
+	RecentOpsSec(opType OpType) float64
+
 	// The average latency, which can give you a rough idea of the performance.
 	// For fine-grain performance analysis, please enable latency sampling
 	// and do the latency analysis by other means.
 	LatencyInMs(opType OpType) float64
 
+	// The `p` percentile (between 0.0 and 1.0, e.g. 0.9999) of the sampled
+	// latencies, within the accuracy of the latency buckets.
+	LatencyPercentileInMs(opType OpType, p float64) float64
+
+	// The average time ops waited for a worker.
+	QueueTimeInMs(opType OpType) float64
+
+	// The average and the largest delay of the ops behind their recorded
+	// timing.
+	ScheduleDriftInMs() (avg float64, max float64)
+
 	// Enable the sampling for latency analysis. Sampled latencies will be sent
 	// out via a channel.
 	SampleLatencies(sampleRate float64, latencyChannel chan Latency)
 }
 
+// StatsCollector counts and times the ops of a worker. All its methods are
+// safe to call while the worker keeps recording ops, e.g. to poll the stats
+// of a live run: each read method takes the collector's lock, so it sees the
+// ops recorded so far as a whole, never half of an op. To read several stats
+// consistently with one another, take a Snapshot().
 type StatsCollector struct {
-	counts    map[OpType]int64
-	durations map[OpType]time.Duration
+	// guards all the fields below, so the stats can be read while the
+	// worker that owns the collector keeps recording ops.
+	lock sync.Mutex
+
+	// the op types the stats are broken down by, AllOpTypes unless the
+	// collector was created by NewStatsCollectorFor
+	opTypes    []OpType
+	counts     map[OpType]int64
+	sampled    map[OpType]int64
+	durations  map[OpType]time.Duration
+	buckets    []time.Duration
+	histograms map[OpType]*latencyHistogram
+	// the sizes of the documents written, only for the op types that wrote
+	// any
+	docSizes   map[OpType]*sizeHistogram
+	queueTimes map[OpType]time.Duration
+	queued     map[OpType]int64
+	errorCodes map[int]int64
+	// the failed ops, by op type and by class
+	errors     map[OpType]map[ErrorClass]int64
+	mismatches map[OpType]int64
+	timeouts   map[OpType]int64
+	expired    map[OpType]int64
+	// inserts whose _id already existed, by how they were resolved
+	idConflicts map[IdConflict]int64
+	// the stats of the ops started with a label, by label
+	labelCounts    map[string]int64
+	labelSampled   map[string]int64
+	labelDurations map[string]time.Duration
 
-	total int
+	// when the first and the last ops of any type started, and the ops of
+	// each type started lately, for the wall-clock ops/sec
+	firstStart time.Time
+	lastStart  time.Time
+	recent     map[OpType]*rateWindow
+
+	total          int64
+	ended          int64
+	orphanGetMores int64
+	cursorTimeouts int64
+	malformed      int64
+	// retries of the ops that failed because the primary stepped down
+	stepdownRetries int64
+	// how long the target took to serve all the ops
+	serviceTime time.Duration
+	// how late the ops started compared to their recorded timing
+	drift    time.Duration
+	maxDrift time.Duration
+	drifted  int64
 	// sample rate will be among [0.0-1.0]
-	sampleRate  float64
-	epoch       *time.Time
-	lastOp      *OpType
+	sampleRate float64
+	// per op type overrides of sampleRate
+	sampleRates map[OpType]float64
+	// set by SampleEvenly(), with the share of an op each op type is owed
+	// towards its next sampled op
+	evenly       bool
+	sampleCredit map[OpType]float64
+	// the type of the current op, sampled or not, for EndOpWithError()
+	currentOp OpType
+
+	// the start and type of the op being sampled; epoch is zero when the
+	// current op isn't sampled. Kept as values so the hot path doesn't
+	// allocate.
+	epoch       time.Time
+	lastOp      OpType
+	lastLabel   string
 	latencyChan chan Latency
+	// only every downsample-th sampled latency is sent to latencyChan
+	downsample   int
+	sinceLastOut int
+	// closed by the latency consumer when it stops reading latencyChan
+	latencyDone <-chan struct{}
+	logger      *Logger
+
+	// stop signals for the goroutines started by Subscribe()
+	subscriptions map[<-chan StatsSnapshot]chan struct{}
+	// set by Close(), after which nothing is recorded anymore
+	closed bool
 }
 
 func NewStatsCollector() *StatsCollector {
+	return NewStatsCollectorWithBuckets(DefaultLatencyBuckets)
+}
+
+// NewStatsCollectorWithBuckets creates a collector whose latency histograms
+// use the given, ascending bucket upper bounds.
+func NewStatsCollectorWithBuckets(buckets []time.Duration) *StatsCollector {
+	return newStatsCollector(buckets, AllOpTypes)
+}
+
+// NewStatsCollectorFor creates a collector that only breaks the stats down by
+// the given op types, e.g. the read ops of a read-only replay, so the other
+// types don't clutter the reports. The ops of the other types only count
+// towards Total().
+func NewStatsCollectorFor(opTypes ...OpType) *StatsCollector {
+	return newStatsCollector(DefaultLatencyBuckets, opTypes)
+}
+
+func newStatsCollector(buckets []time.Duration, opTypes []OpType) *StatsCollector {
 	counts := map[OpType]int64{}
 	durations := map[OpType]time.Duration{}
-	for _, opType := range AllOpTypes {
+	histograms := map[OpType]*latencyHistogram{}
+	recent := map[OpType]*rateWindow{}
+	for _, opType := range opTypes {
 		counts[opType] = 0
 		durations[opType] = 0
+		histograms[opType] = newLatencyHistogram(buckets)
+		recent[opType] = &rateWindow{}
 	}
 	collector := &StatsCollector{
-		counts:     counts,
-		durations:  durations,
-		sampleRate: 1,
+		opTypes:        append([]OpType(nil), opTypes...),
+		counts:         counts,
+		sampled:        map[OpType]int64{},
+		durations:      durations,
+		buckets:        buckets,
+		histograms:     histograms,
+		recent:         recent,
+		docSizes:       map[OpType]*sizeHistogram{},
+		queueTimes:     map[OpType]time.Duration{},
+		queued:         map[OpType]int64{},
+		errorCodes:     map[int]int64{},
+		errors:         map[OpType]map[ErrorClass]int64{},
+		mismatches:     map[OpType]int64{},
+		timeouts:       map[OpType]int64{},
+		expired:        map[OpType]int64{},
+		idConflicts:    map[IdConflict]int64{},
+		labelCounts:    map[string]int64{},
+		labelSampled:   map[string]int64{},
+		labelDurations: map[string]time.Duration{},
+		sampleRate:     1,
+		subscriptions:  map[<-chan StatsSnapshot]chan struct{}{},
 	}
 	return collector
 }
 
 func (s *StatsCollector) StartOp(opType OpType) {
+	s.StartLabeledOp(opType, "")
+}
+
+func (s *StatsCollector) StartLabeledOp(opType OpType, label string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.closed {
+		return
+	}
+	s.currentOp = opType
+	now := time.Now()
+	if s.startOp(opType, label, now) {
+		s.epoch = now
+		s.lastOp = opType
+		s.lastLabel = label
+	}
+}
+
+// Count an op started at `now`, and tell whether its latency is sampled. The
+// caller holds the lock.
+func (s *StatsCollector) startOp(opType OpType, label string, now time.Time) bool {
 	s.total++
+	if s.firstStart.IsZero() {
+		s.firstStart = now
+	}
+	s.lastStart = now
+	if _, ok := s.histograms[opType]; !ok {
+		return false
+	}
 	// should track count of opTypes even if they're not sampled
 	s.counts[opType]++
+	s.recent[opType].count(now)
+	if label != "" {
+		s.labelCounts[label]++
+	}
 
-	if s.sampleRate == 0 {
-		return
+	sampleRate := s.sampleRateFor(opType)
+	if sampleRate == 0 {
+		return false
 	}
 
-	if s.sampleRate == 1.0 || rand.Float64() < s.sampleRate {
-		now := time.Now()
-		s.epoch = &now
-		s.lastOp = &opType
+	if sampleRate == 1.0 || s.sample(opType, sampleRate) {
+		s.sampled[opType]++
+		if label != "" {
+			s.labelSampled[label]++
+		}
+		return true
 	}
+	return false
 }
 
 func (s *StatsCollector) EndOp() {
-	// This particular op is not sampled
-	if s.epoch == nil {
+	s.EndOpWithError(nil)
+}
+
+func (s *StatsCollector) EndOpWithError(err error) {
+	s.lock.Lock()
+	if !s.closed {
+		s.ended++
+		if err != nil {
+			s.recordError(s.currentOp, err)
+		}
+	}
+	// This particular op is not sampled, or the collector was closed since
+	if s.epoch.IsZero() {
+		s.lock.Unlock()
+		return
+	}
+
+	latency := Latency{s.lastOp, time.Now().Sub(s.epoch)}
+	latencyChan, latencyDone := s.endOp(latency, s.lastLabel)
+	// s.counts[s.lastOp]++
+	s.epoch = time.Time{}
+	s.lastOp = ""
+	s.lastLabel = ""
+	s.lock.Unlock()
+
+	// Send outside of the lock so a slow consumer doesn't block readers.
+	if latencyChan != nil {
+		s.sendLatency(latencyChan, latencyDone, latency)
+	}
+}
+
+// Count an op of `opType` that failed with `err`. The caller holds the lock.
+func (s *StatsCollector) recordError(opType OpType, err error) {
+	classes, ok := s.errors[opType]
+	if !ok {
+		classes = map[ErrorClass]int64{}
+		s.errors[opType] = classes
+	}
+	classes[ClassifyError(err)]++
+}
+
+// Record the latency of a sampled op, and return the channel to send it to,
+// nil if it isn't sent. The caller holds the lock.
+func (s *StatsCollector) endOp(latency Latency, label string) (chan Latency, <-chan struct{}) {
+	s.durations[latency.OpType] += latency.Latency
+	s.histograms[latency.OpType].record(latency.Latency)
+	if label != "" {
+		s.labelDurations[label] += latency.Latency
+	}
+	latencyChan, latencyDone := s.latencyChan, s.latencyDone
+	if s.downsample > 1 {
+		s.sinceLastOut++
+		if s.sinceLastOut < s.downsample {
+			latencyChan = nil
+		} else {
+			s.sinceLastOut = 0
+		}
+	}
+	return latencyChan, latencyDone
+}
+
+// Whether to sample an op sampled at `sampleRate`: at random, or every
+// 1/sampleRate-th op of its type once SampleEvenly() was called.
+func (s *StatsCollector) sample(opType OpType, sampleRate float64) bool {
+	if !s.evenly {
+		return rand.Float64() < sampleRate
+	}
+	s.sampleCredit[opType] += sampleRate
+	// within rounding, so a rate of 0.1 samples every 10th op
+	if s.sampleCredit[opType] < 1-1e-9 {
+		return false
+	}
+	s.sampleCredit[opType]--
+	return true
+}
+
+// Send a sampled latency to the consumer. If the consumer went away, either
+// by closing the channel or by closing its done channel, we stop sending
+// samples rather than panicking or blocking forever.
+func (s *StatsCollector) sendLatency(latencyChan chan Latency,
+	latencyDone <-chan struct{}, latency Latency) {
+	defer func() {
+		if recover() != nil {
+			s.stopSendingLatencies(latencyChan, "the latency channel was closed")
+		}
+	}()
+	select {
+	case latencyChan <- latency:
+	case <-latencyDone:
+		s.stopSendingLatencies(latencyChan, "the latency consumer is done")
+	}
+}
+
+func (s *StatsCollector) stopSendingLatencies(latencyChan chan Latency, reason string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	// only the first failed send reports it
+	if s.latencyChan != latencyChan {
 		return
 	}
+	s.latencyChan = nil
+	s.latencyDone = nil
+	if s.logger != nil {
+		s.logger.Errorf("Stopped sending sampled latencies: %s", reason)
+	}
+}
 
-	duration := time.Now().Sub(*s.epoch)
-	s.durations[*s.lastOp] += duration
-	// s.counts[*s.lastOp]++
-	if s.latencyChan != nil {
-		s.latencyChan <- Latency{*s.lastOp, duration}
+func (s *StatsCollector) RecordQueueTime(opType OpType, queueTime time.Duration) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.closed {
+		return
+	}
+	s.queueTimes[opType] += queueTime
+	s.queued[opType]++
+}
+
+func (s *StatsCollector) RecordScheduleDrift(drift time.Duration) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.closed {
+		return
+	}
+	s.drift += drift
+	s.drifted++
+	if drift > s.maxDrift {
+		s.maxDrift = drift
+	}
+}
+
+func (s *StatsCollector) RecordErrorCode(code int) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.closed {
+		return
+	}
+	s.errorCodes[code]++
+}
+
+func (s *StatsCollector) RecordResultMismatch(opType OpType) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.closed {
+		return
+	}
+	s.mismatches[opType]++
+}
+
+func (s *StatsCollector) RecordTimeout(opType OpType) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.closed {
+		return
+	}
+	s.timeouts[opType]++
+}
+
+func (s *StatsCollector) RecordMaxTimeExpired(opType OpType) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.closed {
+		return
+	}
+	s.expired[opType]++
+}
+
+// RecordOrphanGetMore counts a getMore whose cursor was never opened on the
+// target, or was opened under a different id.
+func (s *StatsCollector) RecordOrphanGetMore() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.closed {
+		return
+	}
+	s.orphanGetMores++
+}
+
+func (s *StatsCollector) RecordCursorTimeout() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.closed {
+		return
+	}
+	s.cursorTimeouts++
+}
+
+func (s *StatsCollector) RecordMalformed() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.closed {
+		return
 	}
-	s.epoch = nil
-	s.lastOp = nil
+	s.malformed++
+}
+
+func (s *StatsCollector) RecordStepdownRetry() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.closed {
+		return
+	}
+	s.stepdownRetries++
+}
+
+func (s *StatsCollector) RecordServiceTime(serviceTime time.Duration) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.closed {
+		return
+	}
+	s.serviceTime += serviceTime
+}
+
+func (s *StatsCollector) RecordDocSize(opType OpType, size int64) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.closed {
+		return
+	}
+	s.docSizeHistogram(opType).record(size)
+}
+
+// The document size histogram of an op type, created on first use.
+func (s *StatsCollector) docSizeHistogram(opType OpType) *sizeHistogram {
+	histogram, ok := s.docSizes[opType]
+	if !ok {
+		histogram = newSizeHistogram()
+		s.docSizes[opType] = histogram
+	}
+	return histogram
+}
+
+// DocSizeHistogram returns the cumulative histogram of the sizes of the
+// documents written by the ops of `opType`, nil if they wrote none.
+func (s *StatsCollector) DocSizeHistogram(opType OpType) []SizeBucket {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if histogram, ok := s.docSizes[opType]; ok {
+		return histogram.snapshot()
+	}
+	return nil
+}
+
+func (s *StatsCollector) RecordIdConflict(resolution IdConflict) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.closed {
+		return
+	}
+	s.idConflicts[resolution]++
+}
+
+// IdConflicts returns how many inserts had an _id that already existed, by
+// how they were resolved.
+func (s *StatsCollector) IdConflicts() map[IdConflict]int64 {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return copyIdConflicts(s.idConflicts)
+}
+
+func copyIdConflicts(idConflicts map[IdConflict]int64) map[IdConflict]int64 {
+	copied := make(map[IdConflict]int64, len(idConflicts))
+	for resolution, count := range idConflicts {
+		copied[resolution] = count
+	}
+	return copied
+}
+
+// OrphanGetMores returns how many getMores ran on a cursor that was never
+// opened on the target.
+func (s *StatsCollector) OrphanGetMores() int64 {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.orphanGetMores
+}
+
+// CursorTimeouts returns how many queries failed because the server timed out
+// their cursor.
+func (s *StatsCollector) CursorTimeouts() int64 {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.cursorTimeouts
+}
+
+// Malformed returns how many ops were skipped because their recorded
+// namespace is invalid.
+func (s *StatsCollector) Malformed() int64 {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.malformed
+}
+
+// StepdownRetries returns how many times ops were retried because the primary
+// stepped down.
+func (s *StatsCollector) StepdownRetries() int64 {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.stepdownRetries
+}
+
+// ServiceTime returns how long the target took to serve all the ops.
+func (s *StatsCollector) ServiceTime() time.Duration {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.serviceTime
+}
+
+// ResultMismatches returns how many ops of a type returned a different result
+// than the recorded one.
+func (s *StatsCollector) ResultMismatches(opType OpType) int64 {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.mismatches[opType]
+}
+
+// Timeouts returns how many ops of a type took longer than its timeout.
+func (s *StatsCollector) Timeouts(opType OpType) int64 {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.timeouts[opType]
+}
+
+// MaxTimeExpired returns how many ops of a type the server aborted because
+// they ran past their maxTimeMS.
+func (s *StatsCollector) MaxTimeExpired(opType OpType) int64 {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.expired[opType]
+}
+
+// Labels returns the labels ops were started with, in alphabetical order.
+func (s *StatsCollector) Labels() []string {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	labels := make([]string, 0, len(s.labelCounts))
+	for label := range s.labelCounts {
+		labels = append(labels, label)
+	}
+	sort.Strings(labels)
+	return labels
+}
+
+// LabelCount returns how many ops were started with a label.
+func (s *StatsCollector) LabelCount(label string) int64 {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.labelCounts[label]
+}
+
+// LabelLatencyInMs returns the average sampled latency of the ops started with
+// a label.
+func (s *StatsCollector) LabelLatencyInMs(label string) float64 {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.labelLatencyInMs(label)
+}
+
+// LabelOpsSec returns the ops/sec started with a label, over the wall-clock
+// time from the first op to the last one of any label.
+func (s *StatsCollector) LabelOpsSec(label string) float64 {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.labelOpsSec(label)
+}
+
+func (s *StatsCollector) labelOpsSec(label string) float64 {
+	elapsed := s.lastStart.Sub(s.firstStart)
+	if elapsed <= 0 {
+		return 0
+	}
+	return float64(s.labelCounts[label]) / elapsed.Seconds()
+}
+
+func (s *StatsCollector) labelLatencyInMs(label string) float64 {
+	sampled := s.labelSampled[label]
+	if sampled == 0 {
+		return 0
+	}
+	return s.labelDurations[label].Seconds() / float64(sampled) * 1000
+}
+
+// ErrorCodes returns how many failed ops got each server error code.
+func (s *StatsCollector) ErrorCodes() map[int]int64 {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return copyErrorCodes(s.errorCodes)
+}
+
+// Errors returns how many ops failed, by op type and by class, for the op
+// types that had failures.
+func (s *StatsCollector) Errors() map[OpType]map[ErrorClass]int64 {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return copyErrors(s.errors)
+}
+
+func copyErrors(errors map[OpType]map[ErrorClass]int64) map[OpType]map[ErrorClass]int64 {
+	copied := make(map[OpType]map[ErrorClass]int64, len(errors))
+	for opType, classes := range errors {
+		copied[opType] = make(map[ErrorClass]int64, len(classes))
+		for class, count := range classes {
+			copied[opType][class] = count
+		}
+	}
+	return copied
+}
+
+func copyErrorCodes(errorCodes map[int]int64) map[int]int64 {
+	copied := make(map[int]int64, len(errorCodes))
+	for code, count := range errorCodes {
+		copied[code] = count
+	}
+	return copied
 }
 
 func (s *StatsCollector) Count(opType OpType) int64 {
+	s.lock.Lock()
+	defer s.lock.Unlock()
 	return s.counts[opType]
 }
 
+func (s *StatsCollector) sampleRateFor(opType OpType) float64 {
+	if rate, ok := s.sampleRates[opType]; ok {
+		return rate
+	}
+	return s.sampleRate
+}
+
+// MeasureTimingOverhead estimates how much sampling adds to the latency of an
+// op, by timing StartOp and EndOp on a collector that samples every op.
+func MeasureTimingOverhead() time.Duration {
+	const rounds = 1000
+	stats := NewStatsCollector()
+	start := time.Now()
+	for i := 0; i < rounds; i++ {
+		stats.StartOp(Query)
+		stats.EndOp()
+	}
+	return time.Now().Sub(start) / rounds
+}
+
+// SampledCount returns how many ops of a type had their latency sampled.
+func (s *StatsCollector) SampledCount(opType OpType) int64 {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.sampled[opType]
+}
+
+// EffectiveSampleRate returns the fraction of the ops of a type that actually
+// had their latency sampled, which drifts from the configured rate when few
+// ops were executed.
+func (s *StatsCollector) EffectiveSampleRate(opType OpType) float64 {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.effectiveSampleRate(opType)
+}
+
+func (s *StatsCollector) effectiveSampleRate(opType OpType) float64 {
+	if s.counts[opType] == 0 {
+		return 0
+	}
+	return float64(s.sampled[opType]) / float64(s.counts[opType])
+}
+
+// OpTypes returns the op types the stats are broken down by.
+func (s *StatsCollector) OpTypes() []OpType {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return append([]OpType(nil), s.opTypes...)
+}
+
+func (s *StatsCollector) Total() int64 {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.total
+}
+
+// InFlight returns how many ops were started and not ended yet, as of Close()
+// once the collector is closed.
+func (s *StatsCollector) InFlight() int64 {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.total - s.ended
+}
+
 func (s *StatsCollector) TotalTime(opType OpType) time.Duration {
+	s.lock.Lock()
+	defer s.lock.Unlock()
 	return s.durations[opType]
 }
 
 func (s *StatsCollector) OpsSec(opType OpType) float64 {
-	// TODO: This seems like an unusual way to calculate ops/sec. TotalTime returns the total duration spent doing opType
-	// but really we should be dividing total ops / total wall clock time
-	// this may explain why ops/sec per-op is much higher than total ops/sec
-	nano := s.TotalTime(opType).Nanoseconds()
-	if nano == 0 {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.opsSec(opType)
+}
+
+// The ops of the type per second of wall-clock time between the starts of the
+// first and the last ops recorded. Unlike the time since the collector was
+// made, it stays put once the replay is over, and doesn't count the time the
+// workers took to connect.
+func (s *StatsCollector) opsSec(opType OpType) float64 {
+	elapsed := s.lastStart.Sub(s.firstStart)
+	if elapsed <= 0 {
+		return 0
+	}
+	return float64(s.counts[opType]) / elapsed.Seconds()
+}
+
+func (s *StatsCollector) RecentOpsSec(opType OpType) float64 {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.recentOpsSec(opType, time.Now())
+}
+
+func (s *StatsCollector) recentOpsSec(opType OpType, now time.Time) float64 {
+	window, ok := s.recent[opType]
+	if !ok {
 		return 0
 	}
-	return float64(s.counts[opType]) * float64(time.Second) / float64(nano)
+	return window.rate(now, s.firstStart)
 }
 
 func (s *StatsCollector) LatencyInMs(opType OpType) float64 {
-	count := float64(s.counts[opType])
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.latencyInMs(opType)
+}
+
+// LatencyPercentile returns the upper bound of the latency bucket the `p`
+// percentile (between 0.0 and 1.0) of the sampled latencies falls in, e.g.
+// 0.999 for p99.9; see DefaultLatencyBuckets for its accuracy. It's
+// math.MaxInt64 if the percentile is above the highest bucket, and 0 if no
+// latency was sampled. The full histogram is LatencyHistogramSnapshot(), and
+// ExportHistograms() dumps the ones of all the op types.
+func (s *StatsCollector) LatencyPercentile(opType OpType, p float64) time.Duration {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	histogram, ok := s.histograms[opType]
+	if !ok {
+		return 0
+	}
+	return bucketPercentile(histogram.bounds, histogram.counts, p)
+}
+
+// LatencyPercentileInMs returns LatencyPercentile() in milliseconds, +Inf if
+// the percentile is above the highest bucket.
+func (s *StatsCollector) LatencyPercentileInMs(opType OpType, p float64) float64 {
+	percentile := s.LatencyPercentile(opType, p)
+	if percentile == time.Duration(math.MaxInt64) {
+		return math.Inf(1)
+	}
+	return percentile.Seconds() * 1000
+}
+
+// The average sampled latency of `opType`: only the sampled ops add up to its
+// durations.
+func (s *StatsCollector) latencyInMs(opType OpType) float64 {
+	sampled := s.sampled[opType]
+	if sampled == 0 {
+		return 0
+	}
+	return s.durations[opType].Seconds() / float64(sampled) * 1000
+}
+
+// AverageLatencyInMs returns the average sampled latency over all op types.
+func (s *StatsCollector) AverageLatencyInMs() float64 {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	total, sampled := time.Duration(0), int64(0)
+	for _, opType := range AllOpTypes {
+		total += s.durations[opType]
+		sampled += s.sampled[opType]
+	}
+	if sampled == 0 {
+		return 0
+	}
+	return total.Seconds() / float64(sampled) * 1000
+}
+
+func (s *StatsCollector) QueueTimeInMs(opType OpType) float64 {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.queueTimeInMs(opType)
+}
+
+func (s *StatsCollector) queueTimeInMs(opType OpType) float64 {
+	count := float64(s.queued[opType])
 	if count == 0 {
 		return 0
 	}
-	sec := s.TotalTime(opType).Seconds()
-	return sec / count * 1000
+	return s.queueTimes[opType].Seconds() / count * 1000
+}
+
+func (s *StatsCollector) ScheduleDriftInMs() (float64, float64) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.scheduleDriftInMs()
+}
+
+func (s *StatsCollector) scheduleDriftInMs() (float64, float64) {
+	if s.drifted == 0 {
+		return 0, 0
+	}
+	return s.drift.Seconds() / float64(s.drifted) * 1000, s.maxDrift.Seconds() * 1000
+}
+
+// LatencyHistogramSnapshot returns the cumulative histogram of the sampled
+// latencies for an op type, which can be used to compute arbitrary quantiles.
+func (s *StatsCollector) LatencyHistogramSnapshot(opType OpType) []HistBucket {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if histogram, ok := s.histograms[opType]; ok {
+		return histogram.snapshot()
+	}
+	return nil
+}
+
+// OpMix returns the share (between 0.0 and 1.0) of each op type among all the
+// ops counted so far.
+func (s *StatsCollector) OpMix() map[OpType]float64 {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return opMix(s.counts)
+}
+
+// WriteRatio returns the share of ops that modify data.
+func (s *StatsCollector) WriteRatio() float64 {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return writeRatio(s.counts)
 }
+
+// Snapshot takes a consistent, point-in-time copy of the collected stats.
+func (s *StatsCollector) Snapshot() StatsSnapshot {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	snapshot := StatsSnapshot{
+		Total:            s.total,
+		Counts:           map[OpType]int64{},
+		Sampled:          map[OpType]int64{},
+		OpsSec:           map[OpType]float64{},
+		LatencyInMs:      map[OpType]float64{},
+		Histograms:       map[OpType][]HistBucket{},
+		QueueTimeInMs:    map[OpType]float64{},
+		ResultMismatches: map[OpType]int64{},
+		Timeouts:         map[OpType]int64{},
+		MaxTimeExpired:   map[OpType]int64{},
+		ErrorCodes:       copyErrorCodes(s.errorCodes),
+		Errors:           copyErrors(s.errors),
+		OrphanGetMores:   s.orphanGetMores,
+		CursorTimeouts:   s.cursorTimeouts,
+		Malformed:        s.malformed,
+		StepdownRetries:  s.stepdownRetries,
+		ServiceTimeInMs:  s.serviceTime.Seconds() * 1000,
+		IdConflicts:      copyIdConflicts(s.idConflicts),
+		OpMix:            opMix(s.counts),
+		WriteRatio:       writeRatio(s.counts),
+	}
+	for _, opType := range s.opTypes {
+		snapshot.Counts[opType] = s.counts[opType]
+		snapshot.Sampled[opType] = s.sampled[opType]
+		snapshot.OpsSec[opType] = s.opsSec(opType)
+		snapshot.LatencyInMs[opType] = s.latencyInMs(opType)
+		snapshot.Histograms[opType] = s.histograms[opType].snapshot()
+		snapshot.QueueTimeInMs[opType] = s.queueTimeInMs(opType)
+		snapshot.ResultMismatches[opType] = s.mismatches[opType]
+		snapshot.Timeouts[opType] = s.timeouts[opType]
+		snapshot.MaxTimeExpired[opType] = s.expired[opType]
+	}
+	snapshot.ScheduleDriftInMs, snapshot.MaxScheduleDriftInMs = s.scheduleDriftInMs()
+	if len(s.docSizes) > 0 {
+		snapshot.DocSizes = map[OpType][]SizeBucket{}
+		for opType, histogram := range s.docSizes {
+			snapshot.DocSizes[opType] = histogram.snapshot()
+		}
+	}
+	if len(s.labelCounts) > 0 {
+		snapshot.LabelCounts = map[string]int64{}
+		snapshot.LabelOpsSec = map[string]float64{}
+		snapshot.LabelLatencyInMs = map[string]float64{}
+		for label, count := range s.labelCounts {
+			snapshot.LabelCounts[label] = count
+			snapshot.LabelOpsSec[label] = s.labelOpsSec(label)
+			snapshot.LabelLatencyInMs[label] = s.labelLatencyInMs(label)
+		}
+	}
+	return snapshot
+}
+
+// Subscribe emits a Snapshot() on the returned channel every `interval`, until
+// the subscription is cancelled with Unsubscribe(). A subscriber that is
+// slower than `interval` simply misses the snapshots taken meanwhile.
+func (s *StatsCollector) Subscribe(interval time.Duration) <-chan StatsSnapshot {
+	snapshots := make(chan StatsSnapshot)
+	stop := make(chan struct{})
+
+	s.lock.Lock()
+	if s.closed {
+		s.lock.Unlock()
+		close(snapshots)
+		return snapshots
+	}
+	s.subscriptions[snapshots] = stop
+	s.lock.Unlock()
+
+	go func() {
+		defer close(snapshots)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+			}
+			select {
+			case <-stop:
+				return
+			case snapshots <- s.Snapshot():
+			}
+		}
+	}()
+	return snapshots
+}
+
+// Unsubscribe stops the emitter goroutine behind a channel returned by
+// Subscribe(). The channel is closed once the goroutine exits.
+func (s *StatsCollector) Unsubscribe(snapshots <-chan StatsSnapshot) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if stop, ok := s.subscriptions[snapshots]; ok {
+		close(stop)
+		delete(s.subscriptions, snapshots)
+	}
+}
+
 func (s *StatsCollector) SampleLatencies(sampleRate float64, latencyChannel chan Latency) {
+	s.SampleLatenciesUntil(sampleRate, latencyChannel, nil)
+}
+
+// SampleLatenciesUntil is like SampleLatencies, but stops sending latencies
+// once `done` is closed, so a consumer can go away without blocking the
+// workers.
+func (s *StatsCollector) SampleLatenciesUntil(sampleRate float64,
+	latencyChannel chan Latency, done <-chan struct{}) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
 	s.sampleRate = sampleRate
 	s.latencyChan = latencyChannel
+	s.latencyDone = done
+}
+
+// Close ends the collection: the ops recorded afterwards, including the one
+// being sampled, are ignored, so the stats read after Close() are final. The
+// subscriptions are ended and no more latencies are sent; the latency channel
+// is left open, since it's usually shared with other collectors.
+func (s *StatsCollector) Close() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.closed {
+		return
+	}
+	s.closed = true
+	s.epoch = time.Time{}
+	s.latencyChan = nil
+	s.latencyDone = nil
+	for snapshots, stop := range s.subscriptions {
+		close(stop)
+		delete(s.subscriptions, snapshots)
+	}
+}
+
+// DownsampleLatencies sends only every `every`-th sampled latency to the
+// channel given to SampleLatencies(), so the channel traffic stays bounded on
+// huge replays. The stats held by the collector still cover every sampled op.
+func (s *StatsCollector) DownsampleLatencies(every int) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.downsample = every
+	s.sinceLastOut = 0
+}
+
+// SetLatencyBuckets switches the latency histograms to other ascending bucket
+// upper bounds, e.g. to zoom in on a latency range during a long replay. The
+// latencies recorded from then on are bucketed exactly. The ones recorded
+// before can't be: each is moved, as the other histograms added to this one
+// are, to the new bucket that holds the upper bound of its old bucket. So they
+// keep the resolution of the old buckets, and a percentile that falls among
+// them is only as accurate as before.
+func (s *StatsCollector) SetLatencyBuckets(buckets []time.Duration) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for opType, histogram := range s.histograms {
+		rebucketed := newLatencyHistogram(buckets)
+		rebucketed.add(histogram)
+		s.histograms[opType] = rebucketed
+	}
+	s.buckets = buckets
+}
+
+// SampleEvenly samples the ops at evenly spaced intervals instead of at
+// random, e.g. every 4th op of each type for a rate of 0.25, so the same
+// replay samples the same ops from one run to the next.
+func (s *StatsCollector) SampleEvenly() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.evenly = true
+	s.sampleCredit = map[OpType]float64{}
+}
+
+// SetSampleRates samples the op types in `rates` at their own rate instead of
+// the one passed to SampleLatencies(), e.g. to sample every one of a rare op
+// type while sampling few of a frequent one.
+func (s *StatsCollector) SetSampleRates(rates map[OpType]float64) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.sampleRates = map[OpType]float64{}
+	for opType, rate := range rates {
+		s.sampleRates[opType] = rate
+	}
+}
+
+// ParseSampleRates parses per op type sample rates in the format of
+// "<op type>=<rate>[,<op type>=<rate>...]", e.g. "query=1,command.count=0.5".
+func ParseSampleRates(spec string) (map[OpType]float64, error) {
+	rates := map[OpType]float64{}
+	if spec == "" {
+		return rates, nil
+	}
+	for _, target := range strings.Split(spec, ",") {
+		parts := strings.SplitN(target, "=", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("invalid sample rate %q, expected <op type>=<rate>", target)
+		}
+		opType := OpType(strings.TrimSpace(parts[0]))
+		if !isKnownOpType(opType) {
+			return nil, fmt.Errorf("unknown op type %q in sample rate %q", opType, target)
+		}
+		rate, err := strconv.ParseFloat(strings.TrimSpace(parts[1]), 64)
+		if err != nil || rate < 0 || rate > 1 {
+			return nil, fmt.Errorf("invalid sample rate %q, expected a rate between 0.0 and 1.0", target)
+		}
+		rates[opType] = rate
+	}
+	return rates, nil
+}
+
+// SetLogger sets where the collector reports problems, e.g. losing its
+// latency consumer.
+func (s *StatsCollector) SetLogger(logger *Logger) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.logger = logger
+}
+
+// When combining collectors, sample rates that differ by more than this factor
+// make the combined latencies meaningless.
+const maxSampleRateSpread = 2.0
+
+// CombineStatsChecked is like CombineStats, but refuses to combine collectors
+// that were configured too differently for the aggregate to make sense.
+func CombineStatsChecked(statsList ...*StatsCollector) (*StatsCollector, error) {
+	if err := checkCompatible(statsList...); err != nil {
+		return nil, err
+	}
+	return CombineStats(statsList...), nil
+}
+
+// The bounds of the latency buckets, which SetLatencyBuckets() may change
+// while the stats are read.
+func (s *StatsCollector) latencyBuckets() []time.Duration {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.buckets
+}
+
+func checkCompatible(statsList ...*StatsCollector) error {
+	if len(statsList) == 0 {
+		return nil
+	}
+	buckets := statsList[0].latencyBuckets()
+	for _, stats := range statsList {
+		if !sameBuckets(buckets, stats.latencyBuckets()) {
+			return errors.New("cannot combine stats with different latency buckets")
+		}
+	}
+	for _, opType := range AllOpTypes {
+		minRate, maxRate := 1.0, 0.0
+		for _, stats := range statsList {
+			stats.lock.Lock()
+			rate := stats.sampleRateFor(opType)
+			stats.lock.Unlock()
+			minRate = math.Min(minRate, rate)
+			maxRate = math.Max(maxRate, rate)
+		}
+		if maxRate != 0 && (minRate == 0 || maxRate/minRate > maxSampleRateSpread) {
+			return fmt.Errorf("cannot combine %s stats with sample rates between %v and %v",
+				opType, minRate, maxRate)
+		}
+	}
+	return nil
 }
 
 // Combine the stats collected by multiple stats to one.
 func CombineStats(statsList ...*StatsCollector) *StatsCollector {
 	newStats := NewStatsCollector()
+	if len(statsList) > 0 {
+		newStats = newStatsCollector(statsList[0].buckets, combinedOpTypes(statsList))
+	}
+
+	for _, stats := range statsList {
+		newStats.Add(stats)
+	}
+	return newStats
+}
 
+// The op types any of the collectors breaks the stats down by, in the order
+// of AllOpTypes.
+func combinedOpTypes(statsList []*StatsCollector) []OpType {
+	combined := map[OpType]bool{}
+	for _, stats := range statsList {
+		for _, opType := range stats.opTypes {
+			combined[opType] = true
+		}
+	}
+	opTypes := []OpType{}
 	for _, opType := range AllOpTypes {
-		for _, stats := range statsList {
-			newStats.counts[opType] += stats.counts[opType]
-			newStats.durations[opType] += stats.durations[opType]
-			newStats.total += stats.total
+		if combined[opType] {
+			opTypes = append(opTypes, opType)
 		}
 	}
-	return newStats
+	return opTypes
+}
+
+// Add merges the stats collected by `other` into this collector, e.g. to fold
+// the collectors of the workers into a running total as they finish. Only the
+// stats are merged: the sampling settings of this collector are kept, and
+// nothing is added once it is closed. Latencies are rebucketed when the two
+// collectors use different buckets.
+func (s *StatsCollector) Add(other *StatsCollector) {
+	// Copy `other` first, so the two locks are never held together, which
+	// could deadlock two collectors added to each other.
+	other.lock.Lock()
+	delta := newStatsCollector(other.buckets, other.opTypes)
+	delta.add(other)
+	other.lock.Unlock()
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.closed {
+		return
+	}
+	s.add(delta)
+}
+
+// add merges the stats of `other` into s, whose locks the caller holds.
+func (s *StatsCollector) add(other *StatsCollector) {
+	for _, opType := range s.opTypes {
+		s.counts[opType] += other.counts[opType]
+		s.sampled[opType] += other.sampled[opType]
+		s.durations[opType] += other.durations[opType]
+		if histogram, ok := other.histograms[opType]; ok {
+			s.histograms[opType].add(histogram)
+		}
+		s.queueTimes[opType] += other.queueTimes[opType]
+		s.queued[opType] += other.queued[opType]
+		s.mismatches[opType] += other.mismatches[opType]
+		s.timeouts[opType] += other.timeouts[opType]
+		s.expired[opType] += other.expired[opType]
+		if window, ok := other.recent[opType]; ok {
+			s.recent[opType].add(window)
+		}
+	}
+	if !other.firstStart.IsZero() &&
+		(s.firstStart.IsZero() || other.firstStart.Before(s.firstStart)) {
+		s.firstStart = other.firstStart
+	}
+	if other.lastStart.After(s.lastStart) {
+		s.lastStart = other.lastStart
+	}
+	s.total += other.total
+	s.ended += other.ended
+	s.orphanGetMores += other.orphanGetMores
+	s.cursorTimeouts += other.cursorTimeouts
+	s.malformed += other.malformed
+	s.stepdownRetries += other.stepdownRetries
+	s.serviceTime += other.serviceTime
+	for opType, histogram := range other.docSizes {
+		s.docSizeHistogram(opType).add(histogram)
+	}
+	for label, count := range other.labelCounts {
+		s.labelCounts[label] += count
+		s.labelSampled[label] += other.labelSampled[label]
+		s.labelDurations[label] += other.labelDurations[label]
+	}
+	s.drift += other.drift
+	s.drifted += other.drifted
+	if other.maxDrift > s.maxDrift {
+		s.maxDrift = other.maxDrift
+	}
+	for code, count := range other.errorCodes {
+		s.errorCodes[code] += count
+	}
+	for opType, classes := range other.errors {
+		for class, count := range classes {
+			if _, ok := s.errors[opType]; !ok {
+				s.errors[opType] = map[ErrorClass]int64{}
+			}
+			s.errors[opType][class] += count
+		}
+	}
+	for resolution, count := range other.idConflicts {
+		s.idConflicts[resolution] += count
+	}
+}
+
+// StatsSnapshot is a point-in-time, JSON-serializable copy of the stats held by
+// a StatsCollector.
+type StatsSnapshot struct {
+	Total            int64                   `json:"total"`
+	Counts           map[OpType]int64        `json:"counts"`
+	Sampled          map[OpType]int64        `json:"sampled"`
+	OpsSec           map[OpType]float64      `json:"ops_sec"`
+	LatencyInMs      map[OpType]float64      `json:"latency_ms"`
+	Histograms       map[OpType][]HistBucket `json:"latency_histograms"`
+	QueueTimeInMs    map[OpType]float64      `json:"queue_time_ms"`
+	ErrorCodes       map[int]int64           `json:"error_codes"`
+	OrphanGetMores   int64                   `json:"orphan_getmores"`
+	CursorTimeouts   int64                   `json:"cursor_timeouts"`
+	Malformed        int64                   `json:"malformed"`
+	StepdownRetries  int64                   `json:"stepdown_retries"`
+	ServiceTimeInMs  float64                 `json:"service_time_ms"`
+	IdConflicts      map[IdConflict]int64    `json:"id_conflicts"`
+	ResultMismatches map[OpType]int64        `json:"result_mismatches"`
+	Timeouts         map[OpType]int64        `json:"timeouts"`
+	MaxTimeExpired   map[OpType]int64        `json:"max_time_expired"`
+	OpMix            map[OpType]float64      `json:"op_mix"`
+	WriteRatio       float64                 `json:"write_ratio"`
+
+	// how late the ops started compared to their recorded timing, on average
+	// and at most
+	ScheduleDriftInMs    float64 `json:"schedule_drift_ms"`
+	MaxScheduleDriftInMs float64 `json:"max_schedule_drift_ms"`
+
+	// the failed ops, by op type and ErrorClass
+	Errors map[OpType]map[ErrorClass]int64 `json:"errors"`
+
+	// the stats of the ops started with a label, by label
+	LabelCounts      map[string]int64   `json:"label_counts,omitempty"`
+	LabelOpsSec      map[string]float64 `json:"label_ops_sec,omitempty"`
+	LabelLatencyInMs map[string]float64 `json:"label_latency_ms,omitempty"`
+
+	// the sizes of the documents written, by op type
+	DocSizes map[OpType][]SizeBucket `json:"doc_size_histograms,omitempty"`
+
+	// the ops/sec over a rolling window and the moving average of the
+	// latency of each op type, when the snapshot is taken by LiveStats
+	RecentOpsSec    map[OpType]float64 `json:"recent_ops_sec,omitempty"`
+	EWMALatencyInMs map[OpType]float64 `json:"ewma_latency_ms,omitempty"`
+}
+
+func opMix(counts map[OpType]int64) map[OpType]float64 {
+	total := int64(0)
+	for _, opType := range AllOpTypes {
+		total += counts[opType]
+	}
+	mix := map[OpType]float64{}
+	for _, opType := range AllOpTypes {
+		mix[opType] = 0
+		if total != 0 {
+			mix[opType] = float64(counts[opType]) / float64(total)
+		}
+	}
+	return mix
+}
+
+func writeRatio(counts map[OpType]int64) float64 {
+	total, writes := int64(0), int64(0)
+	for _, opType := range AllOpTypes {
+		total += counts[opType]
+		if opType.IsWrite() {
+			writes += counts[opType]
+		}
+	}
+	if total == 0 {
+		return 0
+	}
+	return float64(writes) / float64(total)
+}
+
+// FormatOpMix renders an op mix as a one-line summary such as
+// "65% query, 20% update, 15% insert", largest share first. Op types that
+// were never seen are left out.
+func FormatOpMix(mix map[OpType]float64) string {
+	opTypes := []OpType{}
+	for _, opType := range AllOpTypes {
+		if mix[opType] > 0 {
+			opTypes = append(opTypes, opType)
+		}
+	}
+	sort.SliceStable(opTypes, func(i, j int) bool {
+		return mix[opTypes[i]] > mix[opTypes[j]]
+	})
+	parts := make([]string, 0, len(opTypes))
+	for _, opType := range opTypes {
+		parts = append(parts, fmt.Sprintf("%.0f%% %s", mix[opType]*100, opType))
+	}
+	if len(parts) == 0 {
+		return "no ops"
+	}
+	return strings.Join(parts, ", ")
 }
 
 // NullStatsCollector is a placeholder that does nothing.
 type nullStatsCollector struct{}
 
 func (e *nullStatsCollector) StartOp(opType OpType)                                           {}
+func (e *nullStatsCollector) StartLabeledOp(opType OpType, label string)                      {}
 func (e *nullStatsCollector) EndOp()                                                          {}
+func (e *nullStatsCollector) EndOpWithError(err error)                                        {}
+func (e *nullStatsCollector) RecordQueueTime(opType OpType, queueTime time.Duration)          {}
+func (e *nullStatsCollector) RecordScheduleDrift(drift time.Duration)                         {}
+func (e *nullStatsCollector) RecordErrorCode(code int)                                        {}
+func (e *nullStatsCollector) RecordResultMismatch(opType OpType)                              {}
+func (e *nullStatsCollector) RecordTimeout(opType OpType)                                     {}
+func (e *nullStatsCollector) RecordMaxTimeExpired(opType OpType)                              {}
+func (e *nullStatsCollector) RecordOrphanGetMore()                                            {}
+func (e *nullStatsCollector) RecordCursorTimeout()                                            {}
+func (e *nullStatsCollector) RecordMalformed()                                                {}
+func (e *nullStatsCollector) RecordStepdownRetry()                                            {}
+func (e *nullStatsCollector) RecordServiceTime(serviceTime time.Duration)                     {}
+func (e *nullStatsCollector) RecordDocSize(opType OpType, size int64)                         {}
+func (e *nullStatsCollector) RecordIdConflict(resolution IdConflict)                          {}
 func (e *nullStatsCollector) SampleLatencies(sampleRate float64, latencyChannel chan Latency) {}
 func (e *nullStatsCollector) Count(opType OpType) int64                                       { return 0 }
+func (e *nullStatsCollector) Total() int64                                                    { return 0 }
 func (e *nullStatsCollector) TotalTime(opType OpType) time.Duration                           { return 0 }
 func (e *nullStatsCollector) OpsSec(opType OpType) float64                                    { return 0 }
+func (e *nullStatsCollector) RecentOpsSec(opType OpType) float64                              { return 0 }
 func (e *nullStatsCollector) LatencyInMs(opType OpType) float64                               { return 0 }
+func (e *nullStatsCollector) LatencyPercentileInMs(opType OpType, p float64) float64          { return 0 }
+func (e *nullStatsCollector) QueueTimeInMs(opType OpType) float64                             { return 0 }
+func (e *nullStatsCollector) ScheduleDriftInMs() (float64, float64)                           { return 0, 0 }
+
+// Every collector implements the whole interface, so forgetting a method of
+// one of them when the interface grows breaks the build right here.
+var (
+	_ IStatsCollector = (*StatsCollector)(nil)
+	_ IStatsCollector = (*nullStatsCollector)(nil)
+	_ IStatsCollector = (*multiStatsCollector)(nil)
+	_ IStatsCollector = (*sharedWorkerStats)(nil)
+)
 
 // NewNullStatsCollector makes a dumb stats collector that does nothing.
 func NewNullStatsCollector() IStatsCollector {
 	return &nullStatsCollector{}
 }
+
+// multiStatsCollector fans the recorded ops out to several collectors.
+type multiStatsCollector struct {
+	collectors []IStatsCollector
+	// answers the read methods
+	first IStatsCollector
+}
+
+// MultiStatsCollector makes a stats collector that records every op into all
+// of `collectors`, e.g. to keep the stats in memory while also forwarding them
+// to a metrics system. The read methods are answered by the first collector.
+// Each collector samples latencies on its own, so giving them the same
+// latency channel sends each sampled latency once per collector.
+func MultiStatsCollector(collectors ...IStatsCollector) IStatsCollector {
+	first := NewNullStatsCollector()
+	if len(collectors) > 0 {
+		first = collectors[0]
+	}
+	return &multiStatsCollector{collectors, first}
+}
+
+func (m *multiStatsCollector) StartOp(opType OpType) {
+	for _, collector := range m.collectors {
+		collector.StartOp(opType)
+	}
+}
+
+func (m *multiStatsCollector) StartLabeledOp(opType OpType, label string) {
+	for _, collector := range m.collectors {
+		collector.StartLabeledOp(opType, label)
+	}
+}
+
+func (m *multiStatsCollector) EndOp() {
+	for _, collector := range m.collectors {
+		collector.EndOp()
+	}
+}
+
+func (m *multiStatsCollector) EndOpWithError(err error) {
+	for _, collector := range m.collectors {
+		collector.EndOpWithError(err)
+	}
+}
+
+func (m *multiStatsCollector) RecordQueueTime(opType OpType, queueTime time.Duration) {
+	for _, collector := range m.collectors {
+		collector.RecordQueueTime(opType, queueTime)
+	}
+}
+
+func (m *multiStatsCollector) RecordScheduleDrift(drift time.Duration) {
+	for _, collector := range m.collectors {
+		collector.RecordScheduleDrift(drift)
+	}
+}
+
+func (m *multiStatsCollector) RecordErrorCode(code int) {
+	for _, collector := range m.collectors {
+		collector.RecordErrorCode(code)
+	}
+}
+
+func (m *multiStatsCollector) RecordTimeout(opType OpType) {
+	for _, collector := range m.collectors {
+		collector.RecordTimeout(opType)
+	}
+}
+
+func (m *multiStatsCollector) RecordMaxTimeExpired(opType OpType) {
+	for _, collector := range m.collectors {
+		collector.RecordMaxTimeExpired(opType)
+	}
+}
+
+func (m *multiStatsCollector) RecordResultMismatch(opType OpType) {
+	for _, collector := range m.collectors {
+		collector.RecordResultMismatch(opType)
+	}
+}
+
+func (m *multiStatsCollector) RecordOrphanGetMore() {
+	for _, collector := range m.collectors {
+		collector.RecordOrphanGetMore()
+	}
+}
+
+func (m *multiStatsCollector) RecordCursorTimeout() {
+	for _, collector := range m.collectors {
+		collector.RecordCursorTimeout()
+	}
+}
+
+func (m *multiStatsCollector) RecordMalformed() {
+	for _, collector := range m.collectors {
+		collector.RecordMalformed()
+	}
+}
+
+func (m *multiStatsCollector) RecordStepdownRetry() {
+	for _, collector := range m.collectors {
+		collector.RecordStepdownRetry()
+	}
+}
+
+func (m *multiStatsCollector) RecordServiceTime(serviceTime time.Duration) {
+	for _, collector := range m.collectors {
+		collector.RecordServiceTime(serviceTime)
+	}
+}
+
+func (m *multiStatsCollector) RecordDocSize(opType OpType, size int64) {
+	for _, collector := range m.collectors {
+		collector.RecordDocSize(opType, size)
+	}
+}
+
+func (m *multiStatsCollector) RecordIdConflict(resolution IdConflict) {
+	for _, collector := range m.collectors {
+		collector.RecordIdConflict(resolution)
+	}
+}
+
+func (m *multiStatsCollector) SampleLatencies(sampleRate float64, latencyChannel chan Latency) {
+	for _, collector := range m.collectors {
+		collector.SampleLatencies(sampleRate, latencyChannel)
+	}
+}
+
+func (m *multiStatsCollector) Count(opType OpType) int64         { return m.first.Count(opType) }
+func (m *multiStatsCollector) Total() int64                      { return m.first.Total() }
+func (m *multiStatsCollector) OpsSec(opType OpType) float64      { return m.first.OpsSec(opType) }
+func (m *multiStatsCollector) LatencyInMs(opType OpType) float64 { return m.first.LatencyInMs(opType) }
+func (m *multiStatsCollector) LatencyPercentileInMs(opType OpType, p float64) float64 {
+	return m.first.LatencyPercentileInMs(opType, p)
+}
+func (m *multiStatsCollector) RecentOpsSec(opType OpType) float64 {
+	return m.first.RecentOpsSec(opType)
+}
+func (m *multiStatsCollector) QueueTimeInMs(opType OpType) float64 {
+	return m.first.QueueTimeInMs(opType)
+}
+
+func (m *multiStatsCollector) ScheduleDriftInMs() (float64, float64) {
+	return m.first.ScheduleDriftInMs()
+}
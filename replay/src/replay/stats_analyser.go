@@ -2,6 +2,8 @@ package replay
 
 import (
 	"sort"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -37,19 +39,7 @@ func NewStatsAnalyzer(
 		lastEndPos[opType] = 0
 	}
 
-	go func() {
-		for {
-			op, ok := <-latencyChan
-			if !ok {
-				break
-			}
-			latencies[op.OpType] = append(
-				latencies[op.OpType], int64(op.Latency),
-			)
-		}
-	}()
-
-	return &StatsAnalyzer{
+	analyzer := &StatsAnalyzer{
 		statsCollectors: statsCollectors,
 		opsExecuted:     opsExecuted,
 		opsExecutedLast: 0,
@@ -60,7 +50,22 @@ func NewStatsAnalyzer(
 		lastEndPos:      lastEndPos,
 		counts:		 counts,
 		countsLast:	 countsLast,
+		timingOverhead:  MeasureTimingOverhead(),
 	}
+	go func() {
+		for {
+			op, ok := <-latencyChan
+			if !ok {
+				break
+			}
+			analyzer.lock.Lock()
+			latencies[op.OpType] = append(
+				latencies[op.OpType], int64(op.Latency),
+			)
+			analyzer.lock.Unlock()
+		}
+	}()
+	return analyzer
 }
 
 // ExecutionStatus encapsulates the aggregated information for the execution
@@ -72,12 +77,92 @@ type ExecutionStatus struct {
 	// OpsPerSecLast stores the ops/sec since the last call to GetStatus()
 	OpsPerSecLast	   float64
 	Duration           time.Duration
+	// OpTypes stores the op types the stats are broken down by
+	OpTypes            []OpType
 	AllTimeLatencies   map[OpType][]int64
 	SinceLastLatencies map[OpType][]int64
 	Counts             map[OpType]int64
 	CountsLast         map[OpType]int64
 	TypeOpsSec         map[OpType]float64
 	TypeOpsSecLast     map[OpType]float64
+	// SampleRates stores the fraction of ops whose latency was sampled
+	SampleRates        map[OpType]float64
+	// TimingOverhead stores how much sampling adds to the latency of an op
+	TimingOverhead     time.Duration
+	// QueueTimeInMs stores the average time ops waited for a worker
+	QueueTimeInMs      map[OpType]float64
+	// ResultMismatches stores how many replayed results differed from the
+	// recorded ones
+	ResultMismatches   map[OpType]int64
+	// Timeouts stores how many ops took longer than the timeout of their type
+	Timeouts           map[OpType]int64
+	// MaxTimeExpired stores how many reads the server aborted because they
+	// ran past their maxTimeMS
+	MaxTimeExpired     map[OpType]int64
+	// ErrorCodes stores how many failed ops got each server error code
+	ErrorCodes         map[int]int64
+	// Errors stores how many ops failed, by op type and ErrorClass
+	Errors             map[OpType]map[ErrorClass]int64
+	// OrphanGetMores stores how many getMores ran on a cursor that was never
+	// opened on the target
+	OrphanGetMores     int64
+	// CursorTimeouts stores how many queries failed because the server timed
+	// out their cursor
+	CursorTimeouts     int64
+	// Malformed stores how many ops were skipped because their recorded
+	// namespace is invalid
+	Malformed          int64
+	// StepdownRetries stores how many times ops were retried because the
+	// primary stepped down
+	StepdownRetries    int64
+	// ServiceTime stores how long the target took to serve all the ops,
+	// over all the workers
+	ServiceTime        time.Duration
+	// IdleTime stores how long the dispatcher slept waiting for the ops to
+	// be due. It's set by the owner of the dispatcher, for timed replays.
+	IdleTime           time.Duration
+	// TimeToFirstOp stores how long after the start the first op ran, and
+	// SlowestDial how long the slowest session took to connect, authenticate
+	// and discover the topology. They're set by the owner of the sessions.
+	TimeToFirstOp      time.Duration
+	SlowestDial        time.Duration
+	// ScheduleDriftInMs and MaxScheduleDriftInMs store how late the ops
+	// started compared to their recorded timing, on average and at most
+	ScheduleDriftInMs    float64
+	MaxScheduleDriftInMs float64
+	// LabelCounts, LabelOpsSec and LabelLatencyInMs store the count, the
+	// throughput and the average latency of the ops by label, when the ops
+	// are labeled
+	LabelCounts      map[string]int64
+	LabelOpsSec      map[string]float64
+	LabelLatencyInMs map[string]float64
+	// DocSizes stores the histogram of the sizes of the documents written by
+	// each op type that wrote any
+	DocSizes map[OpType][]SizeBucket
+	// TailLatenciesInMs stores the P99.9 and P99.99 latencies of each op
+	// type, out of the latency histograms
+	TailLatenciesInMs map[OpType][]float64
+	// IdConflicts stores how many inserts had an _id that already existed,
+	// by how they were resolved
+	IdConflicts        map[IdConflict]int64
+	// QueueDepth stores how many dispatched ops are waiting for a worker. It's
+	// set by the owner of the ops queue.
+	QueueDepth         int
+	// PoolWaits stores how often ops waited for a free connection. It's set
+	// by the owner of the sessions, when it tracks them.
+	PoolWaits          PoolWaits
+	// GCPauses stores how long the garbage collector paused the replay's
+	// process. It's set by the owner of the run, when it tracks them.
+	GCPauses           GCPauses
+	// WorkerCounts, WorkerOpsSec and WorkerLatencyInMs store the ops executed,
+	// ops/sec and average sampled latency of each worker, in worker order
+	WorkerCounts       []int64
+	WorkerOpsSec       []float64
+	WorkerLatencyInMs  []float64
+	// OpMix stores the share of each op type among all executed ops
+	OpMix              map[OpType]float64
+	// WriteRatio stores the share of executed ops that modify data
+	WriteRatio         float64
 }
 
 type StatsAnalyzer struct {
@@ -87,6 +172,9 @@ type StatsAnalyzer struct {
 	// store ops executed at the time of the last GetStatus() call
 	opsExecutedLast int64
 	latencyChan     chan Latency
+	// guards latencies, which are appended to as they are sampled, so
+	// GetStatus() can be called while the replay runs
+	lock            sync.Mutex
 	latencies       map[OpType][]int64
 	// Store the start of the run
 	epoch           time.Time
@@ -95,20 +183,32 @@ type StatsAnalyzer struct {
 	lastEndPos      map[OpType]int
 	counts          map[OpType]int64
 	countsLast	map[OpType]int64
+	// measured once, as the analyzer is made, so it's not measured against
+	// the replay's own load
+	timingOverhead  time.Duration
+	// breaks the ops down by worker when set, else by collector
+	workers         *SharedStatsCollector
+}
+
+// BreakDownByWorker has the status break the ops down by the workers of
+// `shared` rather than by the collectors, which are its shards.
+func (self *StatsAnalyzer) BreakDownByWorker(shared *SharedStatsCollector) {
+	self.workers = shared
 }
 
 func (self *StatsAnalyzer) GetStatus() *ExecutionStatus {
 	// Basics
 	duration := time.Now().Sub(self.epoch)
+	opsExecuted := atomic.LoadInt64(self.opsExecuted)
 	opsPerSec := 0.0
 	if duration != 0 {
-		opsPerSec = float64(*self.opsExecuted) * float64(time.Second) / float64(duration)
+		opsPerSec = float64(opsExecuted) * float64(time.Second) / float64(duration)
 	}
 	// Calculate ops/sec since last call to GetStatus()
 	lastDuration := time.Now().Sub(self.timeLast)
 	opsPerSecLast := 0.0
 	if lastDuration != 0 {
-		opsPerSecLast = float64(*self.opsExecuted - self.opsExecutedLast) * float64(time.Second) / float64(lastDuration)
+		opsPerSecLast = float64(opsExecuted - self.opsExecutedLast) * float64(time.Second) / float64(lastDuration)
 	}
 	
 	self.timeLast = time.Now()
@@ -119,18 +219,31 @@ func (self *StatsAnalyzer) GetStatus() *ExecutionStatus {
 	sinceLastLatencies := make(map[OpType][]int64)
 	typeOpsSec := make(map[OpType]float64)
 	typeOpsSecLast := make(map[OpType]float64)
+	sampleRates := make(map[OpType]float64)
+	queueTimeInMs := make(map[OpType]float64)
+	resultMismatches := make(map[OpType]int64)
+	timeouts := make(map[OpType]int64)
+	expired := make(map[OpType]int64)
 
 	for _, opType := range AllOpTypes {
 		// take a snapshot of current status since the latency list keeps
-		// increasing.
-		length := len(self.latencies[opType])
-		snapshot := self.latencies[opType][:length]
+		// increasing. It's a copy, which gets sorted while more latencies
+		// are appended.
+		self.lock.Lock()
+		snapshot := append([]int64(nil), self.latencies[opType]...)
+		self.lock.Unlock()
+		length := len(snapshot)
 		lastEndPos := self.lastEndPos[opType]
 		self.lastEndPos[opType] = length
 		sinceLastLatencies[opType] =
 			CalculateLatencyStats(snapshot[lastEndPos:])
 		allTimeLatencies[opType] = CalculateLatencyStats(snapshot)
 		self.counts[opType] = stats.Count(opType)
+		sampleRates[opType] = stats.EffectiveSampleRate(opType)
+		queueTimeInMs[opType] = stats.QueueTimeInMs(opType)
+		resultMismatches[opType] = stats.ResultMismatches(opType)
+		timeouts[opType] = stats.Timeouts(opType)
+		expired[opType] = stats.MaxTimeExpired(opType)
 		
 		typeOpsSec[opType] = 0.0
 		typeOpsSecLast[opType] = 0.0
@@ -143,6 +256,26 @@ func (self *StatsAnalyzer) GetStatus() *ExecutionStatus {
 		
 	}
 	
+	var workerCounts []int64
+	var workerLatencyInMs []float64
+	if self.workers != nil {
+		workerCounts = self.workers.WorkerTotals()
+		workerLatencyInMs = self.workers.WorkerLatenciesInMs()
+	} else {
+		workerCounts = make([]int64, len(self.statsCollectors))
+		workerLatencyInMs = make([]float64, len(self.statsCollectors))
+		for i, collector := range self.statsCollectors {
+			workerCounts[i] = collector.Total()
+			workerLatencyInMs[i] = collector.AverageLatencyInMs()
+		}
+	}
+	workerOpsSec := make([]float64, len(workerCounts))
+	for i := range workerCounts {
+		if duration != 0 {
+			workerOpsSec[i] = float64(workerCounts[i]) * float64(time.Second) / float64(duration)
+		}
+	}
+
 	// have to copy values for countsLast into a new object before returning them
 	countsLast := make(map[OpType]int64)
 	for _, opType := range AllOpTypes {
@@ -150,9 +283,10 @@ func (self *StatsAnalyzer) GetStatus() *ExecutionStatus {
 	}
 
 	status := ExecutionStatus{
-		OpsExecuted:        *self.opsExecuted,
+		OpsExecuted:        opsExecuted,
 		OpsExecutedLast:    self.opsExecutedLast,
 		Duration:           duration,
+		OpTypes:            stats.OpTypes(),
 		OpsPerSec:          opsPerSec,
 		OpsPerSecLast:	    opsPerSecLast,
 		AllTimeLatencies:   allTimeLatencies,
@@ -161,10 +295,51 @@ func (self *StatsAnalyzer) GetStatus() *ExecutionStatus {
 		CountsLast:         countsLast,
 		TypeOpsSec:         typeOpsSec,
 		TypeOpsSecLast:     typeOpsSecLast,
+		SampleRates:        sampleRates,
+		TimingOverhead:     self.timingOverhead,
+		QueueTimeInMs:      queueTimeInMs,
+		ResultMismatches:   resultMismatches,
+		Timeouts:           timeouts,
+		MaxTimeExpired:     expired,
+		ErrorCodes:         stats.ErrorCodes(),
+		Errors:             stats.Errors(),
+		OrphanGetMores:     stats.OrphanGetMores(),
+		CursorTimeouts:     stats.CursorTimeouts(),
+		Malformed:          stats.Malformed(),
+		StepdownRetries:    stats.StepdownRetries(),
+		ServiceTime:        stats.ServiceTime(),
+		IdConflicts:        stats.IdConflicts(),
+		WorkerCounts:       workerCounts,
+		WorkerOpsSec:       workerOpsSec,
+		WorkerLatencyInMs:  workerLatencyInMs,
+		OpMix:              stats.OpMix(),
+		WriteRatio:         stats.WriteRatio(),
+	}
+	status.ScheduleDriftInMs, status.MaxScheduleDriftInMs = stats.ScheduleDriftInMs()
+	status.LabelCounts = map[string]int64{}
+	status.LabelOpsSec = map[string]float64{}
+	status.LabelLatencyInMs = map[string]float64{}
+	for _, label := range stats.Labels() {
+		status.LabelCounts[label] = stats.LabelCount(label)
+		status.LabelOpsSec[label] = stats.LabelOpsSec(label)
+		status.LabelLatencyInMs[label] = stats.LabelLatencyInMs(label)
+	}
+	status.DocSizes = map[OpType][]SizeBucket{}
+	for _, opType := range AllOpTypes {
+		if sizes := stats.DocSizeHistogram(opType); sizes != nil {
+			status.DocSizes[opType] = sizes
+		}
+	}
+	status.TailLatenciesInMs = map[OpType][]float64{}
+	for _, opType := range stats.OpTypes() {
+		status.TailLatenciesInMs[opType] = []float64{
+			stats.LatencyPercentileInMs(opType, 0.999),
+			stats.LatencyPercentileInMs(opType, 0.9999),
+		}
 	}
 	
 	// store the latest values in the "last" variables
-	self.opsExecutedLast = *self.opsExecuted
+	self.opsExecutedLast = opsExecuted
 	for _, opType := range AllOpTypes {
 		self.countsLast[opType] = self.counts[opType]
 	}
@@ -92,3 +92,21 @@ func (s *TestStatsAnalyzerSuite) TestLatencies(c *C) {
 		start += 2000
 	}
 }
+
+func (s *TestStatsAnalyzerSuite) TestWorkers(c *C) {
+	opsExecuted := int64(3)
+	workers := []*StatsCollector{NewStatsCollector(), NewStatsCollector()}
+	for i := 0; i < 2; i++ {
+		workers[0].StartOp(Query)
+		workers[0].EndOp()
+	}
+	workers[1].StartOp(Insert)
+	workers[1].EndOp()
+
+	analyser := NewStatsAnalyzer(workers, &opsExecuted, make(chan Latency), 1000)
+	status := analyser.GetStatus()
+	c.Assert(status.WorkerCounts, DeepEquals, []int64{2, 1})
+	c.Assert(status.WorkerOpsSec, HasLen, 2)
+	c.Assert(status.WorkerOpsSec[0] > status.WorkerOpsSec[1], Equals, true)
+	c.Assert(status.WorkerLatencyInMs, HasLen, 2)
+}
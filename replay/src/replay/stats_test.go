@@ -0,0 +1,631 @@
+package replay
+
+import (
+	"bytes"
+	. "gopkg.in/check.v1"
+	"math"
+	"reflect"
+	"testing"
+	"time"
+)
+
+type TestStatsCollectorSuite struct{}
+
+var _ = Suite(&TestStatsCollectorSuite{})
+
+// Replays `ops` ops of `opType` on `stats`, each recorded at `latency`
+// whatever the sample rate. A zero latency records none, so with the sampling
+// off, the histograms only have the latencies set by the tests.
+func replayOps(stats *StatsCollector, opType OpType, ops int, latency time.Duration) {
+	for i := 0; i < ops; i++ {
+		stats.StartOp(opType)
+		stats.EndOp()
+		if latency > 0 {
+			stats.histograms[opType].record(latency)
+		}
+	}
+}
+
+func (s *TestStatsCollectorSuite) TestSubscribe(c *C) {
+	stats := NewStatsCollector()
+	stats.StartOp(Insert)
+	stats.EndOp()
+
+	snapshots := stats.Subscribe(time.Millisecond)
+	snapshot := <-snapshots
+	c.Assert(snapshot.Total, Equals, int64(1))
+	c.Assert(snapshot.Counts[Insert], Equals, int64(1))
+
+	stats.StartOp(Query)
+	stats.EndOp()
+	// the snapshot of the next tick may be waiting since before the op
+	for snapshot.Total < 2 {
+		snapshot = <-snapshots
+	}
+	c.Assert(snapshot.Total, Equals, int64(2))
+
+	// Unsubscribing stops the emitter, which closes the channel.
+	stats.Unsubscribe(snapshots)
+	for _ = range snapshots {
+	}
+	c.Assert(stats.subscriptions, HasLen, 0)
+}
+
+func (s *TestStatsCollectorSuite) TestCombineStatsChecked(c *C) {
+	a, b := NewStatsCollector(), NewStatsCollector()
+	a.SampleLatencies(0.1, nil)
+	b.SampleLatencies(0.15, nil)
+	combined, err := CombineStatsChecked(a, b)
+	c.Assert(err, IsNil)
+	c.Assert(combined, NotNil)
+
+	b.SampleLatencies(1.0, nil)
+	combined, err = CombineStatsChecked(a, b)
+	c.Assert(err, NotNil)
+	c.Assert(combined, IsNil)
+}
+
+func (s *TestStatsCollectorSuite) TestLatencyHistogram(c *C) {
+	stats := NewStatsCollectorWithBuckets(
+		[]time.Duration{time.Millisecond, 10 * time.Millisecond})
+	stats.histograms[Query].record(500 * time.Microsecond)
+	stats.histograms[Query].record(5 * time.Millisecond)
+	stats.histograms[Query].record(time.Second)
+
+	buckets := stats.LatencyHistogramSnapshot(Query)
+	c.Assert(buckets, HasLen, 3)
+	c.Assert(buckets[0], Equals, HistBucket{time.Millisecond, 1})
+	c.Assert(buckets[1], Equals, HistBucket{10 * time.Millisecond, 2})
+	c.Assert(buckets[2].Count, Equals, int64(3))
+
+	// Combining sums the bucket counts.
+	combined := CombineStats(stats, stats)
+	buckets = combined.LatencyHistogramSnapshot(Query)
+	c.Assert(buckets[1], Equals, HistBucket{10 * time.Millisecond, 4})
+	c.Assert(buckets[2].Count, Equals, int64(6))
+
+	_, err := CombineStatsChecked(stats, NewStatsCollector())
+	c.Assert(err, NotNil)
+}
+
+func (s *TestStatsCollectorSuite) TestClosedLatencyChannel(c *C) {
+	latencyChan := make(chan Latency, 1)
+	stats := NewStatsCollector()
+	stats.SampleLatencies(1.0, latencyChan)
+	close(latencyChan)
+
+	// must neither panic nor stop counting
+	stats.StartOp(Query)
+	stats.EndOp()
+	stats.StartOp(Query)
+	stats.EndOp()
+	c.Assert(stats.Count(Query), Equals, int64(2))
+	c.Assert(stats.latencyChan, IsNil)
+}
+
+func (s *TestStatsCollectorSuite) TestLatencyConsumerDone(c *C) {
+	latencyChan := make(chan Latency)
+	done := make(chan struct{})
+	stats := NewStatsCollector()
+	stats.SampleLatenciesUntil(1.0, latencyChan, done)
+	close(done)
+
+	// nobody reads latencyChan, but the collector must not block
+	stats.StartOp(Query)
+	stats.EndOp()
+	c.Assert(stats.latencyChan, IsNil)
+}
+
+func (s *TestStatsCollectorSuite) TestDownsampleLatencies(c *C) {
+	latencyChan := make(chan Latency, 10)
+	stats := NewStatsCollector()
+	stats.SampleLatencies(1.0, latencyChan)
+	stats.DownsampleLatencies(3)
+	for i := 0; i < 7; i++ {
+		stats.StartOp(Query)
+		stats.EndOp()
+	}
+	c.Assert(latencyChan, HasLen, 2)
+	c.Assert(stats.SampledCount(Query), Equals, int64(7))
+}
+
+func (s *TestStatsCollectorSuite) TestClose(c *C) {
+	latencyChan := make(chan Latency, 10)
+	stats := NewStatsCollector()
+	stats.SampleLatencies(1.0, latencyChan)
+	snapshots := stats.Subscribe(time.Hour)
+	stats.StartOp(Query)
+	stats.EndOp()
+	stats.StartOp(Insert)
+
+	stats.Close()
+	for _ = range snapshots {
+	}
+	// neither the op in flight nor the ones after Close() are recorded
+	stats.EndOp()
+	stats.StartOp(Query)
+	stats.EndOp()
+	stats.RecordErrorCode(11000)
+	c.Assert(stats.Total(), Equals, int64(2))
+	c.Assert(stats.SampledCount(Insert), Equals, int64(1))
+	c.Assert(stats.TotalTime(Insert), Equals, time.Duration(0))
+	c.Assert(stats.ErrorCodes(), HasLen, 0)
+	c.Assert(latencyChan, HasLen, 1)
+	_, open := <-stats.Subscribe(time.Millisecond)
+	c.Assert(open, Equals, false)
+	stats.Close()
+}
+
+func (s *TestStatsCollectorSuite) TestAdd(c *C) {
+	total, worker := NewStatsCollector(), NewStatsCollector()
+	worker.SampleLatencies(1.0, nil)
+	worker.StartOp(Query)
+	worker.EndOp()
+	worker.RecordQueueTime(Query, time.Millisecond)
+	worker.RecordErrorCode(11000)
+	worker.RecordOrphanGetMore()
+	worker.RecordCursorTimeout()
+	worker.RecordIdConflict(IdConflictSkip)
+	worker.RecordResultMismatch(Query)
+
+	total.Add(worker)
+	total.Add(worker)
+	c.Assert(total.Total(), Equals, int64(2))
+	c.Assert(total.Count(Query), Equals, int64(2))
+	c.Assert(total.SampledCount(Query), Equals, int64(2))
+	c.Assert(total.TotalTime(Query), Equals, 2*worker.TotalTime(Query))
+	c.Assert(total.LatencyHistogramSnapshot(Query), DeepEquals,
+		CombineStats(worker, worker).LatencyHistogramSnapshot(Query))
+	c.Assert(total.QueueTimeInMs(Query), Equals, worker.QueueTimeInMs(Query))
+	c.Assert(total.ErrorCodes(), DeepEquals, map[int]int64{11000: 2})
+	c.Assert(total.OrphanGetMores(), Equals, int64(2))
+	c.Assert(total.CursorTimeouts(), Equals, int64(2))
+	c.Assert(total.IdConflicts(), DeepEquals, map[IdConflict]int64{IdConflictSkip: 2})
+	c.Assert(total.Snapshot().ResultMismatches[Query], Equals, int64(2))
+
+	// a collector can be added to itself
+	worker.Add(worker)
+	c.Assert(worker.Total(), Equals, int64(2))
+
+	total.Close()
+	total.Add(worker)
+	c.Assert(total.Total(), Equals, int64(2))
+}
+
+func (s *TestStatsCollectorSuite) TestScheduleDrift(c *C) {
+	a, b := NewStatsCollector(), NewStatsCollector()
+	avg, max := a.ScheduleDriftInMs()
+	c.Assert(avg, Equals, 0.0)
+	c.Assert(max, Equals, 0.0)
+
+	a.RecordScheduleDrift(time.Millisecond)
+	a.RecordScheduleDrift(3 * time.Millisecond)
+	b.RecordScheduleDrift(8 * time.Millisecond)
+	avg, max = a.ScheduleDriftInMs()
+	c.Assert(avg, Equals, 2.0)
+	c.Assert(max, Equals, 3.0)
+
+	snapshot := CombineStats(a, b).Snapshot()
+	c.Assert(snapshot.ScheduleDriftInMs, Equals, 4.0)
+	c.Assert(snapshot.MaxScheduleDriftInMs, Equals, 8.0)
+}
+
+func (s *TestStatsCollectorSuite) TestLabels(c *C) {
+	stats := NewStatsCollector()
+	stats.SampleLatencies(1.0, nil)
+	stats.StartLabeledOp(Query, "hot")
+	stats.EndOp()
+	stats.StartLabeledOp(Insert, "hot")
+	stats.EndOp()
+	stats.StartLabeledOp(Query, "background")
+	stats.EndOp()
+	stats.StartOp(Query)
+	stats.EndOp()
+
+	c.Assert(stats.Count(Query), Equals, int64(3))
+	c.Assert(stats.Labels(), DeepEquals, []string{"background", "hot"})
+	c.Assert(stats.LabelCount("hot"), Equals, int64(2))
+	c.Assert(stats.LabelCount("background"), Equals, int64(1))
+	c.Assert(stats.LabelLatencyInMs("hot") > 0, Equals, true)
+	c.Assert(stats.LabelLatencyInMs("other"), Equals, 0.0)
+
+	snapshot := CombineStats(stats, stats).Snapshot()
+	c.Assert(snapshot.LabelCounts, DeepEquals, map[string]int64{"background": 2, "hot": 4})
+	c.Assert(NewStatsCollector().Snapshot().LabelCounts, IsNil)
+
+	// 2 hot ops over the 4s between the first and the last op
+	stats.firstStart = stats.lastStart.Add(-4 * time.Second)
+	c.Assert(stats.LabelOpsSec("hot"), Equals, 0.5)
+	c.Assert(stats.Snapshot().LabelOpsSec["background"], Equals, 0.25)
+
+	latencies := map[string]float64{"db.a": 1, "db.b": 5, "db.c": 3, "db.d": 5}
+	c.Assert(SortLabels(latencies, 0), DeepEquals, []string{"db.a", "db.b", "db.c", "db.d"})
+	c.Assert(SortLabels(latencies, 3), DeepEquals, []string{"db.b", "db.d", "db.c"})
+	c.Assert(SortLabels(latencies, 10), HasLen, 4)
+
+	op := &Op{Database: "db", Collection: "c1"}
+	c.Assert(LabelByNamespace(op), Equals, "db.c1")
+	c.Assert(LabelByDatabase(op), Equals, "db")
+}
+
+// The null collector must stay a placeholder: whatever the interface grows,
+// every method can be called with zero values and returns zero values.
+func (s *TestStatsCollectorSuite) TestNullStatsCollector(c *C) {
+	collector := reflect.ValueOf(NewNullStatsCollector())
+	iface := reflect.TypeOf((*IStatsCollector)(nil)).Elem()
+	for i := 0; i < iface.NumMethod(); i++ {
+		method := collector.MethodByName(iface.Method(i).Name)
+		args := []reflect.Value{}
+		for j := 0; j < method.Type().NumIn(); j++ {
+			args = append(args, reflect.Zero(method.Type().In(j)))
+		}
+		for _, result := range method.Call(args) {
+			c.Assert(result.IsZero(), Equals, true,
+				Commentf("%s returned %v", iface.Method(i).Name, result))
+		}
+	}
+}
+
+func (s *TestStatsCollectorSuite) TestTotal(c *C) {
+	a, b := NewStatsCollector(), NewStatsCollector()
+	a.StartOp(Insert)
+	a.EndOp()
+	a.StartOp(Query)
+	a.EndOp()
+	b.StartOp(Update)
+	b.EndOp()
+	c.Assert(a.Total(), Equals, int64(2))
+	c.Assert(CombineStats(a, b).Total(), Equals, int64(3))
+	c.Assert(NewNullStatsCollector().Total(), Equals, int64(0))
+}
+
+func (s *TestStatsCollectorSuite) TestEffectiveSampleRate(c *C) {
+	stats := NewStatsCollector()
+	stats.SampleLatencies(0, nil)
+	for i := 0; i < 3; i++ {
+		stats.StartOp(Query)
+		stats.EndOp()
+	}
+	stats.SampleLatencies(1.0, nil)
+	stats.StartOp(Query)
+	stats.EndOp()
+
+	c.Assert(stats.SampledCount(Query), Equals, int64(1))
+	c.Assert(stats.EffectiveSampleRate(Query), Equals, 0.25)
+	c.Assert(stats.EffectiveSampleRate(Insert), Equals, 0.0)
+	c.Assert(CombineStats(stats, stats).SampledCount(Query), Equals, int64(2))
+
+	// the average latency is over the sampled ops only
+	stats.durations[Query] = 10 * time.Millisecond
+	c.Assert(stats.LatencyInMs(Query), Equals, 10.0)
+	c.Assert(stats.Snapshot().LatencyInMs[Query], Equals, 10.0)
+	c.Assert(stats.AverageLatencyInMs(), Equals, 10.0)
+}
+
+func (s *TestStatsCollectorSuite) TestMultiStatsCollector(c *C) {
+	a, b := NewStatsCollector(), NewStatsCollector()
+	multi := MultiStatsCollector(a, b)
+	multi.StartOp(Insert)
+	multi.EndOp()
+	multi.RecordErrorCode(11000)
+	c.Assert(a.Count(Insert), Equals, int64(1))
+	c.Assert(b.Count(Insert), Equals, int64(1))
+	c.Assert(b.ErrorCodes(), DeepEquals, map[int]int64{11000: 1})
+	c.Assert(multi.Total(), Equals, int64(1))
+	c.Assert(MultiStatsCollector().Total(), Equals, int64(0))
+}
+
+func (s *TestStatsCollectorSuite) TestSampleRates(c *C) {
+	rates, err := ParseSampleRates("command.count=1, query=0")
+	c.Assert(err, IsNil)
+	c.Assert(rates, DeepEquals, map[OpType]float64{Count: 1, Query: 0})
+	_, err = ParseSampleRates("query=2")
+	c.Assert(err, NotNil)
+	_, err = ParseSampleRates("nosuchop=1")
+	c.Assert(err, NotNil)
+
+	stats := NewStatsCollector()
+	stats.SampleLatencies(0, nil)
+	stats.SetSampleRates(rates)
+	for _, opType := range []OpType{Count, Query, Insert} {
+		stats.StartOp(opType)
+		stats.EndOp()
+	}
+	c.Assert(stats.SampledCount(Count), Equals, int64(1))
+	c.Assert(stats.SampledCount(Query), Equals, int64(0))
+	c.Assert(stats.SampledCount(Insert), Equals, int64(0))
+}
+
+func (s *TestStatsCollectorSuite) TestHotPathAllocations(c *C) {
+	for _, sampleRate := range []float64{0, 1.0} {
+		stats := NewStatsCollector()
+		stats.SampleLatencies(sampleRate, nil)
+		allocs := testing.AllocsPerRun(100, func() {
+			stats.StartOp(Query)
+			stats.EndOp()
+		})
+		c.Assert(allocs, Equals, 0.0, Commentf("sample rate %v", sampleRate))
+	}
+}
+
+func (s *TestStatsCollectorSuite) TestMeasureTimingOverhead(c *C) {
+	overhead := MeasureTimingOverhead()
+	c.Assert(overhead > 0, Equals, true)
+	c.Assert(overhead < time.Millisecond, Equals, true)
+}
+
+func benchmarkStartEndOp(b *testing.B, stats IStatsCollector) {
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		stats.StartOp(Query)
+		stats.EndOp()
+	}
+}
+
+func benchmarkSampleRate(b *testing.B, sampleRate float64) {
+	stats := NewStatsCollector()
+	stats.SampleLatencies(sampleRate, nil)
+	benchmarkStartEndOp(b, stats)
+}
+
+func BenchmarkStartEndOpUnsampled(b *testing.B) { benchmarkSampleRate(b, 0) }
+func BenchmarkStartEndOpSampled10(b *testing.B) { benchmarkSampleRate(b, 0.1) }
+func BenchmarkStartEndOpSampled(b *testing.B)   { benchmarkSampleRate(b, 1.0) }
+
+func BenchmarkStartEndOpNull(b *testing.B) {
+	benchmarkStartEndOp(b, NewNullStatsCollector())
+}
+
+func BenchmarkStartEndOpMulti(b *testing.B) {
+	a, c := NewStatsCollector(), NewStatsCollector()
+	a.SampleLatencies(0.1, nil)
+	c.SampleLatencies(0.1, nil)
+	benchmarkStartEndOp(b, MultiStatsCollector(a, c))
+}
+
+func BenchmarkCombineStats(b *testing.B) {
+	collectors := make([]*StatsCollector, 16)
+	for i := range collectors {
+		collectors[i] = NewStatsCollector()
+		collectors[i].StartOp(Query)
+		collectors[i].EndOp()
+	}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		CombineStats(collectors...)
+	}
+}
+
+func (s *TestStatsCollectorSuite) TestStatsCollectorFor(c *C) {
+	stats := NewStatsCollectorFor(Query, GetMore)
+	c.Assert(stats.OpTypes(), DeepEquals, []OpType{Query, GetMore})
+	for _, opType := range []OpType{Query, Insert, Query} {
+		stats.StartOp(opType)
+		stats.EndOp()
+	}
+	c.Assert(stats.Total(), Equals, int64(3))
+	c.Assert(stats.Count(Query), Equals, int64(2))
+	c.Assert(stats.Count(Insert), Equals, int64(0))
+	c.Assert(stats.LatencyHistogramSnapshot(Insert), IsNil)
+	snapshot := stats.Snapshot()
+	c.Assert(snapshot.Counts, DeepEquals, map[OpType]int64{Query: 2, GetMore: 0})
+	c.Assert(snapshot.Histograms, HasLen, 2)
+
+	// the combined stats are broken down by the types of either collector
+	combined := CombineStats(stats, NewStatsCollectorFor(Insert))
+	c.Assert(combined.OpTypes(), DeepEquals, []OpType{Insert, Query, GetMore})
+	c.Assert(combined.Count(Query), Equals, int64(2))
+	c.Assert(combined.Total(), Equals, int64(3))
+	var saved bytes.Buffer
+	c.Assert(ExportHistograms(&saved, "", combined), IsNil)
+	export, err := LoadHistograms(&saved)
+	c.Assert(err, IsNil)
+	c.Assert(export.Histograms, HasLen, 3)
+
+	all := NewStatsCollector()
+	all.Add(stats)
+	c.Assert(all.Count(Query), Equals, int64(2))
+	c.Assert(all.LatencyHistogramSnapshot(Insert), HasLen, len(DefaultLatencyBuckets)+1)
+}
+
+func (s *TestStatsCollectorSuite) TestSampleEvenly(c *C) {
+	sampled := func() []int {
+		stats := NewStatsCollector()
+		stats.SampleLatencies(0.1, nil)
+		stats.SetSampleRates(map[OpType]float64{Insert: 0.25})
+		stats.SampleEvenly()
+		positions := []int{}
+		for i := 1; i <= 40; i++ {
+			stats.StartOp(Query)
+			if !stats.epoch.IsZero() {
+				positions = append(positions, i)
+			}
+			stats.EndOp()
+			stats.StartOp(Insert)
+			stats.EndOp()
+		}
+		c.Assert(stats.SampledCount(Insert), Equals, int64(10))
+		return positions
+	}
+	c.Assert(sampled(), DeepEquals, []int{10, 20, 30, 40})
+	c.Assert(sampled(), DeepEquals, sampled())
+}
+
+func (s *TestStatsCollectorSuite) TestServiceTime(c *C) {
+	first, second := NewStatsCollector(), NewStatsCollector()
+	first.RecordServiceTime(time.Second)
+	first.RecordServiceTime(500 * time.Millisecond)
+	second.RecordServiceTime(time.Second)
+	c.Assert(first.ServiceTime(), Equals, 1500*time.Millisecond)
+	c.Assert(CombineStats(first, second).ServiceTime(), Equals, 2500*time.Millisecond)
+	c.Assert(first.Snapshot().ServiceTimeInMs, Equals, 1500.0)
+}
+
+func (s *TestStatsCollectorSuite) TestQueueTime(c *C) {
+	first, second := NewStatsCollector(), NewStatsCollector()
+	first.RecordQueueTime(Query, 30*time.Millisecond)
+	first.RecordQueueTime(Query, 10*time.Millisecond)
+	replayOps(first, Query, 2, 0)
+	first.RecordServiceTime(time.Millisecond)
+	c.Assert(math.Abs(first.QueueTimeInMs(Query)-20) < 1e-9, Equals, true)
+	c.Assert(first.QueueTimeInMs(Insert), Equals, 0.0)
+	// the wait for a worker is neither part of the latency of the ops, nor of
+	// the time the target took to serve them
+	c.Assert(first.LatencyInMs(Query) < 10, Equals, true, Commentf("%v", first.LatencyInMs(Query)))
+	c.Assert(first.ServiceTime(), Equals, time.Millisecond)
+
+	// the ops that weren't dispatched don't count in the average
+	second.RecordQueueTime(Query, 50*time.Millisecond)
+	replayOps(second, Query, 3, 0)
+	combined := CombineStats(first, second)
+	c.Assert(combined.Count(Query), Equals, int64(5))
+	c.Assert(math.Abs(combined.QueueTimeInMs(Query)-30) < 1e-9, Equals, true)
+	c.Assert(math.Abs(combined.Snapshot().QueueTimeInMs[Query]-30) < 1e-9, Equals, true)
+}
+
+func (s *TestStatsCollectorSuite) TestLatencyPercentile(c *C) {
+	stats := NewStatsCollector()
+	c.Assert(stats.LatencyPercentileInMs(Query, 0.999), Equals, 0.0)
+	// 1ms to 10s, so the exact p99.9 is 9.991s and the p99.99 9.9991s
+	for i := 1; i <= 10000; i++ {
+		stats.histograms[Query].record(time.Duration(i) * time.Millisecond)
+	}
+	for _, p := range []float64{0.5, 0.99, 0.999, 0.9999} {
+		exact := p * 10000
+		percentile := stats.LatencyPercentileInMs(Query, p)
+		c.Assert(percentile >= exact && percentile <= exact*1.02, Equals, true,
+			Commentf("p%v: %vms, exact %vms", p*100, percentile, exact))
+	}
+	median := stats.LatencyPercentile(Query, 0.5)
+	c.Assert(median >= 5*time.Second && median <= 5100*time.Millisecond, Equals, true)
+	stats.histograms[Query].record(time.Hour)
+	c.Assert(math.IsInf(stats.LatencyPercentileInMs(Query, 1), 1), Equals, true)
+	c.Assert(stats.LatencyPercentile(Query, 1), Equals, time.Duration(math.MaxInt64))
+}
+
+func (s *TestStatsCollectorSuite) TestWallClockOpsSec(c *C) {
+	stats := NewStatsCollector()
+	c.Assert(stats.OpsSec(Query), Equals, 0.0)
+	c.Assert(stats.RecentOpsSec(Query), Equals, 0.0)
+	// 10 queries per second for 10s
+	start := time.Unix(1000, 0)
+	record := func(stats *StatsCollector, opType OpType, at time.Time) {
+		if stats.firstStart.IsZero() {
+			stats.firstStart = at
+		}
+		stats.lastStart = at
+		stats.counts[opType]++
+		stats.recent[opType].count(at)
+	}
+	for i := 0; i < 100; i++ {
+		record(stats, Query, start.Add(time.Duration(i)*100*time.Millisecond))
+	}
+	// the time spent in the ops doesn't matter
+	stats.durations[Query] = time.Millisecond
+	c.Assert(stats.OpsSec(Query), Equals, 100/9.9)
+	// only the last 10s count, the first second being out of the window
+	c.Assert(stats.recentOpsSec(Query, start.Add(10*time.Second)), Equals, 10.0)
+	c.Assert(stats.recentOpsSec(Query, start.Add(15*time.Second)), Equals, 40/9.0)
+	c.Assert(stats.recentOpsSec(Query, start.Add(time.Minute)), Equals, 0.0)
+
+	other := NewStatsCollector()
+	for i := 0; i < 10; i++ {
+		record(other, Insert, start.Add(9*time.Second+time.Duration(i)*100*time.Millisecond))
+	}
+	combined := CombineStats(stats, other)
+	c.Assert(combined.OpsSec(Query), Equals, 100/9.9)
+	c.Assert(combined.OpsSec(Insert), Equals, 10/9.9)
+	c.Assert(combined.recentOpsSec(Insert, start.Add(10*time.Second)), Equals, 10/9.0)
+
+	// right after the start, the rate is over the time since the first op
+	stats = NewStatsCollector()
+	for i := 0; i < 4; i++ {
+		record(stats, Query, start.Add(time.Duration(i)*100*time.Millisecond))
+	}
+	c.Assert(stats.recentOpsSec(Query, start.Add(400*time.Millisecond)), Equals, 10.0)
+
+	stats = NewStatsCollector()
+	stats.StartOp(Query)
+	stats.EndOp()
+	c.Assert(stats.RecentOpsSec(Query) > 0, Equals, true)
+}
+
+func (s *TestStatsCollectorSuite) TestSetLatencyBuckets(c *C) {
+	stats := NewStatsCollectorWithBuckets([]time.Duration{time.Millisecond, 10 * time.Millisecond})
+	stats.histograms[Query].record(500 * time.Microsecond)
+	stats.histograms[Query].record(5 * time.Millisecond)
+
+	stats.SetLatencyBuckets([]time.Duration{2 * time.Millisecond, 20 * time.Millisecond})
+	// past latencies move to the bucket of their old upper bound
+	stats.histograms[Query].record(1500 * time.Microsecond)
+	c.Assert(stats.LatencyHistogramSnapshot(Query), DeepEquals, []HistBucket{
+		{2 * time.Millisecond, 2}, {20 * time.Millisecond, 3}, {time.Duration(math.MaxInt64), 3}})
+	c.Assert(stats.LatencyHistogramSnapshot(Insert), HasLen, 3)
+	c.Assert(CombineStats(stats).LatencyHistogramSnapshot(Query), DeepEquals,
+		stats.LatencyHistogramSnapshot(Query))
+}
+
+func (s *TestStatsCollectorSuite) TestDocSizes(c *C) {
+	a, b := NewStatsCollector(), NewStatsCollector()
+	c.Assert(a.DocSizeHistogram(Insert), IsNil)
+	for i := 0; i < 9; i++ {
+		a.RecordDocSize(Insert, 100)
+	}
+	b.RecordDocSize(Insert, 5000)
+	b.RecordDocSize(Update, 64)
+
+	snapshot := CombineStats(a, b).Snapshot()
+	c.Assert(snapshot.DocSizes, HasLen, 2)
+	inserts := snapshot.DocSizes[Insert]
+	c.Assert(inserts[len(inserts)-1].Count, Equals, int64(10))
+	c.Assert(SizePercentile(inserts, 0.5), Equals, int64(128))
+	c.Assert(SizePercentile(inserts, 0.99), Equals, int64(8192))
+	c.Assert(SizePercentile(snapshot.DocSizes[Update], 1), Equals, int64(64))
+	c.Assert(SizePercentile(nil, 0.5), Equals, int64(0))
+
+	op := &Op{Type: Insert, Content: Document{"o": map[string]interface{}{"a": 1}}}
+	// the document length, an int32 element and the terminating NUL
+	c.Assert(docSize(op), Equals, int64(4+1+2+4+1))
+	c.Assert(docSize(&Op{Type: Query, Content: Document{"query": map[string]interface{}{}}}),
+		Equals, int64(0))
+}
+
+func (s *TestStatsCollectorSuite) TestConcurrentReads(c *C) {
+	stats := NewStatsCollector()
+	stats.SampleLatencies(1.0, nil)
+	opTypes := []OpType{Query, Insert, Update}
+	done := make(chan struct{})
+	for _, opType := range opTypes {
+		go func(opType OpType) {
+			defer func() { done <- struct{}{} }()
+			for i := 0; i < 2000; i++ {
+				stats.StartOp(opType)
+				stats.EndOp()
+			}
+		}(opType)
+	}
+
+	// every snapshot adds up, and the counts never go back while the ops run
+	last := int64(0)
+	for running := len(opTypes); running > 0; {
+		select {
+		case <-done:
+			running--
+		default:
+		}
+		snapshot := stats.Snapshot()
+		sum := int64(0)
+		for _, count := range snapshot.Counts {
+			sum += count
+		}
+		c.Assert(sum, Equals, snapshot.Total)
+		c.Assert(snapshot.Total >= last, Equals, true)
+		last = snapshot.Total
+		c.Assert(stats.Count(Query) >= snapshot.Counts[Query], Equals, true)
+		c.Assert(stats.OpsSec(Query) >= 0, Equals, true)
+		c.Assert(stats.LatencyInMs(Insert) >= 0, Equals, true)
+	}
+	c.Assert(stats.Total(), Equals, int64(6000))
+	c.Assert(stats.Count(Update), Equals, int64(2000))
+}
@@ -0,0 +1,151 @@
+package replay
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// StatsDMaxPacket is the most bytes StatsDEmitter writes at once, so each
+// packet fits within the MTU of most networks.
+const StatsDMaxPacket = 1432
+
+// StatsDEmitter sends the metrics of a replay in the StatsD format, e.g. to a
+// Datadog agent, so the replays land in the dashboards of the target:
+//
+//	<prefix>ops.<op type>        a counter of the ops started
+//	<prefix>errors.<code>        a counter of the failed ops, by error code,
+//	                             "client" for the errors not from the server
+//	<prefix>latency.<op type>    a timing per sampled latency
+//	<prefix>ops_in_flight        a gauge of the ops started and not ended yet
+//
+// The tags, if any, are appended DogStatsD-style, which plain StatsD servers
+// don't understand. The lines are batched into packets of at most
+// StatsDMaxPacket bytes.
+type StatsDEmitter struct {
+	lock   sync.Mutex
+	writer io.Writer
+	prefix string
+	tags   string
+	buffer bytes.Buffer
+	// the stats at the previous flush, as the counters are sent as deltas
+	last *StatsCollector
+}
+
+// NewStatsDEmitter writes the packets to `writer`, each with one Write. The
+// metric names start with `prefix`, e.g. "flashback.", and the `tags` are
+// "key:value" or "key".
+func NewStatsDEmitter(writer io.Writer, prefix string, tags []string) *StatsDEmitter {
+	emitter := &StatsDEmitter{writer: writer, prefix: prefix, last: NewStatsCollector()}
+	if len(tags) > 0 {
+		emitter.tags = "|#" + strings.Join(tags, ",")
+	}
+	return emitter
+}
+
+// DialStatsD sends the metrics over UDP to the StatsD server at `addr`, e.g.
+// localhost:8125.
+func DialStatsD(addr string, prefix string, tags []string) (*StatsDEmitter, error) {
+	conn, err := net.Dial("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	return NewStatsDEmitter(conn, prefix, tags), nil
+}
+
+// ParseStatsDTags reads comma-separated tags, e.g. "env:staging,run:42".
+func ParseStatsDTags(spec string) ([]string, error) {
+	tags := []string{}
+	for _, tag := range strings.Split(spec, ",") {
+		tag = strings.TrimSpace(tag)
+		if tag == "" {
+			continue
+		}
+		if strings.ContainsAny(tag, "|#@ ") {
+			return nil, fmt.Errorf("invalid StatsD tag %q", tag)
+		}
+		tags = append(tags, tag)
+	}
+	return tags, nil
+}
+
+// Timing queues the timing of a sampled latency, to be sent with the next full
+// packet or the next Flush().
+func (e *StatsDEmitter) Timing(latency Latency) error {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	return e.queue(fmt.Sprintf("latency.%s:%.3f|ms", latency.OpType,
+		float64(latency.Latency.Nanoseconds())/1e6))
+}
+
+// Flush sends the counters of the ops and errors since the previous flush out
+// of the cumulative `stats`, the gauge of the ops in flight, and all the
+// queued timings.
+func (e *StatsDEmitter) Flush(stats *StatsCollector) error {
+	current := NewStatsCollector()
+	current.Add(stats)
+
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	last := e.last
+	e.last = current
+	for _, opType := range AllOpTypes {
+		if delta := current.counts[opType] - last.counts[opType]; delta > 0 {
+			if err := e.queue(fmt.Sprintf("ops.%s:%d|c", opType, delta)); err != nil {
+				return err
+			}
+		}
+	}
+	codes := make([]int, 0, len(current.errorCodes))
+	for code := range current.errorCodes {
+		codes = append(codes, code)
+	}
+	sort.Ints(codes)
+	for _, code := range codes {
+		delta := current.errorCodes[code] - last.errorCodes[code]
+		if delta <= 0 {
+			continue
+		}
+		name := fmt.Sprint(code)
+		if code == 0 {
+			name = "client"
+		}
+		if err := e.queue(fmt.Sprintf("errors.%s:%d|c", name, delta)); err != nil {
+			return err
+		}
+	}
+	if err := e.queue(fmt.Sprintf("ops_in_flight:%d|g", stats.InFlight())); err != nil {
+		return err
+	}
+	return e.send()
+}
+
+// Appends a metric to the packet being filled, sending it first if the metric
+// doesn't fit. Called with the lock held.
+func (e *StatsDEmitter) queue(metric string) error {
+	line := e.prefix + metric + e.tags
+	if e.buffer.Len() > 0 && e.buffer.Len()+1+len(line) > StatsDMaxPacket {
+		if err := e.send(); err != nil {
+			return err
+		}
+	}
+	if e.buffer.Len() > 0 {
+		e.buffer.WriteByte('\n')
+	}
+	e.buffer.WriteString(line)
+	return nil
+}
+
+// Sends the packet being filled, if any. Called with the lock held.
+func (e *StatsDEmitter) send() error {
+	if e.buffer.Len() == 0 {
+		return nil
+	}
+	defer e.buffer.Reset()
+	_, err := e.writer.Write(e.buffer.Bytes())
+	return err
+}
@@ -0,0 +1,64 @@
+package replay
+
+import (
+	. "gopkg.in/check.v1"
+	"strings"
+	"time"
+)
+
+type TestStatsDSuite struct{}
+
+var _ = Suite(&TestStatsDSuite{})
+
+type packetRecorder struct {
+	packets []string
+}
+
+func (p *packetRecorder) Write(packet []byte) (int, error) {
+	p.packets = append(p.packets, string(packet))
+	return len(packet), nil
+}
+
+func (s *TestStatsDSuite) TestStatsD(c *C) {
+	tags, err := ParseStatsDTags(" env:staging,,run:42 ")
+	c.Assert(err, IsNil)
+	c.Assert(tags, DeepEquals, []string{"env:staging", "run:42"})
+	_, err = ParseStatsDTags("env:a|b")
+	c.Assert(err, NotNil)
+
+	recorder := &packetRecorder{}
+	emitter := NewStatsDEmitter(recorder, "flashback.", tags)
+	stats := NewStatsCollector()
+	stats.SampleLatencies(0, nil)
+	for i := 0; i < 3; i++ {
+		stats.StartOp(Query)
+	}
+	stats.EndOp()
+	stats.RecordErrorCode(0)
+	c.Assert(emitter.Timing(Latency{Query, 1500 * time.Microsecond}), IsNil)
+	c.Assert(recorder.packets, HasLen, 0)
+	c.Assert(emitter.Flush(stats), IsNil)
+	c.Assert(recorder.packets, DeepEquals, []string{strings.Join([]string{
+		"flashback.latency.query:1.500|ms|#env:staging,run:42",
+		"flashback.ops.query:3|c|#env:staging,run:42",
+		"flashback.errors.client:1|c|#env:staging,run:42",
+		"flashback.ops_in_flight:2|g|#env:staging,run:42",
+	}, "\n")})
+
+	// the counters are deltas, and the packets are kept under the max size
+	recorder.packets = nil
+	stats.StartOp(Insert)
+	for i := 0; i < 100; i++ {
+		c.Assert(emitter.Timing(Latency{Insert, time.Millisecond}), IsNil)
+	}
+	c.Assert(emitter.Flush(stats), IsNil)
+	c.Assert(len(recorder.packets) > 1, Equals, true)
+	lines := []string{}
+	for _, packet := range recorder.packets {
+		c.Assert(len(packet) <= StatsDMaxPacket, Equals, true)
+		lines = append(lines, strings.Split(packet, "\n")...)
+	}
+	c.Assert(lines, HasLen, 102)
+	c.Assert(lines[100], Equals, "flashback.ops.insert:1|c|#env:staging,run:42")
+	c.Assert(lines[101], Equals, "flashback.ops_in_flight:3|g|#env:staging,run:42")
+}
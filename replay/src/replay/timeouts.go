@@ -0,0 +1,85 @@
+package replay
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+)
+
+// OpTimeouts sets, for some op types, how long their ops may take before the
+// executor gives up on them, e.g. a short timeout for point queries and a long
+// one for the commands that legitimately take seconds.
+type OpTimeouts map[OpType]time.Duration
+
+// ParseOpTimeouts parses timeouts in the format of
+// "<op type>=<duration>[,<op type>=<duration>...]", e.g. "query=1s,command.count=30s".
+func ParseOpTimeouts(spec string) (OpTimeouts, error) {
+	timeouts := OpTimeouts{}
+	if spec == "" {
+		return timeouts, nil
+	}
+	for _, target := range strings.Split(spec, ",") {
+		parts := strings.SplitN(target, "=", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("invalid timeout %q, expected <op type>=<duration>", target)
+		}
+		opType := OpType(strings.TrimSpace(parts[0]))
+		if !isKnownOpType(opType) {
+			return nil, fmt.Errorf("unknown op type %q in timeout %q", opType, target)
+		}
+		timeout, err := time.ParseDuration(strings.TrimSpace(parts[1]))
+		if err != nil || timeout <= 0 {
+			return nil, fmt.Errorf("invalid timeout %q, expected a positive duration", target)
+		}
+		timeouts[opType] = timeout
+	}
+	return timeouts, nil
+}
+
+// SetTimeouts bounds how long the ops of each type may take, falling back to
+// `fallback` for the other types. The driver doesn't take a deadline per op,
+// so the timeout of each op is applied to the socket of the session, whose
+// timeout must be `fallback` to begin with. The server doesn't know about the
+// timeout: it keeps running the ops the executor gave up on.
+func (e *OpsExecutor) SetTimeouts(timeouts OpTimeouts, fallback time.Duration) {
+	e.timeouts = timeouts
+	e.fallbackTimeout = fallback
+	e.socketTimeout = fallback
+}
+
+// The server error code of the ops that ran past their maxTimeMS.
+const maxTimeMSExpired = 50
+
+// SetMaxTime sets the maxTimeMS of the reads, i.e. of the queries and counts,
+// so the server aborts the ones that run longer, as it would have with the
+// same limit in production. Unlike the timeouts of SetTimeouts(), the server
+// does stop running them; they are counted apart from the timeouts.
+func (e *OpsExecutor) SetMaxTime(maxTime time.Duration) {
+	e.maxTime = maxTime
+}
+
+// The value of the maxTimeMS option for `maxTime`.
+func maxTimeMS(maxTime time.Duration) int64 {
+	return int64(maxTime / time.Millisecond)
+}
+
+// Set the socket timeout for an op of `opType`, returning it.
+func (e *OpsExecutor) applyTimeout(opType OpType) time.Duration {
+	timeout, ok := e.timeouts[opType]
+	if !ok {
+		timeout = e.fallbackTimeout
+	}
+	if timeout != e.socketTimeout {
+		e.session.SetSocketTimeout(timeout)
+		e.socketTimeout = timeout
+	}
+	return timeout
+}
+
+// Whether an op failed because the socket timed out.
+func isTimeout(err error) bool {
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
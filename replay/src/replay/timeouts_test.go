@@ -0,0 +1,58 @@
+package replay
+
+import (
+	"errors"
+	"github.com/globalsign/mgo"
+	. "gopkg.in/check.v1"
+	"io"
+	"net"
+	"time"
+)
+
+type TestTimeoutsSuite struct{}
+
+var _ = Suite(&TestTimeoutsSuite{})
+
+func (s *TestTimeoutsSuite) TestTimeouts(c *C) {
+	timeouts, err := ParseOpTimeouts("query=1s, command.count=30s")
+	c.Assert(err, IsNil)
+	c.Assert(timeouts, DeepEquals, OpTimeouts{Query: time.Second, Count: 30 * time.Second})
+	_, err = ParseOpTimeouts("query=0s")
+	c.Assert(err, NotNil)
+	_, err = ParseOpTimeouts("nosuchop=1s")
+	c.Assert(err, NotNil)
+
+	c.Assert(isTimeout(&net.OpError{Op: "read", Err: timeoutErr{}}), Equals, true)
+	c.Assert(isTimeout(io.EOF), Equals, false)
+	c.Assert(isTimeout(nil), Equals, false)
+	err = &ExecError{OpType: Query, Err: &TimeoutError{Timeout: time.Second, Err: io.EOF}}
+	var timeout *TimeoutError
+	c.Assert(errors.As(err, &timeout), Equals, true)
+	c.Assert(err.Error(), Equals, "query failed: timed out after 1s: EOF")
+
+	stats := NewStatsCollector()
+	stats.RecordTimeout(Query)
+	c.Assert(stats.Timeouts(Query), Equals, int64(1))
+	c.Assert(stats.Snapshot().Timeouts[Query], Equals, int64(1))
+}
+
+// A net.Error that timed out.
+type timeoutErr struct{}
+
+func (timeoutErr) Error() string   { return "i/o timeout" }
+func (timeoutErr) Timeout() bool   { return true }
+func (timeoutErr) Temporary() bool { return true }
+
+func (s *TestTimeoutsSuite) TestMaxTime(c *C) {
+	c.Assert(maxTimeMS(1500*time.Millisecond), Equals, int64(1500))
+	c.Assert(ErrorCode(&mgo.QueryError{Code: 50, Message: "operation exceeded time limit"}),
+		Equals, maxTimeMSExpired)
+
+	stats := NewStatsCollector()
+	stats.RecordMaxTimeExpired(Query)
+	stats.RecordMaxTimeExpired(Count)
+	c.Assert(stats.MaxTimeExpired(Query), Equals, int64(1))
+	// counted apart from the client timeouts
+	c.Assert(stats.Timeouts(Query), Equals, int64(0))
+	c.Assert(CombineStats(stats, stats).Snapshot().MaxTimeExpired[Count], Equals, int64(2))
+}
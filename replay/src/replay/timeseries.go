@@ -0,0 +1,268 @@
+package replay
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"strings"
+	"sync"
+	"time"
+)
+
+// TimeSeriesPoint is how each op type did over one interval of a run: how
+// many ops were started and failed, their throughput, and the average and the
+// percentiles of their sampled latencies.
+type TimeSeriesPoint struct {
+	Time        time.Time          `json:"time"`
+	IntervalSec float64            `json:"interval_sec"`
+	Counts      map[OpType]int64   `json:"counts"`
+	OpsSec      map[OpType]float64 `json:"ops_sec"`
+	LatencyInMs map[OpType]float64 `json:"latency_ms"`
+	P50InMs     map[OpType]float64 `json:"p50_ms"`
+	P95InMs     map[OpType]float64 `json:"p95_ms"`
+	P99InMs     map[OpType]float64 `json:"p99_ms"`
+	// how many ops failed, all the classes of errors together, as in the
+	// final report
+	Errors map[OpType]int64 `json:"errors"`
+}
+
+// TimeSeriesWriter writes one TimeSeriesPoint per interval of a run, so how
+// the throughput, the latencies and the errors evolved can be plotted without
+// post-processing the raw latencies, e.g. to line the dips up with the
+// checkpoints or elections of the target. The points are written as NDJSON,
+// or as CSV with a header row.
+type TimeSeriesWriter struct {
+	writer    io.Writer
+	csv       *csv.Writer
+	wroteHead bool
+	// the stats at the end of the previous interval
+	last     *StatsCollector
+	lastTime time.Time
+}
+
+// NewTimeSeriesWriter writes the points to `writer` in `format`, either
+// "ndjson" or "csv". The first interval starts at `start`.
+func NewTimeSeriesWriter(writer io.Writer, format string, start time.Time) (*TimeSeriesWriter, error) {
+	series := &TimeSeriesWriter{
+		writer:   writer,
+		last:     NewStatsCollector(),
+		lastTime: start,
+	}
+	switch format {
+	case "ndjson":
+	case "csv":
+		series.csv = csv.NewWriter(writer)
+	default:
+		return nil, fmt.Errorf("unknown time series format %q, expected ndjson or csv", format)
+	}
+	return series, nil
+}
+
+// TimeSeriesFormat tells the format of a time series file from its name.
+func TimeSeriesFormat(filename string) string {
+	if strings.HasSuffix(filename, ".csv") {
+		return "csv"
+	}
+	return "ndjson"
+}
+
+// Write ends the current interval at `now`, and writes its point out of the
+// stats collected since the start of the run.
+func (t *TimeSeriesWriter) Write(now time.Time, stats *StatsCollector) error {
+	current := NewStatsCollector()
+	current.Add(stats)
+	point := timeSeriesPoint(t.last, current, now.Sub(t.lastTime))
+	point.Time = now
+	t.last, t.lastTime = current, now
+
+	if t.csv == nil {
+		encoded, err := json.Marshal(point)
+		if err != nil {
+			return err
+		}
+		_, err = t.writer.Write(append(encoded, '\n'))
+		return err
+	}
+	if !t.wroteHead {
+		header := []string{"time", "interval_sec"}
+		for _, opType := range AllOpTypes {
+			header = append(header, string(opType)+" ops_sec", string(opType)+" latency_ms",
+				string(opType)+" count", string(opType)+" p50_ms", string(opType)+" p95_ms",
+				string(opType)+" p99_ms", string(opType)+" errors")
+		}
+		if err := t.csv.Write(header); err != nil {
+			return err
+		}
+		t.wroteHead = true
+	}
+	row := []string{point.Time.UTC().Format(time.RFC3339), fmt.Sprintf("%.3f", point.IntervalSec)}
+	for _, opType := range AllOpTypes {
+		row = append(row, fmt.Sprintf("%.2f", point.OpsSec[opType]),
+			fmt.Sprintf("%.3f", point.LatencyInMs[opType]), fmt.Sprint(point.Counts[opType]),
+			fmt.Sprintf("%.3f", point.P50InMs[opType]), fmt.Sprintf("%.3f", point.P95InMs[opType]),
+			fmt.Sprintf("%.3f", point.P99InMs[opType]), fmt.Sprint(point.Errors[opType]))
+	}
+	if err := t.csv.Write(row); err != nil {
+		return err
+	}
+	t.csv.Flush()
+	return t.csv.Error()
+}
+
+// The point of the interval of length `interval` between two cumulative
+// stats.
+func timeSeriesPoint(last *StatsCollector, current *StatsCollector,
+	interval time.Duration) *TimeSeriesPoint {
+	point := &TimeSeriesPoint{
+		IntervalSec: interval.Seconds(),
+		Counts:      map[OpType]int64{},
+		OpsSec:      map[OpType]float64{},
+		LatencyInMs: map[OpType]float64{},
+		P50InMs:     map[OpType]float64{},
+		P95InMs:     map[OpType]float64{},
+		P99InMs:     map[OpType]float64{},
+		Errors:      map[OpType]int64{},
+	}
+	for _, opType := range AllOpTypes {
+		point.Counts[opType] = current.counts[opType] - last.counts[opType]
+		point.OpsSec[opType] = 0
+		if interval > 0 {
+			point.OpsSec[opType] = float64(point.Counts[opType]) / interval.Seconds()
+		}
+		point.P50InMs[opType] = opIntervalPercentileInMs(last, current, opType, 0.5)
+		point.P95InMs[opType] = opIntervalPercentileInMs(last, current, opType, 0.95)
+		point.P99InMs[opType] = opIntervalPercentileInMs(last, current, opType, 0.99)
+		point.Errors[opType] = 0
+		for class, count := range current.errors[opType] {
+			point.Errors[opType] += count - last.errors[opType][class]
+		}
+		point.LatencyInMs[opType] = 0
+		if sampled := current.sampled[opType] - last.sampled[opType]; sampled > 0 {
+			total := current.durations[opType] - last.durations[opType]
+			point.LatencyInMs[opType] = total.Seconds() / float64(sampled) * 1000
+		}
+	}
+	return point
+}
+
+// LiveStats tracks how the replay is doing lately, for the dashboards polling
+// its stats during a long run: the ops/sec of each op type over the last
+// RecentOpsSecWindow, as the collectors count it for the dashboard too, and an
+// exponentially weighted moving average (EWMA) of its sampled latency.
+type LiveStats struct {
+	lock   sync.Mutex
+	window time.Duration
+	// the stats at the previous update
+	last     *StatsCollector
+	lastTime time.Time
+	ewma     map[OpType]float64
+}
+
+// NewLiveStats starts tracking at `start`, the EWMA having `window` as time
+// constant.
+func NewLiveStats(start time.Time, window time.Duration) *LiveStats {
+	return &LiveStats{
+		window:   window,
+		last:     NewStatsCollector(),
+		lastTime: start,
+		ewma:     map[OpType]float64{},
+	}
+}
+
+// Update folds in, at `now`, the stats collected since the start of the run.
+// It's meant to be called at a steady pace, several times per window.
+func (l *LiveStats) Update(now time.Time, stats *StatsCollector) {
+	current := NewStatsCollector()
+	current.Add(stats)
+
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	interval := now.Sub(l.lastTime)
+	point := timeSeriesPoint(l.last, current, interval)
+	weight := 1 - math.Exp(-interval.Seconds()/l.window.Seconds())
+	for opType, latency := range point.LatencyInMs {
+		// intervals without samples leave the average as is
+		if current.sampled[opType] == l.last.sampled[opType] {
+			continue
+		}
+		if _, ok := l.ewma[opType]; !ok {
+			l.ewma[opType] = latency
+		} else {
+			l.ewma[opType] += weight * (latency - l.ewma[opType])
+		}
+	}
+	l.last, l.lastTime = current, now
+}
+
+// Snapshot returns the snapshot of `stats` along with its recent ops/sec, and
+// the EWMA latencies as of the last update.
+func (l *LiveStats) Snapshot(stats *StatsCollector) StatsSnapshot {
+	snapshot := stats.Snapshot()
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	snapshot.RecentOpsSec = map[OpType]float64{}
+	snapshot.EWMALatencyInMs = map[OpType]float64{}
+	for _, opType := range stats.OpTypes() {
+		snapshot.RecentOpsSec[opType] = stats.RecentOpsSec(opType)
+		snapshot.EWMALatencyInMs[opType] = l.ewma[opType]
+	}
+	return snapshot
+}
+
+// RecentOpsSecWindow is the window of StatsCollector.RecentOpsSec().
+const RecentOpsSecWindow = 10 * time.Second
+
+const rateWindowSeconds = int64(RecentOpsSecWindow / time.Second)
+
+// rateWindow counts the ops of the last RecentOpsSecWindow, by the second they
+// started in. Slot i holds the second stamps[i], whose seconds modulo the
+// length of the window are i; the slots of older seconds are reused.
+type rateWindow struct {
+	counts [rateWindowSeconds]int64
+	stamps [rateWindowSeconds]int64
+}
+
+func (w *rateWindow) count(now time.Time) {
+	second := now.Unix()
+	i := second % rateWindowSeconds
+	if w.stamps[i] != second {
+		w.stamps[i], w.counts[i] = second, 0
+	}
+	w.counts[i]++
+}
+
+// The ops/sec over the window ending at `now`, or since `start` if that's
+// more recent.
+func (w *rateWindow) rate(now time.Time, start time.Time) float64 {
+	second := now.Unix()
+	total := int64(0)
+	for i, stamp := range w.stamps {
+		if stamp > second-rateWindowSeconds && stamp <= second {
+			total += w.counts[i]
+		}
+	}
+	// the current second is only partly over
+	windowStart := time.Unix(second-rateWindowSeconds+1, 0)
+	if start.After(windowStart) {
+		windowStart = start
+	}
+	elapsed := now.Sub(windowStart)
+	if elapsed <= 0 {
+		return 0
+	}
+	return float64(total) / elapsed.Seconds()
+}
+
+// add merges the counts of other into w, second by second.
+func (w *rateWindow) add(other *rateWindow) {
+	for i, stamp := range other.stamps {
+		switch {
+		case stamp == w.stamps[i]:
+			w.counts[i] += other.counts[i]
+		case stamp > w.stamps[i]:
+			w.stamps[i], w.counts[i] = stamp, other.counts[i]
+		}
+	}
+}
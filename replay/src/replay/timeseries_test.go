@@ -0,0 +1,138 @@
+package replay
+
+import (
+	"encoding/json"
+	. "gopkg.in/check.v1"
+	"io"
+	"math"
+	"strings"
+	"time"
+)
+
+type TestTimeSeriesSuite struct{}
+
+var _ = Suite(&TestTimeSeriesSuite{})
+
+func (s *TestTimeSeriesSuite) TestTimeSeries(c *C) {
+	start := time.Unix(1500000000, 0)
+	stats := NewStatsCollector()
+	var out strings.Builder
+	series, err := NewTimeSeriesWriter(&out, "ndjson", start)
+	c.Assert(err, IsNil)
+
+	replayOps(stats, Query, 4, 0)
+	c.Assert(series.Write(start.Add(2*time.Second), stats), IsNil)
+	replayOps(stats, Insert, 1, 0)
+	c.Assert(series.Write(start.Add(3*time.Second), stats), IsNil)
+
+	points := timeSeriesPoints(c, out.String())
+	c.Assert(points, HasLen, 2)
+	c.Assert(points[0].IntervalSec, Equals, 2.0)
+	c.Assert(points[0].OpsSec[Query], Equals, 2.0)
+	c.Assert(points[0].OpsSec[Insert], Equals, 0.0)
+	// only the ops of the interval count
+	c.Assert(points[1].OpsSec[Query], Equals, 0.0)
+	c.Assert(points[1].OpsSec[Insert], Equals, 1.0)
+	c.Assert(points[1].LatencyInMs[Query], Equals, 0.0)
+
+	out.Reset()
+	series, err = NewTimeSeriesWriter(&out, TimeSeriesFormat("series.csv"), start)
+	c.Assert(err, IsNil)
+	c.Assert(series.Write(start.Add(time.Second), stats), IsNil)
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	c.Assert(lines, HasLen, 2)
+	c.Assert(strings.HasPrefix(lines[0], "time,interval_sec,insert ops_sec,insert latency_ms"), Equals, true)
+	c.Assert(strings.HasPrefix(lines[1], "2017-07-14T02:40:01Z,1.000,1.00,"), Equals, true)
+
+	_, err = NewTimeSeriesWriter(&out, "xml", start)
+	c.Assert(err, NotNil)
+}
+
+// The points of the NDJSON time series `out`.
+func timeSeriesPoints(c *C, out string) []TimeSeriesPoint {
+	points := []TimeSeriesPoint{}
+	for _, line := range strings.Split(strings.TrimSpace(out), "\n") {
+		point := TimeSeriesPoint{}
+		c.Assert(json.Unmarshal([]byte(line), &point), IsNil)
+		points = append(points, point)
+	}
+	return points
+}
+
+func (s *TestTimeSeriesSuite) TestLiveStats(c *C) {
+	start := time.Unix(1500000000, 0)
+	stats := NewStatsCollector()
+	record := func(ops int, latency time.Duration) {
+		for i := 0; i < ops; i++ {
+			stats.counts[Query]++
+			stats.sampled[Query]++
+			stats.durations[Query] += latency
+		}
+	}
+	live := NewLiveStats(start, 10*time.Second)
+	c.Assert(live.Snapshot(stats).RecentOpsSec[Query], Equals, 0.0)
+
+	record(50, 10*time.Millisecond)
+	live.Update(start.Add(5*time.Second), stats)
+	snapshot := live.Snapshot(stats)
+	c.Assert(snapshot.EWMALatencyInMs[Query], Equals, 10.0)
+	c.Assert(snapshot.EWMALatencyInMs[Insert], Equals, 0.0)
+
+	record(10, 20*time.Millisecond)
+	live.Update(start.Add(15*time.Second), stats)
+	snapshot = live.Snapshot(stats)
+	c.Assert(math.Abs(snapshot.EWMALatencyInMs[Query]-(20-10*math.Exp(-1))) < 1e-9, Equals, true)
+	c.Assert(snapshot.Counts[Query], Equals, int64(60))
+
+	// the recent ops/sec are the collector's, like on the dashboard
+	c.Assert(snapshot.RecentOpsSec[Query], Equals, 0.0)
+	stats.StartOp(Query)
+	stats.EndOp()
+	c.Assert(live.Snapshot(stats).RecentOpsSec[Query] > 0, Equals, true)
+}
+
+func (s *TestTimeSeriesSuite) TestTimeSeriesPercentiles(c *C) {
+	start := time.Unix(1500000000, 0)
+	stats := NewStatsCollector()
+	stats.SampleLatencies(0, nil)
+	var out strings.Builder
+	series, err := NewTimeSeriesWriter(&out, "ndjson", start)
+	c.Assert(err, IsNil)
+
+	for _, ms := range []int{1, 2, 3} {
+		replayOps(stats, Query, 1, time.Duration(ms)*time.Millisecond)
+	}
+	stats.StartOp(Query)
+	stats.EndOpWithError(io.EOF)
+	stats.histograms[Query].record(100 * time.Millisecond)
+	// the error codes aren't counted apart from the failed ops
+	stats.RecordErrorCode(11000)
+	c.Assert(series.Write(start.Add(time.Second), stats), IsNil)
+	replayOps(stats, Insert, 1, 0)
+	c.Assert(series.Write(start.Add(2*time.Second), stats), IsNil)
+
+	points := timeSeriesPoints(c, out.String())
+	c.Assert(points, HasLen, 2)
+	c.Assert(points[0].Counts[Query], Equals, int64(4))
+	c.Assert(points[0].Errors[Query], Equals, int64(1))
+	// within the 2% of the buckets
+	p50, p95, p99 := points[0].P50InMs[Query], points[0].P95InMs[Query], points[0].P99InMs[Query]
+	c.Assert(p50 >= 2 && p50 <= 2.04, Equals, true, Commentf("%v", p50))
+	c.Assert(p95 >= 100 && p95 <= 102, Equals, true, Commentf("%v", p95))
+	c.Assert(p99 >= 100 && p99 <= 102, Equals, true, Commentf("%v", p99))
+	// only the ops of the interval count
+	c.Assert(points[1].Counts[Query], Equals, int64(0))
+	c.Assert(points[1].Errors[Query], Equals, int64(0))
+	c.Assert(points[1].P99InMs[Query], Equals, 0.0)
+	c.Assert(points[1].Counts[Insert], Equals, int64(1))
+
+	out.Reset()
+	series, err = NewTimeSeriesWriter(&out, "csv", start)
+	c.Assert(err, IsNil)
+	c.Assert(series.Write(start.Add(time.Second), stats), IsNil)
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	c.Assert(lines, HasLen, 2)
+	c.Assert(lines[0], Matches, ".*,query ops_sec,query latency_ms,query count,query p50_ms,"+
+		"query p95_ms,query p99_ms,query errors,.*")
+	c.Assert(lines[1], Matches, ".*,4.00,0.000,4,2.0[0-9]+,10[0-9.]+,10[0-9.]+,1,.*")
+}
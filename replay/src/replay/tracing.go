@@ -0,0 +1,267 @@
+package replay
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	mathrand "math/rand"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// How often OpTracer exports its spans, and how many spans it exports at once
+// and keeps at most while the collector is slow or down.
+const (
+	TraceExportInterval = 5 * time.Second
+	TraceBatchSize      = 512
+	TraceMaxPending     = 8 * TraceBatchSize
+)
+
+// OpTracer exports a span per sampled op to an OpenTelemetry collector over
+// OTLP/HTTP, in its JSON encoding, so the replayed load can be lined up with
+// the traces of the target. Each span is the root of its own trace, with the
+// op type as name and the namespace and error code as attributes, following
+// the semantic conventions of the database clients.
+type OpTracer struct {
+	lock       sync.Mutex
+	url        string
+	client     *http.Client
+	sampleRate float64
+	resource   []otlpAttribute
+	spans      []otlpSpan
+	// the spans dropped since they couldn't be exported in time
+	dropped int64
+	logger  *Logger
+
+	full    chan struct{}
+	done    chan struct{}
+	stopped chan struct{}
+}
+
+// NewOpTracer exports the spans to the collector at `endpoint`, e.g.
+// http://localhost:4318, in the background until Close(). `sampleRate` is
+// the share of the ops traced, and `resource` the attributes of the replay,
+// e.g. its run id; service.name defaults to flashback.
+func NewOpTracer(endpoint string, sampleRate float64, resource map[string]string,
+	logger *Logger) *OpTracer {
+	attributes := map[string]string{"service.name": "flashback"}
+	for key, value := range resource {
+		attributes[key] = value
+	}
+	tracer := &OpTracer{
+		url:        strings.TrimSuffix(endpoint, "/") + "/v1/traces",
+		client:     &http.Client{Timeout: 10 * time.Second},
+		sampleRate: sampleRate,
+		logger:     logger,
+		full:       make(chan struct{}, 1),
+		done:       make(chan struct{}),
+		stopped:    make(chan struct{}),
+	}
+	keys := make([]string, 0, len(attributes))
+	for key := range attributes {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		tracer.resource = append(tracer.resource, stringAttribute(key, attributes[key]))
+	}
+	go tracer.exportLoop()
+	return tracer
+}
+
+// Record traces an op that was sent to the target at `start` and took
+// `latency`, if it's sampled. It's safe to call from all the workers.
+func (t *OpTracer) Record(op *Op, start time.Time, latency time.Duration, err error) {
+	if t.sampleRate < 1.0 && mathrand.Float64() >= t.sampleRate {
+		return
+	}
+	span := otlpSpan{
+		TraceId:           randomHex(16),
+		SpanId:            randomHex(8),
+		Name:              string(op.Type),
+		Kind:              otlpSpanKindClient,
+		StartTimeUnixNano: strconv.FormatInt(start.UnixNano(), 10),
+		EndTimeUnixNano:   strconv.FormatInt(start.Add(latency).UnixNano(), 10),
+		Attributes: []otlpAttribute{
+			stringAttribute("db.system", "mongodb"),
+			stringAttribute("db.name", op.Database),
+			stringAttribute("db.mongodb.collection", op.Collection),
+			stringAttribute("db.operation", string(op.Type)),
+		},
+	}
+	if err != nil {
+		code := ErrorCode(err)
+		if execErr, ok := err.(*ExecError); ok {
+			code = execErr.Code
+		}
+		span.Status = &otlpStatus{Code: otlpStatusError, Message: err.Error()}
+		span.Attributes = append(span.Attributes, intAttribute("db.mongodb.error_code", int64(code)))
+	}
+
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if len(t.spans) >= TraceMaxPending {
+		t.dropped++
+		return
+	}
+	t.spans = append(t.spans, span)
+	if len(t.spans) >= TraceBatchSize {
+		select {
+		case t.full <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// Dropped returns how many sampled ops weren't traced, since the collector
+// couldn't keep up.
+func (t *OpTracer) Dropped() int64 {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	return t.dropped
+}
+
+// Close exports the remaining spans, and stops the exports.
+func (t *OpTracer) Close() {
+	close(t.done)
+	<-t.stopped
+}
+
+func (t *OpTracer) exportLoop() {
+	defer close(t.stopped)
+	ticker := time.NewTicker(TraceExportInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-t.done:
+			t.exportPending()
+			return
+		case <-ticker.C:
+			t.exportPending()
+		case <-t.full:
+			t.exportPending()
+		}
+	}
+}
+
+// Exports the pending spans a batch at a time. A batch that fails is dropped,
+// rather than retried, so a collector that is down doesn't pile up spans.
+func (t *OpTracer) exportPending() {
+	for {
+		t.lock.Lock()
+		batch := t.spans
+		if len(batch) > TraceBatchSize {
+			batch = batch[:TraceBatchSize]
+		}
+		t.spans = t.spans[len(batch):]
+		t.lock.Unlock()
+		if len(batch) == 0 {
+			return
+		}
+		if err := t.export(batch); err != nil {
+			t.logger.Errorf("Failed to export %d spans to %s: %v", len(batch), t.url, err)
+			t.lock.Lock()
+			t.dropped += int64(len(batch))
+			t.lock.Unlock()
+		}
+	}
+}
+
+func (t *OpTracer) export(spans []otlpSpan) error {
+	request := otlpTraces{ResourceSpans: []otlpResourceSpans{{
+		Resource: otlpResource{Attributes: t.resource},
+		ScopeSpans: []otlpScopeSpans{{
+			Scope: otlpScope{Name: "flashback"},
+			Spans: spans,
+		}},
+	}}}
+	body, err := json.Marshal(request)
+	if err != nil {
+		return err
+	}
+	response, err := t.client.Post(t.url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	response.Body.Close()
+	if response.StatusCode/100 != 2 {
+		return fmt.Errorf("collector replied %s", response.Status)
+	}
+	return nil
+}
+
+func randomHex(size int) string {
+	id := make([]byte, size)
+	rand.Read(id)
+	return hex.EncodeToString(id)
+}
+
+// The messages of OTLP/HTTP in its JSON encoding, which spells the 64-bit
+// integers as strings and the ids in hex.
+type otlpTraces struct {
+	ResourceSpans []otlpResourceSpans `json:"resourceSpans"`
+}
+
+type otlpResourceSpans struct {
+	Resource   otlpResource     `json:"resource"`
+	ScopeSpans []otlpScopeSpans `json:"scopeSpans"`
+}
+
+type otlpResource struct {
+	Attributes []otlpAttribute `json:"attributes"`
+}
+
+type otlpScopeSpans struct {
+	Scope otlpScope  `json:"scope"`
+	Spans []otlpSpan `json:"spans"`
+}
+
+type otlpScope struct {
+	Name string `json:"name"`
+}
+
+const (
+	otlpSpanKindClient = 3
+	otlpStatusError    = 2
+)
+
+type otlpSpan struct {
+	TraceId           string          `json:"traceId"`
+	SpanId            string          `json:"spanId"`
+	Name              string          `json:"name"`
+	Kind              int             `json:"kind"`
+	StartTimeUnixNano string          `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string          `json:"endTimeUnixNano"`
+	Attributes        []otlpAttribute `json:"attributes"`
+	Status            *otlpStatus     `json:"status,omitempty"`
+}
+
+type otlpStatus struct {
+	Code    int    `json:"code"`
+	Message string `json:"message,omitempty"`
+}
+
+type otlpAttribute struct {
+	Key   string    `json:"key"`
+	Value otlpValue `json:"value"`
+}
+
+type otlpValue struct {
+	StringValue *string `json:"stringValue,omitempty"`
+	IntValue    *string `json:"intValue,omitempty"`
+}
+
+func stringAttribute(key string, value string) otlpAttribute {
+	return otlpAttribute{Key: key, Value: otlpValue{StringValue: &value}}
+}
+
+func intAttribute(key string, value int64) otlpAttribute {
+	encoded := strconv.FormatInt(value, 10)
+	return otlpAttribute{Key: key, Value: otlpValue{IntValue: &encoded}}
+}
@@ -0,0 +1,67 @@
+package replay
+
+import (
+	"encoding/json"
+	"errors"
+	. "gopkg.in/check.v1"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"time"
+)
+
+type TestTracingSuite struct{}
+
+var _ = Suite(&TestTracingSuite{})
+
+func (s *TestTracingSuite) TestOpTracer(c *C) {
+	var lock sync.Mutex
+	requests := []otlpTraces{}
+	collector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		c.Check(r.URL.Path, Equals, "/v1/traces")
+		var request otlpTraces
+		c.Check(json.NewDecoder(r.Body).Decode(&request), IsNil)
+		lock.Lock()
+		requests = append(requests, request)
+		lock.Unlock()
+	}))
+	defer collector.Close()
+
+	logger, _ := NewLogger("", "")
+	tracer := NewOpTracer(collector.URL+"/", 1.0, map[string]string{"flashback.run_id": "r1"}, logger)
+	start := time.Unix(1500000000, 0)
+	op := &Op{Type: Query, Database: "db", Collection: "coll"}
+	tracer.Record(op, start, 2*time.Millisecond, nil)
+	tracer.Record(op, start, time.Millisecond, &ExecError{OpType: Query, Code: 50, Err: errors.New("timeout")})
+	tracer.Close()
+	c.Assert(tracer.Dropped(), Equals, int64(0))
+
+	c.Assert(requests, HasLen, 1)
+	resource := requests[0].ResourceSpans[0].Resource.Attributes
+	c.Assert(resource, HasLen, 2)
+	c.Assert(resource[0].Key, Equals, "flashback.run_id")
+	c.Assert(*resource[1].Value.StringValue, Equals, "flashback")
+	spans := requests[0].ResourceSpans[0].ScopeSpans[0].Spans
+	c.Assert(spans, HasLen, 2)
+	c.Assert(spans[0].Name, Equals, "query")
+	c.Assert(spans[0].TraceId, HasLen, 32)
+	c.Assert(spans[0].SpanId, HasLen, 16)
+	c.Assert(spans[0].StartTimeUnixNano, Equals, "1500000000000000000")
+	c.Assert(spans[0].EndTimeUnixNano, Equals, "1500000000002000000")
+	c.Assert(spans[0].Status, IsNil)
+	c.Assert(*spans[0].Attributes[2].Value.StringValue, Equals, "coll")
+	c.Assert(spans[1].Status.Code, Equals, otlpStatusError)
+	last := spans[1].Attributes[len(spans[1].Attributes)-1]
+	c.Assert(last.Key, Equals, "db.mongodb.error_code")
+	c.Assert(*last.Value.IntValue, Equals, "50")
+
+	// the spans the collector refuses are dropped
+	refusing := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer refusing.Close()
+	tracer = NewOpTracer(refusing.URL, 1.0, nil, logger)
+	tracer.Record(op, start, time.Millisecond, nil)
+	tracer.Close()
+	c.Assert(tracer.Dropped(), Equals, int64(1))
+}
@@ -0,0 +1,81 @@
+package replay
+
+import (
+	"github.com/globalsign/mgo"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// InsertCounts counts the documents the replay inserted in each namespace, to
+// check after the replay that the target holds them all. It's shared by the
+// executors of all the workers.
+type InsertCounts struct {
+	lock   sync.Mutex
+	counts map[string]int64
+}
+
+func NewInsertCounts() *InsertCounts {
+	return &InsertCounts{counts: map[string]int64{}}
+}
+
+// Add counts a document inserted in `namespace`, a "<db>.<collection>".
+func (i *InsertCounts) Add(namespace string) {
+	i.lock.Lock()
+	defer i.lock.Unlock()
+	i.counts[namespace]++
+}
+
+// Counts returns how many documents were inserted in each namespace.
+func (i *InsertCounts) Counts() map[string]int64 {
+	i.lock.Lock()
+	defer i.lock.Unlock()
+	counts := make(map[string]int64, len(i.counts))
+	for namespace, count := range i.counts {
+		counts[namespace] = count
+	}
+	return counts
+}
+
+// CountCheck compares the documents inserted in a namespace with what the
+// target holds.
+type CountCheck struct {
+	Namespace string
+	// how many inserts succeeded
+	Inserted int64
+	// how many documents the target holds
+	Found int64
+}
+
+// Matches tells whether the target holds as many documents as were inserted,
+// which is only expected of a target that was empty before the replay and
+// that the replay didn't remove documents from.
+func (c CountCheck) Matches() bool {
+	return c.Inserted == c.Found
+}
+
+// VerifyCounts counts the documents of each namespace that received inserts
+// on the target of `session`. The checks are sorted by namespace.
+func VerifyCounts(inserts *InsertCounts, session *mgo.Session) ([]CountCheck, error) {
+	counts := inserts.Counts()
+	namespaces := make([]string, 0, len(counts))
+	for namespace := range counts {
+		namespaces = append(namespaces, namespace)
+	}
+	sort.Strings(namespaces)
+
+	checks := make([]CountCheck, 0, len(namespaces))
+	for _, namespace := range namespaces {
+		parts := strings.SplitN(namespace, ".", 2)
+		found, err := session.DB(parts[0]).C(parts[1]).Count()
+		if err != nil {
+			return nil, err
+		}
+		checks = append(checks, CountCheck{
+			Namespace: namespace,
+			Inserted:  counts[namespace],
+			Found:     int64(found),
+		})
+	}
+	return checks, nil
+}
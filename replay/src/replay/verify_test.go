@@ -0,0 +1,24 @@
+package replay
+
+import (
+	. "gopkg.in/check.v1"
+)
+
+type TestVerifySuite struct{}
+
+var _ = Suite(&TestVerifySuite{})
+
+func (s *TestVerifySuite) TestInsertCounts(c *C) {
+	inserts := NewInsertCounts()
+	inserts.Add("db.c1")
+	inserts.Add("db.c1")
+	inserts.Add("db.c2")
+	counts := inserts.Counts()
+	c.Assert(counts, DeepEquals, map[string]int64{"db.c1": 2, "db.c2": 1})
+	// a copy
+	counts["db.c1"] = 0
+	c.Assert(inserts.Counts()["db.c1"], Equals, int64(2))
+
+	c.Assert(CountCheck{Namespace: "db.c1", Inserted: 2, Found: 2}.Matches(), Equals, true)
+	c.Assert(CountCheck{Namespace: "db.c1", Inserted: 2, Found: 1}.Matches(), Equals, false)
+}